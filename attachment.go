@@ -0,0 +1,684 @@
+package main
+
+/* Files attached to bugs. The attachment table has the original name,
+   type and size of each file, and the file itself is kept in the
+   sha256 directory of the file store under the SHA-256 of its
+   contents, so a file which is attached several times is only kept
+   once. Images get thumbnails, which are made when first asked for,
+   and text files like patches and logs are shown on the bug page. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The size of a file in bytes, which can be given to the flags with a
+// suffix like 10M.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return formatSize(int64(*s))
+}
+
+func (s *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(value, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			value = strings.TrimSuffix(value, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Bad size %s", value)
+	}
+	*s = byteSize(n * multiplier)
+	return nil
+}
+
+// Write "n" bytes like 1.5 MB.
+func formatSize(n int64) string {
+	units := []string{"bytes", "KB", "MB", "GB"}
+	f := float64(n)
+	for _, unit := range units[:len(units)-1] {
+		if f < 1024 {
+			if unit == "bytes" {
+				return fmt.Sprintf("%d %s", n, unit)
+			}
+			return fmt.Sprintf("%.1f %s", f, unit)
+		}
+		f /= 1024
+	}
+	return fmt.Sprintf("%.1f %s", f, units[len(units)-1])
+}
+
+// The largest thumbnail, in pixels each way.
+var thumbSize = 200
+
+// Larger images than this do not get thumbnails, so that a small file
+// cannot make the server decode an enormous image.
+var maxThumbPixels = 50 * 1000 * 1000
+
+// The most of a text file which is shown on the bug page.
+var previewBytes = 16 * 1024
+var previewLines = 40
+
+// Types for the extensions which mime.TypeByExtension may not know.
+var textExtensions = map[string]string{
+	".diff":  "text/x-diff",
+	".patch": "text/x-diff",
+	".log":   "text/plain; charset=utf-8",
+}
+
+type Attachment struct {
+	AttachmentId int64
+	BugId        int64
+	PersonId     int64
+	// The name of the file which was uploaded.
+	Filename    string
+	ContentType string
+	Size        int64
+	// The hex SHA-256 of the contents, which is also the name of
+	// the stored file.
+	SHA256      string
+	Description string
+	Entered     time.Time
+	// For the bug page: the name of the uploader, and the start of
+	// a text file.
+	Person     string
+	Preview    string
+	PreviewCut bool
+}
+
+// Can the attachment have a thumbnail?
+func (a Attachment) IsImage() bool {
+	switch mediaType(a.ContentType) {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Can the attachment be shown as text?
+func (a Attachment) IsText() bool {
+	t := mediaType(a.ContentType)
+	return strings.HasPrefix(t, "text/") || t == "application/json" ||
+		t == "application/xml"
+}
+
+func (a Attachment) SizeText() string {
+	return formatSize(a.Size)
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+var attachmentFields = `attachment_id, bug_id, person_id, filename, content_type,
+size, sha256, description, entered`
+
+var insertAttachmentSql = `
+INSERT INTO attachment(bug_id, person_id, filename, content_type, size, sha256,
+description, entered) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+`
+var insertAttachmentQuery = bagzullaDb.NewQuery(insertAttachmentSql)
+
+var bugAttachmentsSql = `SELECT ` + attachmentFields + ` FROM attachment
+WHERE bug_id = ? ORDER BY attachment_id`
+var bugAttachmentsQuery = bagzullaDb.NewQuery(bugAttachmentsSql)
+
+var attachmentSql = `SELECT ` + attachmentFields + ` FROM attachment
+WHERE attachment_id = ?`
+var attachmentQuery = bagzullaDb.NewQuery(attachmentSql)
+
+var deleteAttachmentSql = `DELETE FROM attachment WHERE attachment_id = ?`
+var deleteAttachmentQuery = bagzullaDb.NewQuery(deleteAttachmentSql)
+
+var hashUsesSql = `SELECT COUNT(*) FROM attachment WHERE sha256 = ?`
+var hashUsesQuery = bagzullaDb.NewQuery(hashUsesSql)
+
+var projectAttachmentsSizeSql = `SELECT IFNULL(SUM(attachment.size), 0)
+FROM attachment JOIN bug ON attachment.bug_id = bug.bug_id
+WHERE bug.project_id = ?`
+var projectAttachmentsSizeQuery = bagzullaDb.NewQuery(projectAttachmentsSizeSql)
+
+func scanAttachments(rows *sql.Rows) (attachments []Attachment, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var a Attachment
+		err = rows.Scan(&a.AttachmentId, &a.BugId, &a.PersonId, &a.Filename,
+			&a.ContentType, &a.Size, &a.SHA256, &a.Description, &a.Entered)
+		if err != nil {
+			return attachments, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func bugAttachments(store *bagzullaDb.Store, bugId int64) (attachments []Attachment, err error) {
+	rows, err := store.Stmt(bugAttachmentsQuery).Query(bugId)
+	if err != nil {
+		return attachments, err
+	}
+	return scanAttachments(rows)
+}
+
+func attachmentFromId(store *bagzullaDb.Store, attachmentId int64) (a Attachment, found bool, err error) {
+	rows, err := store.Stmt(attachmentQuery).Query(attachmentId)
+	if err != nil {
+		return a, false, err
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil || len(attachments) == 0 {
+		return a, false, err
+	}
+	return attachments[0], true, nil
+}
+
+// Keep only the last part of an uploaded file name, without any
+// control characters.
+func cleanFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(c rune) rune {
+		if c < ' ' || c == 0x7f {
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(strings.ToValidUTF8(name, ""))
+	for len(name) > 200 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "attachment"
+	}
+	return name
+}
+
+// Decide the type of a file from its name, the type the uploader
+// gave, or its first bytes, in that order.
+func attachmentType(filename string, declared string, head []byte) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if t, ok := textExtensions[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	if t := mediaType(declared); t != "" && t != "application/octet-stream" {
+		return declared
+	}
+	return http.DetectContentType(head)
+}
+
+// Keeps the first bytes written to it.
+type headWriter struct {
+	head []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if n := 512 - len(h.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		h.head = append(h.head, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// Attach the contents of "r" to bug "a.BugId", within the limits on
+// the size of a file and of all the files of a project. "a" has the
+// bug, person, file name, type and description, and the return value
+// has the rest. The attachment is saved in "store", which may be a
+// transaction.
+func (ba *Bagapp) attach(store *bagzullaDb.Store, a Attachment, r io.Reader) (stored Attachment, err error) {
+	a.Filename = cleanFilename(a.Filename)
+	err = ba.files.store(r, &a, int64(ba.maxAttachment))
+	if err != nil {
+		return a, err
+	}
+	if ba.projectQuota > 0 {
+		bug, err := store.BugFromId(a.BugId)
+		if err != nil {
+			return a, err
+		}
+		var used int64
+		err = store.Stmt(projectAttachmentsSizeQuery).QueryRow(bug.ProjectId).Scan(&used)
+		if err != nil {
+			return a, err
+		}
+		if used+a.Size > int64(ba.projectQuota) {
+			ba.files.removeUnused(store, a.SHA256)
+			return a, fmt.Errorf("The project's files would be larger than its limit of %s",
+				formatSize(int64(ba.projectQuota)))
+		}
+	}
+	a.Entered = time.Now()
+	result, err := store.Stmt(insertAttachmentQuery).Exec(a.BugId, a.PersonId,
+		a.Filename, a.ContentType, a.Size, a.SHA256, a.Description, a.Entered)
+	if err != nil {
+		ba.files.removeUnused(store, a.SHA256)
+		return a, err
+	}
+	a.AttachmentId, err = result.LastInsertId()
+	return a, err
+}
+
+// Read the start of a text attachment for the bug page.
+func (a *Attachment) readPreview(fs fileStore) error {
+	f, err := fs.open(a.SHA256)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, previewBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	text := strings.ToValidUTF8(string(buf[:n]), "�")
+	a.PreviewCut = int64(n) < a.Size
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > previewLines {
+		lines = lines[:previewLines]
+		a.PreviewCut = true
+	}
+	a.Preview = strings.Join(lines, "")
+	return nil
+}
+
+// Get the attachments of a bug for the bug page.
+func getAttachments(b *Bagreply, bugId int64) (attachments []Attachment, ok bool) {
+	attachments, err := bugAttachments(b.data(), bugId)
+	if err != nil {
+		b.errorPage("Error getting attachments of bug %d: %s", bugId, err)
+		return attachments, false
+	}
+	for i := range attachments {
+		a := &attachments[i]
+		a.Person, ok = getPersonName(b, a.PersonId)
+		if !ok {
+			return attachments, false
+		}
+		if a.IsText() {
+			err = a.readPreview(b.App.files)
+			if err != nil {
+				log.Printf("Error reading attachment %d: %s", a.AttachmentId, err)
+			}
+		}
+	}
+	return attachments, true
+}
+
+// Get the attachment with the ID at the end of the URL, if the user
+// may see its bug.
+func getAttachment(b *Bagreply) (a Attachment, ok bool) {
+	attachmentId, ok := getFinalNum(b)
+	if !ok {
+		return a, false
+	}
+	a, found, err := attachmentFromId(b.data(), attachmentId)
+	if err != nil {
+		b.errorPage("Error getting attachment %d: %s", attachmentId, err)
+		return a, false
+	}
+	if !found {
+		b.w.WriteHeader(http.StatusNotFound)
+		b.errorPage("There is no attachment %d", attachmentId)
+		return a, false
+	}
+	if b.NotAllowedBug(b.perm, a.BugId) {
+		return a, false
+	}
+	return a, true
+}
+
+// Send an attachment at /attachment/N. It is always sent as a
+// download, so that HTML or SVG files cannot run scripts on this
+// site, but images can still be shown with <img>. The contents of an
+// attachment never change, so its hash is its ETag.
+func attachmentHandler(b *Bagreply) {
+	a, ok := getAttachment(b)
+	if !ok {
+		return
+	}
+	f, err := b.App.files.open(a.SHA256)
+	if err != nil {
+		b.errorPage("Error opening attachment %d: %s", a.AttachmentId, err)
+		return
+	}
+	defer f.Close()
+	h := b.w.Header()
+	h.Set("Content-Type", a.ContentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": a.Filename}))
+	serveFile(b, f, a.Entered, a.SHA256)
+}
+
+// Send the file "f" with http.ServeContent, which handles ranges and
+// conditional requests. The user may not be allowed to see the file
+// later, so it is only cached by the browser.
+func serveFile(b *Bagreply, f io.ReadSeeker, modified time.Time, etag string) {
+	h := b.w.Header()
+	h.Set("ETag", `"`+etag+`"`)
+	h.Set("Cache-Control", "private")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	http.ServeContent(b.w, b.r, "", modified, f)
+}
+
+// Shrink "src" to fit in a square of "size" pixels, averaging the
+// pixels which go into each pixel of the thumbnail.
+func shrinkImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w > h {
+			tw, th = size, h*size/w
+		} else {
+			tw, th = w*size/h, size
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0 := bounds.Min.Y + y*h/th
+		y1 := bounds.Min.Y + (y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0 := bounds.Min.X + x*w/tw
+			x1 := bounds.Min.X + (x+1)*w/tw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n),
+				uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// Make the thumbnail of the image with hash "sum", if there is not
+// one already.
+func (fs fileStore) makeThumb(sum string) (path string, err error) {
+	path, err = fs.thumbPath(sum)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(path)
+	if err == nil {
+		return path, nil
+	}
+	f, err := fs.open(sum)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", err
+	}
+	if config.Width*config.Height > maxThumbPixels {
+		return "", fmt.Errorf("Image of %dx%d is too large for a thumbnail",
+			config.Width, config.Height)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), "thumb*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	err = png.Encode(temp, shrinkImage(src, thumbSize))
+	closeErr := temp.Close()
+	if err != nil {
+		return "", err
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+	return path, os.Rename(temp.Name(), path)
+}
+
+// Send the thumbnail of an image attachment at /attachment-thumb/N.
+func attachmentThumbHandler(b *Bagreply) {
+	a, ok := getAttachment(b)
+	if !ok {
+		return
+	}
+	if !a.IsImage() {
+		b.w.WriteHeader(http.StatusNotFound)
+		b.errorPage("Attachment %d is not an image", a.AttachmentId)
+		return
+	}
+	path, err := b.App.files.makeThumb(a.SHA256)
+	if err != nil {
+		b.errorPage("Error making thumbnail of attachment %d: %s", a.AttachmentId, err)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		b.errorPage("Error reading thumbnail of attachment %d: %s", a.AttachmentId, err)
+		return
+	}
+	defer f.Close()
+	b.w.Header().Set("Content-Type", "image/png")
+	serveFile(b, f, a.Entered, "thumb-"+a.SHA256)
+}
+
+// May the user delete a file which the person "ownerId" uploaded to
+// bug "bugId"? People may delete their own files, and developers may
+// delete anyone's. If not, an error page is sent and the return value
+// is false.
+func (b *Bagreply) mayDeleteFile(ownerId int64, bugId int64) bool {
+	if b.User != nil && b.User.PersonId == ownerId {
+		return !b.NotAllowedBug(roleReporter, bugId)
+	}
+	return !b.NotAllowedBug(roleDeveloper, bugId)
+}
+
+// Remove an attachment with the form on the bug page.
+func deleteAttachment(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	a, ok := getAttachment(b)
+	if !ok || !b.mayDeleteFile(a.PersonId, a.BugId) {
+		return
+	}
+	_, err := b.data().Stmt(deleteAttachmentQuery).Exec(a.AttachmentId)
+	if err != nil {
+		b.errorPage("Error removing attachment %d: %s", a.AttachmentId, err)
+		return
+	}
+	err = b.App.files.removeUnused(b.data(), a.SHA256)
+	if err != nil {
+		log.Printf("Error removing file of attachment %d: %s", a.AttachmentId, err)
+	}
+	b.redirectToBug(a.BugId)
+}
+
+// Read the file, bug ID and description of an upload. The caller
+// closes the file.
+func (b *Bagreply) readUpload() (a Attachment, file multipart.File, err error) {
+	r := b.r
+	if b.App.maxAttachment > 0 {
+		// Leave room for the other form fields.
+		r.Body = http.MaxBytesReader(b.w, r.Body, int64(b.App.maxAttachment)+1<<20)
+	}
+	err = r.ParseMultipartForm(10 << 20)
+	if err != nil {
+		return a, nil, fmt.Errorf("Error reading upload: %s", err)
+	}
+	bugid := r.PostFormValue("bug-id")
+	if bugid == "" {
+		return a, nil, fmt.Errorf("Could not get bug ID from form inputs")
+	}
+	bugnum, err := strconv.ParseInt(bugid, 10, 64)
+	if err != nil {
+		return a, nil, fmt.Errorf("Error parsing bug ID %s: %s", html.EscapeString(bugid), err)
+	}
+	file, header, err := r.FormFile("attachment")
+	if err != nil {
+		return a, nil, fmt.Errorf("Error retrieving file from form-data: %s", err)
+	}
+	a = Attachment{
+		BugId:       bugnum,
+		PersonId:    b.User.PersonId,
+		Filename:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Description: strings.TrimSpace(r.PostFormValue("description")),
+	}
+	return a, file, nil
+}
+
+// The reply to an upload from the script of the bug page.
+type uploadReply struct {
+	AttachmentId int64  `json:",omitempty"`
+	Filename     string `json:",omitempty"`
+	// The text which refers to the file in a comment.
+	Reference string `json:",omitempty"`
+	URL       string `json:",omitempty"`
+	Thumb     string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+func (b *Bagreply) sendJSON(status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error making JSON: %s", err)
+		status = http.StatusInternalServerError
+		out = []byte(`{"Error":"Error making the reply"}`)
+	}
+	b.w.Header().Set("Content-Type", "application/json")
+	b.w.WriteHeader(status)
+	b.w.Write(out)
+}
+
+// Attach a file which was pasted or dropped onto the comment box of
+// the bug page. The reply is JSON, so that the script can put a
+// reference to the file into the comment.
+func uploadJSON(b *Bagreply) {
+	// As NotLoggedIn and NotAllowed, but in JSON.
+	if b.User == nil {
+		b.sendJSON(http.StatusUnauthorized, uploadReply{
+			Error: "You are not logged in, and so cannot make changes.",
+		})
+		return
+	}
+	if b.Token != nil && !b.Token.has("write") {
+		b.sendJSON(http.StatusForbidden, uploadReply{
+			Error: fmt.Sprintf("Token %s does not have write scope", b.Token.Name),
+		})
+		return
+	}
+	a, file, err := b.readUpload()
+	if err != nil {
+		b.sendJSON(http.StatusBadRequest, uploadReply{Error: err.Error()})
+		return
+	}
+	defer file.Close()
+	bug, err := b.data().BugFromId(a.BugId)
+	have := b.roleIn(bug.ProjectId)
+	if err != nil || have == roleNone {
+		b.sendJSON(http.StatusNotFound, uploadReply{
+			Error: fmt.Sprintf("There is no bug with ID %d", a.BugId),
+		})
+		return
+	}
+	if have < roleReporter {
+		b.sendJSON(http.StatusForbidden, uploadReply{
+			Error: fmt.Sprintf("You need to be a %s to do this", roleReporter),
+		})
+		return
+	}
+	// As inTrash, but in JSON.
+	if !bug.Deleted.IsZero() {
+		b.sendJSON(http.StatusNotFound, uploadReply{
+			Error: fmt.Sprintf("The bug with ID %d is in the trash", a.BugId),
+		})
+		return
+	}
+	// As inTx and updateChanged, but with the errors in JSON. A
+	// file which cannot be attached is the client's mistake, and
+	// anything else is the server's.
+	status := http.StatusBadRequest
+	err = b.App.data.Transact(func(tx *bagzullaDb.Store) error {
+		a, err = b.App.attach(tx, a, file)
+		if err != nil {
+			return err
+		}
+		status = http.StatusInternalServerError
+		return tx.UpdateChangedForBug(time.Now(), a.BugId)
+	})
+	if err != nil {
+		b.App.files.removeUnused(b.data(), a.SHA256)
+		b.sendJSON(status, uploadReply{
+			Error: fmt.Sprintf("Error saving %s: %s", a.Filename, err),
+		})
+		return
+	}
+	reply := uploadReply{
+		AttachmentId: a.AttachmentId,
+		Filename:     a.Filename,
+		Reference:    fmt.Sprintf("attachment %d", a.AttachmentId),
+		URL:          fmt.Sprintf("%s/attachment/%d", b.App.TopURL, a.AttachmentId),
+	}
+	if a.IsImage() {
+		reply.Thumb = fmt.Sprintf("%s/attachment-thumb/%d", b.App.TopURL, a.AttachmentId)
+	}
+	b.sendJSON(http.StatusOK, reply)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect byteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"500K", 500 << 10},
+		{"10m", 10 << 20},
+		{"2G", 2 << 30},
+	}
+	for _, test := range tests {
+		var s byteSize
+		err := s.Set(test.value)
+		if err != nil || s != test.expect {
+			t.Errorf("%s: expected %d, got %d %v", test.value, test.expect, s, err)
+		}
+	}
+	var s byteSize
+	for _, bad := range []string{"", "M", "-1", "10X"} {
+		if s.Set(bad) == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if formatSize(1536) != "1.5 KB" || formatSize(100) != "100 bytes" {
+		t.Errorf("formatSize gave %s and %s", formatSize(1536), formatSize(100))
+	}
+}
+
+func TestAttachmentNames(t *testing.T) {
+	names := map[string]string{
+		"shot.png":           "shot.png",
+		"../../etc/passwd":   "passwd",
+		`C:\Users\me\a.log`:  "a.log",
+		"..":                 "attachment",
+		"":                   "attachment",
+		"bad\x00name\n.txt":  "badname.txt",
+		"naïve résumé.patch": "naïve résumé.patch",
+	}
+	for name, expect := range names {
+		if got := cleanFilename(name); got != expect {
+			t.Errorf("cleanFilename(%q) is %q, not %q", name, got, expect)
+		}
+	}
+	types := []struct {
+		name, declared, head, expect string
+	}{
+		{"fix.patch", "application/octet-stream", "diff", "text/x-diff"},
+		{"build.log", "", "x", "text/plain; charset=utf-8"},
+		{"noext", "application/octet-stream", "\x89PNG\r\n\x1a\n", "image/png"},
+		{"noext", "text/csv", "a,b", "text/csv"},
+	}
+	for _, test := range types {
+		got := attachmentType(test.name, test.declared, []byte(test.head))
+		if got != test.expect {
+			t.Errorf("attachmentType(%q, %q) is %q, not %q", test.name,
+				test.declared, got, test.expect)
+		}
+	}
+}
+
+// Post "content" as the file "name" to the upload form of bug "bugId".
+func uploadFile(ba *Bagapp, token string, bugId int64, name string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("bug-id", fmt.Sprint(bugId))
+	mw.WriteField("description", "A file called "+name)
+	fw, _ := mw.CreateFormFile("attachment", name)
+	fw.Write(content)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	makeHandler(ba, upload, roleReporter)(w, r)
+	return w
+}
+
+func getPage(ba *Bagapp, token string, fn BagFunc, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	makeHandler(ba, fn, roleViewer)(w, r)
+	return w
+}
+
+func TestAttachments(t *testing.T) {
+	ba := getTestApp(t)
+	defer func() {
+		ba.maxAttachment = 0
+		ba.projectQuota = 0
+	}()
+	bugId, err := addBug(ba.data, "Attached", "Files", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tony, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := []byte("--- a/x\n+++ b/x\n+<script>alert(1)</script>\n")
+	for _, name := range []string{"fix.patch", "same.diff"} {
+		w := uploadFile(ba, tony, bugId, name, patch)
+		if w.Code != http.StatusFound {
+			t.Fatalf("Upload of %s: status %d: %s", name, w.Code, w.Body.String())
+		}
+	}
+	attachments, err := bugAttachments(ba.data, bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %d", len(attachments))
+	}
+	a := attachments[0]
+	if a.Filename != "fix.patch" || a.ContentType != "text/x-diff" ||
+		a.Size != int64(len(patch)) || a.PersonId != 2 ||
+		a.Description != "A file called fix.patch" {
+		t.Errorf("Bad attachment %+v", a)
+	}
+	if attachments[1].SHA256 != a.SHA256 {
+		t.Errorf("Same contents have different hashes")
+	}
+	stored, err := filepath.Glob(filepath.Join(ba.files.root, "sha256", "*", "*"))
+	if err != nil || len(stored) != 1 {
+		t.Errorf("Expected one stored file, got %v %v", stored, err)
+	}
+
+	// The bug page shows the patch without running it.
+	w := getPage(ba, tony, bugHandler, fmt.Sprintf("/bug/%d", bugId))
+	page := w.Body.String()
+	if !strings.Contains(page, "&lt;script&gt;alert(1)") || strings.Contains(page, "<script>alert") {
+		t.Errorf("Patch not shown safely on the bug page")
+	}
+	w = getPage(ba, tony, attachmentHandler, fmt.Sprintf("/attachment/%d", a.AttachmentId))
+	if w.Body.String() != string(patch) {
+		t.Errorf("Download is %q", w.Body.String())
+	}
+	if d := w.Header().Get("Content-Disposition"); d != "attachment; filename=fix.patch" {
+		t.Errorf("Content-Disposition is %q", d)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("No nosniff header")
+	}
+
+	// Images get thumbnails.
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, img)
+	uploadFile(ba, tony, bugId, "shot", pngData.Bytes())
+	attachments, _ = bugAttachments(ba.data, bugId)
+	shot := attachments[len(attachments)-1]
+	if shot.ContentType != "image/png" || !shot.IsImage() {
+		t.Errorf("Screenshot has type %s", shot.ContentType)
+	}
+	w = getPage(ba, tony, attachmentThumbHandler, fmt.Sprintf("/attachment-thumb/%d", shot.AttachmentId))
+	thumb, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Thumbnail is not a PNG: %s", err)
+	}
+	if thumb.Bounds().Dx() != 200 || thumb.Bounds().Dy() != 150 {
+		t.Errorf("Thumbnail is %v", thumb.Bounds())
+	}
+	w = getPage(ba, tony, attachmentThumbHandler, fmt.Sprintf("/attachment-thumb/%d", a.AttachmentId))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Thumbnail of a patch: status %d", w.Code)
+	}
+
+	// The limits.
+	ba.maxAttachment = 10
+	w = uploadFile(ba, tony, bugId, "big.txt", []byte("more than ten bytes"))
+	if !strings.Contains(w.Body.String(), "larger than the limit") {
+		t.Errorf("File over the limit accepted")
+	}
+	ba.maxAttachment = 0
+	var used int64
+	err = ba.db.QueryRow(projectAttachmentsSizeSql, 2).Scan(&used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba.projectQuota = byteSize(used + 5)
+	w = uploadFile(ba, tony, bugId, "over.txt", []byte("more than five"))
+	if !strings.Contains(w.Body.String(), "larger than its limit") {
+		t.Errorf("File over the project quota accepted")
+	}
+	w = uploadFile(ba, tony, bugId, "under.txt", []byte("five"))
+	if w.Code != http.StatusFound {
+		t.Errorf("File under the project quota refused: %s", w.Body.String())
+	}
+	ba.projectQuota = 0
+
+	// The stored file goes when the last attachment using it goes.
+	path, err := ba.files.path(a.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []int64{a.AttachmentId, attachments[1].AttachmentId} {
+		r := httptest.NewRequest("POST", fmt.Sprintf("/delete-attachment/%d", id), nil)
+		r.Header.Set("Authorization", "Bearer "+tony)
+		w = httptest.NewRecorder()
+		makeHandler(ba, deleteAttachment, roleDeveloper)(w, r)
+		if w.Code != http.StatusFound {
+			t.Errorf("Delete of %d: status %d", id, w.Code)
+		}
+		_, err = os.Stat(path)
+		if exists := err == nil; exists != (i == 0) {
+			t.Errorf("After deleting %d attachments, stored file exists is %t", i+1, exists)
+		}
+	}
+}
+
+// Post "content" as the file "name" to the JSON upload of bug "bugId".
+func uploadJSONFile(ba *Bagapp, token string, bugId int64, name string, content []byte) (reply uploadReply, w *httptest.ResponseRecorder) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("bug-id", fmt.Sprint(bugId))
+	fw, _ := mw.CreateFormFile("attachment", name)
+	fw.Write(content)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/upload-json/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w = httptest.NewRecorder()
+	makeHandler(ba, uploadJSON, roleViewer)(w, r)
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	return reply, w
+}
+
+func TestUploadJSON(t *testing.T) {
+	ba := getTestApp(t)
+	bugId, err := addBug(ba.data, "Pasted", "Screenshots", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBug, err := addBug(ba.data, "Other", "Files", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tony, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	shot, w := uploadJSONFile(ba, tony, bugId, "screenshot-1.png", pngData.Bytes())
+	if w.Code != http.StatusOK || shot.Error != "" || shot.AttachmentId == 0 {
+		t.Fatalf("Upload gave %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Reply has type %s", w.Header().Get("Content-Type"))
+	}
+	if shot.Reference != fmt.Sprintf("attachment %d", shot.AttachmentId) ||
+		shot.Thumb != fmt.Sprintf("%s/attachment-thumb/%d", ba.TopURL, shot.AttachmentId) {
+		t.Errorf("Bad reply %+v", shot)
+	}
+	logFile, _ := uploadJSONFile(ba, tony, bugId, "<b>.log", []byte("log"))
+	if logFile.Thumb != "" || logFile.Filename != "<b>.log" {
+		t.Errorf("Bad reply %+v", logFile)
+	}
+	other, _ := uploadJSONFile(ba, tony, otherBug, "other.png", pngData.Bytes())
+
+	// The errors are in JSON too.
+	reply, w := uploadJSONFile(ba, "", bugId, "x.png", pngData.Bytes())
+	if w.Code != http.StatusUnauthorized || !strings.Contains(reply.Error, "not logged in") {
+		t.Errorf("Upload without logging in gave %d %s", w.Code, w.Body.String())
+	}
+	viewer, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, w = uploadJSONFile(ba, viewer, bugId, "x.png", pngData.Bytes())
+	if w.Code != http.StatusForbidden || !strings.Contains(reply.Error, "write scope") {
+		t.Errorf("Upload with a read token gave %d %s", w.Code, w.Body.String())
+	}
+	reply, w = uploadJSONFile(ba, tony, 1000000, "x.png", pngData.Bytes())
+	if w.Code != http.StatusNotFound || reply.Error == "" {
+		t.Errorf("Upload to a missing bug gave %d %s", w.Code, w.Body.String())
+	}
+	binned, err := addBug(ba.data, "Binned", "Files", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setTrash(ba.data, "bug", binned, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, w = uploadJSONFile(ba, tony, binned, "x.png", pngData.Bytes())
+	if w.Code != http.StatusNotFound || !strings.Contains(reply.Error, "in the trash") {
+		t.Errorf("Upload to a bug in the trash gave %d %s", w.Code, w.Body.String())
+	}
+
+	// The references in comments become thumbnails and links, but
+	// not the files of other bugs.
+	comment := fmt.Sprintf("See %s and %s, not attachment %d.",
+		shot.Reference, logFile.Reference, other.AttachmentId)
+	_, err = addComment(ba.data, bugId, 2, comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := getPage(ba, tony, bugHandler, fmt.Sprintf("/bug/%d", bugId)).Body.String()
+	thumb := fmt.Sprintf("<img class='inline-thumb' src='%s'", shot.Thumb)
+	if !strings.Contains(page, thumb) {
+		t.Errorf("No thumbnail for %s", shot.Reference)
+	}
+	link := fmt.Sprintf("href='%s' title='&lt;b&gt;.log'>%s</a>", logFile.URL, logFile.Reference)
+	if !strings.Contains(page, link) {
+		t.Errorf("No link for %s", logFile.Reference)
+	}
+	if !strings.Contains(page, fmt.Sprintf("not attachment %d.", other.AttachmentId)) {
+		t.Errorf("Attachment of another bug was changed")
+	}
+}
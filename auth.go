@@ -25,14 +25,11 @@ func (b *Bagreply) getSession() (user bagzullaDb.Person, found bool, ok bool) {
 		b.errorPage("Error getting user from cookie: %s", err)
 		return user, false, false
 	}
-	user, err = bagzullaDb.PersonFromName(b.App.db, login)
+	user, err = b.data().PersonFromName(login)
 	if err != nil {
 		b.errorPage("Error getting user details for name '%s': %s", login, err)
 		return user, false, false
 	}
-	// For some reason bagzullaDb.go doesn't fill in the Name field of
-	// the Person structure.
-	user.Name = login
 	return user, true, true
 }
 
@@ -88,11 +85,26 @@ func loginHandler(b *Bagreply) {
 		b.errorPage("No password")
 		return
 	}
+	if !b.loginAllowed(name) {
+		return
+	}
+	waiting := signUpWaiting(b.data(), name, password)
+	if waiting != "" {
+		b.w.WriteHeader(http.StatusForbidden)
+		b.errorPage("%s", waiting)
+		return
+	}
 	err := b.App.login.LogIn(b.w, b.r, name, password)
+	b.cookieFlags()
 	if err != nil {
-		b.errorPage("Login failed: %s", err)
+		if debugLogin {
+			log.Printf("Login failed: %s", err)
+		}
+		b.loginFailed(name)
+		b.errorPage(loginFailedMessage)
 		return
 	}
+	b.authEvent(name, authLogin)
 	if debugLogin {
 		log.Printf("Logged in.\n")
 	}
@@ -101,10 +113,11 @@ func loginHandler(b *Bagreply) {
 	http.Redirect(b.w, b.r, referer, http.StatusFound)
 }
 
-// This is called directly by /logout/, so it is not from a form, so
-// just get the referrer from b.r.
+// This is called by the log out button of the menu, which has no
+// referer field, so just get the referrer from b.r.
 func logoutHandler(b *Bagreply) {
 	b.App.login.LogOut(b.w, b.r)
+	b.cookieFlags()
 	referer := b.r.Referer()
 	http.Redirect(b.w, b.r, referer, http.StatusFound)
 }
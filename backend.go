@@ -0,0 +1,378 @@
+package main
+
+/* Ways of checking who the user is other than the passwords in the
+   person table: an htpasswd file, an LDAP server, or a reverse proxy
+   which has already checked and sends the user's name in a header.
+   People who log in through these get a person row when they first
+   log in. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The places to check passwords, for --auth.
+var authBackends = []string{"db", "htpasswd", "ldap", "proxy"}
+
+// Something which checks passwords instead of the person table.
+type passwordChecker interface {
+	checkPassword(user string, password string) (ok bool, err error)
+}
+
+// The options of the authentication backends.
+type authConfig struct {
+	// One of authBackends
+	backend string
+	// The htpasswd file
+	htpasswd string
+	// The LDAP server URL and the DN to bind as
+	ldapURL string
+	ldapDN  string
+	// The header with the user name from the proxy
+	proxyHeader string
+	// Comma-separated addresses or CIDR ranges of the proxies whose
+	// header is believed
+	trustedProxies string
+}
+
+// Set up the login store for the backend in "ac".
+func (ba *Bagapp) initAuth(ac authConfig) error {
+	bu := &baguser{b: ba}
+	ba.store = bu
+	ba.proxyHeader = ""
+	switch ac.backend {
+	case "", "db":
+	case "htpasswd":
+		if ac.htpasswd == "" {
+			return fmt.Errorf("--auth htpasswd needs --htpasswd")
+		}
+		h := &htpasswd{file: ac.htpasswd}
+		err := h.load()
+		if err != nil {
+			return err
+		}
+		bu.checker = h
+	case "ldap":
+		if ac.ldapURL == "" || !strings.Contains(ac.ldapDN, "%s") {
+			return fmt.Errorf("--auth ldap needs --ldap-url and a --ldap-dn containing %%s")
+		}
+		bu.checker = &ldapChecker{url: ac.ldapURL, dn: ac.ldapDN}
+	case "proxy":
+		if ac.proxyHeader == "" {
+			return fmt.Errorf("--auth proxy needs --proxy-header")
+		}
+		nets, err := parseNets(ac.trustedProxies)
+		if err != nil {
+			return err
+		}
+		ba.proxyHeader = ac.proxyHeader
+		ba.trustedProxies = nets
+		// The login form is not used.
+		bu.checker = noPasswords{}
+	default:
+		return fmt.Errorf("Unknown --auth %s, use one of %s", ac.backend,
+			strings.Join(authBackends, ", "))
+	}
+	return ba.login.Init(ba.store, cookieName, cookiePath)
+}
+
+// Make a person for "name", who has logged in through another
+// backend, if there is not one already.
+func ensurePerson(store *bagzullaDb.Store, name string) (person bagzullaDb.Person, err error) {
+	person, err = store.PersonFromName(name)
+	if err != nil || person.PersonId != 0 {
+		return person, err
+	}
+	person.Name = name
+	person.Email = placeholderEmail(name)
+	// Like people who sign up, they can report bugs until an admin
+	// gives them another role.
+	person.Role = signUpRole.String()
+	person.PersonId, err = store.InsertPerson(person)
+	if err != nil {
+		// Another request may have added them first.
+		again, err2 := store.PersonFromName(name)
+		if err2 == nil && again.PersonId != 0 {
+			return again, nil
+		}
+		return person, err
+	}
+	log.Printf("Added person %s (%d)", name, person.PersonId)
+	return person, nil
+}
+
+// Email addresses must be unique, so people who are added by logging
+// in get their name, if it is an address, or an address which goes
+// nowhere.
+func placeholderEmail(name string) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return name + "@invalid"
+}
+
+// A checker which refuses every password, for when the proxy checks
+// who the user is.
+type noPasswords struct{}
+
+func (noPasswords) checkPassword(user string, password string) (bool, error) {
+	return false, nil
+}
+
+// An htpasswd file, which is read again when it changes.
+type htpasswd struct {
+	file     string
+	mu       sync.Mutex
+	modified time.Time
+	hashes   map[string]string
+}
+
+func (h *htpasswd) load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	info, err := os.Stat(h.file)
+	if err != nil {
+		return err
+	}
+	if h.hashes != nil && info.ModTime().Equal(h.modified) {
+		return nil
+	}
+	f, err := os.Open(h.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		colon := strings.Index(line, ":")
+		if colon < 1 {
+			log.Printf("%s: ignoring line without user:password", h.file)
+			continue
+		}
+		hashes[line[:colon]] = line[colon+1:]
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	h.hashes = hashes
+	h.modified = info.ModTime()
+	return nil
+}
+
+func (h *htpasswd) checkPassword(user string, password string) (ok bool, err error) {
+	err = h.load()
+	if err != nil {
+		return false, err
+	}
+	h.mu.Lock()
+	hash, found := h.hashes[user]
+	h.mu.Unlock()
+	if !found {
+		return false, nil
+	}
+	return htpasswdMatch(hash, password)
+}
+
+// Does "password" match "hash" from an htpasswd file? The SHA-1
+// ({SHA}) and MD5 ($apr1$) hashes of the htpasswd program are
+// understood.
+func htpasswdMatch(hash string, password string) (ok bool, err error) {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		computed = md5Crypt(password, hash, "$apr1$")
+	case strings.HasPrefix(hash, "$1$"):
+		computed = md5Crypt(password, hash, "$1$")
+	default:
+		return false, fmt.Errorf("Unsupported password hash; make it with htpasswd -m or -s")
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+}
+
+var md5CryptChars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// The MD5 crypt of Poul-Henning Kamp, as used by Apache with the
+// magic string "$apr1$". The salt is taken from "setting", which may
+// be a whole hash.
+func md5Crypt(password string, setting string, magic string) string {
+	salt := strings.TrimPrefix(setting, magic)
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for n := len(pw); n > 0; n -= 16 {
+		if n > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:n])
+		}
+	}
+	for i := len(pw); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, md5CryptChars[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, t := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[t[0]])<<16|uint32(final[t[1]])<<8|uint32(final[t[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// Parse a list of addresses and CIDR ranges separated by commas.
+func parseNets(list string) (nets []*net.IPNet, err error) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Bad address %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Did the request come straight from a trusted proxy?
+func (ba *Bagapp) trustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range ba.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the user from the header which the proxy sends. The user also
+// gets a login session, so that the forms have a CSRF token.
+func (b *Bagreply) proxyUser() (user bagzullaDb.Person, found bool, ok bool) {
+	name := strings.TrimSpace(b.r.Header.Get(b.App.proxyHeader))
+	if name == "" {
+		return user, false, true
+	}
+	if !b.App.trustedProxy(b.r) {
+		log.Printf("Ignoring %s from %s, which is not a trusted proxy",
+			b.App.proxyHeader, b.r.RemoteAddr)
+		return user, false, true
+	}
+	user, err := ensurePerson(b.data(), name)
+	if err != nil {
+		b.errorPage("Error adding %s: %s", name, err)
+		return user, false, false
+	}
+	login, err := b.App.login.User(b.w, b.r)
+	if err == nil && login == name {
+		return user, true, true
+	}
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		b.errorPage("Error making session: %s", err)
+		return user, false, false
+	}
+	cookie := hex.EncodeToString(buf)
+	err = b.App.store.StoreLogin(name, cookie)
+	if err != nil {
+		b.errorPage("Error storing session: %s", err)
+		return user, false, false
+	}
+	http.SetCookie(b.w, &http.Cookie{Name: cookieName, Value: cookie, Path: cookiePath})
+	b.cookieFlags()
+	b.csrf, err = sessionCSRF(b.data(), cookie)
+	if err != nil {
+		log.Printf("Error getting CSRF token: %s", err)
+	}
+	return user, true, true
+}
+
+// Whether to show the links to log in and out, which are not used
+// when the proxy says who the user is.
+func (ba *Bagapp) LoginLinks() bool {
+	return ba.proxyHeader == ""
+}
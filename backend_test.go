@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Make an application sharing the test database with its own login
+// backend.
+func getBackendApp(t *testing.T, ac authConfig) *Bagapp {
+	ba := getTestApp(t)
+	ext := &Bagapp{
+		db:        ba.db,
+		data:      ba.data,
+		templates: ba.templates,
+		TopURL:    ba.TopURL,
+		Context:   ba.Context,
+	}
+	ext.makeNameCaches()
+	err := ext.initAuth(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ext
+}
+
+func TestMd5Crypt(t *testing.T) {
+	// These were made with "openssl passwd".
+	tests := []struct {
+		password string
+		hash     string
+	}{
+		{"secret", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"},
+		{"a rather long password of many words", "$apr1$8charsal$AG2YU76jexLCI..m/hmba1"},
+		{"", "$apr1$x$tMwYqBfQwi3FYAr0aJc8M/"},
+		{"secret", "$1$abc$iCQ2D3nhptRYi27fDYv2s1"},
+		{"secret", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+	}
+	for _, test := range tests {
+		ok, err := htpasswdMatch(test.hash, test.password)
+		if err != nil || !ok {
+			t.Errorf("%q does not match %s (%v)", test.password, test.hash, err)
+		}
+		ok, err = htpasswdMatch(test.hash, test.password+"x")
+		if err != nil || ok {
+			t.Errorf("%q matches %s (%v)", test.password+"x", test.hash, err)
+		}
+	}
+	_, err := htpasswdMatch("$2y$05$abcdefghijklmnopqrstuu", "secret")
+	if err == nil {
+		t.Errorf("No error for a bcrypt hash")
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	file := filepath.Join(testDir, "htpasswd")
+	err := ioutil.WriteFile(file, []byte(`# Made with htpasswd
+alice:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba := getBackendApp(t, authConfig{backend: "htpasswd", htpasswd: file})
+	for _, name := range []string{"alice", "bob"} {
+		w := tryLogin(ba, name, "secret", "198.51.100.20")
+		if w.Code != http.StatusFound {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusFound, w.Code)
+		}
+		person, err := ba.data.PersonFromName(name)
+		if err != nil || person.PersonId == 0 {
+			t.Errorf("No person made for %s (%v)", name, err)
+		}
+	}
+	person, err := ba.data.PersonFromName("alice")
+	if err != nil || person.Email != "alice@invalid" {
+		t.Errorf("Unexpected email %q for alice (%v)", person.Email, err)
+	}
+	w := tryLogin(ba, "alice", "wrong", "198.51.100.21")
+	if !strings.Contains(w.Body.String(), loginFailedMessage) {
+		t.Errorf("Wrong password was not refused")
+	}
+	// The passwords in the database are not used.
+	w = tryLogin(ba, "duncan", "12345", "198.51.100.22")
+	if !strings.Contains(w.Body.String(), loginFailedMessage) {
+		t.Errorf("Password from the database was accepted")
+	}
+	// Changes to the file are noticed.
+	err = ioutil.WriteFile(file, []byte("alice:$1$abc$iCQ2D3nhptRYi27fDYv2s1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(file, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := ba.store.(*baguser).checker
+	ok, err := checker.checkPassword("bob", "secret")
+	if err != nil || ok {
+		t.Errorf("Removed user bob can still log in (%v)", err)
+	}
+	ok, err = checker.checkPassword("alice", "secret")
+	if err != nil || !ok {
+		t.Errorf("alice cannot log in after the change (%v)", err)
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	ba := getBackendApp(t, authConfig{
+		backend:        "proxy",
+		proxyHeader:    "X-Remote-User",
+		trustedProxies: "127.0.0.1, 192.0.2.0/24",
+	})
+	var user string
+	handler := makeHandler(ba, func(b *Bagreply) {
+		user = ""
+		if b.User != nil {
+			user = b.User.Name
+		}
+	}, roleViewer)
+	request := func(method string, from string, cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Remote-User", "carol")
+		r.RemoteAddr = from + ":4321"
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	w := request("GET", "192.0.2.7", nil, nil)
+	if user != "carol" {
+		t.Fatalf("Expected carol from the proxy, got %q", user)
+	}
+	person, err := ba.data.PersonFromName("carol")
+	if err != nil || person.PersonId == 0 {
+		t.Errorf("No person made for carol (%v)", err)
+	}
+	if person.Role != "reporter" {
+		t.Errorf("Person from the proxy has role %q", person.Role)
+	}
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(cookies) != 1 || cookies[0].Name != cookieName {
+		t.Fatalf("Expected a session cookie, got %v", cookies)
+	}
+	cookie := cookies[0]
+	request("GET", "198.51.100.30", nil, nil)
+	if user != "" {
+		t.Errorf("Header from an untrusted address gave user %q", user)
+	}
+	// The forms still need the CSRF token of the session.
+	w = request("POST", "192.0.2.7", cookie, url.Values{"a": {"b"}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST without token: expected status %d, got %d",
+			http.StatusForbidden, w.Code)
+	}
+	token, err := sessionCSRF(ba.data, cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = request("POST", "192.0.2.7", cookie, url.Values{csrfField: {token}})
+	if w.Code != http.StatusOK || user != "carol" {
+		t.Errorf("POST with token: got status %d and user %q", w.Code, user)
+	}
+	if len(w.Header()["Set-Cookie"]) != 0 {
+		t.Errorf("New session made although the cookie was good")
+	}
+}
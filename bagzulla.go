@@ -21,54 +21,76 @@ import (
 	"fmt"
 	"html"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
 	"github.com/benkasminbullock/gologin/login"
-	"github.com/benkasminbullock/gologin/store"
 )
 
 // The various priorities that a bug may have. The default value is
 // "unknown".
-var priorities = []string{
-	"unknown",
-	"top",
-	"high",
-	"medium",
-	"low",
-	"unimportant",
-}
-
-// A bug with no project number
-const ProjectNone = 1
+var priorities = bagzullaDb.Priorities
 
-// Write a compressed response.
+// Write a compressed response. Whether to compress is decided when
+// the headers are sent, since the files sent by http.ServeContent,
+// which may be ranges of the file, must not be compressed.
 type gzipResponseWriter struct {
-	io.Writer
 	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decided = true
+		h := w.Header()
+		if h.Get("Accept-Ranges") == "" && h.Get("Content-Encoding") == "" &&
+			status != http.StatusNotModified && status != http.StatusNoContent {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
 }
 
-// Use the Writer part of gzipResponseWriter to write the output.
-func (w gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
 }
 
 // Holder for application information.
 type Bagapp struct {
 	store login.LoginStore
 	login login.Login
-	// The connection to the database.
-	db *sql.DB
+	// The connection to the database, and its prepared statements.
+	db   *sql.DB
+	data *bagzullaDb.Store
 	// All the templates after reading in.
 	templates *template.Template
 	port      string
@@ -79,6 +101,56 @@ type Bagapp struct {
 	Cancel     context.CancelFunc
 	Context    context.Context
 	Server     *http.Server
+	// If true, read a mail from standard input, add it to the
+	// database, then exit.
+	ingestMail bool
+	// If true, bring the schema of the database up to date, then
+	// exit.
+	migrateOnly bool
+	// If not empty, give the person with this name the admin role,
+	// then exit.
+	makeAdmin string
+	// The recipient address of the mail, if not taken from the mail
+	// headers.
+	recipient string
+	// Webhook deliveries which are still running.
+	hooks sync.WaitGroup
+	// A login session ends after it has not been used for
+	// "sessionIdle", or after "sessionLifetime" since logging in.
+	// Zero means no limit.
+	sessionIdle     time.Duration
+	sessionLifetime time.Duration
+	// Always mark the cookie as Secure, for servers behind an HTTPS
+	// proxy which does not send X-Forwarded-Proto.
+	secureCookies bool
+	// Lock a name for "loginLockout" after "loginFailures" failed
+	// logins. Zero failures means no limit.
+	loginFailures int
+	loginLockout  time.Duration
+	// If not empty, the user is the one named in this header from a
+	// proxy in "trustedProxies", rather than the one with the cookie.
+	proxyHeader    string
+	trustedProxies []*net.IPNet
+	// Can people sign up at /register/?
+	registration bool
+	// The server for sending mail. If there is one, people who sign
+	// up have to confirm their address.
+	smtp smtpConfig
+	// Where the attached files are kept.
+	files fileStore
+	// The largest attachment, and the most which the attachments of
+	// one project may add up to. Zero means no limit.
+	maxAttachment byteSize
+	projectQuota  byteSize
+	// How long deleted things stay in the trash before an admin
+	// can purge them.
+	trashKeep time.Duration
+	// Copies of the templates for requests to use, from templates().
+	freeTemplates chan *requestTemplates
+	// The caches of the names of projects, parts and people.
+	projectNames *nameCache
+	partNames    *nameCache
+	personNames  *nameCache
 }
 
 // Holder for an individual interaction with the bug tracker.
@@ -88,8 +160,25 @@ type Bagreply struct {
 	r   *http.Request
 	// The user's identification, nil if unidentified.
 	User *bagzullaDb.Person
+	// The API token the user was identified by, nil if the user
+	// was identified by a cookie.
+	Token *Token
+	// The role which the handler needs.
+	perm role
+	// The user's roles, read when first needed.
+	perms *permissions
 	// The title of the page
 	Title string
+	// The URL of an Atom feed for the page, if there is one.
+	Feed string
+	// The CSRF token of the user's session, read when first needed.
+	csrf string
+	// The templates for this request, taken when first needed.
+	tmpl *requestTemplates
+	// The transaction which the changes of the request are made in,
+	// if there is one, and what to do once it is committed.
+	tx          *bagzullaDb.Store
+	afterCommit []func()
 }
 
 // Any handler.
@@ -115,8 +204,9 @@ func stringToPriority(priorityString string) (int64, error) {
 	return -1, fmt.Errorf("Unknown priority %s", priorityString)
 }
 
-// Get an array value. This is used by the template construction.
-func GetArray(counts []int64, id int64) int64 {
+// Get the count for "id", or zero if there is none. This is used by
+// the template construction.
+func GetArray(counts map[int64]int64, id int64) int64 {
 	return counts[id]
 }
 
@@ -154,8 +244,10 @@ type ListBug struct {
 	Priority string
 	// The name of the project this belongs to.
 	ProjectName string
-	// The ID of the project this bug belongs to.
+	// The ID of the project this bug belongs to, or zero if it is in
+	// the inbox.
 	ProjectId int64
+	inInbox   bool
 	// The name of the part of the project which this bug belongs to.
 	PartName string
 	// The name of the owner of this bug.
@@ -177,33 +269,34 @@ type ListBug struct {
 	// The possible values for the project field of the bug's form.
 	Projects []bagzullaDb.Project
 	Images   []bagzullaDb.Image
-	User     *bagzullaDb.Person
+	// Files attached to the bug.
+	Attachments []Attachment
+	User        *bagzullaDb.Person
 }
 
 // A structure which contains a list of bugs. For example a search
 // result.
 type ListBugPage struct {
-	Title string
-	Bugs  []ListBug
+	Title  string
+	Bugs   []ListBug
+	Paging *bugPaging
 }
 
-// A cache of the project names
-var projectNames = make(map[int64]string)
-
 // Given the ID number of a project, get its name. If the name cannot
 // be found, an error page is produced for the user, and the second
 // return value is "false".
 func getProjectName(b *Bagreply, projectId int64) (string, bool) {
+	// Bugs with no project are in the inbox.
 	if projectId == 0 {
-		return "None", true
+		projectId = b.inbox()
 	}
 	// Look in the cache of names first
-	name, ok := projectNames[projectId]
-	if ok {
+	name, found, changes := b.App.projectNames.get(projectId)
+	if found {
 		return name, true
 	}
 	// The name was not in the cache, look in the database.
-	project, err := bagzullaDb.ProjectFromId(b.App.db, projectId)
+	project, err := b.data().ProjectFromId(projectId)
 	if err != nil {
 		b.errorPage("Error retrieving project with id %d from database: %s",
 			projectId, err.Error())
@@ -211,13 +304,13 @@ func getProjectName(b *Bagreply, projectId int64) (string, bool) {
 	}
 	name = project.Name
 	// Save this name to the cache.
-	projectNames[projectId] = name
+	b.App.projectNames.add(projectId, name, changes)
 	return name, true
 }
 
 // Given a project name, find the corresponding project ID.
 func (b *Bagreply) projectIdFromName(projectName string) (int64, bool) {
-	project, err := bagzullaDb.ProjectFromName(b.App.db, projectName)
+	project, err := b.data().ProjectFromName(projectName)
 	if err != nil {
 		b.errorPage("Error getting project with name '%s' from database: %s",
 			projectName, err.Error())
@@ -226,48 +319,41 @@ func (b *Bagreply) projectIdFromName(projectName string) (int64, bool) {
 	return project.ProjectId, true
 }
 
-// Cache of part names so that we don't re-read the database over and
-// over.
-var partNames = make(map[int64]string)
-
 // Given a part ID, get the name of the part.
 func getPartName(b *Bagreply, partId int64) (string, bool) {
 	if partId == 0 {
 		return "None", true
 	}
-	name, ok := partNames[partId]
-	if ok {
+	name, found, changes := b.App.partNames.get(partId)
+	if found {
 		return name, true
 	}
-	part, err := bagzullaDb.PartFromId(b.App.db, partId)
+	part, err := b.data().PartFromId(partId)
 	if err != nil {
 		b.errorPage("Error retrieving part with id %d from database: %s", partId, err.Error())
 		return "", false
 	}
 	name = part.Name
-	partNames[partId] = name
+	b.App.partNames.add(partId, name, changes)
 	return name, true
 }
 
-// Cache of person names
-var personNames = make(map[int64]string)
-
 // Given the ID of a person, get their name.
 func getPersonName(b *Bagreply, personId int64) (string, bool) {
 	if personId == 0 {
 		return "None", true
 	}
-	name, ok := personNames[personId]
-	if ok {
+	name, found, changes := b.App.personNames.get(personId)
+	if found {
 		return name, true
 	}
-	person, err := bagzullaDb.PersonFromId(b.App.db, personId)
+	person, err := b.data().PersonFromId(personId)
 	if err != nil {
 		b.errorPage("Error retrieving person with id %d from database: %s", personId, err.Error())
 		return "", false
 	}
 	name = person.Name
-	personNames[personId] = name
+	b.App.personNames.add(personId, name, changes)
 	return name, true
 }
 
@@ -298,11 +384,7 @@ func getFinalNum(b *Bagreply) (num int64, ok bool) {
 
 // Insert a piece of text into the text-storing place of the database.
 func insertText(b *Bagreply, text string) (id int64, ok bool) {
-	var txt = bagzullaDb.Txt{
-		Content: text,
-		Entered: time.Now(),
-	}
-	id, err := bagzullaDb.InsertTxt(b.App.db, txt)
+	id, err := storeText(b.data(), text)
 	if err != nil {
 		b.errorPage("Error inserting text %s: %s", text, err.Error())
 		return 0, false
@@ -310,6 +392,15 @@ func insertText(b *Bagreply, text string) (id int64, ok bool) {
 	return id, true
 }
 
+// Insert a piece of text into the database without any error page.
+func storeText(store *bagzullaDb.Store, text string) (id int64, err error) {
+	var txt = bagzullaDb.Txt{
+		Content: text,
+		Entered: time.Now(),
+	}
+	return store.InsertTxt(txt)
+}
+
 func (b *Bagreply) GetText(id int64) (text string, ok bool) {
 	if id == 0 {
 		return "", true
@@ -325,7 +416,7 @@ func (b *Bagreply) GetText(id int64) (text string, ok bool) {
 // database. The input is the ID of the text. The return values are
 // the text and whether or not it was found.
 func getText(b *Bagreply, id int64) (text bagzullaDb.Txt, ok bool) {
-	text, err := bagzullaDb.TxtFromId(b.App.db, id)
+	text, err := b.data().TxtFromId(id)
 	if err != nil {
 		b.errorPage("Error retrieving text with ID %d from database: %s",
 			id, err.Error())
@@ -345,12 +436,15 @@ func getProject(b *Bagreply) (project bagzullaDb.Project, ok bool) {
 		b.errorPage("Project %d does not have a description", projectId)
 		return project, false
 	}
-	project, err := bagzullaDb.ProjectFromId(b.App.db, projectId)
+	project, err := b.data().ProjectFromId(projectId)
 	if err != nil {
 		b.errorPage("Error retrieving project with id %d from database: %s",
 			projectId, err.Error())
 		return project, false
 	}
+	if b.NotAllowed(b.perm, project.ProjectId) {
+		return project, false
+	}
 	return project, true
 }
 
@@ -360,12 +454,15 @@ func getPart(b *Bagreply) (part bagzullaDb.Part, ok bool) {
 	if !ok {
 		return
 	}
-	part, err := bagzullaDb.PartFromId(b.App.db, partId)
+	part, err := b.data().PartFromId(partId)
 	if err != nil {
 		b.errorPage("Error getting part with ID %d from database: %s",
 			partId, err.Error())
 		return part, false
 	}
+	if b.NotAllowed(b.perm, part.ProjectId) || b.inTrash("part", partId, part.Deleted) {
+		return part, false
+	}
 	return part, true
 }
 
@@ -380,19 +477,17 @@ func getBugInfo(b *Bagreply, bug bagzullaDb.Bug) (lb ListBug, ok bool) {
 		return lb, false
 	}
 	lb.Title = title.Content
-	lb.DisplayTitle = html.EscapeString(lb.Title)
 	description, ok := getText(b, bug.Description)
 	if !ok {
 		return lb, false
 	}
 	lb.Description = description.Content
-	if bug.ProjectId != ProjectNone {
-		var ok bool
+	lb.inInbox = bug.ProjectId == b.inbox()
+	if !lb.inInbox {
 		lb.ProjectName, ok = getProjectName(b, bug.ProjectId)
 		if !ok {
 			return lb, false
 		}
-		lb.ProjectId = bug.ProjectId
 	}
 	if bug.PartId != 0 {
 		lb.PartName, ok = getPartName(b, bug.PartId)
@@ -400,36 +495,17 @@ func getBugInfo(b *Bagreply, bug bagzullaDb.Bug) (lb ListBug, ok bool) {
 			return lb, false
 		}
 	}
-	lb.Status = statuses[bug.Status]
-	lb.Priority = priorities[bug.Priority]
 	lb.Owner, ok = getPersonName(b, bug.Owner)
-	lb.Estimate = "unknown"
-	if bug.Estimate > 0 {
-		lb.Estimate = fmt.Sprintf("%d minutes", bug.Estimate)
-	}
 	if !ok {
 		return lb, false
 	}
+	lb.setFields()
 	return lb, true
 }
 
-// Put information about the bugs specified by "bugs" into a
-// ListBugPage structure "p".
-func getBugsInfo(b *Bagreply, p *ListBugPage, bugs []bagzullaDb.Bug) bool {
-	for _, bug := range bugs {
-		var lb ListBug
-		lb, ok := getBugInfo(b, bug)
-		if !ok {
-			return false
-		}
-		p.Bugs = append(p.Bugs, lb)
-	}
-	return true
-}
-
 // Run a template with error handling if the template fails to process.
 func (b *Bagreply) runATemplate(name string, data interface{}) bool {
-	t := b.App.templates.Lookup(name)
+	t := b.templates().Lookup(name)
 	err := t.Execute(b.w, data)
 	if err != nil {
 		b.errorPage("Error executing template %s: %s", name, err.Error())
@@ -467,103 +543,27 @@ func (b *Bagreply) errorPage(format string, a ...interface{}) {
 	b.runTemplate("error.html", ep)
 }
 
-type bugsById []ListBug
-
-func (bid bugsById) Len() int {
-	return len(bid)
-}
-
-func (bid bugsById) Swap(i, j int) {
-	bid[i], bid[j] = bid[j], bid[i]
-}
-
-func (bid bugsById) Less(i, j int) bool {
-	return bid[i].Bug.BugId > bid[j].Bug.BugId
-}
-
-func sortBugsById(bugs []ListBug) {
-	sort.Sort(bugsById(bugs))
-}
-
-type bugsByPriority []ListBug
-
-func (bpr bugsByPriority) Len() int {
-	return len(bpr)
-}
-
-func (bpr bugsByPriority) Swap(i, j int) {
-	bpr[i], bpr[j] = bpr[j], bpr[i]
-}
-
-func (bpr bugsByPriority) Less(i, j int) bool {
-	ip := bpr[i].Bug.Priority
-	jp := bpr[j].Bug.Priority
-	if ip == 0 {
-		return false
-	}
-	if jp == 0 {
-		return true
-	}
-	return ip < jp
-}
-
-func sortBugsByPriority(bugs []ListBug) {
-	sort.Sort(bugsByPriority(bugs))
-}
-
-var sortOrder = regexp.MustCompile("/(priority|id|changed)$")
-
-func sortBugs(b *Bagreply, p ListBugPage) (sortType string) {
-	m := sortOrder.FindStringSubmatch(b.r.URL.Path)
-	if m != nil {
-		order := m[1]
-		switch order {
-		case "id":
-			sortBugsById(p.Bugs)
-		case "priority":
-			sortBugsByPriority(p.Bugs)
-		case "changed":
-		default:
-			// No sorting needs to be done.
-		}
-		return order
-	}
-	return ""
-}
-
 // Output the page of all open bugs
 func openBugsHandler(b *Bagreply) {
-	bugs, ok := StatusBugs(b, 0)
-	if !ok {
-		return
-	}
 	var p ListBugPage
-	ok = getBugsInfo(b, &p, bugs)
+	var ok bool
+	p.Bugs, p.Paging, ok = b.bugListPage(openBugList, defaultPageSize)
 	if !ok {
 		return
 	}
-	sortType := sortBugs(b, p)
 	p.Title = "Open bugs"
-	switch sortType {
-	case "priority":
-		p.Title += " by priority"
-	case "id":
-		p.Title += " sorted by ID"
-	}
 	b.Title = p.Title
 	b.runTemplate("bugs.html", p)
 }
 
 // Output the page of all bugs, regardless of status
 func allBugsHandler(b *Bagreply) {
-	bugs, err := bagzullaDb.AllBugs(b.App.db)
-	if err != nil {
-		b.errorPage("Error getting a list of all bugs: %s",
-			err.Error())
+	var p ListBugPage
+	var ok bool
+	p.Bugs, p.Paging, ok = b.bugListPage(allBugList, defaultPageSize)
+	if !ok {
 		return
 	}
-	var p ListBugPage
-	getBugsInfo(b, &p, bugs)
 	b.Title = "All bugs - Bagzulla"
 	p.Title = "All bugs"
 	b.runTemplate("bugs.html", p)
@@ -576,7 +576,7 @@ func redirectToProject(b *Bagreply, projectId int64) {
 
 // Update the time of the most recent change of the bug.
 func (b *Bagreply) updateChanged(bugId int64) bool {
-	err := bagzullaDb.UpdateChangedForBug(b.App.db, time.Now(), bugId)
+	err := b.data().UpdateChangedForBug(time.Now(), bugId)
 	if err != nil {
 		b.errorPage("Error updating change time for %d: %s", bugId, err.Error())
 		return false
@@ -589,10 +589,10 @@ func editProjectName(b *Bagreply) {
 	if !ok {
 		return
 	}
-	projectName := b.r.FormValue("project-name")
+	projectName := b.r.PostFormValue("project-name")
 	if len(projectName) > 0 {
-		bagzullaDb.UpdateNameForProject(b.App.db, projectName, project.ProjectId)
-		projectNames[project.ProjectId] = projectName
+		b.data().UpdateNameForProject(projectName, project.ProjectId)
+		b.App.projectNames.forget(project.ProjectId)
 		redirectToProject(b, project.ProjectId)
 		return
 	}
@@ -613,10 +613,10 @@ func editPartName(b *Bagreply) {
 	if !ok {
 		return
 	}
-	partName := b.r.FormValue("part-name")
+	partName := b.r.PostFormValue("part-name")
 	if len(partName) > 0 {
-		bagzullaDb.UpdateNameForPart(b.App.db, partName, part.PartId)
-		partNames[part.PartId] = partName
+		b.data().UpdateNameForPart(partName, part.PartId)
+		b.App.partNames.forget(part.PartId)
 		redirectToPart(b, part.PartId)
 		return
 	}
@@ -630,9 +630,9 @@ func editPartName(b *Bagreply) {
 // no valid text, valid is set to false. If valid is true, value may
 // be the empty string.
 func (b *Bagreply) FormText(key string) (value string, valid bool) {
-	value = b.r.FormValue(key)
+	value = b.r.PostFormValue(key)
 	if len(value) == 0 {
-		if _, ok := b.r.Form[key]; ok {
+		if _, ok := b.r.PostForm[key]; ok {
 			return "", true
 		}
 		return "", false
@@ -647,19 +647,29 @@ func editProjectDescription(b *Bagreply) {
 	}
 	description, valid := b.FormText("description")
 	if valid {
-		var descriptionId = int64(0)
-		if len(description) > 0 {
-			var ok bool
-			descriptionId, ok = insertText(b, description)
-			if !ok {
-				return
+		ok := b.inTx(func() bool {
+			var descriptionId = int64(0)
+			if len(description) > 0 {
+				var ok bool
+				descriptionId, ok = insertText(b, description)
+				if !ok {
+					return false
+				}
 			}
+			if !b.DeleteText(project.Description) {
+				return false
+			}
+			err := b.data().UpdateDescriptionForProject(descriptionId, project.ProjectId)
+			if err != nil {
+				b.errorPage("Error changing the description of project %d: %s",
+					project.ProjectId, err)
+				return false
+			}
+			return true
+		})
+		if ok {
+			redirectToProject(b, project.ProjectId)
 		}
-		if !b.DeleteText(project.Description) {
-			return
-		}
-		bagzullaDb.UpdateDescriptionForProject(b.App.db, descriptionId, project.ProjectId)
-		redirectToProject(b, project.ProjectId)
 		return
 	}
 	var pp ProjectPage
@@ -680,12 +690,15 @@ func getBug(b *Bagreply) (bug bagzullaDb.Bug, ok bool) {
 	if !ok {
 		return
 	}
-	bug, err := bagzullaDb.BugFromId(b.App.db, bugid)
+	bug, err := b.data().BugFromId(bugid)
 	if err != nil {
 		b.errorPage(fmt.Sprintf("Error retrieving bug with id %d from database: %s",
 			bugid, err.Error()))
 		return bug, false
 	}
+	if b.NotAllowed(b.perm, bug.ProjectId) || b.inTrash("bug", bugid, bug.Deleted) {
+		return bug, false
+	}
 	return bug, true
 }
 
@@ -697,21 +710,24 @@ func editBugDescription(b *Bagreply) {
 	if !ok {
 		return
 	}
-	description := b.r.FormValue("description")
+	description := b.r.PostFormValue("description")
 	if len(description) > 0 {
-		descriptionId, ok := insertText(b, description)
-		if !ok {
-			return
-		}
-		if !b.DeleteText(bug.Description) {
-			return
-		}
-		bagzullaDb.UpdateDescriptionForBug(b.App.db, descriptionId, bug.BugId)
-		ok = b.updateChanged(bug.BugId)
-		if !ok {
-			return
+		ok := b.inTx(func() bool {
+			descriptionId, ok := insertText(b, description)
+			if !ok || !b.DeleteText(bug.Description) {
+				return false
+			}
+			err := b.data().UpdateDescriptionForBug(descriptionId, bug.BugId)
+			if err != nil {
+				b.errorPage("Error changing the description of bug %d: %s",
+					bug.BugId, err)
+				return false
+			}
+			return b.updateChanged(bug.BugId)
+		})
+		if ok {
+			b.redirectToBug(bug.BugId)
 		}
-		b.redirectToBug(bug.BugId)
 		return
 	}
 	lb, ok := getBugInfo(b, bug)
@@ -738,18 +754,25 @@ func editPartDescription(b *Bagreply) {
 	if !ok {
 		return
 	}
-	description := b.r.FormValue("description")
+	description := b.r.PostFormValue("description")
 	if len(description) > 0 {
 		partId := part.PartId
-		descriptionId, ok := insertText(b, description)
-		if !ok {
-			return
-		}
-		if !b.DeleteText(part.Description) {
-			return
+		ok := b.inTx(func() bool {
+			descriptionId, ok := insertText(b, description)
+			if !ok || !b.DeleteText(part.Description) {
+				return false
+			}
+			err := b.data().UpdateDescriptionForPart(descriptionId, partId)
+			if err != nil {
+				b.errorPage("Error changing the description of part %d: %s",
+					partId, err)
+				return false
+			}
+			return true
+		})
+		if ok {
+			redirectToPart(b, partId)
 		}
-		bagzullaDb.UpdateDescriptionForPart(b.App.db, descriptionId, partId)
-		redirectToPart(b, partId)
 		return
 	}
 	var pd PartDesc
@@ -770,10 +793,9 @@ func editPartDescription(b *Bagreply) {
 //                   |_|           |__/
 
 type listProjectPage struct {
-	Projects    []bagzullaDb.Project
-	OpenBugs    []int64
-	DisplayDir  string
-	ProjectNone int64
+	Projects   []bagzullaDb.Project
+	OpenBugs   map[int64]int64
+	DisplayDir string
 }
 
 type pros []bagzullaDb.Project
@@ -830,24 +852,23 @@ func sortParts(parts []bagzullaDb.Part) {
 
 func listProjects(b *Bagreply) {
 	var lpp = listProjectPage{
-		ProjectNone: ProjectNone,
-		DisplayDir:  b.App.DisplayDir,
+		DisplayDir: b.App.DisplayDir,
 	}
-	projects, err := bagzullaDb.AllProjects(b.App.db)
+	projects, err := b.data().AllProjects()
 	if err != nil {
 		b.errorPage("Error making list of pages: %s", err.Error())
 		return
 	}
-	var openProjects []bagzullaDb.Project
-	for _, p := range projects {
-		if p.Status == 0 {
-			openProjects = append(openProjects, p)
+	var listed []bagzullaDb.Project
+	for _, p := range b.visibleProjects(projects) {
+		if stateOf(p).Listed() {
+			listed = append(listed, p)
 		}
 	}
-	projects = openProjects
+	projects = listed
 	sortProjects(projects)
 	lpp.Projects = projects
-	lpp.OpenBugs, err = getOpenBugs(b, projects)
+	lpp.OpenBugs, err = getOpenBugs(b)
 	if err != nil {
 		b.errorPage("Error getting list of open bugs: %s", err.Error())
 		return
@@ -867,8 +888,19 @@ type partPage struct {
 	Description string
 	Project     bagzullaDb.Project
 	Bugs        []ListBug
+	Paging      *bugPaging
 	OpenOnly    bool
 	User        *bagzullaDb.Person
+	// The projects which the part can be moved to.
+	Targets []bagzullaDb.Project
+	// The parts above the part, from the top, and the parts just
+	// under it.
+	Ancestors []bagzullaDb.Part
+	SubParts  []PartNode
+	// Does the list include the bugs of the parts under the part?
+	Sub bool
+	// The parts which the part can go under.
+	Parents []PartNode
 }
 
 func getPartInfo(b *Bagreply) (pp partPage, ok bool) {
@@ -878,7 +910,7 @@ func getPartInfo(b *Bagreply) (pp partPage, ok bool) {
 	}
 	pp.Part = part
 	var err error
-	pp.Project, err = bagzullaDb.ProjectFromId(b.App.db, pp.Part.ProjectId)
+	pp.Project, err = b.data().ProjectFromId(pp.Part.ProjectId)
 	if err != nil {
 		b.errorPage("Error retrieving project with id %d for part id %d: %s",
 			pp.Part.ProjectId, part.PartId, err.Error())
@@ -889,29 +921,42 @@ func getPartInfo(b *Bagreply) (pp partPage, ok bool) {
 		return pp, false
 	}
 	pp.Description = description.Content
+	if !b.partFamily(&pp) {
+		return pp, false
+	}
+	if b.roleIn(part.ProjectId) >= roleDeveloper {
+		open, ok := openProjects(b)
+		if !ok {
+			return pp, false
+		}
+		for _, p := range open {
+			if p.ProjectId != part.ProjectId && p.ProjectId != b.inbox() &&
+				b.roleIn(p.ProjectId) >= roleDeveloper {
+				pp.Targets = append(pp.Targets, p)
+			}
+		}
+	}
 	return pp, true
 }
 
 func getPartBugs(b *Bagreply, pp *partPage) (ok bool) {
-	partId := pp.Part.PartId
-	var bugs []bagzullaDb.Bug
-	var err error
+	list := partBugList
 	if pp.OpenOnly {
-		bugs, err = openBugsFromPartId(b.App.db, partId)
-	} else {
-		bugs, err = bagzullaDb.BugsFromPartId(b.App.db, partId)
+		list = openPartBugList
 	}
-	if err != nil {
-		b.errorPage("Error retrieving bugs with part id %d: %s",
-			partId, err.Error())
+	pp.Sub = b.r.URL.Query().Get("sub") == "1"
+	if pp.Sub {
+		list = partTreeBugList
+		if pp.OpenOnly {
+			list = openPartTreeBugList
+		}
+	}
+	pp.Bugs, pp.Paging, ok = b.bugListPage(list, defaultPageSize, pp.Part.PartId)
+	if !ok {
 		return false
 	}
-	for _, bug := range bugs {
-		lb, ok := getBugInfo(b, bug)
-		if !ok {
-			return false
-		}
-		pp.Bugs = append(pp.Bugs, lb)
+	if pp.Sub {
+		pp.Paging.keep = url.Values{"sub": {"1"}}
 	}
 	pp.User = b.User
 	return true
@@ -927,6 +972,7 @@ func showPart(b *Bagreply) {
 	if !ok {
 		return
 	}
+	b.Feed = fmt.Sprintf("../feed/part/%d", pp.Part.PartId)
 	b.runTemplate("part.html", pp)
 }
 
@@ -946,6 +992,20 @@ func showPartAll(b *Bagreply) {
 type personPage struct {
 	Person bagzullaDb.Person
 	Bugs   []ListBug
+	// The API tokens, only shown to the person themself.
+	Own      bool
+	Tokens   []Token
+	NewToken string
+	Scopes   []string
+	// The person's role and grants, with the forms to change them
+	// if the user is an admin.
+	Role     role
+	Grants   []Grant
+	Admin    bool
+	Roles    []string
+	Projects []bagzullaDb.Project
+	// One of active, unverified, pending or inactive.
+	Status string
 }
 
 func getPerson(b *Bagreply) (person bagzullaDb.Person, ok bool) {
@@ -957,7 +1017,7 @@ func getPerson(b *Bagreply) (person bagzullaDb.Person, ok bool) {
 		b.errorPage("Person %d does not have a description", personId)
 		return person, false
 	}
-	person, err := bagzullaDb.PersonFromId(b.App.db, personId)
+	person, err := b.data().PersonFromId(personId)
 	if err != nil {
 		b.errorPage("Error getting person with ID %d from database: %s", personId, err.Error())
 		return person, false
@@ -970,22 +1030,55 @@ func showPerson(b *Bagreply) {
 	if !ok {
 		return
 	}
+	if !personControls(b, &person) {
+		return
+	}
 	var pp personPage
 	pp.Person = person
+	pp.NewToken, ok = tokenControls(b, person)
+	if !ok {
+		return
+	}
+	if !roleControls(b, person) {
+		return
+	}
 	var err error
-	bugs, err := bagzullaDb.BugsFromOwner(b.App.db, pp.Person.PersonId)
+	pp.Role, err = personRole(b.data(), person.PersonId)
+	if err != nil {
+		b.errorPage("Error getting role of %s: %s", person.Name, err)
+		return
+	}
+	pp.Status, err = personStatus(b.data(), person.PersonId)
 	if err != nil {
-		b.errorPage("Error retrieving bugs with person id %d: %s",
-			person.PersonId, err.Error())
+		b.errorPage("Error getting status of %s: %s", person.Name, err)
 		return
 	}
-	for _, bug := range bugs {
-		lb, ok := getBugInfo(b, bug)
+	pp.Admin = b.Admin()
+	if pp.Admin {
+		pp.Grants, ok = grantList(b, person.PersonId)
 		if !ok {
 			return
 		}
-		pp.Bugs = append(pp.Bugs, lb)
+		pp.Roles = grantableRoles
+		pp.Projects, ok = allProjects(b)
+		if !ok {
+			return
+		}
+	}
+	if b.User != nil && b.Token == nil && b.User.PersonId == person.PersonId {
+		pp.Own = true
+		pp.Scopes = tokenScopes
+		pp.Tokens, err = personTokens(b.data(), person.PersonId)
+		if err != nil {
+			b.errorPage("Error getting tokens of %s: %s", person.Name, err)
+			return
+		}
+	}
+	pp.Bugs, ok = b.bugList(ownerBugList, person.PersonId)
+	if !ok {
+		return
 	}
+	b.Feed = fmt.Sprintf("../feed/person/%d", person.PersonId)
 	b.runTemplate("person.html", pp)
 }
 
@@ -994,15 +1087,17 @@ func projectParts(b *Bagreply) {
 	if !ok {
 		return
 	}
-	parts, err := bagzullaDb.PartsFromProjectId(b.App.db, projectid)
-	if err != nil {
-		b.errorPage("Error getting parts for project %d", projectid)
+	if b.NotAllowed(b.perm, projectid) {
+		return
+	}
+	parts, ok := b.projectPartTree(projectid)
+	if !ok {
 		return
 	}
 	b.w.Header().Set("Content-Type", "application/json")
 	var jout []byte
+	var err error
 	if len(parts) > 0 {
-		sortParts(parts)
 		jout, err = json.Marshal(parts)
 		if err != nil {
 			b.errorPage("Error marshalling part list: %s", err)
@@ -1018,9 +1113,22 @@ func projectParts(b *Bagreply) {
 type ProjectPage struct {
 	Project     bagzullaDb.Project
 	Description string
-	Parts       []bagzullaDb.Part
-	Bugs        []ListBug
-	DisplayDir  string
+	// The live parts, in the order of the tree.
+	Parts      []PartNode
+	Bugs       []ListBug
+	Paging     *bugPaging
+	DisplayDir string
+	Private    bool
+	// Can the user make the project private or public, or delete
+	// it?
+	Admin bool
+	State projectState
+	// The states which an admin can change the project to.
+	Transitions []projectState
+	// What the open bugs can become when the project is archived:
+	// a resolution, or a bug of another project.
+	Resolutions []string
+	Targets     []bagzullaDb.Project
 }
 
 func showProject(b *Bagreply) {
@@ -1028,41 +1136,51 @@ func showProject(b *Bagreply) {
 	if !ok {
 		return
 	}
-	project, err := bagzullaDb.ProjectFromId(b.App.db, projectid)
+	project, err := b.data().ProjectFromId(projectid)
 	if err != nil {
 		b.errorPage("Error finding project with ID %d: %s", projectid, err.Error())
 		return
 	}
+	if b.NotAllowed(b.perm, projectid) {
+		return
+	}
+	if !privateControls(b, projectid) {
+		return
+	}
 	var pp ProjectPage
 	pp.DisplayDir = b.App.DisplayDir
 	pp.Project = project
+	pp.Private = b.isPrivate(projectid)
+	pp.Admin = b.Admin()
+	pp.State = stateOf(project)
+	if pp.Admin && projectid != b.inbox() {
+		pp.Transitions = projectTransitions[pp.State]
+		pp.Resolutions = statuses[1:]
+		open, ok := openProjects(b)
+		if !ok {
+			return
+		}
+		for _, p := range open {
+			if p.ProjectId != projectid {
+				pp.Targets = append(pp.Targets, p)
+			}
+		}
+	}
 	description, ok := b.GetText(project.Description)
 	if !ok {
 		return
 	}
 	pp.Description = b.urlsToLinks(description)
-	parts, err := bagzullaDb.PartsFromProjectId(b.App.db, projectid)
-	if err != nil {
-		errorText := fmt.Sprintf("Error retrieving project id %d: %s",
-			projectid, err.Error())
-		b.errorPage(errorText)
+	pp.Parts, ok = b.projectPartTree(projectid)
+	if !ok || !b.countPartBugs(pp.Parts, projectid) {
 		return
 	}
-	pp.Parts = parts
-	sortParts(pp.Parts)
-	bugs, err := openBugsFromProjectId(b.App.db, projectid)
-	if err != nil {
-		b.errorPage("Error getting list of bugs for project with id %d: %s", projectid, err.Error())
+	pp.Bugs, pp.Paging, ok = b.bugListPage(openProjectBugList, defaultPageSize, projectid)
+	if !ok {
 		return
 	}
-	for _, bug := range bugs {
-		bp, ok := getBugInfo(b, bug)
-		if !ok {
-			return
-		}
-		pp.Bugs = append(pp.Bugs, bp)
-	}
 	b.Title = fmt.Sprintf("%s project bugs", project.Name)
+	b.Feed = fmt.Sprintf("../feed/project/%d", projectid)
 	b.runTemplate("project.html", pp)
 }
 
@@ -1071,39 +1189,30 @@ func showProjectAllBugs(b *Bagreply) {
 	if !ok {
 		return
 	}
-	project, err := bagzullaDb.ProjectFromId(b.App.db, projectid)
+	project, err := b.data().ProjectFromId(projectid)
 	if err != nil {
 		b.errorPage("Error finding project with ID %d: %s", projectid, err.Error())
 		return
 	}
+	if b.NotAllowed(b.perm, projectid) {
+		return
+	}
 	var pp ProjectPage
 	pp.Project = project
+	pp.DisplayDir = b.App.DisplayDir
 	description, ok := getText(b, project.Description)
 	if !ok {
 		return
 	}
 	pp.Description = description.Content
-	parts, err := bagzullaDb.PartsFromProjectId(b.App.db, projectid)
-	if err != nil {
-		errorText := fmt.Sprintf("Error retrieving project id %d: %s",
-			projectid, err.Error())
-		b.errorPage(errorText)
+	pp.Parts, ok = b.projectPartTree(projectid)
+	if !ok {
 		return
 	}
-	pp.Parts = parts
-	sortParts(pp.Parts)
-	bugs, err := bagzullaDb.BugsFromProjectId(b.App.db, projectid)
-	if err != nil {
-		b.errorPage("Error getting list of bugs for project with id %d: %s", projectid, err.Error())
+	pp.Bugs, pp.Paging, ok = b.bugListPage(projectBugList, defaultPageSize, projectid)
+	if !ok {
 		return
 	}
-	for _, bug := range bugs {
-		bp, ok := getBugInfo(b, bug)
-		if !ok {
-			return
-		}
-		pp.Bugs = append(pp.Bugs, bp)
-	}
 	b.Title = fmt.Sprintf("All bugs for %s", project.Name)
 	b.runTemplate("project-all.html", pp)
 }
@@ -1116,19 +1225,26 @@ func addProjectPage(b *Bagreply) {
 // Actually add a new project.
 func addNewProject(b *Bagreply) {
 	var p bagzullaDb.Project
-	p.Name = b.r.FormValue("name")
+	p.Name = b.r.PostFormValue("name")
 	p.Name = strings.TrimSpace(p.Name)
-	p.Directory = b.r.FormValue("directory")
-	descriptionId, ok := insertText(b, b.r.FormValue("description"))
-	if !ok {
-		return
-	}
-	p.Description = descriptionId
-	projectid, err := bagzullaDb.InsertProject(b.App.db, p)
-	if err != nil {
-		b.errorPage("Error adding new project with name %s: %s",
-			p.Name, err.Error())
-	} else {
+	p.Directory = b.r.PostFormValue("directory")
+	var projectid int64
+	ok := b.inTx(func() bool {
+		descriptionId, ok := insertText(b, b.r.PostFormValue("description"))
+		if !ok {
+			return false
+		}
+		p.Description = descriptionId
+		var err error
+		projectid, err = b.data().InsertProject(p)
+		if err != nil {
+			b.errorPage("Error adding new project with name %s: %s",
+				p.Name, err.Error())
+			return false
+		}
+		return true
+	})
+	if ok {
 		redirectToProject(b, projectid)
 	}
 }
@@ -1137,7 +1253,7 @@ func addProjectHandler(b *Bagreply) {
 	if b.NotLoggedIn() {
 		return
 	}
-	name := b.r.FormValue("name")
+	name := b.r.PostFormValue("name")
 	if len(name) > 0 {
 		addNewProject(b)
 		return
@@ -1151,7 +1267,7 @@ func randomOpen(b *Bagreply) {
 	if !ok {
 		return
 	}
-	bugs = append(bugs, open...)
+	bugs = append(bugs, b.visibleBugs(open)...)
 	if len(bugs) == 0 {
 		b.errorPage("There are no open bugs. Congratulations.")
 		return
@@ -1167,7 +1283,7 @@ func openProjects(b *Bagreply) (projects []bagzullaDb.Project, ok bool) {
 		return projects, false
 	}
 	for _, p := range allp {
-		if p.Status == 0 {
+		if stateOf(p).Open() {
 			projects = append(projects, p)
 		}
 	}
@@ -1175,12 +1291,13 @@ func openProjects(b *Bagreply) (projects []bagzullaDb.Project, ok bool) {
 }
 
 func allProjects(b *Bagreply) (projects []bagzullaDb.Project, ok bool) {
-	projects, err := bagzullaDb.AllProjects(b.App.db)
+	projects, err := b.data().AllProjects()
 	if err != nil {
 		b.errorPage("Error getting all projects: %s",
 			err.Error())
 		return projects, false
 	}
+	projects = b.visibleProjects(projects)
 	sortProjects(projects)
 	return projects, true
 }
@@ -1207,7 +1324,7 @@ func addBugPage(b *Bagreply) {
 // Add a bug with some of the fields filled in.  This is for the case
 // that we want to link to the bug reporting page from other projects.
 func addAutoBugHandler(b *Bagreply) {
-	auto := b.r.FormValue("auto")
+	auto := b.r.PostFormValue("auto")
 	if len(auto) > 0 {
 		addNewBug(b)
 		return
@@ -1220,12 +1337,15 @@ func addAutoBugHandler(b *Bagreply) {
 	partString := b.r.FormValue("part")
 	if len(partString) > 0 {
 		partId, err := strconv.ParseInt(partString, 10, 64)
-		part, err := bagzullaDb.PartFromId(b.App.db, partId)
+		part, err := b.data().PartFromId(partId)
 		if err != nil {
 			b.errorPage("Error getting part with ID %d from database: %s",
 				partId, err.Error())
 			return
 		}
+		if b.NotAllowed(roleReporter, part.ProjectId) || b.inTrash("part", partId, part.Deleted) {
+			return
+		}
 		abp.Part = part
 		abp.Project, ok = projectFromId(b, part.ProjectId)
 		if !ok {
@@ -1238,12 +1358,15 @@ func addAutoBugHandler(b *Bagreply) {
 			b.errorPage("Error getting ID from project string %s: %s", projectString, err.Error())
 			return
 		}
-		project, err := bagzullaDb.ProjectFromId(b.App.db, projectId)
+		project, err := b.data().ProjectFromId(projectId)
 		if err != nil {
 			b.errorPage("Error retrieving project with id %d from database: %s",
 				projectId, err.Error())
 			return
 		}
+		if b.NotAllowed(roleReporter, projectId) {
+			return
+		}
 		abp.Project = project
 		b.runTemplate("add-bug-to-project.html", abp)
 	} else {
@@ -1260,7 +1383,7 @@ func addBugHandler(b *Bagreply) {
 	if b.NotLoggedIn() {
 		return
 	}
-	project := b.r.FormValue("project")
+	project := b.r.PostFormValue("project")
 	if len(project) > 0 {
 		addNewBug(b)
 		return
@@ -1270,7 +1393,7 @@ func addBugHandler(b *Bagreply) {
 }
 
 func FormPart(b *Bagreply) (partId int64, ok bool) {
-	part := b.r.FormValue("part")
+	part := b.r.PostFormValue("part")
 	if len(part) > 0 {
 		var err error
 		partId, err = strconv.ParseInt(part, 10, 64)
@@ -1287,11 +1410,11 @@ func addBugToProjectHandler(b *Bagreply) {
 		return
 	}
 	project, ok := getProject(b)
-	if !ok {
+	if !ok || b.projectClosed(project) {
 		return
 	}
-	title := b.r.FormValue("title")
-	description := b.r.FormValue("description")
+	title := b.r.PostFormValue("title")
+	description := b.r.PostFormValue("description")
 	partId, ok := FormPart(b)
 	if !ok {
 		return
@@ -1318,7 +1441,7 @@ func (b *Bagreply) redirectToBug(bugid int64) {
 }
 
 func projectFromId(b *Bagreply, projectid int64) (project bagzullaDb.Project, ok bool) {
-	project, err := bagzullaDb.ProjectFromId(b.App.db, projectid)
+	project, err := b.data().ProjectFromId(projectid)
 	if err != nil {
 		b.errorPage("Error retreiving project with id %d: %s",
 			projectid, err.Error())
@@ -1332,9 +1455,12 @@ func addBugToPartHandler(b *Bagreply) {
 		return
 	}
 	part, ok := getPart(b)
-	title := b.r.FormValue("title")
+	if !ok {
+		return
+	}
+	title := b.r.PostFormValue("title")
 	if len(title) > 0 {
-		description := b.r.FormValue("description")
+		description := b.r.PostFormValue("description")
 		owner := b.User.PersonId
 		bugid, ok := newbug(b, title, description, part.ProjectId, part.PartId, owner)
 		if !ok {
@@ -1353,39 +1479,82 @@ func addBugToPartHandler(b *Bagreply) {
 }
 
 func newbug(b *Bagreply, title string, description string, projectid int64, partid int64, owner int64) (bugid int64, ok bool) {
-	_, ok = projectFromId(b, projectid)
+	project, ok := projectFromId(b, projectid)
 	if !ok {
 		return 0, false
 	}
-	var bug bagzullaDb.Bug
-	titleId, ok := insertText(b, title)
-	if !ok {
-		return
+	if b.NotAllowed(roleReporter, projectid) || b.projectClosed(project) {
+		return 0, false
 	}
-	bug.Title = titleId
-	descriptionId, ok := insertText(b, description)
-	if !ok {
-		return
+	if partid != 0 {
+		part, err := b.data().PartFromId(partid)
+		if err != nil || part.ProjectId != projectid || !part.Deleted.IsZero() {
+			b.errorPage("There is no part with ID %d in project %d", partid, projectid)
+			return 0, false
+		}
 	}
-	bug.Description = descriptionId
-	bug.ProjectId = projectid
-	bug.PartId = partid
-	bug.Owner = owner
-	bug.Entered = time.Now()
-	bug.Changed = bug.Entered
-	bugid, err := bagzullaDb.InsertBug(b.App.db, bug)
+	bugid, err := addBug(b.data(), title, description, projectid, partid, owner)
 	if err != nil {
 		b.errorPage("Error inserting bug with title %s: %s",
 			title, err.Error())
 		return 0, false
 	}
+	b.bugEvent("created", bugid, "", "", description)
 	return bugid, true
 }
 
+// Insert a new bug into the database. This does the work of newbug
+// for callers which are not responding to a web page, such as the
+// mail ingester.
+func addBug(store *bagzullaDb.Store, title string, description string, projectid int64, partid int64, owner int64) (bugid int64, err error) {
+	err = store.Transact(func(tx *bagzullaDb.Store) (err error) {
+		var bug bagzullaDb.Bug
+		bug.Title, err = storeText(tx, title)
+		if err != nil {
+			return err
+		}
+		bug.Description, err = storeText(tx, description)
+		if err != nil {
+			return err
+		}
+		bug.ProjectId = projectid
+		bug.PartId = partid
+		bug.Owner = owner
+		bug.Entered = time.Now()
+		bug.Changed = bug.Entered
+		bugid, err = tx.InsertBug(bug)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return bugid, nil
+}
+
+// Add a comment with text "text" by the person with ID "personId" to
+// the bug with ID "bugId".
+func addComment(store *bagzullaDb.Store, bugId int64, personId int64, text string) (commentId int64, err error) {
+	err = store.Transact(func(tx *bagzullaDb.Store) (err error) {
+		var comment bagzullaDb.Comment
+		comment.TxtId, err = storeText(tx, text)
+		if err != nil {
+			return err
+		}
+		comment.BugId = bugId
+		comment.PersonId = personId
+		commentId, err = tx.InsertComment(comment)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return commentId, nil
+}
+
 func addNewBug(b *Bagreply) {
-	projectString := b.r.FormValue("project")
-	title := b.r.FormValue("title")
-	description := b.r.FormValue("description")
+	projectString := b.r.PostFormValue("project")
+	title := b.r.PostFormValue("title")
+	description := b.r.PostFormValue("description")
 	projectId, err := strconv.ParseInt(projectString, 10, 64)
 	if err != nil {
 		b.errorPage("addNewBug: Error getting ID from project string %s: %s", projectString, err.Error())
@@ -1403,21 +1572,26 @@ func addNewBug(b *Bagreply) {
 	b.redirectToBug(bugid)
 }
 
-func getRelatedBugStatuses(b *Bagreply, rb []RelatedBug) bool {
-	for i, _ := range rb {
-		id := rb[i].Id
-		bug, err := bagzullaDb.BugFromId(b.App.db, id)
+// Get the statuses of the related bugs "rb", and remove the ones the
+// user cannot see.
+func getRelatedBugStatuses(b *Bagreply, rb []RelatedBug) (visible []RelatedBug, ok bool) {
+	for _, r := range rb {
+		bug, err := b.data().BugFromId(r.Id)
 		if err != nil {
-			b.errorPage("Error getting bug information for bug with id %d from database: %s", id, err.Error())
-			return false
+			b.errorPage("Error getting bug information for bug with id %d from database: %s", r.Id, err.Error())
+			return visible, false
 		}
-		rb[i].Status = bug.Status
+		if !bug.Deleted.IsZero() || !b.canSee(bug.ProjectId) {
+			continue
+		}
+		r.Status = bug.Status
+		visible = append(visible, r)
 	}
-	return true
+	return visible, true
 }
 
 func getDependsOn(b *Bagreply, bugId int64) (dependsOn []RelatedBug, ok bool) {
-	deps, err := bagzullaDb.DependencysFromEffect(b.App.db, bugId)
+	deps, err := b.data().DependenciesFromEffect(bugId)
 	if err != nil {
 		b.errorPage("Error getting dependent bugs for bug with id %d from database: %s", bugId, err.Error())
 		return dependsOn, false
@@ -1425,7 +1599,7 @@ func getDependsOn(b *Bagreply, bugId int64) (dependsOn []RelatedBug, ok bool) {
 	for _, dep := range deps {
 		dependsOn = append(dependsOn, RelatedBug{Id: dep.Cause})
 	}
-	ok = getRelatedBugStatuses(b, dependsOn)
+	dependsOn, ok = getRelatedBugStatuses(b, dependsOn)
 	if !ok {
 		return dependsOn, false
 	}
@@ -1433,7 +1607,7 @@ func getDependsOn(b *Bagreply, bugId int64) (dependsOn []RelatedBug, ok bool) {
 }
 
 func getDuplicates(b *Bagreply, bugId int64) (duplicates []RelatedBug, ok bool) {
-	dups, err := bagzullaDb.DuplicatesFromOriginal(b.App.db, bugId)
+	dups, err := b.data().DuplicatesFromOriginal(bugId)
 	if err != nil {
 		b.errorPage("Error getting dependent bugs for bug with id %d from database: %s", bugId, err.Error())
 		return duplicates, false
@@ -1441,7 +1615,7 @@ func getDuplicates(b *Bagreply, bugId int64) (duplicates []RelatedBug, ok bool)
 	for _, dup := range dups {
 		duplicates = append(duplicates, RelatedBug{Id: dup.Duplicate})
 	}
-	ok = getRelatedBugStatuses(b, duplicates)
+	duplicates, ok = getRelatedBugStatuses(b, duplicates)
 	if !ok {
 		return duplicates, false
 	}
@@ -1449,12 +1623,12 @@ func getDuplicates(b *Bagreply, bugId int64) (duplicates []RelatedBug, ok bool)
 }
 
 func getOriginals(b *Bagreply, bugId int64) (originals []RelatedBug, ok bool) {
-	originals, err := OriginalsFromDuplicate(b.App.db, bugId)
+	originals, err := OriginalsFromDuplicate(b.data(), bugId)
 	if err != nil {
 		b.errorPage("Error getting dependent bugs for bug with id %d from database: %s", bugId, err.Error())
 		return originals, false
 	}
-	ok = getRelatedBugStatuses(b, originals)
+	originals, ok = getRelatedBugStatuses(b, originals)
 	if !ok {
 		return originals, false
 	}
@@ -1462,7 +1636,7 @@ func getOriginals(b *Bagreply, bugId int64) (originals []RelatedBug, ok bool) {
 }
 
 func getBlocks(b *Bagreply, bugId int64) (blocks []RelatedBug, ok bool) {
-	deps, err := bagzullaDb.DependencysFromCause(b.App.db, bugId)
+	deps, err := b.data().DependenciesFromCause(bugId)
 	if err != nil {
 		b.errorPage("Error getting blocking bugs for bug with id %d from database: %s", bugId, err.Error())
 		return blocks, false
@@ -1470,7 +1644,7 @@ func getBlocks(b *Bagreply, bugId int64) (blocks []RelatedBug, ok bool) {
 	for _, dep := range deps {
 		blocks = append(blocks, RelatedBug{Id: dep.Effect})
 	}
-	ok = getRelatedBugStatuses(b, blocks)
+	blocks, ok = getRelatedBugStatuses(b, blocks)
 	if !ok {
 		return blocks, false
 	}
@@ -1481,12 +1655,21 @@ func setBugStatus(b *Bagreply, newStatus int64, bugId int64) bool {
 	if b.NotLoggedIn() {
 		return false
 	}
-	err := bagzullaDb.UpdateStatusForBug(b.App.db, newStatus, bugId)
+	bug, err := b.data().BugFromId(bugId)
+	if err != nil {
+		b.errorPage("Error retrieving bug with id %d from database: %s",
+			bugId, err.Error())
+		return false
+	}
+	err = b.data().UpdateStatusForBug(newStatus, bugId)
 	if err != nil {
 		b.errorPage(fmt.Sprintf("Error updating status for bug with id %d to status %d: %s",
 			bugId, newStatus, err.Error()))
 		return false
 	}
+	if bug.Status != newStatus {
+		b.bugEvent("status", bugId, statuses[bug.Status], statuses[newStatus], "")
+	}
 	return true
 }
 
@@ -1514,7 +1697,7 @@ func (b *Bagreply) NotLoggedIn() bool {
 		b.ErrorLogin()
 		return true
 	}
-	return false
+	return !b.needScope("write")
 }
 
 // Handle /bug/%d requests, including those which post new comments to
@@ -1527,79 +1710,74 @@ func bugHandler(b *Bagreply) {
 	if !ok {
 		return
 	}
-	projectname := b.r.FormValue("project")
-	if len(projectname) > 0 {
-		if b.NotLoggedIn() {
-			return
-		}
-		// Deal with user input.
-		var projectid int64
-		if projectname == "None" {
-			projectid = ProjectNone
-		} else {
-			projectid, ok = b.projectIdFromName(projectname)
-			if !ok {
-				return
+	ok = b.inTx(func() bool {
+		projectname := b.r.PostFormValue("project")
+		if len(projectname) > 0 {
+			if b.NotAllowed(roleDeveloper, bug.ProjectId) {
+				return false
 			}
+			// Deal with user input.
+			var projectid int64
+			if projectname == "None" && b.inbox() != 0 {
+				projectid = b.inbox()
+			} else {
+				projectid, ok = b.projectIdFromName(projectname)
+				if !ok {
+					return false
+				}
+			}
+			if !b.moveBugWithPart(bug, projectid) {
+				return false
+			}
+			changed = true
 		}
-		if projectid != bug.ProjectId {
-			b.assignProjectToBug(bug, projectid)
-		}
-		changed = true
-	}
 
-	// If the user has input a new comment, add that to the database.
-	comment_text := b.r.FormValue("comment-text")
-	if len(comment_text) == 0 {
-		if _, ok := b.r.Form["comment-text"]; ok {
-			b.errorPage("Empty comment text")
-			return
-		}
-	}
-	if len(comment_text) > 0 {
-		if b.NotLoggedIn() {
-			return
-		}
-		var comment bagzullaDb.Comment
-		var ok bool
-		comment.TxtId, ok = insertText(b, comment_text)
-		if !ok {
-			return
+		// If the user has input a new comment, add that to the database.
+		comment_text := b.r.PostFormValue("comment-text")
+		if len(comment_text) == 0 {
+			if _, ok := b.r.PostForm["comment-text"]; ok {
+				b.errorPage("Empty comment text")
+				return false
+			}
 		}
-		comment.BugId = bug.BugId
-		comment.PersonId = b.User.PersonId
-		bagzullaDb.InsertComment(b.App.db, comment)
-		changed = true
-		newStatusString := b.r.FormValue("bug-status")
-		if len(newStatusString) > 0 {
-			newStatus, err := stringToStatus(newStatusString)
-			if err != nil {
-				b.errorPage("Error with %s: %s", newStatusString, err.Error())
-				return
+		if len(comment_text) > 0 {
+			if b.NotAllowed(roleReporter, bug.ProjectId) {
+				return false
 			}
-			if newStatus == 3 {
-				b.errorPage("Use Edit duplicates to mark duplicates")
-				return
+			_, err := addComment(b.data(), bug.BugId, b.User.PersonId, comment_text)
+			if err != nil {
+				b.errorPage("Error adding comment to bug %d: %s", bug.BugId, err)
+				return false
 			}
-			oldStatus := bug.Status
-			if oldStatus != newStatus {
-				ok := setBugStatus(b, newStatus, bug.BugId)
-				if !ok {
-					return
+			b.bugEvent("commented", bug.BugId, "", "", comment_text)
+			changed = true
+			newStatusString := b.r.PostFormValue("bug-status")
+			if len(newStatusString) > 0 {
+				newStatus, err := stringToStatus(newStatusString)
+				if err != nil {
+					b.errorPage("Error with %s: %s", newStatusString, err.Error())
+					return false
 				}
-				if !b.updateChanged(bug.BugId) {
-					return
+				if newStatus == 3 {
+					b.errorPage("Use Edit duplicates to mark duplicates")
+					return false
+				}
+				if bug.Status != newStatus {
+					if !setBugStatus(b, newStatus, bug.BugId) {
+						return false
+					}
 				}
-
-				changed = true
 			}
 		}
+		if changed {
+			return b.updateChanged(bug.BugId)
+		}
+		return true
+	})
+	if !ok {
+		return
 	}
 	if changed {
-		ok := b.updateChanged(bug.BugId)
-		if !ok {
-			return
-		}
 		b.redirectToBug(bug.BugId)
 		return
 	}
@@ -1607,28 +1785,33 @@ func bugHandler(b *Bagreply) {
 	if !ok {
 		return
 	}
-	bp.DisplayDescription = b.urlsToLinks(bp.Description)
-	projects, err := bagzullaDb.AllProjects(b.App.db)
+	bp.Attachments, ok = getAttachments(b, bug.BugId)
+	if !ok {
+		return
+	}
+	bp.DisplayDescription = b.bugTextToLinks(bp.Description, bp.Attachments)
+	projects, err := b.data().AllProjects()
 	if err != nil {
 		b.errorPage("Error making list of pages: %s", err.Error())
 		return
 	}
+	projects = b.visibleProjects(projects)
 	sortProjects(projects)
 	bp.Projects = projects
-	images, err := bagzullaDb.ImagesFromBugId(b.App.db, bug.BugId)
+	images, err := b.data().ImagesFromBugId(bug.BugId)
 	if err != nil {
 		b.errorPage(err.Error())
 		return
 	}
 	bp.Images = images
-	comments, err := bagzullaDb.CommentsFromBugId(b.App.db, bug.BugId)
+	comments, err := b.data().CommentsFromBugId(bug.BugId)
 	if err != nil {
 		b.errorPage(err.Error())
 		return
 	}
 	bp.Statuses = statuses
 	bp.Priorities = priorities
-	for _, comment := range comments {
+	for _, comment := range liveComments(comments) {
 		var lc ListComment
 		lc.Comment = comment
 		var ok bool
@@ -1636,8 +1819,8 @@ func bugHandler(b *Bagreply) {
 		if !ok {
 			return
 		}
-		// Substitute URLs with linked URLs.
-		lc.Txt.Content = b.urlsToLinks(lc.Txt.Content)
+		// Substitute URLs and attachments with links.
+		lc.Txt.Content = b.bugTextToLinks(lc.Txt.Content, bp.Attachments)
 
 		lc.Person, ok = getPersonName(b, comment.PersonId)
 		if !ok {
@@ -1662,6 +1845,7 @@ func bugHandler(b *Bagreply) {
 		return
 	}
 	b.Title = html.EscapeString(fmt.Sprintf("%s - %s", bp.Title, bp.ProjectName))
+	b.Feed = fmt.Sprintf("../feed/bug/%d", bug.BugId)
 	b.runTemplate("bug.html", bp)
 }
 
@@ -1673,55 +1857,34 @@ func topHandler(b *Bagreply) {
 }
 
 func assignDirToProject(b *Bagreply, projectId int64, directory string) (err error) {
-	return bagzullaDb.UpdateDirectoryForProject(b.App.db, directory, projectId)
+	return b.data().UpdateDirectoryForProject(directory, projectId)
 }
 
 // Assign the given part ID to the bug specified.
-func assignPartToBug(b *Bagreply, bug bagzullaDb.Bug, partid int64) {
-	err := bagzullaDb.UpdatePartIdForBug(b.App.db, partid, bug.BugId)
-	if err != nil {
-		b.errorPage("Error assigning part with id %d to bug with id %d: %s", partid, bug.BugId, err.Error())
-		return
-	}
-	ok := b.updateChanged(bug.BugId)
-	if !ok {
-		return
-	}
-	b.redirectToBug(bug.BugId)
-}
-
-// Assign the project ID to the bug specified.
-func (b *Bagreply) assignProjectToBug(bug bagzullaDb.Bug, projectid int64) {
-	if b.NotLoggedIn() {
-		return
-	}
-	err := bagzullaDb.UpdateProjectIdForBug(b.App.db, projectid, bug.BugId)
-	if err != nil {
-		b.errorPage("Error assigning project with id %d to bug with id %d: %s",
-			projectid, bug.BugId, err.Error())
-		return
-	}
-	// Set the part to "None".
-	err = bagzullaDb.UpdatePartIdForBug(b.App.db, 0, bug.BugId)
-	if err != nil {
-		b.errorPage("Error resetting part for bug with id %d: %s",
-			bug.BugId, err.Error())
-		return
-	}
-	if !b.updateChanged(bug.BugId) {
-		return
-	}
-	b.redirectToBug(bug.BugId)
+func assignPartToBug(b *Bagreply, bug bagzullaDb.Bug, partid int64) (ok bool) {
+	return b.inTx(func() bool {
+		err := b.data().UpdatePartIdForBug(partid, bug.BugId)
+		if err != nil {
+			b.errorPage("Error assigning part with id %d to bug with id %d: %s", partid, bug.BugId, err.Error())
+			return false
+		}
+		if !b.updateChanged(bug.BugId) {
+			return false
+		}
+		b.bugEvent("reassigned", bug.BugId, fmt.Sprintf("part %d", bug.PartId),
+			fmt.Sprintf("part %d", partid), "")
+		return true
+	})
 }
 
 // Given a project id and a part name, return the part id and true or
 // false if found or not found.
 func partIdFromName(b *Bagreply, projectId int64, partName string) (int64, bool, error) {
-	parts, err := bagzullaDb.PartsFromProjectId(b.App.db, projectId)
+	parts, err := b.data().PartsFromProjectId(projectId)
 	if err != nil {
 		return 0, false, err
 	}
-	for _, part := range parts {
+	for _, part := range liveParts(parts) {
 		if part.Name == partName {
 			return part.PartId, true, nil
 		}
@@ -1738,12 +1901,15 @@ func (b *Bagreply) ChangeBug() (bugid int64, bug bagzullaDb.Bug, ok bool) {
 		return bugid, bug, false
 	}
 	var err error
-	bug, err = bagzullaDb.BugFromId(b.App.db, bugid)
+	bug, err = b.data().BugFromId(bugid)
 	if err != nil {
 		b.errorPage(fmt.Sprintf("Error looking for bug with ID %d: %s",
 			bugid, err.Error()))
 		return bugid, bug, false
 	}
+	if b.NotAllowed(b.perm, bug.ProjectId) || b.inTrash("bug", bugid, bug.Deleted) {
+		return bugid, bug, false
+	}
 	return bugid, bug, true
 }
 
@@ -1773,7 +1939,7 @@ type ChangeBugPart struct {
 	Bug          bagzullaDb.Bug
 	Title        string
 	Project      bagzullaDb.Project
-	ProjectParts []bagzullaDb.Part
+	ProjectParts []PartNode
 }
 
 // Change the part of a project to which a bug belongs.
@@ -1787,23 +1953,26 @@ func changeBugPartHandler(b *Bagreply) {
 		return
 	}
 	var err error
-	cbp.Bug, err = bagzullaDb.BugFromId(b.App.db, bugid)
+	cbp.Bug, err = b.data().BugFromId(bugid)
 	if err != nil {
 		b.errorPage(fmt.Sprintf("Error looking for bug with ID %d: %s",
 			bugid, err.Error()))
 		return
 	}
-	if cbp.Bug.ProjectId != ProjectNone {
+	if b.NotAllowed(b.perm, cbp.Bug.ProjectId) || b.inTrash("bug", bugid, cbp.Bug.Deleted) {
+		return
+	}
+	if cbp.Bug.ProjectId != b.inbox() {
 		var ok bool
 		cbp.Project, ok = projectFromId(b, cbp.Bug.ProjectId)
 		if !ok {
 			return
 		}
 	} else {
-		b.errorPage("Bug id %d is not currently associated with any project; <a href='/set-bug-project/%d'>please pick a project for this bug</a>.", bugid, bugid)
+		b.errorPage("Bug id %d is not currently associated with any project; <a href='../change-bug-project/%d'>please pick a project for this bug</a>.", bugid, bugid)
 		return
 	}
-	newPartName := b.r.FormValue("new-part")
+	newPartName := b.r.PostFormValue("new-part")
 	if len(newPartName) > 0 {
 		url := fmt.Sprintf("%s/add-part-to-project/%d?part-name=%s&bug-id=%d",
 			b.App.TopURL, cbp.Bug.ProjectId, newPartName, bugid)
@@ -1815,7 +1984,7 @@ func changeBugPartHandler(b *Bagreply) {
 		return
 	}
 	cbp.Title = html.EscapeString(title.Content)
-	partname := b.r.FormValue("part")
+	partname := b.r.PostFormValue("part")
 	if len(partname) > 0 {
 		// Deal with user input.
 		var partid int64
@@ -1833,17 +2002,16 @@ func changeBugPartHandler(b *Bagreply) {
 				return
 			}
 		}
-		assignPartToBug(b, cbp.Bug, partid)
+		if assignPartToBug(b, cbp.Bug, partid) {
+			b.redirectToBug(cbp.Bug.BugId)
+		}
 		return
 	}
 	// There was no user input, so print the form.
-	cbp.ProjectParts, err = bagzullaDb.PartsFromProjectId(b.App.db, cbp.Bug.ProjectId)
-	if err != nil {
-		b.errorPage("Error getting parts for project %d: %s",
-			cbp.Bug.ProjectId, err.Error())
+	cbp.ProjectParts, ok = b.projectPartTree(cbp.Bug.ProjectId)
+	if !ok {
 		return
 	}
-	sortParts(cbp.ProjectParts)
 	b.Title = fmt.Sprintf("Change part of %s", cbp.Title)
 	b.runTemplate("change-bug-part.html", cbp)
 }
@@ -1852,6 +2020,8 @@ type ChangeBugProject struct {
 	Bug      bagzullaDb.Bug
 	Title    string
 	Projects []bagzullaDb.Project
+	// The name of the bug's part, or empty if it has none.
+	Part string
 }
 
 // Change the part of a project to which a bug belongs.
@@ -1865,39 +2035,48 @@ func changeBugProjectHandler(b *Bagreply) {
 		return
 	}
 	var err error
-	cbp.Bug, err = bagzullaDb.BugFromId(b.App.db, bugid)
+	cbp.Bug, err = b.data().BugFromId(bugid)
 	if err != nil {
 		b.errorPage(fmt.Sprintf("Error looking for bug with ID %d: %s",
 			bugid, err.Error()))
 		return
 	}
+	if b.NotAllowed(b.perm, cbp.Bug.ProjectId) || b.inTrash("bug", bugid, cbp.Bug.Deleted) {
+		return
+	}
 	title, ok := getText(b, cbp.Bug.Title)
 	if !ok {
 		return
 	}
 	cbp.Title = html.EscapeString(title.Content)
-	projectname := b.r.FormValue("project")
+	projectname := b.r.PostFormValue("project")
 	if len(projectname) > 0 {
 		// Deal with user input.
 		var projectid int64
-		if projectname == "None" {
-			projectid = ProjectNone
+		if projectname == "None" && b.inbox() != 0 {
+			projectid = b.inbox()
 		} else {
 			projectid, ok = b.projectIdFromName(projectname)
 			if !ok {
 				return
 			}
 		}
-		b.assignProjectToBug(cbp.Bug, projectid)
+		if b.moveBugWithPart(cbp.Bug, projectid) {
+			b.redirectToBug(cbp.Bug.BugId)
+		}
 		return
 	}
 	// There was no user input, so print the form.
-	cbp.Projects, err = bagzullaDb.AllProjects(b.App.db)
-	if err != nil {
-		b.errorPage("Error getting all projects: %s", err.Error())
+	cbp.Projects, ok = openProjects(b)
+	if !ok {
 		return
 	}
-	sortProjects(cbp.Projects)
+	if cbp.Bug.PartId != 0 {
+		cbp.Part, ok = getPartName(b, cbp.Bug.PartId)
+		if !ok {
+			return
+		}
+	}
 	b.runTemplate("change-bug-project.html", cbp)
 }
 
@@ -1910,61 +2089,75 @@ func addPartToProjectHandler(b *Bagreply) {
 	if !ok {
 		return
 	}
-	if project.ProjectId == ProjectNone {
-		b.errorPage("Can't add a part to project 'None': choose a project first")
+	if project.ProjectId == b.inbox() {
+		b.errorPage("Can't add a part to the inbox project %s: choose a project first", project.Name)
 		return
 	}
-	if len(b.r.FormValue("name")) > 0 {
+	if b.projectClosed(project) {
+		return
+	}
+	if len(b.r.PostFormValue("name")) > 0 {
 		var p bagzullaDb.Part
-		p.Name = b.r.FormValue("name")
+		p.Name = b.r.PostFormValue("name")
 		if strings.EqualFold(p.Name, "none") {
 			b.errorPage("Part cannot be called 'none'")
 			return
 		}
-		parts, err := bagzullaDb.PartsFromProjectId(b.App.db, project.ProjectId)
+		parts, err := b.data().PartsFromProjectId(project.ProjectId)
 		if err != nil {
 			b.errorPage("Error retrieving existing parts: %s", err)
 			return
 		}
 		for _, q := range parts {
 			if strings.EqualFold(p.Name, q.Name) {
+				if !q.Deleted.IsZero() {
+					b.errorPage("There is already a part '%s' in the trash", q.Name)
+					return
+				}
 				b.errorPage("There is already a part '%s'", q.Name)
 				return
 			}
 		}
-		description := b.r.FormValue("description")
-		descriptionId, ok := insertText(b, description)
-		if !ok {
+		p.ProjectId = project.ProjectId
+		p.ParentId, ok = b.formParent()
+		if !ok || !b.checkParent(p, p.ParentId) {
 			return
 		}
-		p.Description = descriptionId
-		p.ProjectId = project.ProjectId
-		p.PartId, err = bagzullaDb.InsertPart(b.App.db, p)
-		if err != nil {
-			b.errorPage(fmt.Sprintf("Error creating part %s for project with id %d: %s",
-				p.Name, project.ProjectId, err.Error()))
-		} else {
-			bugIdStr := b.r.FormValue("bug-id")
-			if len(bugIdStr) > 0 {
-				bugId, err := strconv.ParseInt(bugIdStr, 10, 64)
+		var bugId int64
+		bugIdStr := b.r.PostFormValue("bug-id")
+		if len(bugIdStr) > 0 {
+			bugId, err = strconv.ParseInt(bugIdStr, 10, 64)
+			if err != nil {
+				b.errorPage("Error getting bug id number from %s",
+					bugIdStr)
+				return
+			}
+		}
+		ok := b.inTx(func() bool {
+			description := b.r.PostFormValue("description")
+			descriptionId, ok := insertText(b, description)
+			if !ok {
+				return false
+			}
+			p.Description = descriptionId
+			p.PartId, err = b.data().InsertPart(p)
+			if err != nil {
+				b.errorPage(fmt.Sprintf("Error creating part %s for project with id %d: %s",
+					p.Name, project.ProjectId, err.Error()))
+				return false
+			}
+			if bugId != 0 {
+				err = b.data().UpdatePartIdForBug(p.PartId, bugId)
 				if err != nil {
-					b.errorPage("Error getting bug id number from %s",
-						bugIdStr)
-					return
-				}
-				if bugId != 0 {
-					err = bagzullaDb.UpdatePartIdForBug(b.App.db, p.PartId, bugId)
-					if err != nil {
-						b.errorPage("Error adding part id %d for bug with id %d",
-							p.PartId, bugId)
-						return
-					}
-					ok := b.updateChanged(bugId)
-					if !ok {
-						return
-					}
+					b.errorPage("Error adding part id %d for bug with id %d",
+						p.PartId, bugId)
+					return false
 				}
+				return b.updateChanged(bugId)
 			}
+			return true
+		})
+		if ok {
 			redirectToPart(b, p.PartId)
 		}
 		return
@@ -1973,9 +2166,25 @@ func addPartToProjectHandler(b *Bagreply) {
 		PartName string
 		BugId    int64
 		Project  bagzullaDb.Project
+		// The parts which the new part can go under, and the one
+		// chosen already.
+		Parts  []PartNode
+		Parent int64
 	}
 	addPart.Project = project
 	addPart.PartName = b.r.FormValue("part-name")
+	addPart.Parts, ok = b.projectPartTree(project.ProjectId)
+	if !ok {
+		return
+	}
+	if parent := b.r.FormValue("parent"); parent != "" {
+		var err error
+		addPart.Parent, err = strconv.ParseInt(parent, 10, 64)
+		if err != nil {
+			b.errorPage("Bad parent part %s", strconv.Quote(parent))
+			return
+		}
+	}
 	bugId := b.r.FormValue("bug-id")
 	if len(bugId) > 0 {
 		var err error
@@ -2004,11 +2213,11 @@ func changeProjectDirectory(b *Bagreply) {
 		return
 	}
 	// Get the user's requested directory.
-	dir := b.r.FormValue("dir")
+	dir := b.r.PostFormValue("dir")
 	if len(dir) > 0 {
 		// Respond to user input.
 		projectid := project.ProjectId
-		err := bagzullaDb.UpdateDirectoryForProject(b.App.db, dir, projectid)
+		err := b.data().UpdateDirectoryForProject(dir, projectid)
 		if err != nil {
 			b.errorPage(fmt.Sprintf("Error updating directory for project %d to %s: %s",
 				projectid, dir, err.Error()))
@@ -2040,7 +2249,7 @@ func changeBugStatus(b *Bagreply) {
 	if !ok {
 		return
 	}
-	newStatusString := b.r.FormValue("status")
+	newStatusString := b.r.PostFormValue("status")
 	if len(newStatusString) > 0 {
 		newStatus, err := stringToStatus(newStatusString)
 		if err != nil {
@@ -2049,14 +2258,14 @@ func changeBugStatus(b *Bagreply) {
 		}
 		oldStatus := bug.Status
 		if oldStatus != newStatus {
-			ok := setBugStatus(b, newStatus, bug.BugId)
-			if !ok {
-				return
-			}
-			if !b.updateChanged(bug.BugId) {
-				return
+			ok := b.inTx(func() bool {
+				return setBugStatus(b, newStatus, bug.BugId) &&
+					b.updateChanged(bug.BugId)
+			})
+			if ok {
+				b.redirectToBug(bug.BugId)
 			}
-			b.redirectToBug(bug.BugId)
+			return
 		}
 	}
 	var bsp bugStatusPage
@@ -2077,7 +2286,7 @@ func changeBugPriority(b *Bagreply) {
 	if !ok {
 		return
 	}
-	newPriorityString := b.r.FormValue("priority")
+	newPriorityString := b.r.PostFormValue("priority")
 	if len(newPriorityString) > 0 {
 		newPriority, err := stringToPriority(newPriorityString)
 		if err != nil {
@@ -2086,16 +2295,24 @@ func changeBugPriority(b *Bagreply) {
 		}
 		oldPriority := bug.Priority
 		if oldPriority != newPriority {
-			err := bagzullaDb.UpdatePriorityForBug(b.App.db, newPriority, bug.BugId)
-			if err != nil {
-				b.errorPage(fmt.Sprintf("Error updating priority for bug with id %d to priority %s (%d): %s",
-					bug.BugId, newPriorityString, newPriority, err.Error()))
-				return
-			}
-			if !b.updateChanged(bug.BugId) {
-				return
+			ok := b.inTx(func() bool {
+				err := b.data().UpdatePriorityForBug(newPriority, bug.BugId)
+				if err != nil {
+					b.errorPage(fmt.Sprintf("Error updating priority for bug with id %d to priority %s (%d): %s",
+						bug.BugId, newPriorityString, newPriority, err.Error()))
+					return false
+				}
+				if !b.updateChanged(bug.BugId) {
+					return false
+				}
+				b.bugEvent("priority", bug.BugId, priorities[oldPriority],
+					newPriorityString, "")
+				return true
+			})
+			if ok {
+				b.redirectToBug(bug.BugId)
 			}
-			b.redirectToBug(bug.BugId)
+			return
 		}
 	}
 	var bsp bugPriorityPage
@@ -2123,18 +2340,20 @@ func save(b *Bagreply) {
 	if !ok {
 		return
 	}
-	newTitle := b.r.FormValue("title")
-	var changed bool
+	newTitle := b.r.PostFormValue("title")
 	if newTitle != lb.Title {
-		newTitleId, ok := insertText(b, newTitle)
-		if !ok {
-			return
-		}
-		bagzullaDb.UpdateTitleForBug(b.App.db, newTitleId, bug.BugId)
-		changed = true
-	}
-	if changed {
-		ok := b.updateChanged(bug.BugId)
+		ok := b.inTx(func() bool {
+			newTitleId, ok := insertText(b, newTitle)
+			if !ok {
+				return false
+			}
+			err := b.data().UpdateTitleForBug(newTitleId, bug.BugId)
+			if err != nil {
+				b.errorPage("Error changing the title of bug %d: %s", bug.BugId, err)
+				return false
+			}
+			return b.updateChanged(bug.BugId)
+		})
 		if !ok {
 			return
 		}
@@ -2173,6 +2392,7 @@ func search(b *Bagreply) {
 			return
 		}
 	}
+	s.Ids = b.visibleTexts(s.Ids)
 	for i, c := range s.Ids {
 		c.Content = strings.Replace(c.Content, "&", "&amp;", -1)
 		c.Content = strings.Replace(c.Content, "<", "&lt;", -1)
@@ -2192,22 +2412,23 @@ func recent(b *Bagreply) {
 	if m != nil {
 		var err error
 		max, err = strconv.ParseInt(m[1], 10, 64)
-		if err != nil {
+		if err != nil || max < 1 {
 			b.errorPage("Could not parse number in %s", b.r.URL.Path)
 			return
 		}
-	}
-	bugs, ok := BugsByChange(b, max)
-	if !ok {
-		return
+		if max > maxPageSize {
+			max = maxPageSize
+		}
 	}
 	var p ListBugPage
-	ok = getBugsInfo(b, &p, bugs)
+	var ok bool
+	p.Bugs, p.Paging, ok = b.bugListPage(bugList{sort: "changed", desc: true}, max)
 	if !ok {
 		return
 	}
 	p.Title = "Recently changed bugs"
 	b.Title = p.Title
+	b.Feed = "../feed/recent/"
 	b.runTemplate("bugs.html", p)
 }
 
@@ -2217,12 +2438,15 @@ func findComment(b *Bagreply) (comment bagzullaDb.Comment, ok bool) {
 	if !ok {
 		return
 	}
-	comment, err := bagzullaDb.CommentFromId(b.App.db, commentid)
+	comment, err := b.data().CommentFromId(commentid)
 	if err != nil {
 		b.errorPage(fmt.Sprintf("Error retrieving comment with id %d from database: %s",
 			commentid, err.Error()))
 		return comment, false
 	}
+	if b.inTrash("comment", commentid, comment.Deleted) {
+		return comment, false
+	}
 	return comment, true
 }
 
@@ -2240,23 +2464,32 @@ func editComment(b *Bagreply) {
 	if !ok {
 		return
 	}
+	// People may edit their own comments, but only developers may
+	// edit other people's.
+	need := b.perm
+	if comment.PersonId != b.User.PersonId {
+		need = roleDeveloper
+	}
+	if b.NotAllowedBug(need, comment.BugId) {
+		return
+	}
 	text, ok := getText(b, comment.TxtId)
 	if !ok {
 		return
 	}
-	commentText := b.r.FormValue("comment-text")
+	commentText := b.r.PostFormValue("comment-text")
 	if len(commentText) > 0 {
 		if commentText != text.Content {
-			commentTextId, ok := insertText(b, commentText)
-			if !ok {
-				return
-			}
-			ok = UpdateCommentTextId(b, comment.CommentId, commentTextId)
+			ok := b.inTx(func() bool {
+				commentTextId, ok := insertText(b, commentText)
+				return ok && UpdateCommentTextId(b, comment.CommentId, commentTextId)
+			})
 			if !ok {
 				return
 			}
 		}
 		b.redirectToBug(comment.BugId)
+		return
 	}
 	var c commentToEdit
 	c.Id = comment.CommentId
@@ -2290,97 +2523,118 @@ func editDependencies(b *Bagreply) {
 	lb.DependsOn = currentDependsOn
 	// Has anything changed?
 	changed := false
-	blocks := b.r.FormValue("blocks")
-	if len(blocks) > 0 {
-		// Get the blocks of the bugs by splitting into numbers.
-		numbers := strings.Fields(blocks)
-		var blocks []int64
-		for i, nStr := range numbers {
-			block, err := strconv.ParseInt(nStr, 10, 64)
-			if err != nil {
-				b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
-				return
-			}
-			if block == bug.BugId {
-				b.errorPage(fmt.Sprintf("Bug cannot block itself"))
-				return
+	ok = b.inTx(func() bool {
+		blocks := b.r.PostFormValue("blocks")
+		if len(blocks) > 0 {
+			// Get the blocks of the bugs by splitting into numbers.
+			numbers := strings.Fields(blocks)
+			var blocks []int64
+			for i, nStr := range numbers {
+				block, err := strconv.ParseInt(nStr, 10, 64)
+				if err != nil {
+					b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
+					return false
+				}
+				if block == bug.BugId {
+					b.errorPage(fmt.Sprintf("Bug cannot block itself"))
+					return false
+				}
+				known := false
+				for _, c := range currentBlocks {
+					if c.Id == block {
+						known = true
+					}
+				}
+				if !known {
+					if b.NotAllowedBug(roleDeveloper, block) {
+						return false
+					}
+					var d bagzullaDb.Dependency
+					d.Cause = bug.BugId
+					d.Effect = block
+					_, err = b.data().InsertDependency(d)
+					if err != nil {
+						b.errorPage("Error adding dependency of %d on %d: %s",
+							d.Effect, d.Cause, err)
+						return false
+					}
+					changed = true
+				}
+				blocks = append(blocks, block)
 			}
-			known := false
 			for _, c := range currentBlocks {
-				if c.Id == block {
-					known = true
+				exists := false
+				for _, e := range blocks {
+					if c.Id == e {
+						exists = true
+						break
+					}
 				}
-			}
-			if !known {
-				var d bagzullaDb.Dependency
-				d.Cause = bug.BugId
-				d.Effect = block
-				bagzullaDb.InsertDependency(b.App.db, d)
-				changed = true
-			}
-			blocks = append(blocks, block)
-		}
-		for _, c := range currentBlocks {
-			exists := false
-			for _, e := range blocks {
-				if c.Id == e {
-					exists = true
-					break
+				if !exists {
+					// delete it
 				}
 			}
-			if !exists {
-				// delete it
-			}
 		}
-	}
-	dependsOn := b.r.FormValue("depends-on")
-	if len(dependsOn) > 0 {
-		// Get the blocks of the bugs by splitting into numbers.
-		numbers := strings.Fields(dependsOn)
-		var dependsOns []int64
-		for i, nStr := range numbers {
-			block, err := strconv.ParseInt(nStr, 10, 64)
-			if err != nil {
-				b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
-				return
-			}
-			if block == bug.BugId {
-				b.errorPage(fmt.Sprintf("Bug cannot depend on itself"))
-				return
+		dependsOn := b.r.PostFormValue("depends-on")
+		if len(dependsOn) > 0 {
+			// Get the blocks of the bugs by splitting into numbers.
+			numbers := strings.Fields(dependsOn)
+			var dependsOns []int64
+			for i, nStr := range numbers {
+				block, err := strconv.ParseInt(nStr, 10, 64)
+				if err != nil {
+					b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
+					return false
+				}
+				if block == bug.BugId {
+					b.errorPage(fmt.Sprintf("Bug cannot depend on itself"))
+					return false
+				}
+				known := false
+				for _, c := range currentDependsOn {
+					if c.Id == block {
+						known = true
+					}
+				}
+				if !known {
+					if b.NotAllowedBug(roleDeveloper, block) {
+						return false
+					}
+					var d bagzullaDb.Dependency
+					d.Cause = block
+					d.Effect = bug.BugId
+					_, err = b.data().InsertDependency(d)
+					if err != nil {
+						b.errorPage("Error adding dependency of %d on %d: %s",
+							d.Effect, d.Cause, err)
+						return false
+					}
+					changed = true
+				}
+				dependsOns = append(dependsOns, block)
 			}
-			known := false
 			for _, c := range currentDependsOn {
-				if c.Id == block {
-					known = true
+				exists := false
+				for _, e := range dependsOns {
+					if c.Id == e {
+						exists = true
+						break
+					}
 				}
-			}
-			if !known {
-				var d bagzullaDb.Dependency
-				d.Cause = block
-				d.Effect = bug.BugId
-				bagzullaDb.InsertDependency(b.App.db, d)
-				changed = true
-			}
-			dependsOns = append(dependsOns, block)
-		}
-		for _, c := range currentDependsOn {
-			exists := false
-			for _, e := range dependsOns {
-				if c.Id == e {
-					exists = true
-					break
+				if !exists {
+					// delete it
 				}
 			}
-			if !exists {
-				// delete it
-			}
 		}
+		if changed {
+			return b.updateChanged(bug.BugId)
+		}
+		return true
+	})
+	if !ok {
+		return
 	}
 	if changed {
-		ok := b.updateChanged(bug.BugId)
-		if !ok {
-			return
-		}
 		b.redirectToBug(bug.BugId)
 		return
 	}
@@ -2416,102 +2670,139 @@ func editDuplicates(b *Bagreply) {
 	lb.Duplicates = currentDuplicates
 	// Has anything changed?
 	changed := false
-	// This is bogus, there should only be one original!
-	originals := b.r.FormValue("originals")
-	if len(originals) > 0 {
-		// Get the originals of the bugs by splitting into numbers.
-		numbers := strings.Fields(originals)
-		if len(numbers) > 1 {
-			b.errorPage(fmt.Sprintf("Too many originals for %d, can only have one", bug.BugId))
-			return
-		}
-		var originals []int64
-		for i, nStr := range numbers {
-			original, err := strconv.ParseInt(nStr, 10, 64)
-			if err != nil {
-				b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
-				return
-			}
-			if original == bug.BugId {
-				b.errorPage(fmt.Sprintf("%d is the current bug entry, cannot be a duplicate of itself", original))
+	ok = b.inTx(func() bool {
+		// This is bogus, there should only be one original!
+		originals := b.r.PostFormValue("originals")
+		if len(originals) > 0 {
+			// Get the originals of the bugs by splitting into numbers.
+			numbers := strings.Fields(originals)
+			if len(numbers) > 1 {
+				b.errorPage(fmt.Sprintf("Too many originals for %d, can only have one", bug.BugId))
+				return false
 			}
-			known := false
-			for _, c := range currentOriginals {
-				if c.Id == original {
-					known = true
+			var originals []int64
+			for i, nStr := range numbers {
+				original, err := strconv.ParseInt(nStr, 10, 64)
+				if err != nil {
+					b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
+					return false
 				}
-			}
-			if !known {
-				var d bagzullaDb.Duplicate
-				d.Duplicate = bug.BugId
-				d.Original = original
-				bagzullaDb.InsertDuplicate(b.App.db, d)
-				ok := setBugStatus(b, 3, bug.BugId)
-				if !ok {
-					return
+				if original == bug.BugId {
+					b.errorPage(fmt.Sprintf("%d is the current bug entry, cannot be a duplicate of itself", original))
+					return false
 				}
-				changed = true
-			}
-			originals = append(originals, original)
-		}
-		for _, c := range currentOriginals {
-			exists := false
-			for _, e := range originals {
-				if c.Id == e {
-					exists = true
-					break
+				known := false
+				for _, c := range currentOriginals {
+					if c.Id == original {
+						known = true
+					}
 				}
+				if !known {
+					if b.NotAllowedBug(roleDeveloper, original) {
+						return false
+					}
+					var d bagzullaDb.Duplicate
+					d.Duplicate = bug.BugId
+					d.Original = original
+					_, err = b.data().InsertDuplicate(d)
+					if err != nil {
+						b.errorPage("Error marking %d as a duplicate of %d: %s",
+							d.Duplicate, d.Original, err)
+						return false
+					}
+					if !setBugStatus(b, 3, bug.BugId) {
+						return false
+					}
+					changed = true
+				}
+				originals = append(originals, original)
 			}
-			if !exists {
-				removeDuplicateOrig(b.App.db, c.Id)
+			for _, c := range currentOriginals {
+				exists := false
+				for _, e := range originals {
+					if c.Id == e {
+						exists = true
+						break
+					}
+				}
+				if !exists {
+					if b.NotAllowedBug(roleDeveloper, c.Id) {
+						return false
+					}
+					err := removeDuplicateOrig(b.data(), c.Id)
+					if err != nil {
+						b.errorPage("Error removing duplicate %d: %s", c.Id, err)
+						return false
+					}
+				}
 			}
 		}
-	}
-	duplicates := b.r.FormValue("duplicates")
-	if len(duplicates) > 0 {
-		// Get the blocks of the bugs by splitting into numbers.
-		numbers := strings.Fields(duplicates)
-		var duplicates []int64
-		for i, nStr := range numbers {
-			duplicate, err := strconv.ParseInt(nStr, 10, 64)
-			if err != nil {
-				b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
-				return
+		duplicates := b.r.PostFormValue("duplicates")
+		if len(duplicates) > 0 {
+			// Get the blocks of the bugs by splitting into numbers.
+			numbers := strings.Fields(duplicates)
+			var duplicates []int64
+			for i, nStr := range numbers {
+				duplicate, err := strconv.ParseInt(nStr, 10, 64)
+				if err != nil {
+					b.errorPage(fmt.Sprintf("Entry %d (%s) is not a number", i, nStr))
+					return false
+				}
+				known := false
+				for _, c := range currentDuplicates {
+					if c.Id == duplicate {
+						known = true
+					}
+				}
+				if !known {
+					if b.NotAllowedBug(roleDeveloper, duplicate) {
+						return false
+					}
+					var d bagzullaDb.Duplicate
+					d.Original = bug.BugId
+					d.Duplicate = duplicate
+					_, err = b.data().InsertDuplicate(d)
+					if err != nil {
+						b.errorPage("Error marking %d as a duplicate of %d: %s",
+							d.Duplicate, d.Original, err)
+						return false
+					}
+					if !setBugStatus(b, 3, d.Duplicate) {
+						return false
+					}
+					changed = true
+				}
+				duplicates = append(duplicates, duplicate)
 			}
-			known := false
 			for _, c := range currentDuplicates {
-				if c.Id == duplicate {
-					known = true
+				exists := false
+				for _, e := range duplicates {
+					if c.Id == e {
+						exists = true
+						break
+					}
 				}
-			}
-			if !known {
-				var d bagzullaDb.Duplicate
-				d.Original = bug.BugId
-				d.Duplicate = duplicate
-				bagzullaDb.InsertDuplicate(b.App.db, d)
-				setBugStatus(b, 3, d.Duplicate)
-				changed = true
-			}
-			duplicates = append(duplicates, duplicate)
-		}
-		for _, c := range currentDuplicates {
-			exists := false
-			for _, e := range duplicates {
-				if c.Id == e {
-					exists = true
-					break
+				if !exists {
+					if b.NotAllowedBug(roleDeveloper, c.Id) {
+						return false
+					}
+					err := removeDuplicate(b.data(), c.Id)
+					if err != nil {
+						b.errorPage("Error removing duplicate %d: %s", c.Id, err)
+						return false
+					}
 				}
 			}
-			if !exists {
-				removeDuplicate(b.App.db, c.Id)
-			}
 		}
+		if changed {
+			return b.updateChanged(bug.BugId)
+		}
+		return true
+	})
+	if !ok {
+		return
 	}
 	if changed {
-		ok := b.updateChanged(bug.BugId)
-		if !ok {
-			return
-		}
 		b.redirectToBug(bug.BugId)
 		return
 	}
@@ -2530,138 +2821,169 @@ func Bin() string {
 
 var topDir string
 
-// The uploaded image files go into this directory.
-
-var bugimages = "bugimages"
-var fileDir string = topDir + "/" + bugimages
-
-var ntou = regexp.MustCompile(fileDir + `/(.*)`)
-
-var filename = regexp.MustCompile("/([^/]+)$")
-
-func fileNameToUrl(name string) (url string) {
-	url = ntou.ReplaceAllString(name, "/image/$1")
-	return url
+// Get the image with the ID at the end of the URL or, for links from
+// before the images had IDs in their URLs, with the file name.
+func getImage(b *Bagreply) (image bagzullaDb.Image, ok bool) {
+	last := path.Base(b.r.URL.Path)
+	var err error
+	imageId, perr := strconv.ParseInt(last, 10, 64)
+	if perr == nil {
+		image, err = b.data().ImageFromId(imageId)
+	} else {
+		image, err = b.data().ImageFromFile(last)
+		image.File = last
+	}
+	if err != nil {
+		b.w.WriteHeader(http.StatusNotFound)
+		b.errorPage("No such image: %s", err)
+		return image, false
+	}
+	if b.NotAllowedBug(b.perm, image.BugId) {
+		return image, false
+	}
+	return image, true
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request) {
-	h := w.Header()
-	file := filename.FindStringSubmatch(r.URL.Path)
-	if file == nil {
-		fmt.Fprintf(w, "File is not in URL path")
+// Send an image which was uploaded before there were attachments.
+func imageHandler(b *Bagreply) {
+	image, ok := getImage(b)
+	if !ok {
+		return
+	}
+	file, err := b.App.files.imagePath(image.File)
+	if err != nil {
+		b.errorPage("Error finding image %d: %s", image.ImageId, err)
 		return
 	}
-	fileBytes, err := ioutil.ReadFile(fileDir + "/" + file[1])
+	f, err := os.Open(file)
 	if err != nil {
-		fmt.Fprintf(w, "Error reading file: %s.\n", err)
+		b.errorPage("Error reading image %d: %s", image.ImageId, err)
 		return
 	}
-	mime_type := http.DetectContentType(fileBytes)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		b.errorPage("Error reading image %d: %s", image.ImageId, err)
+		return
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	mime_type := http.DetectContentType(head[:n])
 	if strings.Contains(mime_type, "text/xml") {
 		mime_type = "image/svg+xml; charset=utf-8"
 	}
-	h.Set("Content-Type", mime_type)
-	w.Write(fileBytes)
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		b.errorPage("Error reading image %d: %s", image.ImageId, err)
+		return
+	}
+	b.w.Header().Set("Content-Type", mime_type)
+	serveFile(b, f, info.ModTime(), fmt.Sprintf("image-%d", image.ImageId))
 }
 
 func upload(b *Bagreply) {
 	if b.NotLoggedIn() {
 		return
 	}
-	r := b.r
-	r.ParseMultipartForm(10 << 20)
-	file, _, err := r.FormFile("bug-image")
+	a, file, err := b.readUpload()
 	if err != nil {
-		b.errorPage("Error retrieving file from form-data: %s.\n", err)
+		b.errorPage("%s", err)
 		return
 	}
 	defer file.Close()
-	tempFile, err := ioutil.TempFile(fileDir, "upload*")
-	if err != nil {
-		b.errorPage("Error creating temp file: %s.\n", err)
+	if b.NotAllowedBug(b.perm, a.BugId) {
 		return
 	}
-	defer tempFile.Close()
-	fileBytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		b.errorPage("Error reading file: %s.\n", err)
+	ok := b.inTx(func() bool {
+		a, err = b.App.attach(b.data(), a, file)
+		if err != nil {
+			b.errorPage("Error saving %s: %s.\n", html.EscapeString(a.Filename), err)
+			return false
+		}
+		return b.updateChanged(a.BugId)
+	})
+	if !ok {
+		b.App.files.removeUnused(b.data(), a.SHA256)
 		return
 	}
-	tempFile.Write(fileBytes)
-
-	// Insert the image into the database.
+	b.redirectToBug(a.BugId)
+}
 
-	bugid := r.FormValue("bug-id")
-	if bugid == "" {
-		b.errorPage("Could not get bug ID from form inputs")
+func deleteImage(b *Bagreply) {
+	if b.NotLoggedIn() {
 		return
 	}
-	bugnum, err := strconv.Atoi(bugid)
-	if err != nil {
-		b.errorPage("Error parsing bug ID %s: %s.\n", bugid, err)
+	image, ok := getImage(b)
+	if !ok || !b.mayDeleteFile(image.PersonId, image.BugId) {
 		return
 	}
-	name := tempFile.Name()
-	name = ntou.ReplaceAllString(name, "$1")
-	personId := int64(0)
-	if b.User != nil {
-		personId = b.User.PersonId
-	}
-	var image = bagzullaDb.Image{
-		File:     name,
-		BugId:    int64(bugnum),
-		PersonId: personId,
-	}
-	_, err = bagzullaDb.InsertImage(b.App.db, image)
+	file, err := b.App.files.imagePath(image.File)
 	if err != nil {
-		b.errorPage("Error inserting image into database: %s.\n", err)
+		b.errorPage("Error finding image %d: %s", image.ImageId, err)
 		return
 	}
-	b.redirectToBug(int64(bugnum))
-}
-
-func deleteImage(b *Bagreply) {
-	if b.NotLoggedIn() {
+	err = removeImage(b.data(), image.File)
+	if err != nil {
+		b.errorPage("Error removing image %d: %s", image.ImageId, err)
 		return
 	}
-	r := b.r
-	file := filename.FindStringSubmatch(r.URL.Path)
-	if file == nil {
-		b.errorPage("File to delete not supplied")
-	}
-	removeImage(b.App.db, file[1])
-	err := os.Remove(fileDir + "/" + file[1])
+	err = os.Remove(file)
 	if err != nil {
-		b.errorPage("Error removing %s: %s", err, file[1])
+		log.Printf("Error removing file of image %d: %s", image.ImageId, err)
 	}
-	b.errorPage("File %s removed", file[1])
+	b.redirectToBug(image.BugId)
 }
 
-func getId(b *Bagreply, s string) (r int64) {
+func getId(b *Bagreply, s string) (r int64, ok bool) {
 	r, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
 		b.errorPage("Error converting %s: %s", s, err)
+		return 0, false
 	}
-	return r
+	return r, true
+}
+
+// Get the ID of the bug in the form value "name", or zero if there is
+// none, and check that the user may change the bug. If "ok" is false,
+// an error page has been sent.
+func formBugId(b *Bagreply, name string) (bugId int64, ok bool) {
+	value := b.r.PostFormValue(name)
+	if len(value) == 0 {
+		return 0, true
+	}
+	bugId, ok = getId(b, value)
+	if !ok || b.NotAllowedBug(roleDeveloper, bugId) {
+		return 0, false
+	}
+	return bugId, true
 }
 
 func deleteDependency(b *Bagreply) {
 	if b.NotLoggedIn() {
 		return
 	}
-	cause := b.r.FormValue("cause")
-	effect := b.r.FormValue("effect")
-	bug := b.r.FormValue("bug")
-	if len(cause) > 0 && len(effect) > 0 {
-		causeId := getId(b, cause)
-		effectId := getId(b, effect)
-		removeDependencyCause(b.App.db, causeId, effectId)
+	causeId, ok := formBugId(b, "cause")
+	if !ok {
+		return
+	}
+	effectId, ok := formBugId(b, "effect")
+	if !ok {
+		return
+	}
+	bugId, ok := formBugId(b, "bug")
+	if !ok {
+		return
 	}
-	if len(bug) > 0 {
-		bugId := getId(b, bug)
-		if bugId != 0 {
-			b.redirectToBug(bugId)
+	if causeId != 0 && effectId != 0 {
+		err := removeDependencyCause(b.data(), causeId, effectId)
+		if err != nil {
+			b.errorPage("Error removing the dependency of %d on %d: %s",
+				effectId, causeId, err)
+			return
 		}
+	}
+	if bugId != 0 {
+		b.redirectToBug(bugId)
 	} else {
 		b.errorPage("No bug specified")
 	}
@@ -2669,36 +2991,56 @@ func deleteDependency(b *Bagreply) {
 
 // Set this bug's status to "open" (0) again, after removing its
 // "duplicate" status. This is a helper for deleteDuplicate.
-func openBug(b *Bagreply, bugId int64) {
-	if bugId != 0 {
-		ok := setBugStatus(b, 0, bugId)
-		if !ok {
-			return
-		}
+func openBug(b *Bagreply, bugId int64) (ok bool) {
+	if bugId == 0 {
+		return true
 	}
+	return setBugStatus(b, 0, bugId)
 }
 
-// Delete a duplicate from the database.
+// Delete a duplicate from the database. The user must be able to
+// change every bug which this changes.
 func deleteDuplicate(b *Bagreply) {
 	if b.NotLoggedIn() {
 		return
 	}
-	original := b.r.FormValue("original")
-	duplicate := b.r.FormValue("duplicate")
-	bug := b.r.FormValue("bug")
-	bugId := int64(0)
-	if len(bug) > 0 {
-		bugId = getId(b, bug)
+	bugId, ok := formBugId(b, "bug")
+	if !ok {
+		return
 	}
-	if len(original) > 0 {
-		originalId := getId(b, original)
-		removeDuplicateOrig(b.App.db, originalId)
-		openBug(b, bugId)
+	originalId, ok := formBugId(b, "original")
+	if !ok {
+		return
 	}
-	if len(duplicate) > 0 {
-		duplicateId := getId(b, duplicate)
-		removeDuplicate(b.App.db, duplicateId)
-		openBug(b, duplicateId)
+	duplicateId, ok := formBugId(b, "duplicate")
+	if !ok {
+		return
+	}
+	ok = b.inTx(func() bool {
+		if originalId != 0 {
+			err := removeDuplicateOrig(b.data(), originalId)
+			if err != nil {
+				b.errorPage("Error removing duplicates of %d: %s", originalId, err)
+				return false
+			}
+			if !openBug(b, bugId) {
+				return false
+			}
+		}
+		if duplicateId != 0 {
+			err := removeDuplicate(b.data(), duplicateId)
+			if err != nil {
+				b.errorPage("Error removing duplicate %d: %s", duplicateId, err)
+				return false
+			}
+			if !openBug(b, duplicateId) {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		return
 	}
 	if bugId != 0 {
 		b.redirectToBug(bugId)
@@ -2708,40 +3050,97 @@ func deleteDuplicate(b *Bagreply) {
 }
 
 type BagControl struct {
-	b        *Bagreply
-	Stopping bool
+	b          *Bagreply
+	Stopping   bool
+	Webhooks   []Webhook
+	Deliveries []Delivery
+	Projects   []bagzullaDb.Project
+	Events     []string
 }
 
 func controls(b *Bagreply) {
 	cb := BagControl{
-		b: b,
+		b:      b,
+		Events: webhookEvents,
 	}
-	stop := b.r.FormValue("stop")
+	stop := b.r.PostFormValue("stop")
 	if len(stop) > 0 && stop != "0" {
 		cb.Stopping = true
 		b.App.Cancel()
+		b.runTemplate("control.html", &cb)
+		return
+	}
+	// The webhooks have secrets, so only people who are logged in
+	// can see or change them.
+	if b.NotLoggedIn() {
+		return
+	}
+	if !webhookControls(b) {
+		return
+	}
+	var err error
+	cb.Webhooks, err = allWebhooks(b.data())
+	if err != nil {
+		b.errorPage("Error getting webhooks: %s", err)
+		return
+	}
+	cb.Deliveries, err = recentDeliveries(b.data(), 50)
+	if err != nil {
+		b.errorPage("Error getting webhook deliveries: %s", err)
+		return
+	}
+	var ok bool
+	cb.Projects, ok = openProjects(b)
+	if !ok {
+		return
 	}
 	b.runTemplate("control.html", &cb)
 }
 
 // makeHandler makes a handler which responds to HTTP requests out of
 // a BagFunc, "fn".  A BagFunc takes one argument, (b *Bagreply).
-func makeHandler(ba *Bagapp, fn BagFunc) http.HandlerFunc {
+func makeHandler(ba *Bagapp, fn BagFunc, perm role) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		b := Bagreply{
 			App: ba,
 			w:   w,
 			r:   r,
 		}
-		user, found, ok := b.getSession()
+		defer b.releaseTemplates()
+		var user bagzullaDb.Person
+		var found, ok bool
+		token, bearer := bearerToken(r)
+		if bearer {
+			user, ok = b.tokenUser(token)
+			found = ok
+		} else if ba.proxyHeader != "" {
+			user, found, ok = b.proxyUser()
+		} else {
+			user, found, ok = b.getSession()
+		}
 		if !ok {
 			return
 		}
+		if found && user.PersonId != 0 {
+			active, err := personActive(ba.data, user.PersonId)
+			if err != nil {
+				b.errorPage("Error getting status of %s: %s", user.Name, err)
+				return
+			}
+			if !active && bearer {
+				http.Error(w, "The owner of the token is not active", http.StatusUnauthorized)
+				return
+			}
+			found = active
+		}
 		if found && user.PersonId != 0 {
 			if debugLogin {
 				log.Printf("User %s found\n", user.Name)
 			}
 			b.User = &user
+			if !bearer {
+				b.touchSession()
+			}
 		} else {
 			if debugLogin {
 				log.Printf("User not found\n")
@@ -2752,12 +3151,21 @@ func makeHandler(ba *Bagapp, fn BagFunc) http.HandlerFunc {
 		h := w.Header()
 		h.Set("Content-Type", "text/html")
 		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			// The client cannot accept it, so return the output
-			// uncompressed.
-			h.Set("Content-Encoding", "gzip")
-			gz := gzip.NewWriter(w)
-			defer gz.Close()
-			b.w = gzipResponseWriter{Writer: gz, ResponseWriter: w}
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.Close()
+			b.w = gw
+		}
+		if !b.checkCSRF() {
+			return
+		}
+		if b.getPermissions().failed {
+			b.w.WriteHeader(http.StatusInternalServerError)
+			b.errorPage("Error reading the permissions, so nothing can be shown")
+			return
+		}
+		b.perm = perm
+		if perm > roleViewer && b.NotAllowed(perm, 0) {
+			return
 		}
 		fn(&b)
 	}
@@ -2777,91 +3185,185 @@ func (b *Bagapp) Init() {
 	database := flag.String("database", defaultDatabase, "database file to use")
 	url := flag.String("url", defaultURL, "URL")
 	display := flag.String("display", defaultDisplayDir, "Application to display directory contents")
+	files := flag.String("files", filepath.Join(topDir, "bugimages"), "directory for the attached files")
+	flag.BoolVar(&b.ingestMail, "ingest-mail", false, "read a mail message from standard input, make it into a bug or comment, then exit")
+	flag.StringVar(&b.recipient, "recipient", "", "recipient address of the mail for --ingest-mail")
+	flag.DurationVar(&b.sessionIdle, "session-idle", 30*24*time.Hour, "log out sessions unused for this long, 0 for never")
+	flag.DurationVar(&b.sessionLifetime, "session-lifetime", 90*24*time.Hour, "log out sessions this long after logging in, 0 for never")
+	flag.BoolVar(&b.secureCookies, "secure-cookies", false, "always mark the login cookie as HTTPS only")
+	flag.IntVar(&b.loginFailures, "login-failures", 5, "lock a name after this many failed logins, 0 for never")
+	flag.DurationVar(&b.loginLockout, "login-lockout", 15*time.Minute, "how long a name stays locked")
+	var ac authConfig
+	flag.StringVar(&ac.backend, "auth", "db", "where to check passwords: "+strings.Join(authBackends, ", "))
+	flag.StringVar(&ac.htpasswd, "htpasswd", "", "htpasswd file for --auth htpasswd")
+	flag.StringVar(&ac.ldapURL, "ldap-url", "", "LDAP server for --auth ldap, like ldap://host:389 or ldaps://host")
+	flag.StringVar(&ac.ldapDN, "ldap-dn", "", "DN to bind as for --auth ldap, with %s for the user name")
+	flag.StringVar(&ac.proxyHeader, "proxy-header", "X-Remote-User", "header with the user name for --auth proxy")
+	flag.StringVar(&ac.trustedProxies, "trusted-proxies", "127.0.0.1,::1", "addresses of the proxies for --auth proxy, separated by commas")
+	b.maxAttachment = 10 << 20
+	flag.Var(&b.maxAttachment, "max-attachment", "largest file which can be attached to a bug, like 500K or 10M, 0 for no limit")
+	b.projectQuota = 1 << 30
+	flag.Var(&b.projectQuota, "project-quota", "most space the attachments of a project can take, 0 for no limit")
+	flag.DurationVar(&b.trashKeep, "trash-keep", 30*24*time.Hour, "how long deleted things stay in the trash before they can be purged")
+	flag.BoolVar(&b.registration, "registration", true, "let people sign up at /register/ for an admin to approve")
+	flag.StringVar(&b.smtp.addr, "smtp", "", "host:port of the SMTP server for sending mail")
+	flag.StringVar(&b.smtp.user, "smtp-user", "", "login name for the SMTP server")
+	flag.StringVar(&b.smtp.password, "smtp-password", os.Getenv("BAGZULLA_SMTP_PASSWORD"), "password for the SMTP server, by default from $BAGZULLA_SMTP_PASSWORD")
+	flag.StringVar(&b.smtp.from, "mail-from", "", "From address of the mail which the server sends")
+	flag.BoolVar(&b.migrateOnly, "migrate-only", false, "bring the schema of the database up to date, then exit")
+	flag.StringVar(&b.makeAdmin, "make-admin", "", "give the person with this name the admin role, then exit")
 	flag.Parse()
 	b.port = *portPtr
-	b.db, err = sql.Open("sqlite3", *database)
+	b.db, err = bagzullaDb.Open(*database)
 	if err != nil {
 		log.Fatalf("Error connecting to database: %s", err)
 	}
+	_, err = migrate(b.db)
+	if err != nil {
+		log.Fatalf("Error updating the database %s: %s", *database, err)
+	}
+	if b.migrateOnly {
+		return
+	}
+	b.data, err = bagzullaDb.NewStore(b.db)
+	if err != nil {
+		log.Fatalf("Error preparing the database: %s", err)
+	}
+	if b.makeAdmin != "" {
+		err = makeAdmin(b.data, b.makeAdmin)
+		if err != nil {
+			log.Fatalf("Error making %s an admin: %s", b.makeAdmin, err)
+		}
+		log.Printf("%s is an admin", b.makeAdmin)
+		b.migrateOnly = true
+		return
+	}
 	b.TopURL = *url
 	b.DisplayDir = *display
-	loginFile := false
-	if loginFile {
-		s := store.Store{}
-		s.Init(topDir)
-		if debugLogin {
-			s.Verbose = true
-		}
-		b.store = &s
-	} else {
-		bu := baguser{
-			b: b,
-		}
-		b.store = &bu
+	b.files, err = openFileStore(*files)
+	if err != nil {
+		log.Fatalf("Error opening file directory %s: %s", *files, err)
+	}
+	if b.smtp.addr != "" && b.smtp.from == "" {
+		log.Fatalf("--smtp needs --mail-from")
+	}
+	err = b.initAuth(ac)
+	if err != nil {
+		log.Fatalf("Error setting up logins: %s", err)
 	}
-	b.login.Init(b.store, cookieName, cookiePath)
 	if debugLogin {
 		b.login.Verbose = true
 	}
+	b.loadTemplates(topDir + "/tmpl/")
+	b.makeNameCaches()
+	b.Context, b.Cancel = context.WithCancel(context.Background())
+	b.Server = &http.Server{Addr: ":" + b.port}
+}
+
+// Read all the templates in the directory "tmplDir".
+func (b *Bagapp) loadTemplates(tmplDir string) {
 	b.templates = template.New("bagzulla")
-	customFunctions := template.FuncMap{"GetArray": GetArray}
+	customFunctions := template.FuncMap{
+		"GetArray": GetArray,
+		// This is replaced in the copies for requests by Bagreply.inbox.
+		"inbox": func() int64 { return 0 },
+		"projectState": func(status int64) projectState {
+			return projectState(status).known()
+		},
+		// This is replaced in the copies for requests by csrfInput.
+		"csrf": func() string { return "" },
+	}
 	b.templates.Funcs(customFunctions)
-	tmplDir := topDir + "/tmpl/"
 	template.Must(b.templates.ParseGlob(tmplDir + "*.html"))
-	b.Context, b.Cancel = context.WithCancel(context.Background())
-	b.Server = &http.Server{Addr: ":" + b.port}
+	b.freeTemplates = make(chan *requestTemplates, freeTemplatesMax)
 }
 
 type hand struct {
 	path   string
 	handle func(b *Bagreply)
+	// The role needed in at least one project to use the handler.
+	perm role
+	// Does the handler only change things, so that it accepts only
+	// POST requests?
+	post bool
+}
+
+func (h hand) handler(ba *Bagapp) http.HandlerFunc {
+	fn := makeHandler(ba, h.handle, h.perm)
+	if h.post {
+		return postOnly(fn)
+	}
+	return fn
 }
 
 var hands = []hand{
-	{"/", topHandler},
-	{"/add-auto-bug/", addAutoBugHandler},
-	{"/add-bug-to-part/", addBugToPartHandler},
-	{"/add-bug-to-project/", addBugToProjectHandler},
-	{"/add-bug/", addBugHandler},
-	{"/add-part-to-project/", addPartToProjectHandler},
-	{"/add-project/", addProjectHandler},
-	{"/bug/", bugHandler},
-	{"/bugs/", allBugsHandler},
-	{"/change-bug-estimate/", changeBugEstimate},
-	{"/change-bug-part/", changeBugPartHandler},
-	{"/change-bug-priority/", changeBugPriority},
-	{"/change-bug-project/", changeBugProjectHandler},
-	{"/change-bug-status/", changeBugStatus},
-	{"/change-project-directory/", changeProjectDirectory},
-	{"/controls/", controls},
-	{"/delete-dependency/", deleteDependency},
-	{"/delete-duplicate/", deleteDuplicate},
-	{"/delete-image/", deleteImage},
-	{"/delete-part/", deletePart},
-	{"/edit-bug-description/", editBugDescription},
-	{"/edit-comment/", editComment},
-	{"/edit-dependencies/", editDependencies},
-	{"/edit-duplicates/", editDuplicates},
-	{"/edit-part-description/", editPartDescription},
-	{"/edit-part-name/", editPartName},
-	{"/edit-project-description/", editProjectDescription},
-	{"/edit-project-name/", editProjectName},
-	{"/edit/", edit},
-	{"/login/", loginHandler},
-	{"/logout/", logoutHandler},
-	{"/open-bugs/", openBugsHandler},
-	{"/part-all/", showPartAll},
-	{"/part/", showPart},
-	{"/person/", showPerson},
-	{"/project-all/", showProjectAllBugs},
-	{"/project-parts/", projectParts},
-	{"/project/", showProject},
-	{"/projects/", listProjects},
-	{"/random-open/", randomOpen},
-	{"/recent/", recent},
-	{"/save/", save},
-	{"/search/", search},
-	{"/upload/", upload},
+	{"/", topHandler, roleViewer, false},
+	{"/add-auto-bug/", addAutoBugHandler, roleReporter, false},
+	{"/add-bug-to-part/", addBugToPartHandler, roleReporter, false},
+	{"/add-bug-to-project/", addBugToProjectHandler, roleReporter, false},
+	{"/add-bug/", addBugHandler, roleReporter, false},
+	{"/add-part-to-project/", addPartToProjectHandler, roleDeveloper, false},
+	{"/add-project/", addProjectHandler, roleAdmin, false},
+	{"/archived-projects/", archivedProjects, roleViewer, false},
+	{"/attachment-thumb/", attachmentThumbHandler, roleViewer, false},
+	{"/attachment/", attachmentHandler, roleViewer, false},
+	{"/auth-events/", authEventsHandler, roleAdmin, false},
+	{"/bug/", bugHandler, roleViewer, false},
+	{"/bugs/", allBugsHandler, roleViewer, false},
+	{"/change-bug-estimate/", changeBugEstimate, roleDeveloper, false},
+	{"/change-bug-part/", changeBugPartHandler, roleDeveloper, false},
+	{"/change-bug-priority/", changeBugPriority, roleDeveloper, false},
+	{"/change-bug-project/", changeBugProjectHandler, roleDeveloper, false},
+	{"/change-bug-status/", changeBugStatus, roleDeveloper, false},
+	{"/change-part-parent/", changePartParent, roleDeveloper, true},
+	{"/change-project-directory/", changeProjectDirectory, roleDeveloper, false},
+	{"/controls/", controls, roleAdmin, false},
+	{"/delete-attachment/", deleteAttachment, roleReporter, true},
+	{"/delete-bug/", deleteBug, roleDeveloper, true},
+	{"/delete-comment/", deleteComment, roleReporter, true},
+	{"/delete-dependency/", deleteDependency, roleDeveloper, true},
+	{"/delete-duplicate/", deleteDuplicate, roleDeveloper, true},
+	{"/delete-image/", deleteImage, roleReporter, true},
+	{"/delete-part/", deletePart, roleDeveloper, true},
+	{"/delete-project/", deleteProject, roleAdmin, true},
+	{"/edit-bug-description/", editBugDescription, roleDeveloper, false},
+	{"/edit-comment/", editComment, roleReporter, false},
+	{"/edit-dependencies/", editDependencies, roleDeveloper, false},
+	{"/edit-duplicates/", editDuplicates, roleDeveloper, false},
+	{"/edit-part-description/", editPartDescription, roleDeveloper, false},
+	{"/edit-part-name/", editPartName, roleDeveloper, false},
+	{"/edit-project-description/", editProjectDescription, roleDeveloper, false},
+	{"/edit-project-name/", editProjectName, roleDeveloper, false},
+	{"/edit/", edit, roleDeveloper, false},
+	{"/feed/", feedHandler, roleViewer, false},
+	{"/image/", imageHandler, roleViewer, false},
+	{"/login/", loginHandler, roleViewer, false},
+	{"/sessions/", sessionsHandler, roleViewer, false},
+	{"/logout/", logoutHandler, roleViewer, true},
+	{"/move-part/", movePart, roleDeveloper, true},
+	{"/open-bugs/", openBugsHandler, roleViewer, false},
+	{"/part-all/", showPartAll, roleViewer, false},
+	{"/part/", showPart, roleViewer, false},
+	{"/person/", showPerson, roleViewer, false},
+	{"/project-all/", showProjectAllBugs, roleViewer, false},
+	{"/project-parts/", projectParts, roleViewer, false},
+	{"/project-state/", changeProjectState, roleAdmin, true},
+	{"/project/", showProject, roleViewer, false},
+	{"/projects/", listProjects, roleViewer, false},
+	{"/random-open/", randomOpen, roleViewer, false},
+	{"/recent/", recent, roleViewer, false},
+	{"/register/", registerHandler, roleViewer, false},
+	{"/registrations/", registrationsHandler, roleAdmin, false},
+	{"/save/", save, roleDeveloper, true},
+	{"/search/", search, roleViewer, false},
+	{"/set-inbox/", setInbox, roleAdmin, true},
+	{"/triage/", triageHandler, roleDeveloper, false},
+	{"/trash/", trashHandler, roleAdmin, false},
+	// uploadJSON checks the role itself, so that the errors are in
+	// JSON.
+	{"/upload-json/", uploadJSON, roleViewer, true},
+	{"/upload/", upload, roleReporter, true},
+	{"/verify/", verifyHandler, roleViewer, false},
 }
 
 var debugLogin = false
@@ -2870,13 +3372,25 @@ func main() {
 	var b Bagapp
 	b.Init()
 	defer b.db.Close()
+	if b.migrateOnly {
+		return
+	}
+	if b.ingestMail {
+		err := b.readMailInput(os.Stdin, b.recipient)
+		// Let the webhooks finish before exiting.
+		b.hooks.Wait()
+		if err != nil {
+			log.Fatalf("Error ingesting mail: %s", err)
+		}
+		return
+	}
 	for _, h := range hands {
-		http.HandleFunc(h.path, makeHandler(&b, h.handle))
+		http.HandleFunc(h.path, h.handler(&b))
 	}
 	// This does not serve gzip content or text/html content, so it
 	// does not use the "makeHandler" subroutine.
-	http.HandleFunc("/image/", imageHandler)
 	http.Handle("/static/", http.FileServer(http.Dir(topDir)))
+	go b.sessionSweeper()
 	go func() {
 		err := b.Server.ListenAndServe()
 		switch err {
@@ -0,0 +1,35 @@
+package bagzullaDb
+
+// The names of the numbers and words kept in the database, which
+// both the server and the command-line client use. The statuses of
+// bugs are made from statuses.txt.
+
+// The priorities which a bug may have, kept in bug.priority. The
+// default is "unknown".
+var Priorities = []string{
+	"unknown",
+	"top",
+	"high",
+	"medium",
+	"low",
+	"unimportant",
+}
+
+// The roles of people, kept in person.role and grant.role, from the
+// one which can do the least to the one which can do the most. "none"
+// is never kept, but is the role of someone who cannot see a project.
+var Roles = []string{
+	"none",
+	"viewer",
+	"reporter",
+	"developer",
+	"admin",
+}
+
+// The states of projects, kept in project.status.
+var ProjectStates = []string{
+	"active",
+	"cancelled",
+	"frozen",
+	"archived",
+}
@@ -0,0 +1,208 @@
+package bagzullaDb
+
+/* The roles of people in projects, which both the server and the
+   command-line client use to decide what someone may do.
+
+   Each person has a role which applies to all projects which are not
+   private. A person may also be granted a role in a particular
+   project, which applies instead of their own role in that project.
+   Private projects can only be seen by admins and people with a
+   grant in the project. People who are not logged in are viewers of
+   the projects which are not private. */
+
+import (
+	"fmt"
+)
+
+// A role, which is its position in Roles.
+type Role int
+
+const (
+	// Cannot see the project at all.
+	RoleNone Role = iota
+	// Can look at bugs.
+	RoleViewer
+	// Can also add bugs, comments and images.
+	RoleReporter
+	// Can also change and delete bugs and parts.
+	RoleDeveloper
+	// Can do anything, including making projects, changing people's
+	// roles and stopping the server.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(Roles) {
+		return "unknown"
+	}
+	return Roles[r]
+}
+
+func RoleFromName(name string) (r Role, ok bool) {
+	for i, n := range Roles {
+		if n == name {
+			return Role(i), true
+		}
+	}
+	return RoleNone, false
+}
+
+// What is known about the permissions of one person.
+type Permissions struct {
+	// The person's own role.
+	Role Role
+	// The roles granted to the person in particular projects.
+	Grants map[int64]Role
+	// The IDs of the private projects.
+	Private map[int64]bool
+	// The IDs of the projects in the trash, which nobody can see.
+	Deleted map[int64]bool
+	// The IDs of the archived projects, which nobody can change.
+	Archived map[int64]bool
+	// The ID of the inbox project, or zero if there is none.
+	Inbox int64
+}
+
+var personRoleSql = `SELECT role FROM person WHERE person_id = ?`
+var personRoleQuery = NewQuery(personRoleSql)
+var personGrantsSql = `SELECT project_id, role FROM grant WHERE person_id = ?`
+var personGrantsQuery = NewQuery(personGrantsSql)
+var projectFlagsSql = fmt.Sprintf(`SELECT project_id, private != 0, deleted IS NOT NULL,
+IFNULL(status, 0) = %[1]d, inbox != 0
+FROM project WHERE private != 0 OR deleted IS NOT NULL OR status = %[1]d OR inbox != 0`,
+	projectArchived)
+var projectFlagsQuery = NewQuery(projectFlagsSql)
+
+// The number kept in project.status for archived projects.
+var projectArchived = func() int {
+	for i, s := range ProjectStates {
+		if s == "archived" {
+			return i
+		}
+	}
+	return -1
+}()
+
+// The role kept in person.role of the person with ID "personId".
+func PersonRole(s *Store, personId int64) (r Role, err error) {
+	var name string
+	err = s.Stmt(personRoleQuery).QueryRow(personId).Scan(&name)
+	if err != nil {
+		return RoleNone, err
+	}
+	r, _ = RoleFromName(name)
+	return r, nil
+}
+
+// The roles granted to the person with ID "personId", by project ID.
+func PersonGrants(s *Store, personId int64) (grants map[int64]Role, err error) {
+	grants = make(map[int64]Role)
+	rows, err := s.Stmt(personGrantsQuery).Query(personId)
+	if err != nil {
+		return grants, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var projectId int64
+		var name string
+		err = rows.Scan(&projectId, &name)
+		if err != nil {
+			return grants, err
+		}
+		grants[projectId], _ = RoleFromName(name)
+	}
+	return grants, rows.Err()
+}
+
+// Read which projects are private, in the trash or archived, and
+// which is the inbox, into "p".
+func (p *Permissions) projectFlags(s *Store) error {
+	p.Private = make(map[int64]bool)
+	p.Deleted = make(map[int64]bool)
+	p.Archived = make(map[int64]bool)
+	rows, err := s.Stmt(projectFlagsQuery).Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var projectId int64
+		var isPrivate, isDeleted, isArchived, isInbox bool
+		err = rows.Scan(&projectId, &isPrivate, &isDeleted, &isArchived, &isInbox)
+		if err != nil {
+			return err
+		}
+		if isPrivate {
+			p.Private[projectId] = true
+		}
+		if isDeleted {
+			p.Deleted[projectId] = true
+		}
+		if isArchived {
+			p.Archived[projectId] = true
+		}
+		if isInbox {
+			p.Inbox = projectId
+		}
+	}
+	return rows.Err()
+}
+
+// Read the permissions of the person with ID "personId", or of
+// someone who is not logged in if "personId" is zero.
+func ReadPermissions(s *Store, personId int64) (p Permissions, err error) {
+	p.Role = RoleViewer
+	err = p.projectFlags(s)
+	if err != nil {
+		return p, err
+	}
+	if personId == 0 {
+		return p, nil
+	}
+	p.Role, err = PersonRole(s, personId)
+	if err != nil {
+		return p, err
+	}
+	p.Grants, err = PersonGrants(s, personId)
+	return p, err
+}
+
+// The role of the person in the project with ID "projectId". If
+// "projectId" is zero, this is the person's highest role in any
+// project. Nobody has a role in a project in the trash, and nobody
+// is more than a viewer in an archived project.
+func (p *Permissions) RoleIn(projectId int64) Role {
+	if p.Deleted[projectId] {
+		return RoleNone
+	}
+	r := p.unarchivedRole(projectId)
+	if p.Archived[projectId] && r > RoleViewer {
+		r = RoleViewer
+	}
+	return r
+}
+
+// The role of the person in the project with ID "projectId" if it is
+// not archived.
+func (p *Permissions) unarchivedRole(projectId int64) Role {
+	if p.Role == RoleAdmin {
+		return RoleAdmin
+	}
+	if projectId == 0 {
+		r := p.Role
+		for _, g := range p.Grants {
+			if g > r {
+				r = g
+			}
+		}
+		return r
+	}
+	g, granted := p.Grants[projectId]
+	if granted {
+		return g
+	}
+	if p.Private[projectId] {
+		return RoleNone
+	}
+	return p.Role
+}
@@ -0,0 +1,171 @@
+package bagzullaDb
+
+//go:generate go run ../cmd/dbgen -o bagzullaDb.go ../schema.txt bug project project_event part gitcommit comment image person dependency duplicate txt
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A query which every Store prepares when it is made.
+type Query struct {
+	Sql   string
+	index int
+}
+
+// All the queries made with NewQuery.
+var queries []*Query
+
+// Add a query to the ones which stores prepare. This is for the
+// package-level variables, so that all of the queries are known
+// before any store is made.
+func NewQuery(sql string) *Query {
+	q := &Query{Sql: sql, index: len(queries)}
+	queries = append(queries, q)
+	return q
+}
+
+// The prepared statements of a database.
+type statements struct {
+	list []*sql.Stmt
+	// The statements for queries which are made while running,
+	// such as lists of bugs sorted in different ways.
+	mutex   sync.Mutex
+	dynamic map[string]*sql.Stmt
+}
+
+// A database with its statements prepared, or a transaction of it.
+type Store struct {
+	DB    *sql.DB
+	tx    *sql.Tx
+	stmts *statements
+}
+
+// Open the SQLite database in "file". Transactions take the lock for
+// writing when they begin, rather than at their first write, so that
+// two transactions which both read and then write cannot deadlock.
+func Open(file string) (*sql.DB, error) {
+	return sql.Open("sqlite3", file+"?_txlock=immediate")
+}
+
+// Prepare all of the queries for "db".
+func NewStore(db *sql.DB) (s *Store, err error) {
+	s = &Store{
+		DB: db,
+		stmts: &statements{
+			list:    make([]*sql.Stmt, 0, len(queries)),
+			dynamic: make(map[string]*sql.Stmt),
+		},
+	}
+	for _, q := range queries {
+		stmt, err := db.Prepare(q.Sql)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Error preparing %s: %s", q.Sql, err)
+		}
+		s.stmts.list = append(s.stmts.list, stmt)
+	}
+	return s, nil
+}
+
+// The prepared statement of "q", in the transaction if "s" is one.
+func (s *Store) Stmt(q *Query) *sql.Stmt {
+	stmt := s.stmts.list[q.index]
+	if s.tx != nil {
+		return s.tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+// The prepared statement of "query", which is prepared the first
+// time it is asked for.
+func (s *Store) Prepared(query string) (stmt *sql.Stmt, err error) {
+	st := s.stmts
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	stmt = st.dynamic[query]
+	if stmt == nil {
+		stmt, err = s.DB.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		st.dynamic[query] = stmt
+	}
+	if s.tx != nil {
+		return s.tx.Stmt(stmt), nil
+	}
+	return stmt, nil
+}
+
+func (s *Store) InTx() bool {
+	return s.tx != nil
+}
+
+// Start a transaction, which has the same statements as "s".
+func (s *Store) Begin() (*Store, error) {
+	if s.tx != nil {
+		return nil, errors.New("Already in a transaction")
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Store{DB: s.DB, tx: tx, stmts: s.stmts}, nil
+}
+
+func (s *Store) Commit() error {
+	if s.tx == nil {
+		return errors.New("Not in a transaction")
+	}
+	return s.tx.Commit()
+}
+
+func (s *Store) Rollback() error {
+	if s.tx == nil {
+		return errors.New("Not in a transaction")
+	}
+	return s.tx.Rollback()
+}
+
+// Run "f" in a transaction, which is committed if "f" returns nil
+// and rolled back otherwise. If "s" is already a transaction, "f" runs
+// in it, and the caller commits it or rolls it back.
+func (s *Store) Transact(f func(tx *Store) error) (err error) {
+	if s.tx != nil {
+		return f(s)
+	}
+	tx, err := s.Begin()
+	if err != nil {
+		return err
+	}
+	done := false
+	defer func() {
+		if !done {
+			tx.Rollback()
+		}
+	}()
+	err = f(tx)
+	done = true
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close the statements, but not the database. This is for the store
+// made by NewStore, not its transactions.
+func (s *Store) Close() {
+	st := s.stmts
+	for _, stmt := range st.list {
+		stmt.Close()
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for query, stmt := range st.dynamic {
+		stmt.Close()
+		delete(st.dynamic, query)
+	}
+}
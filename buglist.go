@@ -0,0 +1,384 @@
+package main
+
+/* Lists of bugs for the pages and feeds. Each bug is read together with
+   its title and description and the names of its project, part and
+   owner in one query, rather than looking these up one by one for each
+   bug of the list. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+var listBugsSql = `SELECT bug.bug_id, bug.title, bug.description,
+bug.project_id, bug.part_id, bug.entered, bug.owner, bug.status,
+bug.priority, bug.changed, bug.estimate,
+IFNULL(title.content, ''), IFNULL(description.content, ''),
+IFNULL(project.name, ''), IFNULL(part.name, ''), IFNULL(person.name, ''),
+IFNULL(project.inbox, 0) != 0
+FROM bug
+LEFT JOIN txt AS title ON title.txt_id = bug.title
+LEFT JOIN txt AS description ON description.txt_id = bug.description
+LEFT JOIN project ON project.project_id = bug.project_id
+LEFT JOIN part ON part.part_id = bug.part_id
+LEFT JOIN person ON person.person_id = bug.owner
+`
+
+// The columns which lists can be sorted by, and how.
+var bugSorts = map[string]string{
+	"id":       "bug.bug_id",
+	"title":    "title.content COLLATE NOCASE",
+	"status":   "bug.status",
+	"priority": "bug.priority",
+	"project":  "project.name COLLATE NOCASE",
+	"part":     "part.name COLLATE NOCASE",
+	"owner":    "person.name COLLATE NOCASE",
+	"entered":  "bug.entered",
+	"changed":  "bug.changed",
+}
+
+// The ways of choosing and ordering the bugs of a list.
+type bugList struct {
+	// The conditions on the table "bug", or the empty string for
+	// all bugs.
+	where string
+	// The column of bugSorts to sort by.
+	sort string
+	desc bool
+	// The most bugs to get, or zero for all of them, after skipping
+	// "offset" bugs.
+	limit  int64
+	offset int64
+}
+
+func (l bugList) whereSql() string {
+	if l.where == "" {
+		return ""
+	}
+	return "WHERE " + l.where + "\n"
+}
+
+func (l bugList) sql() string {
+	s := listBugsSql + l.whereSql()
+	order := bugSorts[l.sort]
+	if order == "" {
+		order = bugSorts["id"]
+	}
+	dir := ""
+	if l.desc {
+		dir = " DESC"
+	}
+	// Bugs with no priority go last either way.
+	if l.sort == "priority" {
+		s += "ORDER BY bug.priority = 0, "
+	} else {
+		s += "ORDER BY "
+	}
+	// Sort equal bugs by ID so that the pages do not overlap.
+	s += order + dir + ", bug.bug_id" + dir + "\n"
+	if l.limit > 0 {
+		s += "LIMIT ? OFFSET ?\n"
+	}
+	return s
+}
+
+// The number of bugs in list "l", ignoring the limit.
+func countBugList(store *bagzullaDb.Store, l bugList, args ...interface{}) (count int64, err error) {
+	stmt, err := store.Prepared("SELECT COUNT(*) FROM bug\n" + l.whereSql())
+	if err != nil {
+		return 0, err
+	}
+	err = stmt.QueryRow(args...).Scan(&count)
+	return count, err
+}
+
+// Get the bugs of list "l". The arguments are for the placeholders of
+// the conditions.
+func loadBugList(store *bagzullaDb.Store, l bugList, args ...interface{}) (bugs []ListBug, err error) {
+	stmt, err := store.Prepared(l.sql())
+	if err != nil {
+		return nil, err
+	}
+	if l.limit > 0 {
+		args = append(args, l.limit, l.offset)
+	}
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lb ListBug
+		var estimate sql.NullInt64
+		bug := &lb.Bug
+		err = rows.Scan(&bug.BugId, &bug.Title, &bug.Description,
+			&bug.ProjectId, &bug.PartId, &bug.Entered, &bug.Owner,
+			&bug.Status, &bug.Priority, &bug.Changed, &estimate,
+			&lb.Title, &lb.Description, &lb.ProjectName, &lb.PartName,
+			&lb.Owner, &lb.inInbox)
+		if err != nil {
+			return bugs, err
+		}
+		if estimate.Valid {
+			bug.Estimate = estimate.Int64
+		}
+		lb.setFields()
+		bugs = append(bugs, lb)
+	}
+	return bugs, rows.Err()
+}
+
+// Fill in the fields of "lb" which come from the fields of the bug.
+func (lb *ListBug) setFields() {
+	bug := lb.Bug
+	lb.DisplayTitle = html.EscapeString(lb.Title)
+	if !lb.inInbox {
+		lb.ProjectId = bug.ProjectId
+	} else {
+		lb.ProjectName = ""
+	}
+	if bug.PartId == 0 {
+		lb.PartName = ""
+	}
+	if bug.Owner == 0 {
+		lb.Owner = "None"
+	}
+	lb.Status = statuses[bug.Status]
+	lb.Priority = priorities[bug.Priority]
+	lb.Estimate = "unknown"
+	if bug.Estimate > 0 {
+		lb.Estimate = fmt.Sprintf("%d minutes", bug.Estimate)
+	}
+}
+
+// The condition for the bugs which the user can see, as for canSee,
+// and which are not in the trash. The arguments are whether the user
+// is an admin, their ID, and whether they can see the projects which
+// are not private.
+var visibleBugsSql = `bug.deleted IS NULL
+AND bug.project_id NOT IN (SELECT project_id FROM project WHERE deleted IS NOT NULL)
+AND (? OR bug.project_id IN (SELECT project_id FROM grant WHERE person_id = ?)
+OR (? AND bug.project_id NOT IN (SELECT project_id FROM project WHERE private != 0)))`
+
+// Restrict list "l" with arguments "args" to the bugs which the user
+// can see.
+func (b *Bagreply) visibleBugList(l bugList, args []interface{}) (bugList, []interface{}) {
+	p := b.getPermissions()
+	var personId int64
+	if b.User != nil {
+		personId = b.User.PersonId
+	}
+	if l.where == "" {
+		l.where = visibleBugsSql
+	} else {
+		l.where = "(" + l.where + ") AND " + visibleBugsSql
+	}
+	args = append(args[:len(args):len(args)], p.Role == roleAdmin, personId, p.Role >= roleViewer)
+	return l, args
+}
+
+// Get the bugs of list "l" which the user can see. If "ok" is false,
+// an error page has been sent.
+func (b *Bagreply) bugList(l bugList, args ...interface{}) (bugs []ListBug, ok bool) {
+	l, args = b.visibleBugList(l, args)
+	all, err := loadBugList(b.data(), l, args...)
+	if err != nil {
+		b.errorPage("Error getting a list of bugs: %s", err)
+		return nil, false
+	}
+	for _, lb := range all {
+		if b.canSee(lb.Bug.ProjectId) {
+			lb.User = b.User
+			bugs = append(bugs, lb)
+		}
+	}
+	return bugs, true
+}
+
+// The number of bugs a page of a list has, unless the request asks
+// for another number, and the most it can ask for.
+const defaultPageSize = 100
+const maxPageSize = 1000
+
+// Which page of a list is shown and how it is sorted, from the query
+// "?sort=title&dir=desc&page=2&size=50" of the request.
+type bugPaging struct {
+	// The column of bugSorts
+	Sort string
+	Desc bool
+	// The number of the page, from one.
+	Page int64
+	// The number of bugs on each page.
+	Size int64
+	// The number of bugs in the whole list.
+	Total int64
+	// The size when the query has none, which is left out of the
+	// links.
+	defaultSize int64
+	// The rest of the query, which the links keep.
+	keep url.Values
+}
+
+// The sorting of the pages from before there were queries, like
+// /open-bugs/priority.
+var sortOrder = regexp.MustCompile("/(priority|id|changed)$")
+
+// Read the page and sorting of list "l" from the request. "size" is
+// the default size of a page.
+func (b *Bagreply) readPaging(l bugList, size int64) (p bugPaging, ok bool) {
+	p = bugPaging{Sort: l.sort, Desc: l.desc, Page: 1, Size: size, defaultSize: size}
+	q := b.r.URL.Query()
+	if sort := q.Get("sort"); sort != "" {
+		if bugSorts[sort] == "" {
+			b.w.WriteHeader(http.StatusBadRequest)
+			b.errorPage("Bugs cannot be sorted by %s", html.EscapeString(sort))
+			return p, false
+		}
+		p.Sort = sort
+		p.Desc = q.Get("dir") == "desc"
+	} else if m := sortOrder.FindStringSubmatch(b.r.URL.Path); m != nil {
+		p.Sort = m[1]
+		p.Desc = m[1] != "priority"
+	}
+	for _, n := range []struct {
+		name  string
+		value *int64
+		max   int64
+	}{
+		{"page", &p.Page, math.MaxInt64 / maxPageSize},
+		{"size", &p.Size, maxPageSize},
+	} {
+		text := q.Get(n.name)
+		if text == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || v < 1 {
+			b.w.WriteHeader(http.StatusBadRequest)
+			b.errorPage("Bad %s number %s", n.name, html.EscapeString(text))
+			return p, false
+		}
+		if v > n.max {
+			v = n.max
+		}
+		*n.value = v
+	}
+	return p, true
+}
+
+// The query for page "page" of the list sorted by "sort".
+func (p *bugPaging) query(sort string, desc bool, page int64) string {
+	v := url.Values{}
+	for name, values := range p.keep {
+		v[name] = values
+	}
+	v.Set("sort", sort)
+	if desc {
+		v.Set("dir", "desc")
+	}
+	if page > 1 {
+		v.Set("page", fmt.Sprint(page))
+	}
+	if p.Size != p.defaultSize {
+		v.Set("size", fmt.Sprint(p.Size))
+	}
+	return html.EscapeString("?" + v.Encode())
+}
+
+// A link for the header of column "column" of the list, which sorts
+// the list by the column, or the other way if it is already sorted by
+// the column.
+func (p *bugPaging) SortLink(column string, label string) string {
+	// Show the newest first.
+	desc := column == "changed" || column == "entered"
+	mark := ""
+	if column == p.Sort {
+		desc = !p.Desc
+		mark = " ▲"
+		if p.Desc {
+			mark = " ▼"
+		}
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>%s`, p.query(column, desc, 1), label, mark)
+}
+
+// The number of pages.
+func (p *bugPaging) Pages() int64 {
+	return (p.Total + p.Size - 1) / p.Size
+}
+
+// The position in the list of the first bug of the page.
+func (p *bugPaging) From() int64 {
+	return (p.Page-1)*p.Size + 1
+}
+
+// The position in the list of the last bug of the page.
+func (p *bugPaging) To() int64 {
+	to := p.Page * p.Size
+	if to > p.Total {
+		to = p.Total
+	}
+	return to
+}
+
+func (p *bugPaging) PrevURL() string {
+	if p.Page <= 1 {
+		return ""
+	}
+	return p.query(p.Sort, p.Desc, p.Page-1)
+}
+
+func (p *bugPaging) NextURL() string {
+	if p.Page >= p.Pages() {
+		return ""
+	}
+	return p.query(p.Sort, p.Desc, p.Page+1)
+}
+
+// Get the page of list "l" which the request asks for. "size" is the
+// default size of the page.
+func (b *Bagreply) bugListPage(l bugList, size int64, args ...interface{}) (bugs []ListBug, p *bugPaging, ok bool) {
+	paging, ok := b.readPaging(l, size)
+	if !ok {
+		return nil, nil, false
+	}
+	l.sort = paging.Sort
+	l.desc = paging.Desc
+	l.limit = paging.Size
+	l.offset = (paging.Page - 1) * paging.Size
+	visible, visibleArgs := b.visibleBugList(l, args)
+	var err error
+	paging.Total, err = countBugList(b.data(), visible, visibleArgs...)
+	if err != nil {
+		b.errorPage("Error counting a list of bugs: %s", err)
+		return nil, nil, false
+	}
+	bugs, ok = b.bugList(l, args...)
+	return bugs, &paging, ok
+}
+
+// Some lists which are used on several pages.
+var (
+	allBugList         = bugList{sort: "id"}
+	openBugList        = bugList{where: "bug.status = 0", sort: "changed", desc: true}
+	projectBugList     = bugList{where: "bug.project_id = ?", sort: "id"}
+	openProjectBugList = bugList{where: "bug.project_id = ? AND bug.status = 0", sort: "changed", desc: true}
+	partBugList        = bugList{where: "bug.part_id = ?", sort: "id"}
+	openPartBugList    = bugList{where: "bug.part_id = ? AND bug.status = 0", sort: "changed", desc: true}
+	ownerBugList       = bugList{where: "bug.owner = ?", sort: "id"}
+)
+
+// The bug lists of the feeds, which are limited to feedLength bugs.
+var feedBugLists = map[string]bugList{
+	"recent":  {sort: "changed", desc: true},
+	"project": {where: "bug.project_id = ?", sort: "changed", desc: true},
+	"part":    {where: "bug.part_id = ?", sort: "changed", desc: true},
+	"person":  {where: "bug.owner = ?", sort: "changed", desc: true},
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBugList(t *testing.T) {
+	ba := getTestApp(t)
+	partId, err := ba.data.InsertPart(bagzullaDb.Part{Name: "Lists", ProjectId: 2, Description: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for i, bug := range []struct {
+		project, part, owner int64
+	}{
+		{2, partId, 2},
+		{2, 0, 1},
+		// The inbox of the seed.
+		{1, 0, 0},
+	} {
+		id, err := addBug(ba.data, fmt.Sprintf("List <%d>", i), "Listed", bug.project, bug.part, bug.owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	_, err = ba.db.Exec(`UPDATE bug SET estimate = 30 WHERE bug_id = ?`, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bugs, err := loadBugList(ba.data, bugList{where: "bug.bug_id IN (?, ?, ?)", sort: "id"},
+		ids[0], ids[1], ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bugs) != 3 {
+		t.Fatalf("Got %d bugs", len(bugs))
+	}
+	// The list gives the same as looking up each bug.
+	b := &Bagreply{App: ba, w: httptest.NewRecorder(), r: httptest.NewRequest("GET", "/", nil)}
+	for i, lb := range bugs {
+		bug, err := ba.data.BugFromId(ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := getBugInfo(b, bug)
+		if !ok {
+			t.Fatalf("getBugInfo failed for %d", ids[i])
+		}
+		// The times come back from the database in UTC.
+		want.Bug.Entered = lb.Bug.Entered
+		want.Bug.Changed = lb.Bug.Changed
+		if !reflect.DeepEqual(want, lb) {
+			t.Errorf("List has\n%+v\nnot\n%+v", lb, want)
+		}
+	}
+	if bugs[0].PartName != "Lists" || bugs[0].Owner != "tony" ||
+		bugs[0].ProjectName != "Bagzulla" || bugs[0].Estimate != "30 minutes" ||
+		bugs[0].DisplayTitle != "List &lt;0&gt;" {
+		t.Errorf("Bad first bug %+v", bugs[0])
+	}
+	if bugs[2].ProjectName != "" || bugs[2].Owner != "None" {
+		t.Errorf("Bad bug with no project %+v", bugs[2])
+	}
+	limited, err := loadBugList(ba.data, bugList{sort: "id", desc: true, limit: 2})
+	if err != nil || len(limited) != 2 || limited[0].Bug.BugId != ids[2] {
+		t.Errorf("Limited list gave %d bugs: %v", len(limited), err)
+	}
+}
+
+func TestNameCache(t *testing.T) {
+	ba := getTestApp(t)
+	result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status) VALUES('Before', '', 1, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId, _ := result.LastInsertId()
+	b := &Bagreply{App: ba, w: httptest.NewRecorder(), r: httptest.NewRequest("GET", "/", nil)}
+	name, ok := getProjectName(b, projectId)
+	if !ok || name != "Before" {
+		t.Fatalf("Name is %q", name)
+	}
+	// Look up the name while it changes.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := &Bagreply{App: ba, w: httptest.NewRecorder(), r: httptest.NewRequest("GET", "/", nil)}
+			for j := 0; j < 50; j++ {
+				getProjectName(b, projectId)
+			}
+		}()
+	}
+	tony, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", fmt.Sprintf("/edit-project-name/%d", projectId),
+		strings.NewReader("project-name=After"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+tony)
+	makeHandler(ba, editProjectName, roleDeveloper)(httptest.NewRecorder(), r)
+	wg.Wait()
+	name, ok = getProjectName(b, projectId)
+	if !ok || name != "After" {
+		t.Errorf("After renaming, the name is %q", name)
+	}
+
+	// A name read before a change is not kept.
+	c := newNameCache()
+	_, _, changes := c.get(1)
+	c.forget(1)
+	c.add(1, "old", changes)
+	if _, found, _ := c.get(1); found {
+		t.Errorf("Name from before a change was kept")
+	}
+}
+
+// A database with 50,000 bugs for the benchmarks.
+var benchStore *bagzullaDb.Store
+var benchDbOnce sync.Once
+
+func TestBugListPages(t *testing.T) {
+	ba := getTestApp(t)
+	var projects []int64
+	for _, p := range []struct {
+		name    string
+		private int
+	}{{"Paged", 0}, {"Paged privately", 1}} {
+		result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status, private)
+VALUES(?, '', 1, 2, 0, ?)`, p.name, p.private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		projects = append(projects, id)
+	}
+	titles := []string{"delta", "Alpha", "echo", "charlie", "bravo"}
+	for i, title := range titles {
+		id, err := addBug(ba.data, title, "Paged", projects[0], 0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ba.db.Exec(`UPDATE bug SET priority = ? WHERE bug_id = ?`, i%3, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, title := range []string{"secret", "hidden"} {
+		_, err := addBug(ba.data, title, "Paged", projects[1], 0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES('paige', 'paige@localhost', 'x', 'viewer')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paigeId, _ := result.LastInsertId()
+	paige, err := ba.data.PersonFromId(paigeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tony, err := ba.data.PersonFromId(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ba.db.Exec(`INSERT INTO grant(person_id, project_id, role) VALUES(2, ?, 'developer')`, projects[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := bugList{where: "bug.project_id IN (?, ?)", sort: "id"}
+	tests := []struct {
+		user  *bagzullaDb.Person
+		query string
+		total int64
+		want  []string
+	}{
+		{&tony, "?sort=title&size=2", 7, []string{"Alpha", "bravo"}},
+		{&tony, "?sort=title&dir=desc&size=3&page=3", 7, []string{"Alpha"}},
+		{&paige, "?sort=title&size=2&page=2", 5, []string{"charlie", "delta"}},
+		// Unset priorities go last either way.
+		{&paige, "?sort=priority", 5, []string{"Alpha", "bravo", "echo", "delta", "charlie"}},
+		{&paige, "?sort=priority&dir=desc", 5, []string{"echo", "bravo", "Alpha", "charlie", "delta"}},
+		{&paige, "?size=2&page=4", 5, nil},
+	}
+	for _, test := range tests {
+		b := &Bagreply{App: ba, User: test.user, w: httptest.NewRecorder(),
+			r: httptest.NewRequest("GET", "/bugs/"+test.query, nil)}
+		bugs, paging, ok := b.bugListPage(list, defaultPageSize, projects[0], projects[1])
+		if !ok {
+			t.Fatalf("%s failed", test.query)
+		}
+		var got []string
+		for _, lb := range bugs {
+			got = append(got, lb.Title)
+		}
+		if paging.Total != test.total || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s for %s gave %d bugs %v, expected %d %v", test.query,
+				test.user.Name, paging.Total, got, test.total, test.want)
+		}
+	}
+
+	b := &Bagreply{App: ba, r: httptest.NewRequest("GET", "/bugs/?sort=title&dir=desc&size=2&page=2", nil)}
+	_, paging, _ := b.bugListPage(list, defaultPageSize, projects[0], projects[1])
+	if paging.PrevURL() != "?dir=desc&amp;size=2&amp;sort=title" ||
+		paging.NextURL() != "?dir=desc&amp;page=3&amp;size=2&amp;sort=title" {
+		t.Errorf("Bad links %s %s", paging.PrevURL(), paging.NextURL())
+	}
+	if link := paging.SortLink("title", "Title"); link != `<a href="?size=2&amp;sort=title">Title</a> ▼` {
+		t.Errorf("Bad sort link %s", link)
+	}
+	for _, query := range []string{"?sort=bug_id", "?sort=title%20DESC", "?page=0", "?size=x"} {
+		w := httptest.NewRecorder()
+		b := &Bagreply{App: ba, w: w, r: httptest.NewRequest("GET", "/bugs/"+query, nil)}
+		if _, _, ok := b.bugListPage(list, defaultPageSize, projects[0], projects[1]); ok || w.Code != 400 {
+			t.Errorf("%s gave %d", query, w.Code)
+		}
+	}
+}
+
+func getBenchStore(b *testing.B) *bagzullaDb.Store {
+	benchDbOnce.Do(func() {
+		db, err := sql.Open("sqlite3", filepath.Join(testDir, "bench.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = migrate(db)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		now := time.Now()
+		for i := 1; i <= 100; i++ {
+			tx.Exec(`INSERT INTO person(name, email) VALUES(?, ?)`,
+				fmt.Sprintf("p%d", i), fmt.Sprintf("p%d@localhost", i))
+			tx.Exec(`INSERT INTO project(name, description, owner) VALUES(?, 1, 1)`,
+				fmt.Sprintf("project %d", i))
+			tx.Exec(`INSERT INTO part(name, description, project_id) VALUES(?, 1, ?)`,
+				fmt.Sprintf("part %d", i), i)
+		}
+		for i := 0; i < 50000; i++ {
+			tx.Exec(`INSERT INTO txt(content, entered) VALUES(?, ?), (?, ?)`,
+				fmt.Sprintf("Bug %d", i), now, strings.Repeat("Description. ", 20), now)
+			_, err = tx.Exec(`INSERT INTO bug(title, description, project_id, part_id, entered,
+owner, status, priority, changed) VALUES(?, ?, ?, ?, ?, ?, ?, 0, ?)`,
+				2*i+1, 2*i+2, i%100+1, i%100+1, now, i%100+1, i%5, now)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchStore, err = bagzullaDb.NewStore(db)
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+	if benchStore == nil {
+		b.Fatal("No benchmark database")
+	}
+	return benchStore
+}
+
+// The list of open bugs, about 10,000 of the 50,000, in one query.
+func BenchmarkBugList(b *testing.B) {
+	store := getBenchStore(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bugs, err := loadBugList(store, openBugList)
+		if err != nil || len(bugs) != 10000 {
+			b.Fatalf("Got %d bugs: %v", len(bugs), err)
+		}
+	}
+}
+
+// The same list made by looking up the texts and names of each bug,
+// as the lists were made before.
+func BenchmarkBugListEachBug(b *testing.B) {
+	db := getBenchStore(b).DB
+	var stmts []*sql.Stmt
+	for _, s := range []string{
+		"SELECT content FROM txt WHERE txt_id = ?",
+		"SELECT name FROM project WHERE project_id = ?",
+		"SELECT name FROM part WHERE part_id = ?",
+		"SELECT name FROM person WHERE person_id = ?",
+	} {
+		stmt, err := db.Prepare(s)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer stmt.Close()
+		stmts = append(stmts, stmt)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rows, err := db.Query("SELECT " + bagzullaDb.BugFields + " FROM bug WHERE status = 0 ORDER BY changed DESC")
+		if err != nil {
+			b.Fatal(err)
+		}
+		bugs, err := bagzullaDb.BugsFromRows(rows)
+		rows.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var list []ListBug
+		for _, bug := range bugs {
+			lb := ListBug{Bug: bug}
+			stmts[0].QueryRow(bug.Title).Scan(&lb.Title)
+			stmts[0].QueryRow(bug.Description).Scan(&lb.Description)
+			stmts[1].QueryRow(bug.ProjectId).Scan(&lb.ProjectName)
+			stmts[2].QueryRow(bug.PartId).Scan(&lb.PartName)
+			stmts[3].QueryRow(bug.Owner).Scan(&lb.Owner)
+			lb.setFields()
+			list = append(list, lb)
+		}
+		if len(list) != 10000 {
+			b.Fatalf("Got %d bugs", len(list))
+		}
+	}
+}
@@ -0,0 +1,749 @@
+// Bag is a command-line client for Bagzulla. It works directly on
+// the SQLite database file of the tracker.
+
+// Usage:
+//
+//     bag [-d database] [-u user] [--json] command [arguments]
+//
+// The commands are
+//
+//     new -p project -t title [-m description] [--part part]
+//     show BUG
+//     comment BUG -m text
+//     close BUG [-s status] [-m text]
+//     list [--project project] [--status status] [--owner person]
+
+// Changes made with bag do not send webhooks, since those are sent by
+// the server.
+
+// Bag does not check passwords, so -u lets whoever runs it act as any
+// person. The roles stop mistakes, but anyone who can write to the
+// database file can change anything in it anyway, so only the people
+// who run the server should have access to it.
+
+// Bag needs bagzulla-status.go, which is made from statuses.txt by
+// scripts/make-statuses.pl and is not kept in git; "make bag" makes
+// it.
+
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type bagCmd struct {
+	db    *sql.DB
+	store *bagzullaDb.Store
+	// The name of the person using the command.
+	user string
+	// Print JSON rather than text.
+	json bool
+	// Where to print.
+	out io.Writer
+	// The permissions of the person using the command, which are
+	// read when they are first needed.
+	perms *bagzullaDb.Permissions
+}
+
+// A bug as it is printed out.
+type cmdBug struct {
+	Id          int64        `json:"id"`
+	Title       string       `json:"title"`
+	Description string       `json:"description,omitempty"`
+	Project     string       `json:"project"`
+	Part        string       `json:"part,omitempty"`
+	Status      string       `json:"status"`
+	Priority    string       `json:"priority"`
+	Owner       string       `json:"owner"`
+	Entered     time.Time    `json:"entered"`
+	Changed     time.Time    `json:"changed"`
+	Comments    []cmdComment `json:"comments,omitempty"`
+}
+
+type cmdComment struct {
+	Id      int64     `json:"id"`
+	Person  string    `json:"person"`
+	Entered time.Time `json:"entered"`
+	Text    string    `json:"text"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: bag [options] command [arguments]
+
+Commands:
+  new -p project -t title [-m description] [--part part]
+  show BUG
+  comment BUG -m text
+  close BUG [-s status] [-m text]
+  list [--project project] [--status status] [--owner person]
+
+Options:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	bc := bagCmd{out: os.Stdout}
+	database := flag.String("d", defaultDatabase(), "database file to use")
+	flag.StringVar(&bc.user, "u", defaultUser(), "name of the person using bag, which is not checked")
+	flag.BoolVar(&bc.json, "json", false, "print JSON")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	_, err := os.Stat(*database)
+	if err != nil {
+		fail("Cannot use database: %s", err)
+	}
+	bc.db, err = bagzullaDb.Open(*database)
+	if err != nil {
+		fail("Error opening database %s: %s", *database, err)
+	}
+	defer bc.db.Close()
+	bc.store, err = bagzullaDb.NewStore(bc.db)
+	if err != nil {
+		fail("Error preparing database %s: %s", *database, err)
+	}
+	err = bc.run(flag.Args())
+	if err == errUsage {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+}
+
+var errUsage = errors.New("Unknown command")
+
+// Run the command "args[0]" with the arguments after it.
+func (bc *bagCmd) run(args []string) error {
+	switch args[0] {
+	case "new":
+		return bc.newBug(args[1:])
+	case "show":
+		return bc.show(args[1:])
+	case "comment":
+		return bc.comment(args[1:])
+	case "close":
+		return bc.close(args[1:])
+	case "list":
+		return bc.list(args[1:])
+	}
+	return errUsage
+}
+
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "bag: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+// The database is $BAGZULLA_DB if set, otherwise bagzulla.db in the
+// current directory.
+func defaultDatabase() string {
+	db := os.Getenv("BAGZULLA_DB")
+	if db != "" {
+		return db
+	}
+	return filepath.Join(".", "bagzulla.db")
+}
+
+// The person is $BAGZULLA_USER if set, otherwise the login name.
+func defaultUser() string {
+	name := os.Getenv("BAGZULLA_USER")
+	if name != "" {
+		return name
+	}
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// Parse the flags of a command which takes a bug number. The number
+// may come before or after the flags.
+func bugArgs(fs *flag.FlagSet, args []string) (bugId int64, err error) {
+	var number string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		number = args[0]
+		args = args[1:]
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return 0, err
+	}
+	if number == "" {
+		if fs.NArg() != 1 {
+			return 0, fmt.Errorf("%s needs one bug number", fs.Name())
+		}
+		number = fs.Arg(0)
+	} else if fs.NArg() != 0 {
+		return 0, fmt.Errorf("Unexpected arguments %s", strings.Join(fs.Args(), " "))
+	}
+	bugId, err = strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad bug number %s: %s", number, err)
+	}
+	return bugId, nil
+}
+
+// Find the person using the command.
+func (bc *bagCmd) person() (person bagzullaDb.Person, err error) {
+	if bc.user == "" {
+		return person, fmt.Errorf("No user name; use -u or $BAGZULLA_USER")
+	}
+	person, err = bc.store.PersonFromName(bc.user)
+	if err != nil {
+		return person, err
+	}
+	if person.PersonId == 0 {
+		return person, fmt.Errorf("No person called '%s'", bc.user)
+	}
+	return person, nil
+}
+
+// Find a project from its name or ID number.
+func (bc *bagCmd) project(name string) (project bagzullaDb.Project, err error) {
+	id, err := strconv.ParseInt(name, 10, 64)
+	if err == nil {
+		project, err = bc.store.ProjectFromId(id)
+		if err != nil {
+			return project, fmt.Errorf("No project with ID %d: %s", id, err)
+		}
+		if !project.Deleted.IsZero() {
+			return project, fmt.Errorf("Project %d is in the trash", id)
+		}
+		seen, err := bc.canSee(project)
+		if err != nil {
+			return project, err
+		}
+		if !seen {
+			return project, fmt.Errorf("No project with ID %d", id)
+		}
+		return project, nil
+	}
+	projects, err := bc.store.AllProjects()
+	if err != nil {
+		return project, err
+	}
+	for _, p := range projects {
+		if strings.EqualFold(p.Name, name) && p.Deleted.IsZero() {
+			seen, err := bc.canSee(p)
+			if err != nil {
+				return project, err
+			}
+			if seen {
+				return p, nil
+			}
+		}
+	}
+	return project, fmt.Errorf("No project called '%s'", name)
+}
+
+// Find a part of "project" from its name or ID number.
+func (bc *bagCmd) part(project bagzullaDb.Project, name string) (part bagzullaDb.Part, err error) {
+	parts, err := bc.store.PartsFromProjectId(project.ProjectId)
+	if err != nil {
+		return part, err
+	}
+	id, _ := strconv.ParseInt(name, 10, 64)
+	for _, p := range parts {
+		if !p.Deleted.IsZero() {
+			continue
+		}
+		if p.PartId == id || strings.EqualFold(p.Name, name) {
+			return p, nil
+		}
+	}
+	return part, fmt.Errorf("No part '%s' in %s", name, project.Name)
+}
+
+func statusNumber(name string) (status int64, err error) {
+	for i, s := range statuses {
+		if s == name {
+			return int64(i), nil
+		}
+	}
+	return -1, fmt.Errorf("Unknown status %s; the statuses are %s", name,
+		strings.Join(statuses, ", "))
+}
+
+// The state of "project". Any number which is not a state means that
+// the project was cancelled.
+func projectState(project bagzullaDb.Project) string {
+	if project.Status < 0 || project.Status >= int64(len(bagzullaDb.ProjectStates)) {
+		return "cancelled"
+	}
+	return bagzullaDb.ProjectStates[project.Status]
+}
+
+// Read the permissions of the person using the command. Someone who
+// is not in the database, or cannot log in, is a viewer, like people
+// on the web who are not logged in.
+func (bc *bagCmd) readPermissions() error {
+	var personId int64
+	if bc.user != "" {
+		person, err := bc.store.PersonFromName(bc.user)
+		if err != nil {
+			return err
+		}
+		if person.Status == "active" {
+			personId = person.PersonId
+		}
+	}
+	perms, err := bagzullaDb.ReadPermissions(bc.store, personId)
+	if err != nil {
+		return err
+	}
+	bc.perms = &perms
+	return nil
+}
+
+// The role of the person using the command in "project", which is
+// worked out by the same rules as on the web.
+func (bc *bagCmd) roleIn(project bagzullaDb.Project) (r bagzullaDb.Role, err error) {
+	if bc.perms == nil {
+		err = bc.readPermissions()
+		if err != nil {
+			return bagzullaDb.RoleNone, err
+		}
+	}
+	return bc.perms.RoleIn(project.ProjectId), nil
+}
+
+// Can the person using the command see "project"?
+func (bc *bagCmd) canSee(project bagzullaDb.Project) (bool, error) {
+	r, err := bc.roleIn(project)
+	return r >= bagzullaDb.RoleViewer, err
+}
+
+// Check that the person using the command has the role "need" in
+// "project".
+func (bc *bagCmd) need(need bagzullaDb.Role, project bagzullaDb.Project) error {
+	r, err := bc.roleIn(project)
+	if err != nil {
+		return err
+	}
+	if r < need {
+		return fmt.Errorf("You need to be a %s in %s to do this", need, project.Name)
+	}
+	return nil
+}
+
+func storeText(tx *bagzullaDb.Store, text string) (int64, error) {
+	return tx.InsertTxt(bagzullaDb.Txt{
+		Content: text,
+		Entered: time.Now(),
+	})
+}
+
+func addComment(tx *bagzullaDb.Store, bugId int64, person bagzullaDb.Person, text string) (err error) {
+	var comment bagzullaDb.Comment
+	comment.TxtId, err = storeText(tx, text)
+	if err != nil {
+		return err
+	}
+	comment.BugId = bugId
+	comment.PersonId = person.PersonId
+	_, err = tx.InsertComment(comment)
+	if err != nil {
+		return err
+	}
+	return tx.UpdateChangedForBug(time.Now(), bugId)
+}
+
+func (bc *bagCmd) text(id int64) (string, error) {
+	if id == 0 {
+		return "", nil
+	}
+	txt, err := bc.store.TxtFromId(id)
+	return txt.Content, err
+}
+
+func (bc *bagCmd) personName(id int64) (string, error) {
+	person, err := bc.store.PersonFromId(id)
+	return person.Name, err
+}
+
+// Get the printable form of "bug". The comments are only retrieved if
+// "comments" is true.
+func (bc *bagCmd) cmdBug(bug bagzullaDb.Bug, comments bool) (cb cmdBug, err error) {
+	cb.Id = bug.BugId
+	cb.Entered = bug.Entered
+	cb.Changed = bug.Changed
+	if bug.Status >= 0 && bug.Status < int64(len(statuses)) {
+		cb.Status = statuses[bug.Status]
+	}
+	if bug.Priority >= 0 && bug.Priority < int64(len(bagzullaDb.Priorities)) {
+		cb.Priority = bagzullaDb.Priorities[bug.Priority]
+	}
+	cb.Title, err = bc.text(bug.Title)
+	if err != nil {
+		return cb, err
+	}
+	cb.Description, err = bc.text(bug.Description)
+	if err != nil {
+		return cb, err
+	}
+	project, err := bc.store.ProjectFromId(bug.ProjectId)
+	if err != nil {
+		return cb, err
+	}
+	cb.Project = project.Name
+	if bug.PartId != 0 {
+		part, err := bc.store.PartFromId(bug.PartId)
+		if err != nil {
+			return cb, err
+		}
+		cb.Part = part.Name
+	}
+	cb.Owner, err = bc.personName(bug.Owner)
+	if err != nil {
+		return cb, err
+	}
+	if !comments {
+		return cb, nil
+	}
+	cs, err := bc.store.CommentsFromBugId(bug.BugId)
+	if err != nil {
+		return cb, err
+	}
+	for _, c := range cs {
+		if !c.Deleted.IsZero() {
+			continue
+		}
+		txt, err := bc.store.TxtFromId(c.TxtId)
+		if err != nil {
+			return cb, err
+		}
+		person, err := bc.personName(c.PersonId)
+		if err != nil {
+			return cb, err
+		}
+		cb.Comments = append(cb.Comments, cmdComment{
+			Id:      c.CommentId,
+			Person:  person,
+			Entered: txt.Entered,
+			Text:    txt.Content,
+		})
+	}
+	return cb, nil
+}
+
+func (bc *bagCmd) printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(bc.out, "%s\n", out)
+	return nil
+}
+
+// Get the bug with ID "bugId", which must not be in the trash, and
+// its project, which the person using the command must be able to
+// see.
+func (bc *bagCmd) bug(bugId int64) (bug bagzullaDb.Bug, project bagzullaDb.Project, err error) {
+	bug, err = bc.store.BugFromId(bugId)
+	if err != nil {
+		return bug, project, err
+	}
+	project, err = bc.store.ProjectFromId(bug.ProjectId)
+	if err != nil {
+		return bug, project, err
+	}
+	if !bug.Deleted.IsZero() || !project.Deleted.IsZero() {
+		return bug, project, fmt.Errorf("Bug %d is in the trash", bugId)
+	}
+	seen, err := bc.canSee(project)
+	if err != nil {
+		return bug, project, err
+	}
+	if !seen {
+		return bug, project, fmt.Errorf("No bug %d", bugId)
+	}
+	return bug, project, nil
+}
+
+// Get the bug with ID "bugId" to change it, which needs the role
+// "need" in its project. As on the web, only the bugs of active and
+// frozen projects can be changed.
+func (bc *bagCmd) changeBug(bugId int64, need bagzullaDb.Role) (bug bagzullaDb.Bug, err error) {
+	bug, project, err := bc.bug(bugId)
+	if err != nil {
+		return bug, err
+	}
+	state := projectState(project)
+	if state != "active" && state != "frozen" {
+		return bug, fmt.Errorf("Bug %d is in project %s, which is %s", bugId,
+			project.Name, state)
+	}
+	return bug, bc.need(need, project)
+}
+
+// Print a bug in full.
+func (bc *bagCmd) printBug(bugId int64) error {
+	bug, _, err := bc.bug(bugId)
+	if err != nil {
+		return err
+	}
+	cb, err := bc.cmdBug(bug, true)
+	if err != nil {
+		return err
+	}
+	if bc.json {
+		return bc.printJSON(cb)
+	}
+	project := cb.Project
+	if cb.Part != "" {
+		project += " / " + cb.Part
+	}
+	fmt.Fprintf(bc.out, "Bug %d: %s\n", cb.Id, cb.Title)
+	fmt.Fprintf(bc.out, "Project:  %s\n", project)
+	fmt.Fprintf(bc.out, "Status:   %s\n", cb.Status)
+	fmt.Fprintf(bc.out, "Priority: %s\n", cb.Priority)
+	fmt.Fprintf(bc.out, "Owner:    %s\n", cb.Owner)
+	fmt.Fprintf(bc.out, "Entered:  %s\n", cb.Entered.Format("2006-01-02 15:04"))
+	fmt.Fprintf(bc.out, "Changed:  %s\n", cb.Changed.Format("2006-01-02 15:04"))
+	if cb.Description != "" {
+		fmt.Fprintf(bc.out, "\n%s\n", cb.Description)
+	}
+	for _, c := range cb.Comments {
+		fmt.Fprintf(bc.out, "\n--- %s, %s\n%s\n", c.Person,
+			c.Entered.Format("2006-01-02 15:04"), c.Text)
+	}
+	return nil
+}
+
+func (bc *bagCmd) newBug(args []string) (err error) {
+	fs := flag.NewFlagSet("new", flag.ExitOnError)
+	projectName := fs.String("p", "", "project of the bug")
+	title := fs.String("t", "", "title of the bug")
+	description := fs.String("m", "", "description of the bug")
+	partName := fs.String("part", "", "part of the project")
+	fs.Parse(args)
+	if *projectName == "" || *title == "" {
+		return fmt.Errorf("new needs a project (-p) and a title (-t)")
+	}
+	person, err := bc.person()
+	if err != nil {
+		return err
+	}
+	project, err := bc.project(*projectName)
+	if err != nil {
+		return err
+	}
+	if state := projectState(project); state != "active" {
+		return fmt.Errorf("Project %s is %s, so it cannot take new bugs",
+			project.Name, state)
+	}
+	err = bc.need(bagzullaDb.RoleReporter, project)
+	if err != nil {
+		return err
+	}
+	var bug bagzullaDb.Bug
+	if *partName != "" {
+		part, err := bc.part(project, *partName)
+		if err != nil {
+			return err
+		}
+		bug.PartId = part.PartId
+	}
+	bug.ProjectId = project.ProjectId
+	bug.Owner = person.PersonId
+	bug.Entered = time.Now()
+	bug.Changed = bug.Entered
+	var bugId int64
+	// The texts are only kept if the bug is.
+	err = bc.store.Transact(func(tx *bagzullaDb.Store) (err error) {
+		bug.Title, err = storeText(tx, *title)
+		if err != nil {
+			return err
+		}
+		bug.Description, err = storeText(tx, *description)
+		if err != nil {
+			return err
+		}
+		bugId, err = tx.InsertBug(bug)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if bc.json {
+		return bc.printBug(bugId)
+	}
+	fmt.Fprintf(bc.out, "Made bug %d\n", bugId)
+	return nil
+}
+
+func (bc *bagCmd) show(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	bugId, err := bugArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	return bc.printBug(bugId)
+}
+
+func (bc *bagCmd) comment(args []string) error {
+	fs := flag.NewFlagSet("comment", flag.ExitOnError)
+	text := fs.String("m", "", "text of the comment")
+	bugId, err := bugArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *text == "" {
+		return fmt.Errorf("comment needs some text (-m)")
+	}
+	person, err := bc.person()
+	if err != nil {
+		return err
+	}
+	_, err = bc.changeBug(bugId, bagzullaDb.RoleReporter)
+	if err != nil {
+		return err
+	}
+	err = bc.store.Transact(func(tx *bagzullaDb.Store) error {
+		return addComment(tx, bugId, person, *text)
+	})
+	if err != nil {
+		return err
+	}
+	if bc.json {
+		return bc.printBug(bugId)
+	}
+	fmt.Fprintf(bc.out, "Commented on bug %d\n", bugId)
+	return nil
+}
+
+func (bc *bagCmd) close(args []string) error {
+	fs := flag.NewFlagSet("close", flag.ExitOnError)
+	statusName := fs.String("s", "fixed", "status to give the bug")
+	text := fs.String("m", "", "comment to add")
+	bugId, err := bugArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	status, err := statusNumber(*statusName)
+	if err != nil {
+		return err
+	}
+	person, err := bc.person()
+	if err != nil {
+		return err
+	}
+	_, err = bc.changeBug(bugId, bagzullaDb.RoleDeveloper)
+	if err != nil {
+		return err
+	}
+	err = bc.store.Transact(func(tx *bagzullaDb.Store) error {
+		err := tx.UpdateStatusForBug(status, bugId)
+		if err != nil {
+			return err
+		}
+		if *text != "" {
+			return addComment(tx, bugId, person, *text)
+		}
+		return tx.UpdateChangedForBug(time.Now(), bugId)
+	})
+	if err != nil {
+		return err
+	}
+	if bc.json {
+		return bc.printBug(bugId)
+	}
+	fmt.Fprintf(bc.out, "Bug %d is %s\n", bugId, *statusName)
+	return nil
+}
+
+func (bc *bagCmd) list(args []string) (err error) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	projectName := fs.String("project", "", "only list bugs of this project")
+	statusName := fs.String("status", "", "only list bugs with this status")
+	ownerName := fs.String("owner", "", "only list bugs of this person")
+	fs.Parse(args)
+	var bugs []bagzullaDb.Bug
+	if *projectName != "" {
+		project, err := bc.project(*projectName)
+		if err != nil {
+			return err
+		}
+		bugs, err = bc.store.BugsFromProjectId(project.ProjectId)
+	} else {
+		bugs, err = bc.store.AllBugs()
+	}
+	if err != nil {
+		return err
+	}
+	status := int64(-1)
+	if *statusName != "" {
+		status, err = statusNumber(*statusName)
+		if err != nil {
+			return err
+		}
+	}
+	// The projects which are not in the trash and which the person
+	// using the command can see.
+	seen := make(map[int64]bool)
+	projects, err := bc.store.AllProjects()
+	if err != nil {
+		return err
+	}
+	for _, p := range projects {
+		seen[p.ProjectId], err = bc.canSee(p)
+		if err != nil {
+			return err
+		}
+	}
+	var owner int64
+	if *ownerName != "" {
+		person, err := bc.store.PersonFromName(*ownerName)
+		if err != nil {
+			return err
+		}
+		if person.PersonId == 0 {
+			return fmt.Errorf("No person called '%s'", *ownerName)
+		}
+		owner = person.PersonId
+	}
+	cbs := []cmdBug{}
+	for _, bug := range bugs {
+		if !bug.Deleted.IsZero() || !seen[bug.ProjectId] {
+			continue
+		}
+		if status >= 0 && bug.Status != status {
+			continue
+		}
+		if owner != 0 && bug.Owner != owner {
+			continue
+		}
+		cb, err := bc.cmdBug(bug, false)
+		if err != nil {
+			return err
+		}
+		cb.Description = ""
+		cbs = append(cbs, cb)
+	}
+	if bc.json {
+		return bc.printJSON(cbs)
+	}
+	for _, cb := range cbs {
+		fmt.Fprintf(bc.out, "%6d %-9s %-12s %s\n", cb.Id, cb.Status, cb.Project, cb.Title)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// People with each role, one of them with a grant in the private
+// project, and an open, a private and an archived project.
+var testSeed = `
+INSERT INTO person(name, email, role) VALUES('ada', 'ada@localhost', 'admin');
+INSERT INTO person(name, email, role) VALUES('rae', 'rae@localhost', 'reporter');
+INSERT INTO person(name, email, role) VALUES('vic', 'vic@localhost', 'viewer');
+INSERT INTO person(name, email, role) VALUES('gil', 'gil@localhost', 'reporter');
+INSERT INTO txt(content, entered) VALUES('A project', CURRENT_TIMESTAMP);
+INSERT INTO project(name, directory, description, owner, status) VALUES('Open', '', 1, 1, 0);
+INSERT INTO project(name, directory, description, owner, status, private) VALUES('Hidden', '', 1, 1, 0, 1);
+INSERT INTO project(name, directory, description, owner, status) VALUES('Shut', '', 1, 1, 3);
+INSERT INTO grant(person_id, project_id, role) VALUES(4, 2, 'developer');
+`
+
+func testStore(t *testing.T) *bagzullaDb.Store {
+	schema, err := ioutil.ReadFile(filepath.Join("..", "..", "schema.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bagzullaDb.Open(filepath.Join(t.TempDir(), "bagzulla.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(string(schema) + testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := bagzullaDb.NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestCommands(t *testing.T) {
+	store := testStore(t)
+	bag := func(user string, args ...string) (string, error) {
+		var out bytes.Buffer
+		bc := bagCmd{db: store.DB, store: store, user: user, out: &out}
+		err := bc.run(args)
+		return out.String(), err
+	}
+	tests := []struct {
+		user    string
+		args    []string
+		refused bool
+	}{
+		{"ada", []string{"new", "-p", "Open", "-t", "Public bug"}, false},
+		{"ada", []string{"new", "-p", "Hidden", "-t", "Secret bug"}, false},
+		{"ada", []string{"new", "-p", "Shut", "-t", "Late bug"}, true},
+		{"vic", []string{"new", "-p", "Open", "-t", "Viewed bug"}, true},
+		{"rae", []string{"new", "-p", "Hidden", "-t", "Found bug"}, true},
+		{"rae", []string{"show", "2"}, true},
+		{"rae", []string{"comment", "1", "-m", "Me too"}, false},
+		{"rae", []string{"close", "1"}, true},
+		{"gil", []string{"close", "2", "-m", "Done"}, false},
+	}
+	for _, test := range tests {
+		_, err := bag(test.user, test.args...)
+		if test.refused != (err != nil) {
+			t.Errorf("%s: bag %s: %v", test.user, strings.Join(test.args, " "), err)
+		}
+	}
+
+	// Only people who can see the private project get its bugs.
+	for user, secret := range map[string]bool{"rae": false, "": false, "gil": true, "ada": true} {
+		out, err := bag(user, "list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "Public bug") || strings.Contains(out, "Secret bug") != secret {
+			t.Errorf("%q lists %s", user, out)
+		}
+	}
+
+	var buf bytes.Buffer
+	bc := bagCmd{db: store.DB, store: store, user: "gil", json: true, out: &buf}
+	err := bc.run([]string{"show", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"status": "fixed"`, `"priority": "unknown"`, `"person": "gil"`, `"text": "Done"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Bug 2 does not have %s: %s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,418 @@
+// Dbgen makes bagzullaDb/bagzullaDb.go, the typed accessors of the
+// tables of Bagzulla, from the CREATE TABLE statements in schema.txt.
+
+// Usage:
+//
+//     dbgen [-o output] schema table...
+//
+// For each table it makes a structure with a field for each column,
+// and methods of bagzullaDb.Store which get rows by ID, by any
+// column, or all of them, and which insert, update and delete rows.
+// Each method has a variant ending in Context which takes a
+// context.Context. Columns which may be NULL read as the zero value of
+// their type, a zero value inserted into a column with a default gets
+// the default, and the zero time is written as NULL.
+
+// It is run by "go generate" in bagzullaDb.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A column of a table.
+type column struct {
+	// The name in the database.
+	Name string
+	// The SQL type, which may be empty, since SQLite allows that.
+	SqlType  string
+	NotNull  bool
+	Unique   bool
+	Primary  bool
+	Default  string
+	Field    string
+	Param    string
+	GoType   string
+	NullType string
+}
+
+// A table and its columns.
+type table struct {
+	Name    string
+	Columns []*column
+	// The INTEGER PRIMARY KEY.
+	Id *column
+	// The name of the structure, such as "Bug".
+	Type string
+	// The plural of Type, such as "Bugs".
+	Plural string
+	// The start of the names of the queries, such as "bug".
+	Var string
+}
+
+// The columns apart from the ID.
+func (t *table) Fields() (fields []*column) {
+	for _, c := range t.Columns {
+		if c != t.Id {
+			fields = append(fields, c)
+		}
+	}
+	return fields
+}
+
+// The names of all the columns, for SELECT.
+func (t *table) Select() string {
+	var names []string
+	for _, c := range t.Columns {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// The names of the columns apart from the ID, for INSERT.
+func (t *table) InsertColumns() string {
+	var names []string
+	for _, c := range t.Fields() {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// The placeholders of the INSERT. A column with a default gets it
+// when the value is NULL, which the zero value of its field is sent
+// as.
+func (t *table) InsertValues() string {
+	var values []string
+	for _, c := range t.Fields() {
+		if c.Default != "" {
+			values = append(values, "COALESCE(?, "+c.Default+")")
+		} else {
+			values = append(values, "?")
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// The Go values of the fields of "v" for the INSERT.
+func (t *table) InsertArgs(v string) string {
+	var args []string
+	for _, c := range t.Fields() {
+		args = append(args, c.Arg(v+"."+c.Field))
+	}
+	return strings.Join(args, ", ")
+}
+
+// The value "v" of the column to write to the database. A zero value
+// is NULL if the column has a default, or if it is a time which may be
+// NULL, since the zero time means that there is none.
+func (c *column) Arg(v string) string {
+	if c.Default != "" || c.NullType == "sql.NullTime" {
+		return "zeroToNull(" + v + ")"
+	}
+	return v
+}
+
+// The value "v" of the column to write to the database with an
+// UPDATE. Unlike an INSERT, a zero value is written as it is, since
+// the default is only for new rows, except for a time which is not
+// set.
+func (c *column) UpdateArg(v string) string {
+	if c.NullType == "sql.NullTime" {
+		return "zeroToNull(" + v + ")"
+	}
+	return v
+}
+
+// The columns which may be NULL.
+func (t *table) Nullable() (nullable []*column) {
+	for _, c := range t.Columns {
+		if c.NullType != "" {
+			nullable = append(nullable, c)
+		}
+	}
+	return nullable
+}
+
+// Whether any column is a time.
+func hasTime(tables []*table) bool {
+	for _, t := range tables {
+		for _, c := range t.Columns {
+			if c.GoType == "time.Time" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The Go types of the SQL types, and the types which read them when
+// they may be NULL. A column without a type is taken to be an
+// integer.
+var goTypes = map[string][2]string{
+	"":          {"int64", "sql.NullInt64"},
+	"INTEGER":   {"int64", "sql.NullInt64"},
+	"INT":       {"int64", "sql.NullInt64"},
+	"TEXT":      {"string", "sql.NullString"},
+	"REAL":      {"float64", "sql.NullFloat64"},
+	"TIMESTAMP": {"time.Time", "sql.NullTime"},
+	"DATETIME":  {"time.Time", "sql.NullTime"},
+}
+
+// Words which start a constraint rather than being a type.
+var constraintWords = map[string]bool{
+	"NOT":        true,
+	"NULL":       true,
+	"UNIQUE":     true,
+	"PRIMARY":    true,
+	"DEFAULT":    true,
+	"REFERENCES": true,
+	"CHECK":      true,
+}
+
+// "bug_id" becomes "BugId".
+func camel(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(name, "_") {
+		if word == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(word[:1]))
+		b.WriteString(word[1:])
+	}
+	return b.String()
+}
+
+// "bug_id" becomes "bugId".
+func lowerCamel(name string) string {
+	c := camel(name)
+	return strings.ToLower(c[:1]) + c[1:]
+}
+
+// The plural of an English noun, such as "Dependencies".
+func plural(noun string) string {
+	lower := strings.ToLower(noun)
+	switch {
+	case strings.HasSuffix(lower, "y") && len(lower) > 1 &&
+		!strings.ContainsRune("aeiou", rune(lower[len(lower)-2])):
+		return noun[:len(noun)-1] + "ies"
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "x"),
+		strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return noun + "es"
+	}
+	return noun + "s"
+}
+
+var createTable = regexp.MustCompile(`(?i)^\s*CREATE\s+TABLE\s+"?(\w+)"?\s*\(`)
+
+// Remove the "--" comments from "sql".
+func stripComments(sql string) string {
+	var lines []string
+	for _, line := range strings.Split(sql, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Split the inside of a CREATE TABLE at the commas which are not in
+// brackets.
+func splitDefinitions(body string) (defs []string) {
+	depth := 0
+	start := 0
+	for i, c := range body {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, strings.TrimSpace(body[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	last := strings.TrimSpace(body[start:])
+	if last != "" {
+		defs = append(defs, last)
+	}
+	return defs
+}
+
+// Read a column from its definition. The return value is nil for
+// constraints of the table such as FOREIGN KEY.
+func parseColumn(def string) (c *column, err error) {
+	words := strings.Fields(def)
+	first := strings.ToUpper(words[0])
+	if i := strings.Index(first, "("); i >= 0 {
+		first = first[:i]
+	}
+	switch first {
+	case "FOREIGN", "UNIQUE", "PRIMARY", "CHECK", "CONSTRAINT":
+		return nil, nil
+	}
+	c = &column{Name: strings.Trim(words[0], `"`)}
+	rest := words[1:]
+	if len(rest) > 0 && !constraintWords[strings.ToUpper(rest[0])] {
+		c.SqlType = strings.ToUpper(rest[0])
+		rest = rest[1:]
+	}
+	for i := 0; i < len(rest); i++ {
+		switch strings.ToUpper(rest[i]) {
+		case "NOT":
+			c.NotNull = true
+		case "UNIQUE":
+			c.Unique = true
+		case "PRIMARY":
+			c.Primary = true
+		case "DEFAULT":
+			if i+1 >= len(rest) {
+				return nil, fmt.Errorf("No default for %s", c.Name)
+			}
+			i++
+			c.Default = rest[i]
+		}
+	}
+	types, ok := goTypes[c.SqlType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown type %s of %s", c.SqlType, c.Name)
+	}
+	c.GoType = types[0]
+	if !c.NotNull && !c.Primary {
+		c.NullType = types[1]
+	}
+	c.Field = camel(c.Name)
+	c.Param = lowerCamel(c.Name)
+	return c, nil
+}
+
+// Read the tables from the CREATE TABLE statements of "r".
+func parseSchema(r io.Reader) (tables map[string]*table, err error) {
+	tables = make(map[string]*table)
+	scanner := bufio.NewScanner(r)
+	var t *table
+	var body strings.Builder
+	for scanner.Scan() {
+		line := stripComments(scanner.Text())
+		if t == nil {
+			m := createTable.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			t = &table{Name: m[1]}
+			body.Reset()
+			line = line[len(m[0]):]
+		}
+		end := strings.Index(line, ");")
+		if end < 0 {
+			body.WriteString(line + "\n")
+			continue
+		}
+		body.WriteString(line[:end])
+		for _, def := range splitDefinitions(body.String()) {
+			c, err := parseColumn(def)
+			if err != nil {
+				return nil, fmt.Errorf("Error in table %s: %s", t.Name, err)
+			}
+			if c == nil {
+				continue
+			}
+			if c.Primary {
+				t.Id = c
+			}
+			t.Columns = append(t.Columns, c)
+		}
+		tables[t.Name] = t
+		t = nil
+	}
+	if t != nil {
+		return nil, fmt.Errorf("Table %s has no end", t.Name)
+	}
+	return tables, scanner.Err()
+}
+
+// Make the Go code for "names", which are tables of "tables".
+func generate(w io.Writer, tables map[string]*table, names []string, schema string) error {
+	var chosen []*table
+	for _, name := range names {
+		t := tables[name]
+		if t == nil {
+			return fmt.Errorf("No table %s in %s", name, schema)
+		}
+		if t.Id == nil || t.Id.GoType != "int64" {
+			return fmt.Errorf("Table %s has no INTEGER PRIMARY KEY", name)
+		}
+		t.Type = camel(name)
+		t.Plural = plural(t.Type)
+		t.Var = lowerCamel(name)
+		chosen = append(chosen, t)
+	}
+	var buf bytes.Buffer
+	err := codeTemplate.Execute(&buf, map[string]interface{}{
+		"Schema":  filepath.Base(schema),
+		"Tables":  chosen,
+		"HasTime": hasTime(chosen),
+	})
+	if err != nil {
+		return err
+	}
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Error formatting the code: %s", err)
+	}
+	_, err = w.Write(code)
+	return err
+}
+
+func main() {
+	output := flag.String("o", "", "File to write to instead of the standard output")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: dbgen [-o output] schema table...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	schema := flag.Arg(0)
+	f, err := os.Open(schema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbgen: %s\n", err)
+		os.Exit(1)
+	}
+	tables, err := parseSchema(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbgen: %s: %s\n", schema, err)
+		os.Exit(1)
+	}
+	var buf bytes.Buffer
+	err = generate(&buf, tables, flag.Args()[1:], schema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbgen: %s\n", err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	err = ioutil.WriteFile(*output, buf.Bytes(), 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dbgen: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	for _, test := range [][3]string{
+		{"bug_id", "BugId", "bugId"},
+		{"txttype", "Txttype", "txttype"},
+		{"other_id", "OtherId", "otherId"},
+	} {
+		if got := camel(test[0]); got != test[1] {
+			t.Errorf("camel(%s) = %s, expected %s", test[0], got, test[1])
+		}
+		if got := lowerCamel(test[0]); got != test[2] {
+			t.Errorf("lowerCamel(%s) = %s, expected %s", test[0], got, test[2])
+		}
+	}
+	for noun, want := range map[string]string{
+		"Bug":        "Bugs",
+		"Dependency": "Dependencies",
+		"Day":        "Days",
+		"Status":     "Statuses",
+		"Box":        "Boxes",
+		"Branch":     "Branches",
+	} {
+		if got := plural(noun); got != want {
+			t.Errorf("plural(%s) = %s, expected %s", noun, got, want)
+		}
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	tables, err := parseSchema(strings.NewReader(`
+-- A comment, with a comma
+CREATE TABLE "thing" (
+	thing_id INTEGER PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL, size,
+	-- A comment
+	kind TEXT NOT NULL DEFAULT 'plain',
+	seen TIMESTAMP,
+	UNIQUE(name, kind),
+	FOREIGN KEY(size) REFERENCES other(other_id)
+);
+CREATE INDEX thing_name ON thing(name);
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thing := tables["thing"]
+	if thing == nil || len(tables) != 1 {
+		t.Fatalf("Got tables %v", tables)
+	}
+	var got []string
+	for _, c := range thing.Columns {
+		got = append(got, c.Name+" "+c.GoType+" "+c.NullType+" "+c.Default)
+	}
+	want := []string{
+		"thing_id int64  ",
+		"name string  ",
+		"size int64 sql.NullInt64 ",
+		"kind string  'plain'",
+		"seen time.Time sql.NullTime ",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Got columns %q, expected %q", got, want)
+	}
+	if thing.Id != thing.Columns[0] || !thing.Columns[1].Unique {
+		t.Error("Wrong ID or unique column")
+	}
+	_, err = parseSchema(strings.NewReader("CREATE TABLE x(\n\ty BLOB\n);\n"))
+	if err == nil {
+		t.Error("No error for an unknown type")
+	}
+}
+
+// The code in bagzullaDb is what "go generate" makes from the schema
+// now.
+func TestGenerated(t *testing.T) {
+	source, err := ioutil.ReadFile("../../bagzullaDb/store.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args []string
+	for _, line := range strings.Split(string(source), "\n") {
+		if strings.HasPrefix(line, "//go:generate go run ../cmd/dbgen -o bagzullaDb.go ../schema.txt ") {
+			args = strings.Fields(line)[7:]
+		}
+	}
+	if len(args) == 0 {
+		t.Fatal("No go:generate line in store.go")
+	}
+	f, err := os.Open("../../schema.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tables, err := parseSchema(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = generate(&buf, tables, args, "schema.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadFile("../../bagzullaDb/bagzullaDb.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), old) {
+		t.Error("bagzullaDb.go is out of date, run go generate in bagzullaDb")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import "text/template"
+
+var codeTemplate = template.Must(template.New("code").Parse(`// Code generated by dbgen from {{.Schema}}. DO NOT EDIT.
+
+package bagzullaDb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+{{- if .HasTime}}
+	"time"
+{{- end}}
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A row which can be read, either *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// NULL for the zero value of "v", so that an inserted column gets its
+// default, and a time which is not set is NULL.
+func zeroToNull(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int64:
+		if x == 0 {
+			return nil
+		}
+	case float64:
+		if x == 0 {
+			return nil
+		}
+	case string:
+		if x == "" {
+			return nil
+		}
+{{- if .HasTime}}
+	case time.Time:
+		if x.IsZero() {
+			return nil
+		}
+{{- end}}
+	}
+	return v
+}
+
+// An error unless "result" changed the one row of "table" with ID
+// "id".
+func oneRow(result sql.Result, table string, id int64) error {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		return fmt.Errorf("%d rows of %s changed for id %d", rows, table, id)
+	}
+	return nil
+}
+{{range $t := .Tables}}
+type {{$t.Type}} struct {
+{{- range $t.Columns}}
+	{{.Field}} {{.GoType}}
+{{- end}}
+}
+
+// The columns of {{$t.Name}}, in the order which {{$t.Plural}}FromRows reads them.
+const {{$t.Type}}Fields = "{{$t.Select}}"
+
+func scan{{$t.Type}}(row scanner) ({{$t.Var}} {{$t.Type}}, err error) {
+{{- range $t.Nullable}}
+	var null{{.Field}} {{.NullType}}
+{{- end}}
+	err = row.Scan(
+{{- range $i, $c := $t.Columns}}{{if $i}}, {{end}}&{{if $c.NullType}}null{{$c.Field}}{{else}}{{$t.Var}}.{{$c.Field}}{{end}}{{end -}}
+	)
+	if err != nil {
+		return {{$t.Var}}, err
+	}
+{{- range $t.Nullable}}
+	{{$t.Var}}.{{.Field}} = null{{.Field}}.{{if eq .GoType "int64"}}Int64{{else if eq .GoType "string"}}String{{else if eq .GoType "float64"}}Float64{{else}}Time{{end}}
+{{- end}}
+	return {{$t.Var}}, nil
+}
+
+// Read the rows of a query of {{$t.Type}}Fields. The caller closes
+// "rows".
+func {{$t.Plural}}FromRows(rows *sql.Rows) ({{$t.Var}}List []{{$t.Type}}, err error) {
+	for rows.Next() {
+		{{$t.Var}}, err := scan{{$t.Type}}(rows)
+		if err != nil {
+			return {{$t.Var}}List, err
+		}
+		{{$t.Var}}List = append({{$t.Var}}List, {{$t.Var}})
+	}
+	return {{$t.Var}}List, rows.Err()
+}
+
+func (s *Store) query{{$t.Plural}}(ctx context.Context, q *Query, args ...interface{}) ({{$t.Var}}List []{{$t.Type}}, err error) {
+	rows, err := s.Stmt(q).QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return {{$t.Plural}}FromRows(rows)
+}
+
+var {{$t.Var}}FromId = NewQuery("SELECT " + {{$t.Type}}Fields + " FROM {{$t.Name}} WHERE {{$t.Id.Name}} = ?")
+
+// Get the {{$t.Name}} with ID "{{$t.Id.Param}}", or an error if there is none.
+func (s *Store) {{$t.Type}}FromId({{$t.Id.Param}} int64) ({{$t.Type}}, error) {
+	return s.{{$t.Type}}FromIdContext(context.Background(), {{$t.Id.Param}})
+}
+
+func (s *Store) {{$t.Type}}FromIdContext(ctx context.Context, {{$t.Id.Param}} int64) ({{$t.Var}} {{$t.Type}}, err error) {
+	{{$t.Var}}, err = scan{{$t.Type}}(s.Stmt({{$t.Var}}FromId).QueryRowContext(ctx, {{$t.Id.Param}}))
+	if err == sql.ErrNoRows {
+		return {{$t.Var}}, fmt.Errorf("{{$t.Name}} with id %d not found", {{$t.Id.Param}})
+	}
+	return {{$t.Var}}, err
+}
+
+var insert{{$t.Type}} = NewQuery("INSERT INTO {{$t.Name}}({{$t.InsertColumns}}) VALUES({{$t.InsertValues}})")
+
+// Add "{{$t.Var}}", apart from its ID, and return the new ID.
+func (s *Store) Insert{{$t.Type}}({{$t.Var}} {{$t.Type}}) (int64, error) {
+	return s.Insert{{$t.Type}}Context(context.Background(), {{$t.Var}})
+}
+
+func (s *Store) Insert{{$t.Type}}Context(ctx context.Context, {{$t.Var}} {{$t.Type}}) (int64, error) {
+	result, err := s.Stmt(insert{{$t.Type}}).ExecContext(ctx, {{$t.InsertArgs $t.Var}})
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+var all{{$t.Plural}} = NewQuery("SELECT " + {{$t.Type}}Fields + " FROM {{$t.Name}}")
+
+func (s *Store) All{{$t.Plural}}() ([]{{$t.Type}}, error) {
+	return s.All{{$t.Plural}}Context(context.Background())
+}
+
+func (s *Store) All{{$t.Plural}}Context(ctx context.Context) ([]{{$t.Type}}, error) {
+	return s.query{{$t.Plural}}(ctx, all{{$t.Plural}})
+}
+
+var delete{{$t.Type}} = NewQuery("DELETE FROM {{$t.Name}} WHERE {{$t.Id.Name}} = ?")
+
+// Remove the {{$t.Name}} with ID "{{$t.Id.Param}}", or give an error if there is none.
+func (s *Store) Delete{{$t.Type}}({{$t.Id.Param}} int64) error {
+	return s.Delete{{$t.Type}}Context(context.Background(), {{$t.Id.Param}})
+}
+
+func (s *Store) Delete{{$t.Type}}Context(ctx context.Context, {{$t.Id.Param}} int64) error {
+	result, err := s.Stmt(delete{{$t.Type}}).ExecContext(ctx, {{$t.Id.Param}})
+	if err != nil {
+		return err
+	}
+	return oneRow(result, "{{$t.Name}}", {{$t.Id.Param}})
+}
+{{range $c := $t.Fields}}
+{{- if $c.Unique}}
+var {{$t.Var}}From{{$c.Field}} = NewQuery("SELECT " + {{$t.Type}}Fields + " FROM {{$t.Name}} WHERE {{$c.Name}} = ?")
+
+// Get the {{$t.Name}} whose {{$c.Name}} is "{{$c.Param}}". If there is none, the
+// {{$t.Name}} is empty.
+func (s *Store) {{$t.Type}}From{{$c.Field}}({{$c.Param}} {{$c.GoType}}) ({{$t.Type}}, error) {
+	return s.{{$t.Type}}From{{$c.Field}}Context(context.Background(), {{$c.Param}})
+}
+
+func (s *Store) {{$t.Type}}From{{$c.Field}}Context(ctx context.Context, {{$c.Param}} {{$c.GoType}}) ({{$t.Var}} {{$t.Type}}, err error) {
+	{{$t.Var}}, err = scan{{$t.Type}}(s.Stmt({{$t.Var}}From{{$c.Field}}).QueryRowContext(ctx, {{$c.Param}}))
+	if err == sql.ErrNoRows {
+		return {{$t.Var}}, nil
+	}
+	return {{$t.Var}}, err
+}
+{{- else}}
+var {{$t.Var}}From{{$c.Field}} = NewQuery("SELECT " + {{$t.Type}}Fields + " FROM {{$t.Name}} WHERE {{$c.Name}} = ?")
+
+func (s *Store) {{$t.Plural}}From{{$c.Field}}({{$c.Param}} {{$c.GoType}}) ([]{{$t.Type}}, error) {
+	return s.{{$t.Plural}}From{{$c.Field}}Context(context.Background(), {{$c.Param}})
+}
+
+func (s *Store) {{$t.Plural}}From{{$c.Field}}Context(ctx context.Context, {{$c.Param}} {{$c.GoType}}) ([]{{$t.Type}}, error) {
+	return s.query{{$t.Plural}}(ctx, {{$t.Var}}From{{$c.Field}}, {{$c.Param}})
+}
+{{- end}}
+
+var {{$t.Var}}Update{{$c.Field}} = NewQuery("UPDATE {{$t.Name}} SET {{$c.Name}} = ? WHERE {{$t.Id.Name}} = ?")
+
+func (s *Store) Update{{$c.Field}}For{{$t.Type}}({{$c.Param}} {{$c.GoType}}, {{$t.Id.Param}} int64) error {
+	return s.Update{{$c.Field}}For{{$t.Type}}Context(context.Background(), {{$c.Param}}, {{$t.Id.Param}})
+}
+
+func (s *Store) Update{{$c.Field}}For{{$t.Type}}Context(ctx context.Context, {{$c.Param}} {{$c.GoType}}, {{$t.Id.Param}} int64) error {
+	result, err := s.Stmt({{$t.Var}}Update{{$c.Field}}).ExecContext(ctx, {{$c.UpdateArg $c.Param}}, {{$t.Id.Param}})
+	if err != nil {
+		return err
+	}
+	return oneRow(result, "{{$t.Name}}", {{$t.Id.Param}})
+}
+{{end}}
+{{- end}}
+`))
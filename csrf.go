@@ -0,0 +1,170 @@
+package main
+
+/* Protection against cross-site request forgery. Each login session
+   has a random token, which the templates put into every form with
+   {{csrf}}. A POST request from someone logged in with a cookie must
+   send the token back, either as the form value "csrf" or in the
+   X-CSRF-Token header, or it is refused. Requests with an API token
+   do not use the cookie, so they do not need it. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"text/template"
+)
+
+var csrfField = "csrf"
+var csrfHeader = "X-CSRF-Token"
+
+var sessionCSRFSQL = `SELECT IFNULL(csrf, '') FROM session WHERE cookie = ?`
+var sessionCSRFQuery = bagzullaDb.NewQuery(sessionCSRFSQL)
+
+var setSessionCSRFSQL = `UPDATE session SET csrf = ? WHERE cookie = ? AND csrf IS NULL`
+var setSessionCSRFQuery = bagzullaDb.NewQuery(setSessionCSRFSQL)
+
+// Get the CSRF token of the session with cookie "cookie". Sessions
+// get their token when it is first needed.
+func sessionCSRF(store *bagzullaDb.Store, cookie string) (token string, err error) {
+	err = store.Stmt(sessionCSRFQuery).QueryRow(cookie).Scan(&token)
+	if err != nil || token != "" {
+		return token, err
+	}
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	_, err = store.Stmt(setSessionCSRFQuery).Exec(hex.EncodeToString(buf), cookie)
+	if err != nil {
+		return "", err
+	}
+	// Read it back, in case another request made one first.
+	err = store.Stmt(sessionCSRFQuery).QueryRow(cookie).Scan(&token)
+	return token, err
+}
+
+// The CSRF token of the user's session, or the empty string if the
+// user is not logged in with a cookie.
+func (b *Bagreply) csrfToken() string {
+	if b.csrf != "" || b.User == nil || b.Token != nil {
+		return b.csrf
+	}
+	cookie, err := b.r.Cookie(cookieName)
+	if err != nil {
+		return ""
+	}
+	b.csrf, err = sessionCSRF(b.data(), cookie.Value)
+	if err != nil {
+		log.Printf("Error getting CSRF token: %s", err)
+	}
+	return b.csrf
+}
+
+// The hidden form input with the CSRF token, for {{csrf}} in the
+// templates.
+func (b *Bagreply) csrfInput() string {
+	token := b.csrfToken()
+	if token == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		csrfField, token)
+}
+
+// A copy of the templates whose functions which depend on the request,
+// {{csrf}} and {{inbox}}, use the request "b". A copy is used by one
+// request at a time, then kept in Bagapp.freeTemplates for the next
+// one, so that the templates are only copied when every copy is in
+// use, rather than for each request.
+type requestTemplates struct {
+	t *template.Template
+	b *Bagreply
+}
+
+// How many copies of the templates are kept for reuse.
+var freeTemplatesMax = 32
+
+// The templates with the functions which depend on the request.
+func (b *Bagreply) templates() *template.Template {
+	if b.tmpl != nil {
+		return b.tmpl.t
+	}
+	var rt *requestTemplates
+	select {
+	case rt = <-b.App.freeTemplates:
+	default:
+		t, err := b.App.templates.Clone()
+		if err != nil {
+			log.Printf("Error copying templates: %s", err)
+			return b.App.templates
+		}
+		rt = &requestTemplates{t: t}
+		t.Funcs(template.FuncMap{
+			"csrf":  func() string { return rt.b.csrfInput() },
+			"inbox": func() int64 { return rt.b.inbox() },
+		})
+	}
+	rt.b = b
+	b.tmpl = rt
+	return rt.t
+}
+
+// Give the templates of the request back for the next request, once
+// the request is finished with them.
+func (b *Bagreply) releaseTemplates() {
+	if b.tmpl == nil {
+		return
+	}
+	b.tmpl.b = nil
+	select {
+	case b.App.freeTemplates <- b.tmpl:
+	default:
+	}
+	b.tmpl = nil
+}
+
+// Does the request change things, so that it needs a CSRF token?
+func changesState(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// Check the CSRF token of a request. If it is missing or wrong, an
+// error page is sent and the return value is false.
+func (b *Bagreply) checkCSRF() bool {
+	if !changesState(b.r) || b.User == nil || b.Token != nil {
+		return true
+	}
+	sent := b.r.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = b.r.PostFormValue(csrfField)
+	}
+	token := b.csrfToken()
+	if token != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1 {
+		return true
+	}
+	b.w.WriteHeader(http.StatusForbidden)
+	b.errorPage("The form was out of date or was sent from another site. Please go back, reload the page and try again.")
+	return false
+}
+
+// Refuse anything but POST requests to "fn", for handlers which only
+// change things.
+func postOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "This needs a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	ba := getTestApp(t)
+	bu := baguser{b: ba}
+	cookie := &http.Cookie{Name: cookieName, Value: "csrf-test"}
+	err := bu.StoreLogin("tony", cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bu.DeleteCookie(cookie.Value)
+	token, err := sessionCSRF(ba.data, cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 32 {
+		t.Fatalf("Unexpected CSRF token %q", token)
+	}
+	again, err := sessionCSRF(ba.data, cookie.Value)
+	if err != nil || again != token {
+		t.Errorf("CSRF token changed from %q to %q (%v)", token, again, err)
+	}
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		for _, h := range hands {
+			if h.path == path {
+				h.handler(ba)(w, r)
+				return w
+			}
+		}
+		t.Fatalf("No handler for %s", path)
+		return w
+	}
+	// A form from another site, with everything but the token.
+	forged := url.Values{
+		"comment-text": {"forged"},
+		"project":      {"Bagzulla"},
+		"title":        {"forged"},
+		"description":  {"forged"},
+		"name":         {"forged"},
+		"stop":         {"1"},
+		"cause":        {"1"},
+		"effect":       {"2"},
+		"bug":          {"1"},
+	}
+	for _, h := range hands {
+		for _, sent := range []string{"", "wrong"} {
+			form := url.Values{}
+			for k, v := range forged {
+				form[k] = v
+			}
+			if sent != "" {
+				form.Set(csrfField, sent)
+			}
+			w := post(h.path, form)
+			if w.Code != http.StatusForbidden ||
+				!strings.Contains(w.Body.String(), "another site") {
+				t.Errorf("%s with token %q: expected forbidden, got %d",
+					h.path, sent, w.Code)
+			}
+		}
+		if h.post {
+			r := httptest.NewRequest("GET", h.path+"?"+forged.Encode(), nil)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			h.handler(ba)(w, r)
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("GET %s: expected status %d, got %d", h.path,
+					http.StatusMethodNotAllowed, w.Code)
+			}
+		}
+	}
+	// The forms carry the token.
+	r := httptest.NewRequest("GET", "/sessions/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	makeHandler(ba, sessionsHandler, roleViewer)(w, r)
+	if !strings.Contains(w.Body.String(), `name="csrf" value="`+token+`"`) {
+		t.Errorf("No CSRF token in the form of /sessions/")
+	}
+	// The next request reuses the templates with its own token.
+	if len(ba.freeTemplates) == 0 {
+		t.Errorf("The templates were not kept for reuse")
+	}
+	other := &http.Cookie{Name: cookieName, Value: "csrf-test-other"}
+	err = bu.StoreLogin("duncan", other.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bu.DeleteCookie(other.Value)
+	otherToken, err := sessionCSRF(ba.data, other.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/sessions/", nil)
+	r.AddCookie(other)
+	w = httptest.NewRecorder()
+	makeHandler(ba, sessionsHandler, roleViewer)(w, r)
+	if strings.Contains(w.Body.String(), token) ||
+		!strings.Contains(w.Body.String(), `name="csrf" value="`+otherToken+`"`) {
+		t.Errorf("The forms of another session do not have its own token")
+	}
+	// The right token, in the form or in the header, is accepted.
+	w = post("/sessions/", url.Values{
+		"revoke-session": {"0"},
+		csrfField:        {token},
+	})
+	if w.Code != http.StatusFound {
+		t.Errorf("Form with CSRF token: expected status %d, got %d",
+			http.StatusFound, w.Code)
+	}
+	r = httptest.NewRequest("POST", "/sessions/", strings.NewReader("revoke-session=0"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(csrfHeader, token)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	makeHandler(ba, sessionsHandler, roleViewer)(w, r)
+	if w.Code != http.StatusFound {
+		t.Errorf("CSRF token in header: expected status %d, got %d",
+			http.StatusFound, w.Code)
+	}
+	// API tokens do not need it.
+	api, err := insertToken(ba.data, Token{PersonId: 2, Name: "csrf", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("POST", "/sessions/", strings.NewReader("revoke-session=0"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+api)
+	w = httptest.NewRecorder()
+	makeHandler(ba, sessionsHandler, roleViewer)(w, r)
+	if w.Code != http.StatusFound {
+		t.Errorf("API token: expected status %d, got %d", http.StatusFound,
+			w.Code)
+	}
+}
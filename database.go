@@ -10,18 +10,59 @@ import (
 	"bagzulla/bagzullaDb"
 	"database/sql"
 	"errors"
-	"fmt"
 )
 
-// Prepare an SQL statement.
-func PrepareSql(b *Bagreply, sql string) (*sql.Stmt, bool) {
-	stmt, err := b.App.db.Prepare(sql)
+// The store of the request, which is its transaction while it has
+// one.
+func (b *Bagreply) data() *bagzullaDb.Store {
+	if b.tx != nil {
+		return b.tx
+	}
+	return b.App.data
+}
+
+// Make the changes of "f" in a transaction, which is committed if "f"
+// returns true and rolled back if it returns false. "f" sends the
+// error page itself. If the request is already in a transaction, "f"
+// is part of it.
+func (b *Bagreply) inTx(f func() bool) (ok bool) {
+	if b.tx != nil {
+		return f()
+	}
+	failed := errors.New("failed")
+	err := b.App.data.Transact(func(tx *bagzullaDb.Store) error {
+		b.tx = tx
+		defer func() {
+			b.tx = nil
+		}()
+		if !f() {
+			return failed
+		}
+		return nil
+	})
+	after := b.afterCommit
+	b.afterCommit = nil
+	if err == failed {
+		return false
+	}
 	if err != nil {
-		b.errorPage(fmt.Sprintf("Error preparing SQL %s: %s",
-			sql, err.Error()))
-		return stmt, false
+		b.errorPage("Error saving changes: %s", err)
+		return false
 	}
-	return stmt, true
+	for _, f := range after {
+		f()
+	}
+	return true
+}
+
+// Do "f" once the changes of the request are saved, or now if the
+// request is not in a transaction.
+func (b *Bagreply) onCommit(f func()) {
+	if b.tx == nil {
+		f()
+		return
+	}
+	b.afterCommit = append(b.afterCommit, f)
 }
 
 // Scan the rows of a list of bugs returned by a query to the database
@@ -37,199 +78,57 @@ func scanRows(b *Bagreply, rows *sql.Rows) (bugs []bagzullaDb.Bug, ok bool) {
 
 // Make a list of bugs with the specified status.
 var statusBugsSql = `
-SELECT * FROM bug WHERE bug.status=? ORDER BY bug.changed DESC 
+SELECT ` + bagzullaDb.BugFields + ` FROM bug WHERE bug.status=? AND bug.deleted IS NULL
+ORDER BY bug.changed DESC
 `
-var statusBugsStmt *sql.Stmt
+var statusBugsQuery = bagzullaDb.NewQuery(statusBugsSql)
 
 func StatusBugs(b *Bagreply, status int) (bugs []bagzullaDb.Bug, ok bool) {
-	if statusBugsStmt == nil {
-		statusBugsStmt, ok = PrepareSql(b, statusBugsSql)
-		if !ok {
-			return bugs, false
-		}
-	}
-	rows, err := statusBugsStmt.Query(status)
-	defer rows.Close()
+	rows, err := b.data().Stmt(statusBugsQuery).Query(status)
 	if err != nil {
 		b.errorPage("Error looking for status %d bugs: %s", status, err.Error())
 		return bugs, false
 	}
+	defer rows.Close()
 	bugs, ok = scanRows(b, rows)
 	return bugs, ok
 }
 
-// Delete a part of a project
+// Take the bugs out of a part which is being purged.
 
 var setNoPartSQL = `
 UPDATE bug SET part_id=0 WHERE part_id=?
 `
-var setNoPartStmt *sql.Stmt
-
-// Delete a part from a project.
-func deletePart(b *Bagreply) {
-	part, ok := getPart(b)
-	if !ok {
-		return
-	}
-	setNoPartStmt, ok := PrepareSql(b, setNoPartSQL)
-	if !ok {
-		return
-	}
-	_, err := setNoPartStmt.Exec(part.PartId)
-	if err != nil {
-		b.errorPage("Error changing existing parts: %s", err.Error())
-	}
-	err = bagzullaDb.UpdateProjectIdForPart(b.App.db, 0, part.PartId)
-	if err != nil {
-		b.errorPage("Error setting project id to 0 for part %d: %s",
-			part.PartId, err.Error())
-	}
-	// Redirect user back to main project.
-	redirectToProject(b, part.ProjectId)
-}
+var setNoPartQuery = bagzullaDb.NewQuery(setNoPartSQL)
 
 // Get a count of open bugs by project
 
 var openBugCounts = `
 SELECT count(*), project_id
 FROM bug
-WHERE status=0
+WHERE status=0 AND deleted IS NULL
 GROUP BY project_id
 `
 
-var openBugCountsStmt *sql.Stmt
+var openBugCountsQuery = bagzullaDb.NewQuery(openBugCounts)
 
-func getOpenBugs(b *Bagreply, projects []bagzullaDb.Project) (openBugs []int64, err error) {
-	var maxProjectId int64
-	for _, project := range projects {
-		if project.ProjectId > maxProjectId {
-			maxProjectId = project.ProjectId
-		}
-	}
-	if openBugCountsStmt == nil {
-		openBugCountsStmt, err = b.App.db.Prepare(openBugCounts)
-		if err != nil {
-			return
-		}
-	}
-	rows, err := openBugCountsStmt.Query()
-	openBugs = make([]int64, maxProjectId+1)
-	defer rows.Close()
+func getOpenBugs(b *Bagreply) (openBugs map[int64]int64, err error) {
+	openBugs = make(map[int64]int64)
+	rows, err := b.data().Stmt(openBugCountsQuery).Query()
 	if err != nil {
-		return
+		return openBugs, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var count int64
 		var id int64
 		err = rows.Scan(&count, &id)
 		if err != nil {
-			return
-		}
-		if id > maxProjectId {
-			err = errors.New(fmt.Sprintf("Id is too big %d >= %d", id, maxProjectId))
 			return openBugs, err
 		}
 		openBugs[id] = count
 	}
-	return openBugs, nil
-}
-
-// Get a list of open bugs with a particular project ID
-
-var openBugFromProjectId = "SELECT " + bagzullaDb.SelFi + ` FROM bug
-WHERE bug.project_id = ?
-AND bug.status=0
-ORDER BY bug.changed DESC
-`
-
-var openBugFromProjectIdStmt *sql.Stmt
-
-func openBugsFromProjectId(db *sql.DB, project_id int64) (bugs []bagzullaDb.Bug, err error) {
-	if openBugFromProjectIdStmt == nil {
-		openBugFromProjectIdStmt, err = db.Prepare(openBugFromProjectId)
-		if err != nil {
-			return
-		}
-	}
-	rows, err := openBugFromProjectIdStmt.Query(project_id)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-	return bagzullaDb.BugsFromRows(rows)
-}
-
-// Get a list of open bugs with a particular part-of-project ID
-
-var openBugFromPartId = "SELECT " + bagzullaDb.SelFi + ` FROM bug
-WHERE bug.part_id = ?
-AND (bug.status=0)
-ORDER BY bug.changed DESC
-`
-
-var openBugFromPartIdStmt *sql.Stmt
-
-func openBugsFromPartId(db *sql.DB, part_id int64) (bugs []bagzullaDb.Bug, err error) {
-	if openBugFromPartIdStmt == nil {
-		openBugFromPartIdStmt, err = db.Prepare(openBugFromPartId)
-		if err != nil {
-			return
-		}
-	}
-	rows, err := openBugFromPartIdStmt.Query(part_id)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-	return bagzullaDb.BugsFromRows(rows)
-}
-
-// Get the user ID number corresponding to the name and password
-// given.
-
-var userIdSql = `
-SELECT person_id FROM person WHERE name = ? AND password = ?
-`
-
-var userIdStmt *sql.Stmt
-
-func userId(b *Bagreply) (int64, bool) {
-	var p bagzullaDb.Person
-	p.Name = b.r.FormValue("name")
-	p.Password = b.r.FormValue("password")
-	var err error
-	if userIdStmt == nil {
-		userIdStmt, err = b.App.db.Prepare(userIdSql)
-		if err != nil {
-			b.errorPage(fmt.Sprintf("Error preparing SQL %s: %s",
-				userIdSql, err.Error()))
-			return 0, false
-		}
-	}
-	rows, err := userIdStmt.Query(p.Name, p.Password)
-	defer rows.Close()
-	if err != nil {
-		b.errorPage("Error retrieving user id from database: %s",
-			err.Error())
-		return 0, false
-	}
-	found := false
-	for rows.Next() {
-		if found {
-			b.errorPage("Duplicate user ids for this name/password combination")
-			return 0, false
-		}
-		err = rows.Scan(&p.PersonId)
-		if err != nil {
-			b.errorPage("Error retrieving ID: %s", err.Error())
-		}
-		found = true
-	}
-	if found {
-		return p.PersonId, true
-	}
-	b.errorPage("User with name <b>%s</b> and password <b>%s</b> was not found", p.Name, p.Password)
-	return 0, false
+	return openBugs, rows.Err()
 }
 
 // https://devtidbits.com/2020/08/03/go-sql-error-converting-null-to-string-is-unsupported/
@@ -243,21 +142,13 @@ type text struct {
 
 // Search the database for "string".
 
+var textSearchSql = `SELECT content, txt_id, txttype, other_id
+FROM txt WHERE content LIKE '%' || ? || '%' AND txttype IS NOT 'deleted'`
+
+var textSearchQuery = bagzullaDb.NewQuery(textSearchSql)
+
 func searchText(b *Bagreply, searchTerm string) (txtIds []text, ok bool) {
-	var textSearchSql = "SELECT " +
-		"content, txt_id, txttype, other_id " +
-		"FROM txt WHERE content LIKE '%" + searchTerm +
-		"%' AND txttype IS NOT 'deleted'"
-	var textSearchStmt *sql.Stmt
-	if false {
-		b.errorPage("%s\n", textSearchSql)
-		return txtIds, false
-	}
-	textSearchStmt, ok = PrepareSql(b, textSearchSql)
-	if !ok {
-		return txtIds, false
-	}
-	rows, err := textSearchStmt.Query()
+	rows, err := b.data().Stmt(textSearchQuery).Query(searchTerm)
 	if err != nil {
 		b.errorPage("Error searching for '%s': %s", searchTerm, err.Error())
 		return txtIds, false
@@ -273,7 +164,7 @@ func searchText(b *Bagreply, searchTerm string) (txtIds []text, ok bool) {
 		switch r.Type.String {
 		case "comment":
 			var c bagzullaDb.Comment
-			c, err = bagzullaDb.CommentFromId(b.App.db, r.OtherId.Int64)
+			c, err = b.data().CommentFromId(r.OtherId.Int64)
 			r.BugId = c.BugId
 		case "title", "description":
 			r.BugId = r.OtherId.Int64
@@ -285,29 +176,6 @@ func searchText(b *Bagreply, searchTerm string) (txtIds []text, ok bool) {
 	return txtIds, true
 }
 
-var bugsByChangeSql = `
-SELECT * FROM bug ORDER BY bug.changed DESC limit ?
-`
-
-var bugsByChangeStmt *sql.Stmt
-
-func BugsByChange(b *Bagreply, m int64) (bugs []bagzullaDb.Bug, ok bool) {
-	if bugsByChangeStmt == nil {
-		bugsByChangeStmt, ok = PrepareSql(b, bugsByChangeSql)
-		if !ok {
-			return bugs, false
-		}
-	}
-	rows, err := bugsByChangeStmt.Query(m)
-	defer rows.Close()
-	if err != nil {
-		b.errorPage("Error getting bugs by change time: %s", err.Error())
-		return bugs, false
-	}
-	bugs, ok = scanRows(b, rows)
-	return bugs, ok
-}
-
 // Update the text associated with a particular comment by putting the
 // new text's id number into the database.
 
@@ -315,16 +183,10 @@ var updateCommentTextIdSql = `
 UPDATE comment SET txt_id=? WHERE comment_id=?
 `
 
-var updateCommentTextIdStmt *sql.Stmt
+var updateCommentTextIdQuery = bagzullaDb.NewQuery(updateCommentTextIdSql)
 
 func UpdateCommentTextId(b *Bagreply, c int64, t int64) (ok bool) {
-	if updateCommentTextIdStmt == nil {
-		updateCommentTextIdStmt, ok = PrepareSql(b, updateCommentTextIdSql)
-		if !ok {
-			return false
-		}
-	}
-	_, err := updateCommentTextIdStmt.Exec(t, c)
+	_, err := b.data().Stmt(updateCommentTextIdQuery).Exec(t, c)
 	if err != nil {
 		b.errorPage("Error changing text content of comment %d to %d: %s",
 			c, t, err.Error())
@@ -334,19 +196,17 @@ func UpdateCommentTextId(b *Bagreply, c int64, t int64) (ok bool) {
 }
 
 var effectToCausesSql = `
-SELECT cause_id WHERE effect_id=?
+SELECT cause FROM dependency WHERE effect = ?
 `
 
-var effectToCausesStmt *sql.Stmt
+var effectToCausesQuery = bagzullaDb.NewQuery(effectToCausesSql)
 
 func EffectToCauses(b *Bagreply, effect int64) (causes []int64, ok bool) {
-	if effectToCausesStmt == nil {
-		effectToCausesStmt, ok = PrepareSql(b, effectToCausesSql)
-		if !ok {
-			return causes, false
-		}
+	rows, err := b.data().Stmt(effectToCausesQuery).Query(effect)
+	if err != nil {
+		b.errorPage("Error looking for causes of bug %d: %s", effect, err.Error())
+		return causes, false
 	}
-	rows, err := effectToCausesStmt.Query(effect)
 	defer rows.Close()
 	for rows.Next() {
 		var cause int64
@@ -360,19 +220,17 @@ func EffectToCauses(b *Bagreply, effect int64) (causes []int64, ok bool) {
 }
 
 var causeToEffectsSql = `
-SELECT effect_id WHERE cause_id=?
+SELECT effect FROM dependency WHERE cause = ?
 `
 
-var causeToEffectsStmt *sql.Stmt
+var causeToEffectsQuery = bagzullaDb.NewQuery(causeToEffectsSql)
 
 func CauseToEffects(b *Bagreply, cause int64) (effects []int64, ok bool) {
-	if causeToEffectsStmt == nil {
-		causeToEffectsStmt, ok = PrepareSql(b, causeToEffectsSql)
-		if !ok {
-			return effects, false
-		}
+	rows, err := b.data().Stmt(causeToEffectsQuery).Query(cause)
+	if err != nil {
+		b.errorPage("Error looking for effects of bug %d: %s", cause, err.Error())
+		return effects, false
 	}
-	rows, err := causeToEffectsStmt.Query(cause)
 	defer rows.Close()
 	for rows.Next() {
 		var effect int64
@@ -390,20 +248,14 @@ SELECT original
 FROM duplicate
 WHERE duplicate.duplicate = ?
 `
-var originalFromDuplicateStmt *sql.Stmt
+var originalFromDuplicateQuery = bagzullaDb.NewQuery(originalFromDuplicateSql)
 
-func OriginalsFromDuplicate(db *sql.DB, duplicate int64) (originals []RelatedBug, err error) {
-	if originalFromDuplicateStmt == nil {
-		originalFromDuplicateStmt, err = db.Prepare(originalFromDuplicateSql)
-		if err != nil {
-			return originals, err
-		}
-	}
-	rows, err := originalFromDuplicateStmt.Query(duplicate)
-	defer rows.Close()
+func OriginalsFromDuplicate(store *bagzullaDb.Store, duplicate int64) (originals []RelatedBug, err error) {
+	rows, err := store.Stmt(originalFromDuplicateQuery).Query(duplicate)
 	if err != nil {
 		return originals, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var original int64
 		err = rows.Scan(&original)
@@ -417,16 +269,10 @@ func OriginalsFromDuplicate(db *sql.DB, duplicate int64) (originals []RelatedBug
 
 var deleteFileSql = `DELETE FROM image WHERE file = ?`
 
-var deleteFileStmt *sql.Stmt
+var deleteFileQuery = bagzullaDb.NewQuery(deleteFileSql)
 
-func removeImage(db *sql.DB, file string) (err error) {
-	if deleteFileStmt == nil {
-		deleteFileStmt, err = db.Prepare(deleteFileSql)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = deleteFileStmt.Exec(file)
+func removeImage(store *bagzullaDb.Store, file string) (err error) {
+	_, err = store.Stmt(deleteFileQuery).Exec(file)
 	if err != nil {
 		return err
 	}
@@ -435,16 +281,10 @@ func removeImage(db *sql.DB, file string) (err error) {
 
 var deleteDuplicateSql = `DELETE FROM duplicate WHERE duplicate = ?`
 
-var deleteDuplicateStmt *sql.Stmt
+var deleteDuplicateQuery = bagzullaDb.NewQuery(deleteDuplicateSql)
 
-func removeDuplicate(db *sql.DB, duplicate int64) (err error) {
-	if deleteDuplicateStmt == nil {
-		deleteDuplicateStmt, err = db.Prepare(deleteDuplicateSql)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = deleteDuplicateStmt.Exec(duplicate)
+func removeDuplicate(store *bagzullaDb.Store, duplicate int64) (err error) {
+	_, err = store.Stmt(deleteDuplicateQuery).Exec(duplicate)
 	if err != nil {
 		return err
 	}
@@ -453,16 +293,10 @@ func removeDuplicate(db *sql.DB, duplicate int64) (err error) {
 
 var deleteDuplicateOrigSql = `DELETE FROM duplicate WHERE original = ?`
 
-var deleteDuplicateOrigStmt *sql.Stmt
+var deleteDuplicateOrigQuery = bagzullaDb.NewQuery(deleteDuplicateOrigSql)
 
-func removeDuplicateOrig(db *sql.DB, orig int64) (err error) {
-	if deleteDuplicateOrigStmt == nil {
-		deleteDuplicateOrigStmt, err = db.Prepare(deleteDuplicateOrigSql)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = deleteDuplicateOrigStmt.Exec(orig)
+func removeDuplicateOrig(store *bagzullaDb.Store, orig int64) (err error) {
+	_, err = store.Stmt(deleteDuplicateOrigQuery).Exec(orig)
 	if err != nil {
 		return err
 	}
@@ -471,16 +305,10 @@ func removeDuplicateOrig(db *sql.DB, orig int64) (err error) {
 
 var deleteDependencyCauseSql = `DELETE FROM dependency WHERE cause = ? AND effect = ?`
 
-var deleteDependencyCauseStmt *sql.Stmt
+var deleteDependencyCauseQuery = bagzullaDb.NewQuery(deleteDependencyCauseSql)
 
-func removeDependencyCause(db *sql.DB, cause int64, effect int64) (err error) {
-	if deleteDependencyCauseStmt == nil {
-		deleteDependencyCauseStmt, err = db.Prepare(deleteDependencyCauseSql)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = deleteDependencyCauseStmt.Exec(cause, effect)
+func removeDependencyCause(store *bagzullaDb.Store, cause int64, effect int64) (err error) {
+	_, err = store.Stmt(deleteDependencyCauseQuery).Exec(cause, effect)
 	if err != nil {
 		return err
 	}
@@ -490,32 +318,25 @@ func removeDependencyCause(db *sql.DB, cause int64, effect int64) (err error) {
 // The sessions are not stored in the database but in a file called
 // "logins.json". This should be updated when they are stored there.
 
-var searchCookieSQL = "SELECT person_id FROM session WHERE cookie=?"
-var searchCookieStmt *sql.Stmt
+var searchCookieSQL = "SELECT " + sessionFields + " FROM session WHERE cookie=?"
+var searchCookieQuery = bagzullaDb.NewQuery(searchCookieSQL)
 
-func SearchCookie(b *Bagapp, cookie string) (personId int64, found bool, err error) {
-	if searchCookieStmt == nil {
-		var err error
-		searchCookieStmt, err = b.db.Prepare(searchCookieSQL)
-		if err != nil {
-			return 0, false, err
-		}
-	}
-	rows, err := searchCookieStmt.Query(cookie)
-	defer rows.Close()
+func SearchCookie(b *Bagapp, cookie string) (s Session, found bool, err error) {
+	rows, err := b.data.Stmt(searchCookieQuery).Query(cookie)
 	if err != nil {
-		return 0, false, err
+		return s, false, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		err := rows.Scan(&personId)
+		s, err = scanSession(rows)
 		if err != nil {
-			return 0, false, err
+			return s, false, err
 		}
-		if personId != 0 {
-			return personId, true, nil
+		if s.PersonId != 0 {
+			return s, true, nil
 		}
 	}
-	return 0, false, nil
+	return s, false, rows.Err()
 }
 
 var txtDeleteSQL = `
@@ -524,16 +345,10 @@ SET txttype="deleted"
 WHERE txt_id = ?
 `
 
-var txtDeleteStmt *sql.Stmt
+var txtDeleteQuery = bagzullaDb.NewQuery(txtDeleteSQL)
 
 func (b *Bagreply) DeleteText(id int64) (ok bool) {
-	if txtDeleteStmt == nil {
-		txtDeleteStmt, ok = PrepareSql(b, txtDeleteSQL)
-		if !ok {
-			return false
-		}
-	}
-	_, err := txtDeleteStmt.Exec(id)
+	_, err := b.data().Stmt(txtDeleteQuery).Exec(id)
 	if err != nil {
 		b.errorPage("Error changing text to deleted status: %s", err.Error())
 		return false
@@ -1,7 +1,415 @@
 package main
 
-import "testing"
+import (
+	"bagzulla/bagzullaDb"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The directory where the test database is kept.
+var testDir string
+
+func TestMain(m *testing.M) {
+	var err error
+	testDir, err = ioutil.TempDir("", "bagzulla-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+var testApp *Bagapp
+var testAppOnce sync.Once
+
+// Some people and projects for the tests.
+var testSeed = `
+INSERT INTO person(name, email, password, role) VALUES('duncan', 'duncan@localhost', '12345', 'developer');
+INSERT INTO person(name, email, password, role) VALUES('tony', 'tony@localhost', 'abcde', 'developer');
+INSERT INTO txt(content, entered) VALUES('Project unspecified', CURRENT_TIMESTAMP);
+INSERT INTO project(name, directory, description, owner, status, inbox) VALUES('None', '', 1, 1, 0, 1);
+INSERT INTO project(name, directory, description, owner, status) VALUES('Bagzulla', '', 1, 1, 0);
+`
+
+// Get an application with a database made by the migrations in a
+// temporary directory. All the tests share one database, which is
+// only made once.
+func getTestApp(t testing.TB) *Bagapp {
+	testAppOnce.Do(func() {
+		var ba Bagapp
+		var err error
+		ba.db, err = bagzullaDb.Open(filepath.Join(testDir, "bagzulla.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = migrate(ba.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ba.db.Exec(testSeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ba.data, err = bagzullaDb.NewStore(ba.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ba.TopURL = "http://localhost"
+		ba.files, err = openFileStore(filepath.Join(testDir, "files"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ba.initAuth(authConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ba.loadTemplates("tmpl/")
+		ba.makeNameCaches()
+		ba.Context, ba.Cancel = context.WithCancel(context.Background())
+		testApp = &ba
+	})
+	if testApp == nil {
+		t.Fatal("No test application")
+	}
+	return testApp
+}
+
+// Add an active project called "name" to the test database.
+func addTestProject(t testing.TB, ba *Bagapp, name string) (projectId int64) {
+	t.Helper()
+	result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status)
+VALUES(?, '', 1, 1, 0)`, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId, err = result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return projectId
+}
+
+// Add a person called "name" with the role "role" to the test
+// database.
+func addTestPerson(t testing.TB, ba *Bagapp, name string, role string) (personId int64) {
+	t.Helper()
+	result, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES(?, ?, 'x', ?)`, name, name+"@localhost", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	personId, err = result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return personId
+}
 
 func TestSearchCookie(t *testing.T) {
 
 }
+
+// Each store has its own statements, so stores for two databases can
+// be used at the same time.
+func TestStores(t *testing.T) {
+	var stores []*bagzullaDb.Store
+	for _, name := range []string{"store1.db", "store2.db"} {
+		db := openTestDb(t, name, "")
+		_, err := migrate(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := bagzullaDb.NewStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		_, err = store.InsertPerson(bagzullaDb.Person{Name: name, Email: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, store)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := stores[i%2]
+			for j := 0; j < 20; j++ {
+				persons, err := store.AllPersons()
+				if err != nil || len(persons) != 1 {
+					t.Errorf("Got %d people: %v", len(persons), err)
+					return
+				}
+				if _, err := store.Prepared("SELECT COUNT(*) FROM bug"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, name := range []string{"store1.db", "store2.db"} {
+		person, err := stores[i].PersonFromName(name)
+		if err != nil || person.PersonId == 0 {
+			t.Errorf("%s not found in its own database: %v", name, err)
+		}
+	}
+
+	// The dependencies, which could not be prepared before.
+	ba := getTestApp(t)
+	cause, err := addBug(ba.data, "Cause", "Causes", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	effect, err := addBug(ba.data, "Effect", "Effects", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ba.data.InsertDependency(bagzullaDb.Dependency{Cause: cause, Effect: effect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Bagreply{App: ba, w: httptest.NewRecorder(), r: httptest.NewRequest("GET", "/", nil)}
+	causes, ok := EffectToCauses(b, effect)
+	effects, ok2 := CauseToEffects(b, cause)
+	if !ok || !ok2 || !reflect.DeepEqual(causes, []int64{cause}) || !reflect.DeepEqual(effects, []int64{effect}) {
+		t.Errorf("Dependencies gave %v %v", causes, effects)
+	}
+}
+
+// A store for a database which has been closed, so that every query
+// fails.
+func closedStore(t *testing.T, name string) *bagzullaDb.Store {
+	db := openTestDb(t, name, "")
+	_, err := migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := bagzullaDb.NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	return store
+}
+
+// Each application has its own caches of names, so that the names of
+// one database are not shown for another.
+func TestNameCaches(t *testing.T) {
+	ba := getTestApp(t)
+	first, ok := getProjectName(&Bagreply{App: ba}, 2)
+	if !ok {
+		t.Fatal("No name for project 2")
+	}
+	db := openTestDb(t, "names.db", "")
+	defer db.Close()
+	_, err := migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(testSeed + `UPDATE project SET name = 'Elsewhere' WHERE project_id = 2;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := bagzullaDb.NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other := &Bagapp{db: db, data: store}
+	other.makeNameCaches()
+	second, ok := getProjectName(&Bagreply{App: other}, 2)
+	if !ok || second != "Elsewhere" {
+		t.Errorf("Project 2 of the other database is %q, not Elsewhere (the first is %q)",
+			second, first)
+	}
+}
+
+// A query which fails gives an error page rather than a panic.
+func TestQueryErrors(t *testing.T) {
+	ba := getTestApp(t)
+	store := closedStore(t, "closed-queries.db")
+	app := &Bagapp{db: store.DB, data: store, templates: ba.templates}
+	checks := map[string]func(b *Bagreply) bool{
+		"StatusBugs": func(b *Bagreply) bool {
+			_, ok := StatusBugs(b, 0)
+			return ok
+		},
+		"EffectToCauses": func(b *Bagreply) bool {
+			_, ok := EffectToCauses(b, 1)
+			return ok
+		},
+		"CauseToEffects": func(b *Bagreply) bool {
+			_, ok := CauseToEffects(b, 1)
+			return ok
+		},
+		"OriginalsFromDuplicate": func(b *Bagreply) bool {
+			_, err := OriginalsFromDuplicate(b.data(), 1)
+			return err == nil
+		},
+	}
+	for name, check := range checks {
+		w := httptest.NewRecorder()
+		b := &Bagreply{App: app, w: w, r: httptest.NewRequest("GET", "/", nil)}
+		if check(b) {
+			t.Errorf("%s did not fail with a closed database", name)
+		}
+	}
+}
+
+// Count the rows of "table".
+func countRows(t *testing.T, ba *Bagapp, table string) (n int64) {
+	err := ba.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Make a later write fail with a trigger, and check that the earlier
+// writes of the change are rolled back.
+func TestTransactions(t *testing.T) {
+	ba := getTestApp(t)
+	fail := func(trigger string) {
+		_, err := ba.db.Exec(trigger)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer ba.db.Exec(`DROP TRIGGER IF EXISTS fail_test`)
+
+	// The title and description of a bug are not kept if the bug
+	// cannot be made.
+	texts := countRows(t, ba, "txt")
+	fail(`CREATE TRIGGER fail_test BEFORE INSERT ON bug BEGIN SELECT RAISE(ABORT, 'injected'); END`)
+	_, err := addBug(ba.data, "Lost", "Not kept", 2, 0, 1)
+	if err == nil {
+		t.Error("addBug did not fail")
+	}
+	if got := countRows(t, ba, "txt"); got != texts {
+		t.Errorf("%d texts after a failed bug, expected %d", got, texts)
+	}
+	ba.db.Exec(`DROP TRIGGER fail_test`)
+
+	// Moving a bug to another project does not keep the new project
+	// if its part cannot be reset.
+	bugId, err := addBug(ba.data, "Mover", "Moves", 2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bug, err := ba.data.BugFromId(bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail(`CREATE TRIGGER fail_test BEFORE UPDATE OF part_id ON bug BEGIN SELECT RAISE(ABORT, 'injected'); END`)
+	var events int
+	duncan := bagzullaDb.Person{PersonId: 1, Name: "duncan"}
+	b := &Bagreply{App: ba, User: &duncan, w: httptest.NewRecorder(),
+		r: httptest.NewRequest("POST", "/", nil), perms: &permissions{Permissions: bagzullaDb.Permissions{Role: roleAdmin}}}
+	if b.moveBug(bug, 1, 0) {
+		t.Error("moveBug did not fail")
+	}
+	if !strings.Contains(b.w.(*httptest.ResponseRecorder).Body.String(), "injected") {
+		t.Error("Move did not fail at the trigger")
+	}
+	ba.db.Exec(`DROP TRIGGER fail_test`)
+	bug, err = ba.data.BugFromId(bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bug.ProjectId != 2 {
+		t.Errorf("Bug is in project %d after a failed move", bug.ProjectId)
+	}
+
+	// What is done after a commit only happens if it succeeds.
+	ok := b.inTx(func() bool {
+		b.onCommit(func() { events++ })
+		err := b.data().UpdateStatusForBug(1, bugId)
+		if err != nil {
+			t.Error(err)
+		}
+		return false
+	})
+	if ok || events != 0 {
+		t.Errorf("Rolled back change gave %t with %d events", ok, events)
+	}
+	bug, _ = ba.data.BugFromId(bugId)
+	if bug.Status != 0 {
+		t.Errorf("Status %d kept after rollback", bug.Status)
+	}
+	ok = b.inTx(func() bool {
+		b.onCommit(func() { events++ })
+		return b.moveBug(bug, 1, 0)
+	})
+	bug, _ = ba.data.BugFromId(bugId)
+	if !ok || events != 1 || bug.ProjectId != 1 {
+		t.Errorf("Move gave %t with %d events, bug in project %d: %s", ok, events,
+			bug.ProjectId, b.w.(*httptest.ResponseRecorder).Body)
+	}
+}
+
+// The generated code reads NULL as the zero value, gives columns their
+// defaults, and fills in the column which a row was found by.
+func TestGeneratedStore(t *testing.T) {
+	ba := getTestApp(t)
+	id, err := ba.data.InsertPerson(bagzullaDb.Person{Name: "gene", Email: "gene@localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err := ba.data.PersonFromName("gene")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if person.PersonId != id || person.Name != "gene" || person.Role != "reporter" ||
+		person.Status != accountActive || !person.Registered.IsZero() {
+		t.Errorf("Got %+v", person)
+	}
+	// An update to the zero value writes it, rather than NULL, which
+	// a column with a default cannot hold.
+	for _, private := range []int64{1, 0} {
+		err = ba.data.UpdatePrivateForProject(private, 2)
+		if err != nil {
+			t.Fatalf("Updating private to %d: %s", private, err)
+		}
+		project, err := ba.data.ProjectFromId(2)
+		if err != nil || project.Private != private {
+			t.Errorf("Private is %d, not %d: %v", project.Private, private, err)
+		}
+	}
+	err = ba.data.DeletePerson(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	person, err = ba.data.PersonFromName("gene")
+	if err != nil || person.PersonId != 0 {
+		t.Errorf("Deleted person gave %+v %v", person, err)
+	}
+	if ba.data.DeletePerson(id) == nil {
+		t.Error("No error deleting a deleted person")
+	}
+	_, err = ba.data.PersonFromId(id)
+	if err == nil {
+		t.Error("No error getting a deleted person")
+	}
+
+	result, err := ba.db.Exec(`INSERT INTO txt(content) VALUES('bare')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txtId, _ := result.LastInsertId()
+	txt, err := ba.data.TxtFromIdContext(context.Background(), txtId)
+	if err != nil || txt.Content != "bare" || txt.Txttype != "" || !txt.Entered.IsZero() {
+		t.Errorf("Got %+v %v", txt, err)
+	}
+}
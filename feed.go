@@ -0,0 +1,279 @@
+// Atom feeds of changes to bugs, so that people can follow the bug
+// tracker in a feed reader.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of entries in a feed.
+var feedLength int64 = 50
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Content *atomText   `xml:"content,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// Format a time for a feed.
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Make an absolute URL from "path", which should start with a slash.
+// If the top URL given on the command line is not absolute, the host
+// of the request is used.
+func (b *Bagreply) absURL(path string) string {
+	top := b.App.TopURL
+	if !strings.Contains(top, "://") {
+		scheme := "http"
+		if b.r.TLS != nil {
+			scheme = "https"
+		}
+		top = scheme + "://" + b.r.Host
+	}
+	return strings.TrimSuffix(top, "/") + path
+}
+
+// Add an entry to the feed, and make the feed's update time the
+// latest update time of its entries.
+func (f *atomFeed) add(e atomEntry, updated time.Time) {
+	e.Updated = atomTime(updated)
+	if e.Updated > f.Updated {
+		f.Updated = e.Updated
+	}
+	f.Entries = append(f.Entries, e)
+}
+
+// Start a feed with the given title for the page at "path".
+func (b *Bagreply) newFeed(title string, path string) (f atomFeed) {
+	f.Title = title
+	f.Id = b.absURL(path)
+	f.Links = []atomLink{
+		{Href: b.absURL(path), Rel: "alternate", Type: "text/html"},
+		{Href: b.absURL("/feed" + path), Rel: "self", Type: "application/atom+xml"},
+	}
+	return f
+}
+
+// Make a feed from a list of bugs, with each bug's change time as the
+// time of its entry.
+func (b *Bagreply) bugFeed(title string, path string, bugs []ListBug) (f atomFeed, ok bool) {
+	f = b.newFeed(title, path)
+	for _, lb := range bugs {
+		bugURL := b.absURL(fmt.Sprintf("/bug/%d", lb.Bug.BugId))
+		title := lb.Title
+		if lb.ProjectName != "" {
+			title = lb.ProjectName + ": " + title
+		}
+		e := atomEntry{
+			Title: fmt.Sprintf("%s [%s]", title, lb.Status),
+			Id:    bugURL,
+			Link:  atomLink{Href: bugURL},
+			Author: &atomPerson{
+				Name: lb.Owner,
+				URI:  b.absURL(fmt.Sprintf("/person/%d", lb.Bug.Owner)),
+			},
+			Content: &atomText{Type: "text", Text: lb.Description},
+		}
+		f.add(e, lb.Bug.Changed)
+	}
+	return f, true
+}
+
+// Write the feed to the user.
+func (b *Bagreply) writeFeed(f atomFeed) {
+	if f.Updated == "" {
+		f.Updated = atomTime(time.Now())
+	}
+	out, err := xml.MarshalIndent(f, "", " ")
+	if err != nil {
+		b.errorPage("Error making feed: %s", err)
+		return
+	}
+	b.w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	b.w.Write([]byte(xml.Header))
+	b.w.Write(out)
+}
+
+// Get the most recently changed bugs, or those with a particular
+// project, part or owner.
+func feedBugs(b *Bagreply, which string, id int64) (bugs []ListBug, ok bool) {
+	l := feedBugLists[which]
+	l.limit = feedLength
+	if which == "recent" {
+		return b.bugList(l)
+	}
+	return b.bugList(l, id)
+}
+
+// Make the feed of comments of a single bug.
+func bugCommentFeed(b *Bagreply, bugId int64) (f atomFeed, ok bool) {
+	bug, err := b.data().BugFromId(bugId)
+	if err != nil {
+		b.errorPage("Error retrieving bug with id %d from database: %s",
+			bugId, err)
+		return f, false
+	}
+	if b.NotAllowed(roleViewer, bug.ProjectId) || b.inTrash("bug", bugId, bug.Deleted) {
+		return f, false
+	}
+	lb, ok := getBugInfo(b, bug)
+	if !ok {
+		return f, false
+	}
+	path := fmt.Sprintf("/bug/%d", bugId)
+	bugURL := b.absURL(path)
+	f = b.newFeed(fmt.Sprintf("Bug %d: %s", bugId, lb.Title), path)
+	f.add(atomEntry{
+		Title:   lb.Title,
+		Id:      bugURL,
+		Link:    atomLink{Href: bugURL},
+		Author:  &atomPerson{Name: lb.Owner},
+		Content: &atomText{Type: "text", Text: lb.Description},
+	}, bug.Entered)
+	comments, err := b.data().CommentsFromBugId(bugId)
+	if err != nil {
+		b.errorPage("Error getting comments for bug %d: %s", bugId, err)
+		return f, false
+	}
+	for _, c := range liveComments(comments) {
+		txt, ok := getText(b, c.TxtId)
+		if !ok {
+			return f, false
+		}
+		person, ok := getPersonName(b, c.PersonId)
+		if !ok {
+			return f, false
+		}
+		commentURL := fmt.Sprintf("%s#comment-%d", bugURL, c.CommentId)
+		f.add(atomEntry{
+			Title:   fmt.Sprintf("Comment by %s", person),
+			Id:      commentURL,
+			Link:    atomLink{Href: commentURL},
+			Author:  &atomPerson{Name: person},
+			Content: &atomText{Type: "text", Text: txt.Content},
+		}, txt.Entered)
+	}
+	return f, true
+}
+
+var feedPath = regexp.MustCompile(`^/feed/(recent|project|part|person|bug)(?:/([0-9]+))?/?$`)
+
+// Handle /feed/recent/, /feed/project/N, /feed/part/N, /feed/person/N
+// and /feed/bug/N.
+func feedHandler(b *Bagreply) {
+	m := feedPath.FindStringSubmatch(b.r.URL.Path)
+	if m == nil {
+		b.errorPage("Unknown feed %s", b.r.URL.Path)
+		return
+	}
+	which := m[1]
+	var id int64
+	if which != "recent" {
+		var err error
+		id, err = strconv.ParseInt(m[2], 10, 64)
+		if err != nil || id == 0 {
+			b.errorPage("Feed %s needs an ID number", b.r.URL.Path)
+			return
+		}
+	}
+	var f atomFeed
+	var bugs []ListBug
+	var ok bool
+	switch which {
+	case "recent":
+		bugs, ok = feedBugs(b, which, 0)
+		if !ok {
+			return
+		}
+		f, ok = b.bugFeed("Recently changed bugs", "/recent/", bugs)
+	case "project":
+		// A private project is not found, like one which does not
+		// exist, so the access is checked before looking for it.
+		if b.NotAllowed(roleViewer, id) {
+			return
+		}
+		project, err := b.data().ProjectFromId(id)
+		if err != nil {
+			b.w.WriteHeader(http.StatusNotFound)
+			b.errorPage("There is no project with ID %d", id)
+			return
+		}
+		bugs, ok = feedBugs(b, which, id)
+		if !ok {
+			return
+		}
+		f, ok = b.bugFeed(fmt.Sprintf("Bugs in %s", project.Name),
+			fmt.Sprintf("/project/%d", id), bugs)
+	case "part":
+		part, err := b.data().PartFromId(id)
+		if err != nil || !b.canSee(part.ProjectId) {
+			b.w.WriteHeader(http.StatusNotFound)
+			b.errorPage("There is no part with ID %d", id)
+			return
+		}
+		if b.inTrash("part", id, part.Deleted) {
+			return
+		}
+		bugs, ok = feedBugs(b, which, id)
+		if !ok {
+			return
+		}
+		f, ok = b.bugFeed(fmt.Sprintf("Bugs in %s", part.Name),
+			fmt.Sprintf("/part/%d", id), bugs)
+	case "person":
+		person, err := b.data().PersonFromId(id)
+		if err != nil {
+			b.errorPage("Error finding person with ID %d: %s", id, err)
+			return
+		}
+		bugs, ok = feedBugs(b, which, id)
+		if !ok {
+			return
+		}
+		f, ok = b.bugFeed(fmt.Sprintf("Bugs of %s", person.Name),
+			fmt.Sprintf("/person/%d", id), bugs)
+	case "bug":
+		f, ok = bugCommentFeed(b, id)
+	}
+	if !ok {
+		return
+	}
+	b.writeFeed(f)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFeedAccess(t *testing.T) {
+	ba := getTestApp(t)
+	private := addTestProject(t, ba, "Unfed")
+	err := ba.data.UpdatePrivateForProject(1, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := addBug(ba.data, "Unfed secret", "Private", private, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ba.db.Exec(`INSERT INTO part(name, project_id, description) VALUES('Unfed part', ?, 1)`, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretPart, _ := result.LastInsertId()
+	trashed, err := addBug(ba.data, "Unfed rubbish", "Deleted", 2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setTrash(ba.data, "bug", trashed, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		makeHandler(ba, feedHandler, roleViewer)(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/feed/recent/")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Unfed") {
+		t.Errorf("Recent feed has private or deleted bugs: %d %s", w.Code, w.Body.String())
+	}
+	for _, bugId := range []int64{secret, trashed} {
+		w = get(fmt.Sprintf("/feed/bug/%d", bugId))
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "Unfed") {
+			t.Errorf("Feed of bug %d: %d %s", bugId, w.Code, w.Body.String())
+		}
+	}
+
+	// A private project or part looks the same as one which does not
+	// exist.
+	for _, kind := range []string{"project", "part"} {
+		id := private
+		if kind == "part" {
+			id = secretPart
+		}
+		hidden := get(fmt.Sprintf("/feed/%s/%d", kind, id))
+		missing := get(fmt.Sprintf("/feed/%s/%d", kind, id+1000))
+		if hidden.Code != http.StatusNotFound || missing.Code != http.StatusNotFound {
+			t.Errorf("Feeds of %ss: %d and %d", kind, hidden.Code, missing.Code)
+		}
+		want := fmt.Sprintf("There is no %s with ID", kind)
+		if !strings.Contains(hidden.Body.String(), want) || !strings.Contains(missing.Body.String(), want) ||
+			strings.Contains(hidden.Body.String(), "Unfed") {
+			t.Errorf("Feeds of %ss differ: %s\n%s", kind, hidden.Body.String(), missing.Body.String())
+		}
+	}
+}
@@ -85,6 +85,55 @@ func (b *Bagreply) replaceBugN(ins fixstrings) (outs fixstrings) {
 	return outs
 }
 
+var attachmentRegex = "[aA]ttachment\\s+([0-9]+)"
+var attachmentReplace = regexp.MustCompile(attachmentRegex)
+
+// The link for "text", a reference to attachment "a".
+func (b *Bagreply) attachmentLink(a Attachment, text string) string {
+	url := fmt.Sprintf("%s/attachment/%d", b.App.TopURL, a.AttachmentId)
+	name := html.EscapeString(a.Filename)
+	if a.IsImage() {
+		return fmt.Sprintf("<a target='_blank' href='%s'><img class='inline-thumb' src='%s/attachment-thumb/%d' alt='%s' title='%s'></a>",
+			url, b.App.TopURL, a.AttachmentId, name, name)
+	}
+	return fmt.Sprintf("<a target='_blank' href='%s' title='%s'>%s</a>", url, name, text)
+}
+
+// Replace instances of "attachment n" with a link, if attachment n is
+// in "attachments". Others are left alone, so that the text does not
+// show files from a bug which the reader may not be able to see.
+func (b *Bagreply) replaceAttachmentN(ins fixstrings, attachments []Attachment) (outs fixstrings) {
+	byId := make(map[string]Attachment)
+	for _, a := range attachments {
+		byId[fmt.Sprint(a.AttachmentId)] = a
+	}
+	outs = make([]fixstring, 0)
+	for i := range ins {
+		if ins[i].changed {
+			outs = append(outs, ins[i])
+			continue
+		}
+		in := ins[i].s
+		var end = 0
+		for _, r := range attachmentReplace.FindAllStringSubmatchIndex(in, -1) {
+			a, found := byId[in[r[2]:r[3]]]
+			if !found {
+				continue
+			}
+			if r[0] > end {
+				outs = append(outs, fixstring{s: in[end:r[0]], changed: false})
+			}
+			out := b.attachmentLink(a, in[r[0]:r[1]])
+			outs = append(outs, fixstring{s: out, changed: true})
+			end = r[1]
+		}
+		if end < len(in) {
+			outs = append(outs, fixstring{s: in[end:], changed: false})
+		}
+	}
+	return outs
+}
+
 func (b *Bagreply) bugsToLinks(ins fixstrings) (outs fixstrings) {
 	outs = b.replaceBugN(ins)
 	return outs
@@ -92,6 +141,13 @@ func (b *Bagreply) bugsToLinks(ins fixstrings) (outs fixstrings) {
 
 // Replace URLs in the text with actual links
 func (b *Bagreply) urlsToLinks(input string) (out string) {
+	return b.bugTextToLinks(input, nil)
+}
+
+// Replace URLs in the text of a bug with links, and "attachment n",
+// where n is one of the bug's attachments, with a link to it, or its
+// thumbnail if it is an image.
+func (b *Bagreply) bugTextToLinks(input string, attachments []Attachment) (out string) {
 	ins := fixstrings{fixstring{s: input, changed: false}}
 	outs := make(fixstrings, 0)
 	for i := range ins {
@@ -118,6 +174,9 @@ func (b *Bagreply) urlsToLinks(input string) (out string) {
 		}
 	}
 	outs = b.bugsToLinks(outs)
+	if len(attachments) > 0 {
+		outs = b.replaceAttachmentN(outs, attachments)
+	}
 	out = outs.Join()
 	return out
 }
@@ -0,0 +1,277 @@
+package main
+
+/* Checking passwords with an LDAP simple bind. Only the bind request
+   and its response are needed, so the little BER encoding which they
+   use is done here rather than with an LDAP library. */
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// BER tags of the parts of the LDAP messages.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	ldapBindReq    = 0x60
+	ldapBindResp   = 0x61
+	ldapUnbindReq  = 0x42
+	ldapSimpleAuth = 0x80
+)
+
+// LDAP result codes.
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// The largest LDAP message which is read.
+var ldapMaxMessage = 1 << 16
+
+var ldapTimeout = 10 * time.Second
+
+type ldapChecker struct {
+	// The address of the server, like ldap://host:389 or
+	// ldaps://host:636
+	url string
+	// The DN to bind as, with %s where the user name goes.
+	dn string
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	var c []byte
+	for _, part := range content {
+		c = append(c, part...)
+	}
+	out := append([]byte{tag}, berLength(len(c))...)
+	return append(out, c...)
+}
+
+// Encode a non-negative integer.
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func parseBerInt(b []byte) (n int, err error) {
+	if len(b) == 0 || len(b) > 4 {
+		return 0, fmt.Errorf("bad integer length %d", len(b))
+	}
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
+
+// Split the first tag, length and value off "data".
+func splitTLV(data []byte) (tag byte, content []byte, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated BER")
+	}
+	tag = data[0]
+	length := int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(data) < n {
+			return 0, nil, nil, fmt.Errorf("bad BER length")
+		}
+		length = 0
+		for _, c := range data[:n] {
+			length = length<<8 | int(c)
+		}
+		data = data[n:]
+	}
+	if len(data) < length {
+		return 0, nil, nil, fmt.Errorf("truncated BER")
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+// Read one whole BER element from "r".
+func readTLV(r *bufio.Reader) (data []byte, err error) {
+	head := make([]byte, 2)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return nil, err
+	}
+	length := int(head[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 {
+			return nil, fmt.Errorf("bad BER length")
+		}
+		extra := make([]byte, n)
+		_, err = io.ReadFull(r, extra)
+		if err != nil {
+			return nil, err
+		}
+		head = append(head, extra...)
+		length = 0
+		for _, c := range extra {
+			length = length<<8 | int(c)
+		}
+	}
+	if length > ldapMaxMessage {
+		return nil, fmt.Errorf("LDAP message of %d bytes is too long", length)
+	}
+	content := make([]byte, length)
+	_, err = io.ReadFull(r, content)
+	if err != nil {
+		return nil, err
+	}
+	return append(head, content...), nil
+}
+
+func ldapBindRequest(messageId int, dn string, password string) []byte {
+	return berTLV(berSequence,
+		berInt(berInteger, messageId),
+		berTLV(ldapBindReq,
+			berInt(berInteger, 3),
+			berTLV(berOctetString, []byte(dn)),
+			berTLV(ldapSimpleAuth, []byte(password))))
+}
+
+func ldapUnbindRequest(messageId int) []byte {
+	return berTLV(berSequence, berInt(berInteger, messageId),
+		berTLV(ldapUnbindReq))
+}
+
+// Get the result code and message from a bind response.
+func parseBindResponse(data []byte) (code int, message string, err error) {
+	tag, msg, _, err := splitTLV(data)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != berSequence {
+		return 0, "", fmt.Errorf("LDAP message is not a sequence")
+	}
+	tag, _, msg, err = splitTLV(msg)
+	if err != nil || tag != berInteger {
+		return 0, "", fmt.Errorf("LDAP message has no ID")
+	}
+	tag, op, _, err := splitTLV(msg)
+	if err != nil || tag != ldapBindResp {
+		return 0, "", fmt.Errorf("LDAP reply is not a bind response")
+	}
+	tag, codeBytes, op, err := splitTLV(op)
+	if err != nil || tag != berEnumerated {
+		return 0, "", fmt.Errorf("LDAP bind response has no result code")
+	}
+	code, err = parseBerInt(codeBytes)
+	if err != nil {
+		return 0, "", err
+	}
+	// Skip the matched DN.
+	_, _, op, err = splitTLV(op)
+	if err == nil {
+		var diagnostic []byte
+		_, diagnostic, _, err = splitTLV(op)
+		if err == nil {
+			message = string(diagnostic)
+		}
+	}
+	return code, message, nil
+}
+
+// Escape the special characters of a value in a DN (RFC 4514).
+func ldapEscape(value string) string {
+	var b strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (l *ldapChecker) dial() (conn net.Conn, err error) {
+	u, err := url.Parse(l.url)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "389")
+		}
+		return dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, nil)
+	}
+	return nil, fmt.Errorf("Unknown LDAP URL scheme %s", u.Scheme)
+}
+
+// Check the password by binding to the server as the user.
+func (l *ldapChecker) checkPassword(user string, password string) (ok bool, err error) {
+	// An empty password makes an anonymous bind, which usually
+	// succeeds.
+	if password == "" || user == "" {
+		return false, nil
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	dn := strings.Replace(l.dn, "%s", ldapEscape(user), -1)
+	_, err = conn.Write(ldapBindRequest(1, dn, password))
+	if err != nil {
+		return false, err
+	}
+	reply, err := readTLV(bufio.NewReader(conn))
+	if err != nil {
+		return false, err
+	}
+	code, message, err := parseBindResponse(reply)
+	if err != nil {
+		return false, err
+	}
+	conn.Write(ldapUnbindRequest(2))
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("LDAP bind as %s failed with code %d: %s", dn, code, message)
+}
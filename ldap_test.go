@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// A stand-in LDAP server which understands only bind requests, and
+// accepts the password "letmein" for "dn".
+type fakeLDAP struct {
+	listener net.Listener
+	dn       string
+	mu       sync.Mutex
+	binds    []string
+}
+
+func startFakeLDAP(t *testing.T, dn string) *fakeLDAP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLDAP{listener: listener, dn: dn}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(t, conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLDAP) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	data, err := readTLV(bufio.NewReader(conn))
+	if err != nil {
+		t.Errorf("Error reading bind request: %s", err)
+		return
+	}
+	_, msg, _, err := splitTLV(data)
+	if err != nil {
+		t.Errorf("Bad LDAP message: %s", err)
+		return
+	}
+	_, id, msg, err := splitTLV(msg)
+	if err != nil {
+		t.Errorf("Bad message ID: %s", err)
+		return
+	}
+	tag, bind, _, err := splitTLV(msg)
+	if err != nil || tag != ldapBindReq {
+		t.Errorf("Not a bind request: %x %v", tag, err)
+		return
+	}
+	_, _, bind, _ = splitTLV(bind)
+	_, dn, bind, _ := splitTLV(bind)
+	tag, password, _, err := splitTLV(bind)
+	if err != nil || tag != ldapSimpleAuth {
+		t.Errorf("Not a simple bind: %x %v", tag, err)
+		return
+	}
+	f.mu.Lock()
+	f.binds = append(f.binds, string(dn))
+	f.mu.Unlock()
+	code := ldapInvalidCredentials
+	if string(dn) == f.dn && string(password) == "letmein" {
+		code = ldapSuccess
+	}
+	messageId, _ := parseBerInt(id)
+	conn.Write(berTLV(berSequence,
+		berInt(berInteger, messageId),
+		berTLV(ldapBindResp,
+			berInt(berEnumerated, code),
+			berTLV(berOctetString),
+			berTLV(berOctetString, []byte("diagnostic")))))
+}
+
+func TestLDAP(t *testing.T) {
+	f := startFakeLDAP(t, "uid=dave,ou=people,dc=example,dc=org")
+	defer f.listener.Close()
+	ba := getBackendApp(t, authConfig{
+		backend: "ldap",
+		ldapURL: "ldap://" + f.listener.Addr().String(),
+		ldapDN:  "uid=%s,ou=people,dc=example,dc=org",
+	})
+	checker := ba.store.(*baguser).checker
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"dave", "letmein", true},
+		{"dave", "wrong", false},
+		{"dave", "", false},
+		{"eve,ou=admins", "letmein", false},
+	}
+	for _, test := range tests {
+		ok, err := checker.checkPassword(test.user, test.password)
+		if err != nil || ok != test.ok {
+			t.Errorf("%s/%q: expected %t, got %t (%v)", test.user,
+				test.password, test.ok, ok, err)
+		}
+	}
+	f.mu.Lock()
+	binds := f.binds
+	f.mu.Unlock()
+	// The empty password is refused without asking the server.
+	if len(binds) != 3 || binds[2] != `uid=eve\,ou\=admins,ou=people,dc=example,dc=org` {
+		t.Errorf("Unexpected binds %q", binds)
+	}
+	w := tryLogin(ba, "dave", "letmein", "198.51.100.40")
+	if w.Code != http.StatusFound {
+		t.Errorf("Login: expected status %d, got %d", http.StatusFound, w.Code)
+	}
+	person, err := ba.data.PersonFromName("dave")
+	if err != nil || person.PersonId == 0 {
+		t.Errorf("No person made for dave (%v)", err)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+/* The states of projects. A project is active, frozen, archived or
+   cancelled, which is kept in project.status. Only active projects
+   take new bugs and parts. Frozen projects are still listed and their
+   bugs can be worked on, while archived and cancelled projects are
+   only on the list of archived projects. Archiving a project resolves
+   its open bugs or moves them to another project, and after that its
+   bugs can be looked at but not changed. The page of a project keeps
+   its name and address whatever its state, so old links still work.
+   Each change of state is kept in project_event. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type projectState int64
+
+const (
+	projectActive projectState = iota
+	// Any other number in project.status from before there were
+	// states meant that the project was cancelled.
+	projectCancelled
+	projectFrozen
+	projectArchived
+)
+
+var projectStateNames = bagzullaDb.ProjectStates
+
+func (s projectState) String() string {
+	return projectStateNames[s.known()]
+}
+
+// The state itself, or cancelled for a number which is not a state.
+func (s projectState) known() projectState {
+	if s < 0 || int(s) >= len(projectStateNames) {
+		return projectCancelled
+	}
+	return s
+}
+
+func projectStateFromName(name string) (s projectState, ok bool) {
+	for i, n := range projectStateNames {
+		if n == name {
+			return projectState(i), true
+		}
+	}
+	return projectActive, false
+}
+
+func stateOf(project bagzullaDb.Project) projectState {
+	return projectState(project.Status).known()
+}
+
+// Can bugs and parts be added to a project in state "s"?
+func (s projectState) Open() bool {
+	return s == projectActive
+}
+
+// Is a project in state "s" on the list of projects rather than the
+// list of archived projects?
+func (s projectState) Listed() bool {
+	return s == projectActive || s == projectFrozen
+}
+
+// The states which a project can go to from each state.
+var projectTransitions = map[projectState][]projectState{
+	projectActive:    {projectFrozen, projectArchived, projectCancelled},
+	projectFrozen:    {projectActive, projectArchived, projectCancelled},
+	projectArchived:  {projectActive},
+	projectCancelled: {projectActive, projectArchived},
+}
+
+func (s projectState) canBecome(to projectState) bool {
+	for _, t := range projectTransitions[s.known()] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Send an error page if no bugs or parts can be added to "project".
+// The return value is true if they cannot.
+func (b *Bagreply) projectClosed(project bagzullaDb.Project) bool {
+	state := stateOf(project)
+	if state.Open() {
+		return false
+	}
+	b.errorPage("Project %s is %s, so nothing can be added to it", project.Name, state)
+	return true
+}
+
+var openProjectBugsSql = `SELECT bug_id FROM bug
+WHERE project_id = ? AND status = 0 AND deleted IS NULL`
+var openProjectBugsQuery = bagzullaDb.NewQuery(openProjectBugsSql)
+
+func openProjectBugs(store *bagzullaDb.Store, projectId int64) (bugIds []int64, err error) {
+	rows, err := store.Stmt(openProjectBugsQuery).Query(projectId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bugId int64
+		err = rows.Scan(&bugId)
+		if err != nil {
+			return nil, err
+		}
+		bugIds = append(bugIds, bugId)
+	}
+	return bugIds, rows.Err()
+}
+
+// Resolve the open bugs of "project" with status "resolution", with a
+// comment saying why. The return value is the number of bugs.
+func (b *Bagreply) resolveOpenBugs(project bagzullaDb.Project, resolution int64) (count int, ok bool) {
+	bugIds, err := openProjectBugs(b.data(), project.ProjectId)
+	if err != nil {
+		b.errorPage("Error getting the open bugs of %s: %s", project.Name, err)
+		return 0, false
+	}
+	text := fmt.Sprintf("Resolved as %s when project %s was archived.",
+		statuses[resolution], project.Name)
+	for _, bugId := range bugIds {
+		err = b.data().UpdateStatusForBug(resolution, bugId)
+		if err == nil {
+			_, err = addComment(b.data(), bugId, b.User.PersonId, text)
+		}
+		if err != nil {
+			b.errorPage("Error resolving bug %d: %s", bugId, err)
+			return 0, false
+		}
+		if !b.updateChanged(bugId) {
+			return 0, false
+		}
+		b.bugEvent("status", bugId, statuses[0], statuses[resolution], text)
+	}
+	return len(bugIds), true
+}
+
+// Move the open bugs of "project" to "target" in the same way as
+// moving one bug, so that the form's "part-map" decides what happens
+// to their parts. The return value is the number of bugs.
+func (b *Bagreply) moveOpenBugs(project bagzullaDb.Project, target bagzullaDb.Project) (count int, ok bool) {
+	bugIds, err := openProjectBugs(b.data(), project.ProjectId)
+	if err != nil {
+		b.errorPage("Error getting the open bugs of %s: %s", project.Name, err)
+		return 0, false
+	}
+	for _, bugId := range bugIds {
+		bug, err := b.data().BugFromId(bugId)
+		if err != nil {
+			b.errorPage("Error getting bug %d: %s", bugId, err)
+			return 0, false
+		}
+		if !b.moveBugWithPart(bug, target.ProjectId) {
+			return 0, false
+		}
+	}
+	return len(bugIds), true
+}
+
+// Deal with the open bugs of "project" as the archiving form asks.
+// The return value is the note for the history.
+func (b *Bagreply) archiveOpenBugs(project bagzullaDb.Project) (note string, ok bool) {
+	switch b.r.PostFormValue("open-bugs") {
+	case "resolve":
+		resolution, err := stringToStatus(b.r.PostFormValue("resolution"))
+		if err != nil || resolution == 0 {
+			b.errorPage("Bad resolution %s", strconv.Quote(b.r.PostFormValue("resolution")))
+			return "", false
+		}
+		count, ok := b.resolveOpenBugs(project, resolution)
+		if !ok {
+			return "", false
+		}
+		if count == 0 {
+			return "", true
+		}
+		return fmt.Sprintf("Resolved %d open bugs as %s", count, statuses[resolution]), true
+	case "move":
+		targetId, err := strconv.ParseInt(b.r.PostFormValue("target"), 10, 64)
+		if err != nil {
+			b.errorPage("Bad project %s", strconv.Quote(b.r.PostFormValue("target")))
+			return "", false
+		}
+		if targetId == project.ProjectId {
+			b.errorPage("The open bugs cannot be moved to the project being archived")
+			return "", false
+		}
+		target, ok := projectFromId(b, targetId)
+		if !ok || b.NotAllowed(roleDeveloper, targetId) || b.projectClosed(target) {
+			return "", false
+		}
+		count, ok := b.moveOpenBugs(project, target)
+		if !ok {
+			return "", false
+		}
+		if count == 0 {
+			return "", true
+		}
+		return fmt.Sprintf("Moved %d open bugs to %s", count, target.Name), true
+	}
+	bugIds, err := openProjectBugs(b.data(), project.ProjectId)
+	if err != nil {
+		b.errorPage("Error getting the open bugs of %s: %s", project.Name, err)
+		return "", false
+	}
+	if len(bugIds) > 0 {
+		b.errorPage("Project %s has %d open bugs, which must be resolved or moved to archive it",
+			project.Name, len(bugIds))
+		return "", false
+	}
+	return "", true
+}
+
+// Return the project specified by the number at the end of the
+// current URL for something which only admins may do. Unlike
+// getProject, this works for archived projects, which nobody may
+// otherwise change.
+func getAdminProject(b *Bagreply) (project bagzullaDb.Project, ok bool) {
+	projectId, ok := getFinalNum(b)
+	if !ok {
+		return project, false
+	}
+	if b.NotAllowed(roleAdmin, 0) {
+		return project, false
+	}
+	if !b.canSee(projectId) {
+		b.w.WriteHeader(http.StatusNotFound)
+		b.errorPage("There is no project with ID %d", projectId)
+		return project, false
+	}
+	return projectFromId(b, projectId)
+}
+
+// Change the state of a project with the form on the project page.
+func changeProjectState(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	project, ok := getAdminProject(b)
+	if !ok {
+		return
+	}
+	if project.ProjectId == b.inbox() {
+		b.errorPage("Project %s is the inbox, so it stays active", project.Name)
+		return
+	}
+	from := stateOf(project)
+	to, found := projectStateFromName(b.r.PostFormValue("state"))
+	if !found {
+		b.errorPage("Unknown state %s", strconv.Quote(b.r.PostFormValue("state")))
+		return
+	}
+	if !from.canBecome(to) {
+		b.errorPage("Project %s cannot go from %s to %s", project.Name, from, to)
+		return
+	}
+	ok = b.inTx(func() bool {
+		var event = bagzullaDb.ProjectEvent{
+			ProjectId: project.ProjectId,
+			PersonId:  b.User.PersonId,
+			Entered:   time.Now(),
+			OldStatus: project.Status,
+			NewStatus: int64(to),
+		}
+		if to == projectArchived {
+			var ok bool
+			event.Note, ok = b.archiveOpenBugs(project)
+			if !ok {
+				return false
+			}
+		}
+		err := b.data().UpdateStatusForProject(int64(to), project.ProjectId)
+		if err == nil {
+			_, err = b.data().InsertProjectEvent(event)
+		}
+		if err != nil {
+			b.errorPage("Error changing the state of %s: %s", project.Name, err)
+			return false
+		}
+		return true
+	})
+	if !ok {
+		return
+	}
+	b.perms = nil
+	log.Printf("%s changed project %s from %s to %s", b.User.Name, project.Name, from, to)
+	redirectToProject(b, project.ProjectId)
+}
+
+// A change of state of a project, for the pages.
+type ProjectEventInfo struct {
+	bagzullaDb.ProjectEvent
+	Person string
+	From   projectState
+	To     projectState
+}
+
+func getProjectEvents(b *Bagreply, projectId int64) (events []ProjectEventInfo, ok bool) {
+	list, err := b.data().ProjectEventsFromProjectId(projectId)
+	if err != nil {
+		b.errorPage("Error getting the history of project %d: %s", projectId, err)
+		return nil, false
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		e := ProjectEventInfo{
+			ProjectEvent: list[i],
+			From:         projectState(list[i].OldStatus).known(),
+			To:           projectState(list[i].NewStatus).known(),
+		}
+		e.Person, ok = getPersonName(b, e.PersonId)
+		if !ok {
+			return nil, false
+		}
+		events = append(events, e)
+	}
+	return events, true
+}
+
+type archivedProject struct {
+	Project bagzullaDb.Project
+	State   projectState
+	// The changes of state, latest first.
+	Events []ProjectEventInfo
+}
+
+// The list of the archived and cancelled projects.
+func archivedProjects(b *Bagreply) {
+	all, ok := allProjects(b)
+	if !ok {
+		return
+	}
+	var projects []archivedProject
+	for _, p := range all {
+		state := stateOf(p)
+		if state.Listed() {
+			continue
+		}
+		ap := archivedProject{Project: p, State: state}
+		ap.Events, ok = getProjectEvents(b, p.ProjectId)
+		if !ok {
+			return
+		}
+		projects = append(projects, ap)
+	}
+	b.Title = "Archived projects"
+	b.runTemplate("archived-projects.html", projects)
+}
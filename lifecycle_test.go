@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProjectStates(t *testing.T) {
+	ba := getTestApp(t)
+	projects := make(map[string]int64)
+	for _, name := range []string{"Retired", "Successor", "Closing"} {
+		result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status)
+VALUES(?, '', 1, 1, 0)`, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		projects[name], _ = result.LastInsertId()
+	}
+	description, err := storeText(ba.data, "Holds it up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := ba.data.InsertPart(bagzullaDb.Part{Name: "Frame", ProjectId: projects["Retired"], Description: description})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moved []int64
+	for i, title := range []string{"Loose end", "Another loose end"} {
+		var partId int64
+		if i == 0 {
+			partId = frame
+		}
+		bugId, err := addBug(ba.data, title, "Still open", projects["Retired"], partId, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		moved = append(moved, bugId)
+	}
+	fixed, err := addBug(ba.data, "Done already", "Fixed", projects["Retired"], 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ba.data.UpdateStatusForBug(1, fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, err := addBug(ba.data, "Never to be", "Open in a closing project", projects["Closing"], 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES('keeper', 'keeper@localhost', 'x', 'admin')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeperId, _ := result.LastInsertId()
+	admin, err := insertToken(ba.data, Token{PersonId: keeperId, Name: "t", Scope: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	developer, err := insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(fn BagFunc, perm role, path string, form url.Values, token string) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, perm)(w, r)
+		return w
+	}
+	state := func(name string) projectState {
+		project, err := ba.data.ProjectFromId(projects[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stateOf(project)
+	}
+	statePath := func(name string) string {
+		return fmt.Sprintf("/project-state/%d", projects[name])
+	}
+
+	w := send(changeProjectState, roleAdmin, statePath("Retired"),
+		url.Values{"state": {"archived"}}, developer)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Developer changed the state of a project: %d", w.Code)
+	}
+	w = send(changeProjectState, roleAdmin, statePath("Retired"),
+		url.Values{"state": {"archived"}}, admin)
+	if !strings.Contains(w.Body.String(), "2 open bugs") || state("Retired") != projectActive {
+		t.Errorf("Archived a project with open bugs without dealing with them: %s", w.Body.String())
+	}
+	w = send(changeProjectState, roleAdmin, statePath("Retired"),
+		url.Values{"state": {"archived"}, "open-bugs": {"move"}, "part-map": {"same"},
+			"target": {fmt.Sprint(projects["Successor"])}}, admin)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Archiving: %d %s", w.Code, w.Body.String())
+	}
+	if state("Retired") != projectArchived {
+		t.Errorf("Project not archived: %s", state("Retired"))
+	}
+	for _, bugId := range moved {
+		bug, err := ba.data.BugFromId(bugId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bug.ProjectId != projects["Successor"] {
+			t.Errorf("Bug %d not moved: in project %d", bugId, bug.ProjectId)
+		}
+		if bugId == moved[0] {
+			part, err := ba.data.PartFromId(bug.PartId)
+			if err != nil || part.Name != "Frame" || part.ProjectId != projects["Successor"] {
+				t.Errorf("Bug %d did not keep its part: %v %v", bugId, part, err)
+			}
+		}
+		comments, err := ba.data.CommentsFromBugId(bugId)
+		if err != nil || len(comments) != 1 {
+			t.Errorf("Expected a comment on moved bug %d, got %v %v", bugId, comments, err)
+		}
+	}
+	bug, err := ba.data.BugFromId(fixed)
+	if err != nil || bug.ProjectId != projects["Retired"] {
+		t.Errorf("Fixed bug moved: %v %v", bug, err)
+	}
+
+	// The archived project can be looked at but not changed.
+	w = send(showProject, roleViewer, fmt.Sprintf("/project/%d", projects["Retired"]), nil, developer)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "This project is archived") {
+		t.Errorf("Archived project page: %d", w.Code)
+	}
+	w = send(changeBugStatus, roleDeveloper, fmt.Sprintf("/change-bug-status/%d", fixed),
+		url.Values{"status": {"open"}}, developer)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "archived") {
+		t.Errorf("Changed a bug of an archived project: %d %s", w.Code, w.Body.String())
+	}
+	w = send(addBugToProjectHandler, roleReporter, fmt.Sprintf("/add-bug-to-project/%d", projects["Retired"]),
+		url.Values{"title": {"Too late"}}, admin)
+	if w.Code == http.StatusFound {
+		t.Errorf("Added a bug to an archived project")
+	}
+	w = send(listProjects, roleViewer, "/projects/", nil, developer)
+	if strings.Contains(w.Body.String(), "Retired") {
+		t.Errorf("Archived project is in the list of projects")
+	}
+	w = send(archivedProjects, roleViewer, "/archived-projects/", nil, developer)
+	if !strings.Contains(w.Body.String(), "Retired") ||
+		!strings.Contains(w.Body.String(), "Moved 2 open bugs to Successor") {
+		t.Errorf("Archived project not in the list with its history: %s", w.Body.String())
+	}
+
+	w = send(changeProjectState, roleAdmin, statePath("Retired"),
+		url.Values{"state": {"frozen"}}, admin)
+	if state("Retired") != projectArchived {
+		t.Errorf("Archived project went straight to frozen")
+	}
+	send(changeProjectState, roleAdmin, statePath("Retired"),
+		url.Values{"state": {"active"}}, admin)
+	if state("Retired") != projectActive {
+		t.Errorf("Project not made active again: %s", state("Retired"))
+	}
+	w = send(changeBugStatus, roleDeveloper, fmt.Sprintf("/change-bug-status/%d", fixed),
+		url.Values{"status": {"open"}}, developer)
+	if w.Code != http.StatusFound {
+		t.Errorf("Changing a bug of a project made active again: %d %s", w.Code, w.Body.String())
+	}
+
+	send(changeProjectState, roleAdmin, statePath("Closing"),
+		url.Values{"state": {"archived"}, "open-bugs": {"resolve"},
+			"resolution": {"wontfix"}}, admin)
+	bug, err = ba.data.BugFromId(abandoned)
+	if err != nil || statuses[bug.Status] != "wontfix" {
+		t.Errorf("Open bug not resolved on archiving: %v %v", bug, err)
+	}
+
+	// A frozen project stays on the list but takes no new bugs.
+	send(changeProjectState, roleAdmin, statePath("Successor"),
+		url.Values{"state": {"frozen"}}, admin)
+	w = send(addBugToProjectHandler, roleReporter, fmt.Sprintf("/add-bug-to-project/%d", projects["Successor"]),
+		url.Values{"title": {"Frozen out"}}, developer)
+	if !strings.Contains(w.Body.String(), "is frozen") {
+		t.Errorf("Added a bug to a frozen project: %d %s", w.Code, w.Body.String())
+	}
+	w = send(listProjects, roleViewer, "/projects/", nil, developer)
+	if !strings.Contains(w.Body.String(), "Successor") {
+		t.Errorf("Frozen project is not in the list of projects")
+	}
+}
@@ -0,0 +1,380 @@
+// Take incoming email and turn it into bugs or comments.
+
+// The mail is read as an RFC 822 message, for example piped from a
+// mail delivery agent:
+//
+//     bagzulla --ingest-mail < message
+//
+// A message sent to "anything+projectname@host" creates a new bug in
+// the project called "projectname", with the subject as the title and
+// the body as the description. Without a project name, the bug goes
+// in the inbox. A message with "[bug N]" in its
+// subject is added as a comment to bug N. Attachments of the mail
+// become attachments of the bug.
+
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A file attached to an incoming mail.
+type mailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// The parts of an incoming mail which we are interested in.
+type incomingMail struct {
+	// The address of the sender.
+	From string
+	// The addresses the mail was delivered to.
+	To      []string
+	Subject string
+	// The plain text of the body.
+	Body        string
+	Attachments []mailAttachment
+}
+
+// Headers which may contain the address the mail was delivered to,
+// in the order in which they are searched.
+var recipientHeaders = []string{
+	"Delivered-To",
+	"X-Original-To",
+	"To",
+	"Cc",
+}
+
+var headerDecoder = new(mime.WordDecoder)
+
+// Read a mail message from "r".
+func readMail(r io.Reader) (m incomingMail, err error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return m, fmt.Errorf("Error reading mail: %s", err)
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return m, fmt.Errorf("Error parsing From address: %s", err)
+	}
+	m.From = from.Address
+	for _, h := range recipientHeaders {
+		list, err := msg.Header.AddressList(h)
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			m.To = append(m.To, a.Address)
+		}
+	}
+	m.Subject, err = headerDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+	m.Subject = strings.TrimSpace(m.Subject)
+	err = m.readPart(msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"),
+		msg.Header.Get("Content-Disposition"), msg.Body)
+	if err != nil {
+		return m, err
+	}
+	m.Body = strings.TrimSpace(m.Body)
+	return m, nil
+}
+
+// Undo the content transfer encoding of a part of the mail.
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// Read one part of the mail, descending into multipart parts. The
+// first plain text part which is not marked as an attachment becomes
+// the body, and everything else with a file name becomes an
+// attachment.
+func (m *incomingMail) readPart(contentType, encoding, disposition string, body io.Reader) (err error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("Error parsing content type %s: %s", contentType, err)
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("Error reading multipart mail: %s", err)
+			}
+			err = m.readPart(p.Header.Get("Content-Type"),
+				p.Header.Get("Content-Transfer-Encoding"),
+				p.Header.Get("Content-Disposition"), p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	data, err := ioutil.ReadAll(decodeTransfer(encoding, body))
+	if err != nil {
+		return fmt.Errorf("Error reading mail part: %s", err)
+	}
+	var name string
+	var attached bool
+	if disposition != "" {
+		d, dparams, err := mime.ParseMediaType(disposition)
+		if err == nil {
+			attached = d == "attachment"
+			name = dparams["filename"]
+		}
+	}
+	if name == "" {
+		name = params["name"]
+	}
+	if mediaType == "text/plain" && !attached && len(m.Body) == 0 {
+		m.Body = string(data)
+		return nil
+	}
+	if attached || name != "" {
+		m.Attachments = append(m.Attachments, mailAttachment{
+			Name:        name,
+			ContentType: mediaType,
+			Data:        data,
+		})
+	}
+	return nil
+}
+
+// Match the bug number in a subject like "Re: [bug 123] Title".
+var mailBugRegex = regexp.MustCompile(`(?i)\[bug\s+([0-9]+)\]`)
+
+// Find the bug number in the subject of a reply, or zero if it is not
+// a reply to a bug.
+func (m *incomingMail) replyBug() int64 {
+	match := mailBugRegex.FindStringSubmatch(m.Subject)
+	if match == nil {
+		return 0
+	}
+	bugId, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return bugId
+}
+
+// Find the project name in a recipient address like
+// "bugs+projectname@example.com".
+func (m *incomingMail) projectName() string {
+	for _, to := range m.To {
+		at := strings.LastIndex(to, "@")
+		if at < 0 {
+			continue
+		}
+		local := to[:at]
+		plus := strings.Index(local, "+")
+		if plus < 0 {
+			continue
+		}
+		name := local[plus+1:]
+		if len(name) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// Remove lines quoted from a previous message from the body of a
+// reply.
+func stripQuoted(body string) string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Find the project which the mail is addressed to.
+func (ba *Bagapp) mailProject(name string) (project bagzullaDb.Project, err error) {
+	project, err = ba.data.ProjectFromName(name)
+	if err != nil {
+		return project, err
+	}
+	if project.ProjectId != 0 {
+		if !project.Deleted.IsZero() {
+			return project, fmt.Errorf("Project '%s' is in the trash", name)
+		}
+		if state := stateOf(project); !state.Open() {
+			return project, fmt.Errorf("Project '%s' is %s", name, state)
+		}
+		return project, nil
+	}
+	// Allow the case of the name to differ, since mail addresses
+	// are often lower-cased along the way.
+	projects, err := ba.data.AllProjects()
+	if err != nil {
+		return project, err
+	}
+	for _, p := range projects {
+		if strings.EqualFold(p.Name, name) && p.Deleted.IsZero() {
+			if state := stateOf(p); !state.Open() {
+				return p, fmt.Errorf("Project '%s' is %s", p.Name, state)
+			}
+			return p, nil
+		}
+	}
+	return project, fmt.Errorf("No project called '%s'", name)
+}
+
+// Read a mail from "r" and make a bug or a comment from it. If
+// "recipient" is not empty, it is used instead of the recipient
+// addresses in the mail headers.
+func (ba *Bagapp) readMailInput(r io.Reader, recipient string) (err error) {
+	m, err := readMail(r)
+	if err != nil {
+		return err
+	}
+	if recipient != "" {
+		m.To = []string{recipient}
+	}
+	person, err := ba.data.PersonFromEmail(m.From)
+	if err != nil {
+		return fmt.Errorf("Error looking up sender %s: %s", m.From, err)
+	}
+	if person.PersonId == 0 {
+		return fmt.Errorf("Unknown sender %s", m.From)
+	}
+	active, err := personActive(ba.data, person.PersonId)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("Sender %s cannot log in", m.From)
+	}
+	// The sender needs the same role as on the web, so the
+	// permissions are those of a request made by them.
+	sender := Bagreply{App: ba, User: &person}
+	if sender.getPermissions().failed {
+		return fmt.Errorf("Error reading the permissions of %s", m.From)
+	}
+	// The bug, its comment and its files are saved together, and the
+	// webhooks are only told once they are.
+	var events []func()
+	var stored []string
+	err = ba.data.Transact(func(tx *bagzullaDb.Store) error {
+		bugId := m.replyBug()
+		if bugId != 0 {
+			bug, err := tx.BugFromId(bugId)
+			if err != nil {
+				return err
+			}
+			project, err := tx.ProjectFromId(bug.ProjectId)
+			if err != nil {
+				return err
+			}
+			if !bug.Deleted.IsZero() || !project.Deleted.IsZero() {
+				return fmt.Errorf("Bug %d is in the trash", bugId)
+			}
+			if state := stateOf(project); !state.Listed() {
+				return fmt.Errorf("Bug %d is in project %s, which is %s",
+					bugId, project.Name, state)
+			}
+			if sender.roleIn(bug.ProjectId) < roleReporter {
+				return fmt.Errorf("Sender %s cannot comment on bug %d", m.From, bugId)
+			}
+			text := stripQuoted(m.Body)
+			if len(text) == 0 && len(m.Attachments) == 0 {
+				return fmt.Errorf("Reply to bug %d has no text", bugId)
+			}
+			if len(text) > 0 {
+				_, err = addComment(tx, bugId, person.PersonId, text)
+				if err != nil {
+					return err
+				}
+				events = append(events, func() {
+					ba.bugEvent("commented", bugId, person.Name, "", "", text)
+				})
+			}
+			log.Printf("Added mail from %s to bug %d", m.From, bugId)
+		} else {
+			var project bagzullaDb.Project
+			name := m.projectName()
+			if name == "" {
+				project, err = inboxProject(tx)
+				if err != nil {
+					return fmt.Errorf("No project+name address in %s: %s",
+						strings.Join(m.To, ", "), err)
+				}
+			} else {
+				project, err = ba.mailProject(name)
+				if err != nil {
+					return err
+				}
+			}
+			if sender.roleIn(project.ProjectId) < roleReporter {
+				return fmt.Errorf("Sender %s cannot add bugs to %s", m.From, project.Name)
+			}
+			if len(m.Subject) == 0 {
+				return fmt.Errorf("Mail from %s has no subject", m.From)
+			}
+			bugId, err = addBug(tx, m.Subject, m.Body, project.ProjectId, 0,
+				person.PersonId)
+			if err != nil {
+				return err
+			}
+			log.Printf("Made bug %d in %s from mail from %s", bugId,
+				project.Name, m.From)
+			events = append(events, func() {
+				ba.bugEvent("created", bugId, person.Name, "", "", m.Body)
+			})
+		}
+		for _, a := range m.Attachments {
+			saved, err := ba.attach(tx, Attachment{
+				BugId:       bugId,
+				PersonId:    person.PersonId,
+				Filename:    a.Name,
+				ContentType: a.ContentType,
+			}, bytes.NewReader(a.Data))
+			if err != nil {
+				return fmt.Errorf("Error saving attachment %s: %s", a.Name, err)
+			}
+			stored = append(stored, saved.SHA256)
+		}
+		return tx.UpdateChangedForBug(time.Now(), bugId)
+	})
+	if err != nil {
+		for _, sum := range stored {
+			ba.files.removeUnused(ba.data, sum)
+		}
+		return err
+	}
+	for _, event := range events {
+		event()
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testMail = "From: Tony <tony@localhost>\r\n" +
+	"To: bugs+bagzulla@localhost\r\n" +
+	"Subject: =?UTF-8?Q?Re:_[bug_12]_Caf=C3=A9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=XYZ\r\n" +
+	"\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"It still happens.\r\n" +
+	"> Does it still happen?\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: image/png; name=shot.png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=shot.png\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--XYZ--\r\n"
+
+func TestReadMail(t *testing.T) {
+	m, err := readMail(strings.NewReader(testMail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From != "tony@localhost" {
+		t.Errorf("From is %s", m.From)
+	}
+	if m.projectName() != "bagzulla" {
+		t.Errorf("Project name is %s", m.projectName())
+	}
+	if m.replyBug() != 12 {
+		t.Errorf("Reply bug is %d", m.replyBug())
+	}
+	if stripQuoted(m.Body) != "It still happens." {
+		t.Errorf("Body is %q", stripQuoted(m.Body))
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0].Name != "shot.png" {
+		t.Fatalf("Attachments are %v", m.Attachments)
+	}
+	if string(m.Attachments[0].Data) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("Attachment data is %q", m.Attachments[0].Data)
+	}
+}
+
+// Mail needs the same role as the web: a reporter can add bugs and
+// comments, a viewer cannot, and nobody can use a private project
+// without a grant.
+func TestMailRoles(t *testing.T) {
+	ba := getTestApp(t)
+	addTestPerson(t, ba, "vera", "viewer")
+	addTestPerson(t, ba, "rex", "reporter")
+	private := addTestProject(t, ba, "Postbox")
+	err := ba.data.UpdatePrivateForProject(1, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := addBug(ba.data, "Sealed", "Private", private, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bugs of frozen projects can be replied to, but not those of
+	// cancelled projects.
+	var shut [2]int64
+	for i, state := range []projectState{projectFrozen, projectCancelled} {
+		projectId := addTestProject(t, ba, "Shut "+state.String())
+		err = ba.data.UpdateStatusForProject(int64(state), projectId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shut[i], err = addBug(ba.data, "Shut", "Old", projectId, 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mail := func(from string, to string, subject string) error {
+		text := fmt.Sprintf("From: %s@localhost\r\nTo: %s\r\nSubject: %s\r\n\r\nBy mail.\r\n",
+			from, to, subject)
+		return ba.readMailInput(strings.NewReader(text), "")
+	}
+	tests := []struct {
+		from    string
+		to      string
+		subject string
+		refused bool
+	}{
+		{"vera", "bugs+bagzulla@localhost", "Viewed", true},
+		{"rex", "bugs+postbox@localhost", "Posted", true},
+		{"rex", "bugs+bagzulla@localhost", fmt.Sprintf("Re: [bug %d] Sealed", secret), true},
+		{"rex", "bugs+bagzulla@localhost", "Reported", false},
+		{"rex", "bugs+bagzulla@localhost", fmt.Sprintf("Re: [bug %d] Shut", shut[0]), false},
+		{"rex", "bugs+bagzulla@localhost", fmt.Sprintf("Re: [bug %d] Shut", shut[1]), true},
+	}
+	for _, test := range tests {
+		err := mail(test.from, test.to, test.subject)
+		if test.refused != (err != nil) {
+			t.Errorf("Mail from %s to %s about %s: %v", test.from, test.to, test.subject, err)
+		}
+	}
+	comments, err := ba.data.CommentsFromBugId(secret)
+	if err != nil || len(comments) != 0 {
+		t.Errorf("Private bug has comments %v %v", comments, err)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+/* Changes to the schema of the database. The server applies the
+   migrations below in order when it starts, and keeps the version of
+   each one it has applied in the table schema_version, so each one
+   runs once. To change the schema, add a migration to the end of the
+   list and change schema.txt to match. A test checks that the two
+   agree. Never change a migration once it has been released.
+
+   Databases from before there were migrations have no
+   schema_version. They were made from schema.txt, sometimes with
+   columns added by hand, so the first migrations only add the tables
+   and columns which are missing. */
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	// Make the changes. This runs in a transaction, so nothing is
+	// changed if it fails.
+	up func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "tables from before migrations", func(tx *sql.Tx) error {
+		err := execSql(tx, baselineSql)
+		if err != nil {
+			return err
+		}
+		// These were added by hand to some databases.
+		err = addColumns(tx, []column{
+			{"bug", "changed", "timestamp"},
+			{"bug", "estimate", "INTEGER"},
+			{"project", "status", ""},
+		})
+		if err != nil {
+			return err
+		}
+		// The bug lists cannot read bugs with no change time.
+		return execSql(tx, `UPDATE bug SET changed = entered WHERE changed IS NULL`)
+	}},
+	{2, "webhooks", func(tx *sql.Tx) error {
+		return execSql(tx, webhookSql)
+	}},
+	{3, "API tokens", func(tx *sql.Tx) error {
+		return execSql(tx, tokenSql)
+	}},
+	{4, "session details", func(tx *sql.Tx) error {
+		return addColumns(tx, []column{
+			{"session", "last_seen", "TIMESTAMP"},
+			{"session", "user_agent", "TEXT"},
+			{"session", "ip", "TEXT"},
+		})
+	}},
+	{5, "roles and private projects", func(tx *sql.Tx) error {
+		hadRoles, err := hasColumn(tx, "person", "role")
+		if err != nil {
+			return err
+		}
+		err = addColumns(tx, []column{
+			{"project", "private", "INTEGER NOT NULL DEFAULT 0"},
+			{"person", "role", "TEXT NOT NULL DEFAULT 'reporter'"},
+		})
+		if err != nil {
+			return err
+		}
+		if !hadRoles {
+			// Everyone could change everything before there
+			// were roles, so the people already there stay
+			// developers, and the owner of the first project,
+			// or else the first person, becomes the admin.
+			err = execSql(tx, `UPDATE person SET role = 'developer';
+UPDATE person SET role = 'admin' WHERE person_id = IFNULL(
+(SELECT owner FROM project ORDER BY project_id LIMIT 1),
+(SELECT MIN(person_id) FROM person))`)
+			if err != nil {
+				return err
+			}
+		}
+		return execSql(tx, grantSql)
+	}},
+	{6, "CSRF tokens", func(tx *sql.Tx) error {
+		return addColumns(tx, []column{
+			{"session", "csrf", "TEXT"},
+		})
+	}},
+	{7, "log of logins", func(tx *sql.Tx) error {
+		return execSql(tx, authEventSql)
+	}},
+	{8, "signing up", func(tx *sql.Tx) error {
+		return addColumns(tx, []column{
+			{"person", "status", "TEXT NOT NULL DEFAULT 'active'"},
+			{"person", "verify", "TEXT"},
+			{"person", "registered", "TIMESTAMP"},
+		})
+	}},
+	{9, "attachments", func(tx *sql.Tx) error {
+		return execSql(tx, attachmentTableSql)
+	}},
+	{10, "trash", func(tx *sql.Tx) error {
+		var columns []column
+		for _, table := range []string{"bug", "comment", "part", "project"} {
+			columns = append(columns,
+				column{table, "deleted", "TIMESTAMP"},
+				column{table, "deleted_by", "INTEGER"})
+		}
+		return addColumns(tx, columns)
+	}},
+	{11, "project states", func(tx *sql.Tx) error {
+		return execSql(tx, projectEventSql)
+	}},
+	{12, "inbox project", func(tx *sql.Tx) error {
+		err := addColumns(tx, []column{
+			{"project", "inbox", "INTEGER NOT NULL DEFAULT 0"},
+		})
+		if err != nil {
+			return err
+		}
+		// The inbox used to be the project with ID 1, which
+		// scripts/init.pl makes.
+		return execSql(tx, `UPDATE project SET inbox = 1 WHERE project_id = 1`)
+	}},
+	{13, "parts of parts", func(tx *sql.Tx) error {
+		return addColumns(tx, []column{
+			{"part", "parent_id", "INTEGER NOT NULL DEFAULT 0"},
+		})
+	}},
+}
+
+var baselineSql = `
+CREATE TABLE IF NOT EXISTS bug(
+	bug_id INTEGER PRIMARY KEY,
+	title INTEGER NOT NULL,
+	description INTEGER NOT NULL,
+	project_id INTEGER NOT NULL,
+	part_id INTEGER NOT NULL,
+	entered TIMESTAMP,
+	owner INTEGER NOT NULL,
+	status INTEGER,
+	priority INTEGER,
+	changed timestamp,
+	estimate INTEGER,
+	FOREIGN KEY(title) REFERENCES txt(txt_id),
+	FOREIGN KEY(description) REFERENCES txt(txt_id),
+	FOREIGN KEY(project_id) REFERENCES project(project_id),
+	FOREIGN KEY(part_id) REFERENCES part(part_id),
+	FOREIGN KEY(owner) REFERENCES person(person_id)
+);
+CREATE TABLE IF NOT EXISTS project(
+	project_id INTEGER PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	directory TEXT,
+	description INTEGER NOT NULL,
+	owner INTEGER NOT NULL, status,
+	FOREIGN KEY(description) REFERENCES txt(txt_id),
+	FOREIGN KEY(owner) REFERENCES person(person_id)
+);
+CREATE TABLE IF NOT EXISTS part(
+	part_id INTEGER PRIMARY KEY,
+	name TEXT,
+	description INTEGER NOT NULL,
+	project_id INTEGER NOT NULL,
+	FOREIGN KEY(description) REFERENCES txt(txt_id),
+	FOREIGN KEY(project_id) REFERENCES project(project_id)
+);
+CREATE TABLE IF NOT EXISTS gitcommit(
+	gitcommit_id INTEGER PRIMARY KEY,
+	githash TEXT,
+	project_id INTEGER NOT NULL,
+	FOREIGN KEY(project_id) REFERENCES project(project_id)
+);
+CREATE TABLE IF NOT EXISTS comment(
+	comment_id INTEGER PRIMARY KEY,
+	txt_id INTEGER NOT NULL,
+	bug_id INTEGER NOT NULL,
+	person_id INTEGER NOT NULL,
+	FOREIGN KEY(txt_id) REFERENCES txt(txt_id),
+	FOREIGN KEY(bug_id) REFERENCES bug(bug_id),
+	FOREIGN KEY(person_id) REFERENCES person(person_id)
+);
+CREATE TABLE IF NOT EXISTS person(
+	person_id INTEGER PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	email TEXT UNIQUE NOT NULL,
+	password TEXT
+);
+CREATE TABLE IF NOT EXISTS dependency(
+	dependency_id INTEGER PRIMARY KEY,
+	cause INTEGER NOT NULL,
+	effect INTEGER NOT NULL,
+	FOREIGN KEY(cause) REFERENCES bug(bug_id),
+	FOREIGN KEY(effect) REFERENCES bug(bug_id)
+);
+CREATE TABLE IF NOT EXISTS duplicate(
+	duplicate_id INTEGER PRIMARY KEY,
+	original INTEGER NOT NULL,
+	duplicate INTEGER NOT NULL,
+	FOREIGN KEY(original) REFERENCES bug(bug_id),
+	FOREIGN KEY(duplicate) REFERENCES bug(bug_id)
+);
+CREATE TABLE IF NOT EXISTS image(
+	image_id INTEGER PRIMARY KEY,
+	file TEXT UNIQUE NOT NULL,
+	bug_id INTEGER NOT NULL,
+	person_id INTEGER NOT NULL,
+	FOREIGN KEY(bug_id) REFERENCES bug(bug_id),
+	FOREIGN KEY(person_id) REFERENCES person(person_id)
+);
+CREATE TABLE IF NOT EXISTS session(
+	session_id INTEGER PRIMARY KEY,
+	person_id INTEGER NOT NULL,
+	cookie TEXT NOT NULL,
+	start TIMESTAMP,
+	FOREIGN KEY(person_id) REFERENCES person(person_id)
+);
+CREATE TABLE IF NOT EXISTS "txt" (
+	txt_id INTEGER PRIMARY KEY,
+	entered TIMESTAMP,
+	content TEXT,
+	txttype TEXT,
+	other_id INTEGER
+);
+`
+
+var webhookSql = `
+CREATE TABLE IF NOT EXISTS webhook(
+	webhook_id INTEGER PRIMARY KEY,
+	project_id INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT
+);
+CREATE TABLE IF NOT EXISTS delivery(
+	delivery_id INTEGER PRIMARY KEY,
+	webhook_id INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	attempts INTEGER,
+	status INTEGER,
+	error TEXT,
+	created TIMESTAMP,
+	delivered TIMESTAMP,
+	FOREIGN KEY(webhook_id) REFERENCES webhook(webhook_id)
+);
+`
+
+var tokenSql = `
+CREATE TABLE IF NOT EXISTS token(
+	token_id INTEGER PRIMARY KEY,
+	person_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	hash TEXT NOT NULL UNIQUE,
+	scope TEXT NOT NULL,
+	created TIMESTAMP,
+	expires TIMESTAMP,
+	last_used TIMESTAMP,
+	FOREIGN KEY(person_id) REFERENCES person(person_id)
+);
+`
+
+var grantSql = `
+CREATE TABLE IF NOT EXISTS grant(
+	grant_id INTEGER PRIMARY KEY,
+	person_id INTEGER NOT NULL,
+	project_id INTEGER NOT NULL,
+	role TEXT NOT NULL,
+	UNIQUE(person_id, project_id),
+	FOREIGN KEY(person_id) REFERENCES person(person_id),
+	FOREIGN KEY(project_id) REFERENCES project(project_id)
+);
+`
+
+var authEventSql = `
+CREATE TABLE IF NOT EXISTS auth_event(
+	auth_event_id INTEGER PRIMARY KEY,
+	entered TIMESTAMP NOT NULL,
+	name TEXT NOT NULL,
+	person_id INTEGER NOT NULL DEFAULT 0,
+	ip TEXT NOT NULL,
+	event TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS auth_event_name ON auth_event(name);
+CREATE INDEX IF NOT EXISTS auth_event_ip ON auth_event(ip);
+`
+
+var attachmentTableSql = `
+CREATE TABLE IF NOT EXISTS attachment(
+	attachment_id INTEGER PRIMARY KEY,
+	bug_id INTEGER NOT NULL,
+	person_id INTEGER NOT NULL,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	sha256 TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	entered TIMESTAMP,
+	FOREIGN KEY(bug_id) REFERENCES bug(bug_id),
+	FOREIGN KEY(person_id) REFERENCES person(person_id)
+);
+CREATE INDEX IF NOT EXISTS attachment_bug ON attachment(bug_id);
+CREATE INDEX IF NOT EXISTS attachment_sha256 ON attachment(sha256);
+`
+
+var projectEventSql = `
+CREATE TABLE IF NOT EXISTS project_event(
+	project_event_id INTEGER PRIMARY KEY,
+	project_id INTEGER NOT NULL,
+	person_id INTEGER NOT NULL,
+	entered TIMESTAMP NOT NULL,
+	old_status INTEGER NOT NULL,
+	new_status INTEGER NOT NULL,
+	note TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY(project_id) REFERENCES project(project_id),
+	FOREIGN KEY(person_id) REFERENCES person(person_id)
+);
+CREATE INDEX IF NOT EXISTS project_event_project ON project_event(project_id);
+`
+
+var schemaVersionSql = `
+CREATE TABLE IF NOT EXISTS schema_version(
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied TIMESTAMP NOT NULL
+)
+`
+
+func execSql(tx *sql.Tx, statements string) error {
+	_, err := tx.Exec(statements)
+	return err
+}
+
+// A column which a migration adds to a table.
+type column struct {
+	table string
+	name  string
+	// The type and constraints, as in CREATE TABLE
+	decl string
+}
+
+func hasColumn(tx *sql.Tx, table string, name string) (found bool, err error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var colName, colType string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &colName, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			return false, err
+		}
+		if colName == name {
+			found = true
+		}
+	}
+	return found, rows.Err()
+}
+
+// Add the columns which are not already there.
+func addColumns(tx *sql.Tx, columns []column) error {
+	for _, c := range columns {
+		found, err := hasColumn(tx, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.decl))
+		if err != nil {
+			return fmt.Errorf("Error adding %s to %s: %s", c.name, c.table, err)
+		}
+	}
+	return nil
+}
+
+// The latest version applied to "db", or zero if none has been.
+func schemaVersion(db *sql.DB) (version int, err error) {
+	err = db.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// Bring the schema of "db" up to date. "applied" is the number of
+// migrations which were applied.
+func migrate(db *sql.DB) (applied int, err error) {
+	_, err = db.Exec(schemaVersionSql)
+	if err != nil {
+		return 0, err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return 0, fmt.Errorf("The database has schema version %d, but this program only knows up to %d", current, latest)
+	}
+	if current == 0 {
+		var tables int
+		err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'bug'`).Scan(&tables)
+		if err != nil {
+			return 0, err
+		}
+		if tables > 0 {
+			log.Printf("The database is from before migrations, adding what is missing")
+		}
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		err = m.up(tx)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_version(version, name, applied) VALUES(?, ?, ?)`,
+				m.version, m.name, time.Now())
+		}
+		if err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("Error in migration %d, %s: %s", m.version, m.name, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return applied, err
+		}
+		log.Printf("Applied migration %d, %s", m.version, m.name)
+		applied++
+	}
+	return applied, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A description of the tables and indexes of "db" for comparing.
+func describeSchema(t *testing.T, db *sql.DB) []string {
+	var tables []string
+	var out []string
+	rows, err := db.Query(`SELECT type, name, tbl_name FROM sqlite_master
+WHERE name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var kind, name, table string
+		err = rows.Scan(&kind, &name, &table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind == "table" {
+			tables = append(tables, name)
+		}
+		out = append(out, fmt.Sprintf("%s %s on %s", kind, name, table))
+	}
+	rows.Close()
+	for _, table := range tables {
+		rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var cid, notNull, pk int
+			var name, colType string
+			var dflt sql.NullString
+			err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, fmt.Sprintf("%s.%d %s %s notnull=%d default=%s pk=%d",
+				table, cid, name, colType, notNull, dflt.String, pk))
+		}
+		rows.Close()
+	}
+	sort.Strings(out)
+	return out
+}
+
+func openTestDb(t *testing.T, name string, schema string) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(testDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema != "" {
+		_, err = db.Exec(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func readSchema(t *testing.T, file string) string {
+	schema, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(schema)
+}
+
+func TestMigrationsMatchSchema(t *testing.T) {
+	fromSchema := openTestDb(t, "schema.db", readSchema(t, "schema.txt"))
+	defer fromSchema.Close()
+	migrated := openTestDb(t, "migrated.db", "")
+	defer migrated.Close()
+	applied, err := migrate(migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("Applied %d of %d migrations to an empty database", applied, len(migrations))
+	}
+	want := describeSchema(t, fromSchema)
+	got := describeSchema(t, migrated)
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("The migrations do not make schema.txt:\nschema.txt: %s\nmigrations: %s",
+			strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	// A database made from schema.txt before there were migrations.
+	applied, err = migrate(fromSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) || !reflect.DeepEqual(describeSchema(t, fromSchema), want) {
+		t.Errorf("Migrating a database made from schema.txt changed it")
+	}
+}
+
+var oldData = `
+INSERT INTO person(name, email, password) VALUES('old', 'old@localhost', 'pw');
+INSERT INTO person(name, email, password) VALUES('older', 'older@localhost', 'pw');
+INSERT INTO txt(content, entered) VALUES('Old bug', CURRENT_TIMESTAMP);
+INSERT INTO project(name, directory, description, owner) VALUES('Old', '', 1, 1);
+INSERT INTO bug(title, description, project_id, part_id, entered, owner, status, priority)
+VALUES(1, 1, 1, 0, CURRENT_TIMESTAMP, 1, 0, 0);
+INSERT INTO session(person_id, cookie, start) VALUES(1, 'cookie', CURRENT_TIMESTAMP);
+`
+
+func TestUpgradeOldDatabase(t *testing.T) {
+	want := describeSchema(t, openTestDb(t, "want.db", readSchema(t, "schema.txt")))
+	old := readSchema(t, "testdata/schema-before-migrations.txt")
+	// Some databases did not have the columns which were added by hand.
+	older := strings.Replace(old, "\tchanged timestamp,\n\testimate INTEGER,\n", "", 1)
+	older = strings.Replace(older, "NOT NULL, status,", "NOT NULL,", 1)
+	if older == old {
+		t.Fatal("Could not remove the columns from the old schema")
+	}
+	for i, schema := range []string{old, older} {
+		db := openTestDb(t, fmt.Sprintf("old%d.db", i), schema+oldData)
+		applied, err := migrate(db)
+		if err != nil {
+			t.Fatalf("Upgrade %d: %s", i, err)
+		}
+		if applied != len(migrations) {
+			t.Errorf("Upgrade %d applied %d migrations", i, applied)
+		}
+		got := describeSchema(t, db)
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("Upgrade %d gave a different schema:\n%s", i, strings.Join(got, "\n"))
+		}
+		// The owner of the first project becomes the admin, and
+		// everyone else a developer.
+		var private int
+		for name, want := range map[string]string{"old": "admin", "older": "developer"} {
+			var role, status string
+			err = db.QueryRow(`SELECT role, status FROM person WHERE name = ?`, name).Scan(&role, &status)
+			if err != nil || role != want || status != "active" {
+				t.Errorf("Upgrade %d: %s has role %q and status %q: %v", i, name, role, status, err)
+			}
+		}
+		err = db.QueryRow(`SELECT private FROM project WHERE name = 'Old'`).Scan(&private)
+		if err != nil || private != 0 {
+			t.Errorf("Upgrade %d: old project has private %d: %v", i, private, err)
+		}
+		bugs, err := bagzullaDb.BugsFromRows(mustQuery(t, db, `SELECT * FROM bug`))
+		if err != nil || len(bugs) != 1 || bugs[0].Title != 1 || bugs[0].ProjectId != 1 {
+			t.Errorf("Upgrade %d: old bugs are %+v: %v", i, bugs, err)
+		}
+		applied, err = migrate(db)
+		if err != nil || applied != 0 {
+			t.Errorf("Upgrade %d: second run applied %d: %v", i, applied, err)
+		}
+		db.Close()
+	}
+}
+
+func mustQuery(t *testing.T, db *sql.DB, query string) *sql.Rows {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestMigrationFailure(t *testing.T) {
+	db := openTestDb(t, "failure.db", "")
+	defer db.Close()
+	_, err := migrate(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := migrations
+	defer func() { migrations = saved }()
+	latest := saved[len(saved)-1].version
+	migrations = append(saved[:len(saved):len(saved)], migration{latest + 1, "broken", func(tx *sql.Tx) error {
+		err := execSql(tx, `CREATE TABLE half(half_id INTEGER PRIMARY KEY)`)
+		if err != nil {
+			return err
+		}
+		return execSql(tx, `ALTER TABLE nothing ADD COLUMN x TEXT`)
+	}})
+	_, err = migrate(db)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Broken migration gave %v", err)
+	}
+	version, err := schemaVersion(db)
+	if err != nil || version != latest {
+		t.Errorf("After a failure the version is %d: %v", version, err)
+	}
+	var tables int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half'`).Scan(&tables)
+	if tables != 0 {
+		t.Errorf("The failed migration was not rolled back")
+	}
+
+	// A database from a newer version of the program.
+	migrations = saved
+	_, err = db.Exec(`INSERT INTO schema_version(version, name, applied) VALUES(?, 'future', CURRENT_TIMESTAMP)`, latest+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrate(db)
+	if err == nil || !strings.Contains(err.Error(), "only knows up to") {
+		t.Errorf("Newer database gave %v", err)
+	}
+}
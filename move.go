@@ -0,0 +1,268 @@
+package main
+
+/* Moving bugs and parts between projects. When a bug moves, its part
+   can go with it, as the part of the same name in the new project,
+   which is made if the project does not have one. A part can also
+   move to another project with all its bugs. Each move of a bug adds
+   a comment to it saying where it came from. The parts under a part
+   move with it. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Where a bug is, for the comments about moves.
+func (b *Bagreply) bugPlace(projectId int64, partId int64) (place string, ok bool) {
+	project, ok := getProjectName(b, projectId)
+	if !ok {
+		return "", false
+	}
+	if partId == 0 {
+		return "project " + project, true
+	}
+	part, ok := getPartName(b, partId)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("part %s of project %s", part, project), true
+}
+
+// Move "bug" to the part with ID "partId" of the project with ID
+// "projectId", or to no part if "partId" is zero, with a comment
+// saying so.
+func (b *Bagreply) moveBug(bug bagzullaDb.Bug, projectId int64, partId int64) (ok bool) {
+	if b.NotAllowed(roleDeveloper, projectId) {
+		return false
+	}
+	project, ok := projectFromId(b, projectId)
+	if !ok || b.projectClosed(project) {
+		return false
+	}
+	from, ok := b.bugPlace(bug.ProjectId, bug.PartId)
+	if !ok {
+		return false
+	}
+	to, ok := b.bugPlace(projectId, partId)
+	if !ok {
+		return false
+	}
+	return b.inTx(func() bool {
+		err := b.data().UpdateProjectIdForBug(projectId, bug.BugId)
+		if err != nil {
+			b.errorPage("Error assigning project with id %d to bug with id %d: %s",
+				projectId, bug.BugId, err.Error())
+			return false
+		}
+		err = b.data().UpdatePartIdForBug(partId, bug.BugId)
+		if err != nil {
+			b.errorPage("Error setting part for bug with id %d: %s",
+				bug.BugId, err.Error())
+			return false
+		}
+		text := fmt.Sprintf("Moved from %s to %s.", from, to)
+		_, err = addComment(b.data(), bug.BugId, b.User.PersonId, text)
+		if err != nil {
+			b.errorPage("Error adding a comment to bug %d: %s", bug.BugId, err)
+			return false
+		}
+		if !b.updateChanged(bug.BugId) {
+			return false
+		}
+		b.bugEvent("reassigned", bug.BugId, fmt.Sprintf("project %d", bug.ProjectId),
+			fmt.Sprintf("project %d", projectId), text)
+		return true
+	})
+}
+
+// The part of project "project" with the same name as "part", or a
+// new one if it does not have one.
+func (b *Bagreply) samePart(part bagzullaDb.Part, project bagzullaDb.Project) (partId int64, ok bool) {
+	parts, err := b.data().PartsFromProjectId(project.ProjectId)
+	if err != nil {
+		b.errorPage("Error getting the parts of %s: %s", project.Name, err)
+		return 0, false
+	}
+	for _, p := range parts {
+		if strings.EqualFold(p.Name, part.Name) {
+			if !p.Deleted.IsZero() {
+				b.errorPage("The part '%s' of %s is in the trash", p.Name, project.Name)
+				return 0, false
+			}
+			return p.PartId, true
+		}
+	}
+	if project.ProjectId == b.inbox() {
+		return 0, true
+	}
+	ok = b.inTx(func() bool {
+		description, ok := getText(b, part.Description)
+		if !ok {
+			return false
+		}
+		descriptionId, ok := insertText(b, description.Content)
+		if !ok {
+			return false
+		}
+		partId, err = b.data().InsertPart(bagzullaDb.Part{
+			Name:        part.Name,
+			Description: descriptionId,
+			ProjectId:   project.ProjectId,
+		})
+		if err != nil {
+			b.errorPage("Error adding part %s to %s: %s", part.Name, project.Name, err)
+			return false
+		}
+		return true
+	})
+	return partId, ok
+}
+
+// Move "bug" to the project with ID "projectId". If the form's
+// "part-map" is "same", the bug goes in the part with the same name
+// as its part there, otherwise in no part.
+func (b *Bagreply) moveBugWithPart(bug bagzullaDb.Bug, projectId int64) (ok bool) {
+	if projectId == bug.ProjectId {
+		return true
+	}
+	if b.r.PostFormValue("part-map") != "same" || bug.PartId == 0 {
+		return b.moveBug(bug, projectId, 0)
+	}
+	if b.NotAllowed(roleDeveloper, projectId) {
+		return false
+	}
+	part, err := b.data().PartFromId(bug.PartId)
+	if err != nil {
+		b.errorPage("Error getting part %d: %s", bug.PartId, err)
+		return false
+	}
+	project, ok := projectFromId(b, projectId)
+	if !ok || b.projectClosed(project) {
+		return false
+	}
+	return b.inTx(func() bool {
+		partId, ok := b.samePart(part, project)
+		return ok && b.moveBug(bug, projectId, partId)
+	})
+}
+
+// Move the part at the end of the URL to the project of the form,
+// with all its bugs.
+func movePart(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	part, ok := getPart(b)
+	if !ok {
+		return
+	}
+	targetId, err := strconv.ParseInt(b.r.PostFormValue("project"), 10, 64)
+	if err != nil {
+		b.errorPage("Bad project %s", strconv.Quote(b.r.PostFormValue("project")))
+		return
+	}
+	if targetId == part.ProjectId {
+		b.errorPage("Part %s is already in that project", part.Name)
+		return
+	}
+	if b.NotAllowed(roleDeveloper, targetId) {
+		return
+	}
+	source, ok := projectFromId(b, part.ProjectId)
+	if !ok {
+		return
+	}
+	target, ok := projectFromId(b, targetId)
+	if !ok || b.projectClosed(target) {
+		return
+	}
+	if targetId == b.inbox() {
+		b.errorPage("Parts cannot be moved to the inbox project %s", target.Name)
+		return
+	}
+	// The part and the parts under it, including those in the
+	// trash.
+	sourceParts, err := b.data().PartsFromProjectId(part.ProjectId)
+	if err != nil {
+		b.errorPage("Error getting the parts of %s: %s", source.Name, err)
+		return
+	}
+	under := partDescendants(sourceParts, part.PartId)
+	moving := []bagzullaDb.Part{part}
+	for _, p := range sourceParts {
+		if under[p.PartId] {
+			moving = append(moving, p)
+		}
+	}
+	parts, err := b.data().PartsFromProjectId(targetId)
+	if err != nil {
+		b.errorPage("Error getting the parts of %s: %s", target.Name, err)
+		return
+	}
+	for _, p := range parts {
+		for _, m := range moving {
+			if strings.EqualFold(p.Name, m.Name) {
+				b.errorPage("There is already a part '%s' in %s", p.Name, target.Name)
+				return
+			}
+		}
+	}
+	var bugs []bagzullaDb.Bug
+	for _, m := range moving {
+		partBugs, err := b.data().BugsFromPartId(m.PartId)
+		if err != nil {
+			b.errorPage("Error getting the bugs of part %s: %s", m.Name, err)
+			return
+		}
+		bugs = append(bugs, partBugs...)
+	}
+	text := fmt.Sprintf("Moved with part %s from project %s to project %s.",
+		part.Name, source.Name, target.Name)
+	ok = b.inTx(func() bool {
+		for _, m := range moving {
+			err := b.data().UpdateProjectIdForPart(targetId, m.PartId)
+			if err != nil {
+				b.errorPage("Error moving part %s: %s", m.Name, err)
+				return false
+			}
+		}
+		if part.ParentId != 0 {
+			err := b.data().UpdateParentIdForPart(0, part.PartId)
+			if err != nil {
+				b.errorPage("Error moving part %s: %s", part.Name, err)
+				return false
+			}
+		}
+		for _, bug := range bugs {
+			err := b.data().UpdateProjectIdForBug(targetId, bug.BugId)
+			if err != nil {
+				b.errorPage("Error moving bug %d: %s", bug.BugId, err)
+				return false
+			}
+			// Bugs in the trash go with the part, without a
+			// comment.
+			if !bug.Deleted.IsZero() {
+				continue
+			}
+			_, err = addComment(b.data(), bug.BugId, b.User.PersonId, text)
+			if err != nil {
+				b.errorPage("Error adding a comment to bug %d: %s", bug.BugId, err)
+				return false
+			}
+			if !b.updateChanged(bug.BugId) {
+				return false
+			}
+			b.bugEvent("reassigned", bug.BugId, fmt.Sprintf("project %d", source.ProjectId),
+				fmt.Sprintf("project %d", targetId), text)
+		}
+		return true
+	})
+	if !ok {
+		return
+	}
+	log.Printf("%s moved part %s from %s to %s", b.User.Name, part.Name, source.Name, target.Name)
+	redirectToPart(b, part.PartId)
+}
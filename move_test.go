@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	ba := getTestApp(t)
+	projects := make(map[string]int64)
+	for _, name := range []string{"Origin", "Destination"} {
+		result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status)
+VALUES(?, '', 1, 1, 0)`, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		projects[name], _ = result.LastInsertId()
+	}
+	parts := make(map[string]int64)
+	for _, p := range [][2]string{{"Origin", "Engine"}, {"Origin", "Wheels"}, {"Origin", "Gearbox"},
+		{"Destination", "engine"}} {
+		description, err := storeText(ba.data, p[1]+" things")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := ba.db.Exec(`INSERT INTO part(name, project_id, description) VALUES(?, ?, ?)`,
+			p[1], projects[p[0]], description)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[p[0]+"/"+p[1]], _ = result.LastInsertId()
+	}
+	bugs := make(map[string]int64)
+	for _, b := range [][2]string{{"Engine", "Knocking"}, {"Wheels", "Wobbling"},
+		{"Wheels", "Squeaking"}, {"Gearbox", "Grinding"}, {"Gearbox", "Slipping"}} {
+		bugId, err := addBug(ba.data, b[1], "Noisy", projects["Origin"], parts["Origin/"+b[0]], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bugs[b[1]] = bugId
+	}
+	err := ba.data.UpdateStatusForBug(1, bugs["Slipping"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(fn BagFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, roleDeveloper)(w, r)
+		return w
+	}
+	moveBug := func(name string, partMap string) {
+		w := send(changeBugProjectHandler, fmt.Sprintf("/change-bug-project/%d", bugs[name]),
+			url.Values{"project": {"Destination"}, "part-map": {partMap}})
+		if w.Code != http.StatusFound {
+			t.Fatalf("Moving %s: %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	// Where the bug is and its last comment.
+	where := func(name string) (projectId int64, partId int64, comment string) {
+		bug, err := ba.data.BugFromId(bugs[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments, err := ba.data.CommentsFromBugId(bug.BugId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(comments) > 0 {
+			txt, err := ba.data.TxtFromId(comments[len(comments)-1].TxtId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			comment = txt.Content
+		}
+		return bug.ProjectId, bug.PartId, comment
+	}
+
+	// The same name in another case is the same part.
+	moveBug("Knocking", "same")
+	project, part, comment := where("Knocking")
+	if project != projects["Destination"] || part != parts["Destination/engine"] {
+		t.Errorf("Knocking moved to project %d part %d", project, part)
+	}
+	if comment != "Moved from part Engine of project Origin to part engine of project Destination." {
+		t.Errorf("Move comment is %q", comment)
+	}
+
+	// A part which the project does not have is added.
+	moveBug("Wobbling", "same")
+	_, part, _ = where("Wobbling")
+	added, err := ba.data.PartFromId(part)
+	if err != nil || added.Name != "Wheels" || added.ProjectId != projects["Destination"] {
+		t.Fatalf("Wobbling moved to part %v %v", added, err)
+	}
+	description, err := ba.data.TxtFromId(added.Description)
+	if err != nil || description.Content != "Wheels things" {
+		t.Errorf("Added part has description %v %v", description, err)
+	}
+	moveBug("Squeaking", "none")
+	_, part, comment = where("Squeaking")
+	if part != 0 || !strings.HasSuffix(comment, "to project Destination.") {
+		t.Errorf("Squeaking moved to part %d with %q", part, comment)
+	}
+
+	// A part goes with all its bugs, but not to a project with a part
+	// of the same name.
+	w := send(movePart, fmt.Sprintf("/move-part/%d", parts["Origin/Wheels"]),
+		url.Values{"project": {fmt.Sprint(projects["Destination"])}})
+	if !strings.Contains(w.Body.String(), "already a part") {
+		t.Errorf("Moved a part to a project with one of the same name: %d", w.Code)
+	}
+	w = send(movePart, fmt.Sprintf("/move-part/%d", parts["Origin/Gearbox"]),
+		url.Values{"project": {fmt.Sprint(projects["Destination"])}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("Moving a part: %d %s", w.Code, w.Body.String())
+	}
+	gearbox, err := ba.data.PartFromId(parts["Origin/Gearbox"])
+	if err != nil || gearbox.ProjectId != projects["Destination"] {
+		t.Errorf("Part not moved: %v %v", gearbox, err)
+	}
+	for _, name := range []string{"Grinding", "Slipping"} {
+		project, part, comment := where(name)
+		if project != projects["Destination"] || part != gearbox.PartId ||
+			comment != "Moved with part Gearbox from project Origin to project Destination." {
+			t.Errorf("%s is in project %d part %d with %q", name, project, part, comment)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+/* Caches of the names of projects, parts and people, which are shown
+   with each bug and comment. The handlers run at the same time, so
+   each cache has a lock. A name is removed from its cache when it is
+   changed, and read again from the database the next time it is
+   needed. */
+
+import (
+	"sync"
+)
+
+type nameCache struct {
+	sync.RWMutex
+	names map[int64]string
+	// The number of changes, so that a name which was read from the
+	// database before a change is not put into the cache after it.
+	changes int64
+}
+
+func newNameCache() *nameCache {
+	return &nameCache{names: make(map[int64]string)}
+}
+
+// Get the name with ID "id". If it is not found, "changes" is passed
+// to "add" with the name from the database.
+func (c *nameCache) get(id int64) (name string, found bool, changes int64) {
+	c.RLock()
+	defer c.RUnlock()
+	name, found = c.names[id]
+	return name, found, c.changes
+}
+
+// Add a name which was read from the database. It is not added if the
+// name has been changed since "get".
+func (c *nameCache) add(id int64, name string, changes int64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.changes == changes {
+		c.names[id] = name
+	}
+}
+
+// Remove the name with ID "id", after it has been changed.
+func (c *nameCache) forget(id int64) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.names, id)
+	c.changes++
+}
+
+// Make the caches of names of "ba". Each application has its own, so
+// that the names of one database are not shown for another.
+func (ba *Bagapp) makeNameCaches() {
+	ba.projectNames = newNameCache()
+	ba.partNames = newNameCache()
+	ba.personNames = newNameCache()
+}
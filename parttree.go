@@ -0,0 +1,278 @@
+package main
+
+/* Parts of parts. A part can be under another part of the same
+   project, kept in part.parent_id, so that a large project can have
+   parts like compiler/parser/lexer. A part cannot go under itself or
+   under any part which is under it. A part whose parent is in the
+   trash is shown at the top until the parent is restored. The page of
+   a part can include the bugs of the parts under it, and the open bugs
+   of the parts on the page of the project include those of the parts
+   under them. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"strconv"
+	"strings"
+)
+
+// A part in the tree of the parts of a project.
+type PartNode struct {
+	bagzullaDb.Part
+	// How many parts it is under.
+	Depth int
+	// The names of the parts down to this one, like
+	// "compiler/parser/lexer".
+	Path string
+	// The number of open bugs in the part and the parts under it.
+	OpenBugs int64 `json:"-"`
+}
+
+// Spaces to put before the name of the part in a list, so that it
+// is under its parent.
+func (n PartNode) Indent() string {
+	return strings.Repeat("\u00a0\u00a0\u00a0", n.Depth)
+}
+
+// The parts under each part of "parts", by the ID of the parent.
+func partChildren(parts []bagzullaDb.Part) map[int64][]bagzullaDb.Part {
+	children := make(map[int64][]bagzullaDb.Part)
+	for _, p := range parts {
+		children[p.ParentId] = append(children[p.ParentId], p)
+	}
+	return children
+}
+
+// Put the parts "parts" of one project in the order of the tree, each
+// followed by the parts under it, sorted by name.
+func partTree(parts []bagzullaDb.Part) (tree []PartNode) {
+	ids := make(map[int64]bool)
+	for _, p := range parts {
+		ids[p.PartId] = true
+	}
+	children := partChildren(parts)
+	var roots []bagzullaDb.Part
+	for _, p := range parts {
+		if !ids[p.ParentId] {
+			roots = append(roots, p)
+		}
+	}
+	seen := make(map[int64]bool)
+	var add func(p bagzullaDb.Part, depth int, path string)
+	add = func(p bagzullaDb.Part, depth int, path string) {
+		if seen[p.PartId] {
+			return
+		}
+		seen[p.PartId] = true
+		if path != "" {
+			path += "/"
+		}
+		path += p.Name
+		tree = append(tree, PartNode{Part: p, Depth: depth, Path: path})
+		under := children[p.PartId]
+		sortParts(under)
+		for _, c := range under {
+			add(c, depth+1, path)
+		}
+	}
+	sortParts(roots)
+	for _, p := range roots {
+		add(p, 0, "")
+	}
+	// Parts in a loop, which there should not be, go at the end.
+	for _, p := range parts {
+		add(p, 0, "")
+	}
+	return tree
+}
+
+// The IDs of the parts of "parts" which are under the part with ID
+// "partId", however deep.
+func partDescendants(parts []bagzullaDb.Part, partId int64) map[int64]bool {
+	children := partChildren(parts)
+	under := make(map[int64]bool)
+	var add func(id int64)
+	add = func(id int64) {
+		for _, c := range children[id] {
+			if !under[c.PartId] && c.PartId != partId {
+				under[c.PartId] = true
+				add(c.PartId)
+			}
+		}
+	}
+	add(partId)
+	return under
+}
+
+var noParentQuery = bagzullaDb.NewQuery(`UPDATE part SET parent_id = 0 WHERE parent_id = ?`)
+
+var partOpenBugsSql = `SELECT part_id, COUNT(*) FROM bug
+WHERE project_id = ? AND status = 0 AND deleted IS NULL GROUP BY part_id`
+var partOpenBugsQuery = bagzullaDb.NewQuery(partOpenBugsSql)
+
+// Count the open bugs of each part of "tree", which are the parts of
+// the project with ID "projectId", together with those of the parts
+// under it.
+func (b *Bagreply) countPartBugs(tree []PartNode, projectId int64) (ok bool) {
+	rows, err := b.data().Stmt(partOpenBugsQuery).Query(projectId)
+	if err != nil {
+		b.errorPage("Error counting the open bugs of the parts: %s", err)
+		return false
+	}
+	defer rows.Close()
+	index := make(map[int64]int)
+	for i, n := range tree {
+		index[n.PartId] = i
+	}
+	for rows.Next() {
+		var partId, count int64
+		err = rows.Scan(&partId, &count)
+		if err != nil {
+			b.errorPage("Error counting the open bugs of the parts: %s", err)
+			return false
+		}
+		i, found := index[partId]
+		if found {
+			tree[i].OpenBugs = count
+		}
+	}
+	if rows.Err() != nil {
+		b.errorPage("Error counting the open bugs of the parts: %s", rows.Err())
+		return false
+	}
+	// The parts under a part come after it, so adding the counts
+	// from the end adds each part's total to its parent.
+	for i := len(tree) - 1; i >= 0; i-- {
+		if tree[i].Depth == 0 {
+			continue
+		}
+		parent, found := index[tree[i].ParentId]
+		if found {
+			tree[parent].OpenBugs += tree[i].OpenBugs
+		}
+	}
+	return true
+}
+
+// The live parts of the project with ID "projectId" as a tree.
+func (b *Bagreply) projectPartTree(projectId int64) (tree []PartNode, ok bool) {
+	parts, err := b.data().PartsFromProjectId(projectId)
+	if err != nil {
+		b.errorPage("Error getting the parts of project %d: %s", projectId, err)
+		return nil, false
+	}
+	return partTree(liveParts(parts)), true
+}
+
+// Check that the part with ID "parentId" can be the parent of the
+// part "part", or of a new part if the ID of "part" is zero. A zero
+// "parentId" puts the part at the top.
+func (b *Bagreply) checkParent(part bagzullaDb.Part, parentId int64) (ok bool) {
+	if parentId == 0 {
+		return true
+	}
+	parent, err := b.data().PartFromId(parentId)
+	if err != nil || parent.ProjectId != part.ProjectId || !parent.Deleted.IsZero() {
+		b.errorPage("There is no part with ID %d in the project", parentId)
+		return false
+	}
+	if part.PartId == 0 {
+		return true
+	}
+	parts, err := b.data().PartsFromProjectId(part.ProjectId)
+	if err != nil {
+		b.errorPage("Error getting the parts of project %d: %s", part.ProjectId, err)
+		return false
+	}
+	if parentId == part.PartId || partDescendants(parts, part.PartId)[parentId] {
+		b.errorPage("Part %s cannot go under %s, which is under it", part.Name, parent.Name)
+		return false
+	}
+	return true
+}
+
+// The parent part of the form, or zero for none.
+func (b *Bagreply) formParent() (parentId int64, ok bool) {
+	value := b.r.PostFormValue("parent")
+	if value == "" {
+		return 0, true
+	}
+	parentId, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		b.errorPage("Bad parent part %s", strconv.Quote(value))
+		return 0, false
+	}
+	return parentId, true
+}
+
+// Change the part which the part at the end of the URL is under.
+func changePartParent(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	part, ok := getPart(b)
+	if !ok {
+		return
+	}
+	parentId, ok := b.formParent()
+	if !ok || !b.checkParent(part, parentId) {
+		return
+	}
+	err := b.data().UpdateParentIdForPart(parentId, part.PartId)
+	if err != nil {
+		b.errorPage("Error changing the parent of %s: %s", part.Name, err)
+		return
+	}
+	redirectToPart(b, part.PartId)
+}
+
+// The parts with ID "?" and all the parts under it which are not in
+// the trash.
+var partTreeSql = `bug.part_id IN (WITH RECURSIVE sub(part_id) AS
+(SELECT ? UNION SELECT part.part_id FROM part JOIN sub ON part.parent_id = sub.part_id
+WHERE part.deleted IS NULL) SELECT part_id FROM sub)`
+
+// The bugs of a part together with those of the parts under it.
+var (
+	partTreeBugList     = bugList{where: partTreeSql, sort: "id"}
+	openPartTreeBugList = bugList{where: partTreeSql + " AND bug.status = 0", sort: "changed", desc: true}
+)
+
+// Fill in the parts above and under the part of "pp", and the parts
+// which it can go under.
+func (b *Bagreply) partFamily(pp *partPage) (ok bool) {
+	tree, ok := b.projectPartTree(pp.Part.ProjectId)
+	if !ok || !b.countPartBugs(tree, pp.Part.ProjectId) {
+		return false
+	}
+	live := make(map[int64]bagzullaDb.Part)
+	for _, n := range tree {
+		live[n.PartId] = n.Part
+	}
+	for id := pp.Part.ParentId; id != 0 && len(pp.Ancestors) < len(tree); {
+		parent, found := live[id]
+		if !found {
+			break
+		}
+		pp.Ancestors = append([]bagzullaDb.Part{parent}, pp.Ancestors...)
+		id = parent.ParentId
+	}
+	// The parts under the part come just after it in the tree, and
+	// the parts after those can be its parent.
+	for i := 0; i < len(tree); i++ {
+		if tree[i].PartId != pp.Part.PartId {
+			pp.Parents = append(pp.Parents, tree[i])
+			continue
+		}
+		depth := tree[i].Depth
+		for i+1 < len(tree) && tree[i+1].Depth > depth {
+			i++
+			if tree[i].Depth == depth+1 {
+				pp.SubParts = append(pp.SubParts, tree[i])
+			}
+		}
+	}
+	if b.roleIn(pp.Part.ProjectId) < roleDeveloper {
+		pp.Parents = nil
+	}
+	return true
+}
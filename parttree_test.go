@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPartTree(t *testing.T) {
+	ba := getTestApp(t)
+	projects := make(map[string]int64)
+	for _, name := range []string{"Machine", "Elsewhere"} {
+		result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status)
+VALUES(?, '', 1, 1, 0)`, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		projects[name], _ = result.LastInsertId()
+	}
+	parts := make(map[string]int64)
+	for _, p := range [][2]string{{"Compiler", ""}, {"Parser", "Compiler"}, {"Lexer", "Parser"},
+		{"Optimiser", "Compiler"}, {"Docs", ""}} {
+		result, err := ba.db.Exec(`INSERT INTO part(name, project_id, description, parent_id)
+VALUES(?, ?, 1, ?)`, p[0], projects["Machine"], parts[p[1]])
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[p[0]], _ = result.LastInsertId()
+	}
+	for _, b := range [][3]string{{"Lexer", "Bad tokens", "open"}, {"Lexer", "Slow scanning", "open"},
+		{"Parser", "Lost brackets", "open"}, {"Parser", "Old grammar", "fixed"}, {"Docs", "Typos", "open"}} {
+		bugId, err := addBug(ba.data, b[1], "Broken", projects["Machine"], parts[b[0]], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[2] != "open" {
+			err = ba.data.UpdateStatusForBug(1, bugId)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	token, err := insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(fn BagFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, roleViewer)(w, r)
+		return w
+	}
+
+	all, err := ba.data.PartsFromProjectId(projects["Machine"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, n := range partTree(all) {
+		paths = append(paths, fmt.Sprintf("%d %s", n.Depth, n.Path))
+	}
+	expect := "0 Compiler, 1 Compiler/Optimiser, 1 Compiler/Parser, 2 Compiler/Parser/Lexer, 0 Docs"
+	if strings.Join(paths, ", ") != expect {
+		t.Errorf("Tree of parts is %q", strings.Join(paths, ", "))
+	}
+
+	// A part cannot go under a part which is under it.
+	w := send(changePartParent, fmt.Sprintf("/change-part-parent/%d", parts["Compiler"]),
+		url.Values{"parent": {fmt.Sprint(parts["Lexer"])}})
+	if !strings.Contains(w.Body.String(), "which is under it") {
+		t.Errorf("Made a loop of parts: %d %s", w.Code, w.Body.String())
+	}
+	w = send(changePartParent, fmt.Sprintf("/change-part-parent/%d", parts["Docs"]),
+		url.Values{"parent": {fmt.Sprint(parts["Optimiser"])}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("Changing the parent: %d %s", w.Code, w.Body.String())
+	}
+	docs, err := ba.data.PartFromId(parts["Docs"])
+	if err != nil || docs.ParentId != parts["Optimiser"] {
+		t.Errorf("Docs is under %d: %v", docs.ParentId, err)
+	}
+
+	// The open bugs of the parts under a part are counted with it.
+	w = send(showProject, fmt.Sprintf("/project/%d", projects["Machine"]), nil)
+	if !strings.Contains(w.Body.String(), "Compiler</a>\n(4 open)") ||
+		!strings.Contains(w.Body.String(), "Parser</a>\n(3 open)") {
+		t.Errorf("Project page does not count the open bugs: %s", w.Body.String())
+	}
+
+	parser := fmt.Sprintf("/part/%d", parts["Parser"])
+	w = send(showPart, parser, nil)
+	if strings.Contains(w.Body.String(), "Bad tokens") || !strings.Contains(w.Body.String(), "Lost brackets") {
+		t.Errorf("Part page has the wrong bugs: %s", w.Body.String())
+	}
+	w = send(showPart, parser+"?sub=1", nil)
+	body := w.Body.String()
+	if !strings.Contains(body, "Bad tokens") || !strings.Contains(body, "Lost brackets") ||
+		strings.Contains(body, "Old grammar") {
+		t.Errorf("Part page does not include the bugs of the parts under it: %s", body)
+	}
+	if !strings.Contains(body, "sort=id&amp;sub=1") {
+		t.Errorf("Sorting links lose the parts under it: %s", body)
+	}
+
+	w = send(deletePart, fmt.Sprintf("/delete-part/%d", parts["Parser"]), url.Values{})
+	if !strings.Contains(w.Body.String(), "has parts under it") {
+		t.Errorf("Deleted a part with parts under it: %d", w.Code)
+	}
+
+	// The parts under a part move with it.
+	w = send(movePart, fmt.Sprintf("/move-part/%d", parts["Parser"]),
+		url.Values{"project": {fmt.Sprint(projects["Elsewhere"])}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("Moving a part: %d %s", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"Parser", "Lexer"} {
+		part, err := ba.data.PartFromId(parts[name])
+		if err != nil || part.ProjectId != projects["Elsewhere"] {
+			t.Errorf("%s did not move: %v %v", name, part, err)
+		}
+	}
+	moved, err := ba.data.PartFromId(parts["Parser"])
+	if err != nil || moved.ParentId != 0 {
+		t.Errorf("Moved part is still under %d: %v", moved.ParentId, err)
+	}
+	bugs, err := ba.data.BugsFromPartId(parts["Lexer"])
+	if err != nil || len(bugs) != 2 || bugs[0].ProjectId != projects["Elsewhere"] {
+		t.Errorf("The bugs of the part under it did not move: %v %v", bugs, err)
+	}
+}
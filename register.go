@@ -0,0 +1,553 @@
+package main
+
+/* Signing up. Anyone can ask for a login at /register/. If the server
+   can send mail, the new person first has to follow a link mailed to
+   their address, then an admin approves or rejects them at
+   /registrations/. Until then, and after an admin deactivates them
+   from their person page, they cannot log in. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The statuses of a person.
+const (
+	// Can log in.
+	accountActive = "active"
+	// Signed up, but has not followed the link in the mail yet.
+	accountUnverified = "unverified"
+	// Signed up, and waiting for an admin.
+	accountPending = "pending"
+	// Deactivated by an admin.
+	accountInactive = "inactive"
+)
+
+var minPasswordLength = 8
+var maxNameLength = 40
+
+// The role which the admin's approval form starts with.
+var signUpRole = roleReporter
+
+var personStatusSql = `SELECT status FROM person WHERE person_id = ?`
+var personStatusQuery = bagzullaDb.NewQuery(personStatusSql)
+
+// Get the status of the person with ID "personId".
+func personStatus(store *bagzullaDb.Store, personId int64) (status string, err error) {
+	err = store.Stmt(personStatusQuery).QueryRow(personId).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// Can the person with ID "personId" log in?
+func personActive(store *bagzullaDb.Store, personId int64) (active bool, err error) {
+	status, err := personStatus(store, personId)
+	return status == accountActive, err
+}
+
+// Why the person called "name" cannot log in yet, if they have
+// signed up and "password" is theirs, or else "". This is checked
+// before logging in, so that they are told what to do rather than
+// that the login failed. The password is checked for every name, so
+// that the time taken does not tell whether "name" has signed up.
+func signUpWaiting(store *bagzullaDb.Store, name string, password string) string {
+	person, err := store.PersonFromName(name)
+	waiting := err == nil && person.PersonId != 0 &&
+		(person.Status == accountUnverified || person.Status == accountPending)
+	stored := noPasswordHash
+	if waiting {
+		stored = person.Password
+	}
+	if !passwordMatch(stored, password) || !waiting {
+		return ""
+	}
+	if person.Status == accountUnverified {
+		return "You cannot log in until you confirm your address with the link in the mail which was sent to you"
+	}
+	return "You cannot log in until an admin approves your account, which is waiting for approval"
+}
+
+var setPersonStatusSql = `UPDATE person SET status = ?, verify = NULL WHERE person_id = ?`
+var setPersonStatusQuery = bagzullaDb.NewQuery(setPersonStatusSql)
+
+var insertSignUpSql = `
+INSERT INTO person(name, email, password, role, status, verify, registered)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+`
+var insertSignUpQuery = bagzullaDb.NewQuery(insertSignUpSql)
+
+var deleteSignUpSql = `DELETE FROM person WHERE person_id = ? AND status IN ('` +
+	accountUnverified + `', '` + accountPending + `')`
+var deleteSignUpQuery = bagzullaDb.NewQuery(deleteSignUpSql)
+
+var personEmailSql = `SELECT person_id FROM person WHERE lower(email) = lower(?)`
+var personEmailQuery = bagzullaDb.NewQuery(personEmailSql)
+
+var verifyPersonSql = `UPDATE person SET status = '` + accountPending + `', verify = NULL
+WHERE verify = ? AND status = '` + accountUnverified + `'`
+var verifyPersonQuery = bagzullaDb.NewQuery(verifyPersonSql)
+
+var signUpFields = `person_id, name, email, status, role, registered`
+
+var signUpsSql = `SELECT ` + signUpFields + ` FROM person
+WHERE status IN ('` + accountUnverified + `', '` + accountPending + `')
+ORDER BY registered`
+var signUpsQuery = bagzullaDb.NewQuery(signUpsSql)
+
+var signUpSql = `SELECT ` + signUpFields + ` FROM person
+WHERE person_id = ? AND status IN ('` + accountUnverified + `', '` + accountPending + `')`
+var signUpQuery = bagzullaDb.NewQuery(signUpSql)
+
+var editPersonSql = `UPDATE person SET name = ?, email = ? WHERE person_id = ?`
+var editPersonQuery = bagzullaDb.NewQuery(editPersonSql)
+var setPasswordSql = `UPDATE person SET password = ? WHERE person_id = ?`
+var setPasswordQuery = bagzullaDb.NewQuery(setPasswordSql)
+var deletePersonSessionsSql = `DELETE FROM session WHERE person_id = ?`
+var deletePersonSessionsQuery = bagzullaDb.NewQuery(deletePersonSessionsSql)
+
+// Someone who has signed up.
+type SignUp struct {
+	PersonId   int64
+	Name       string
+	Email      string
+	Status     string
+	Role       string
+	Registered time.Time
+}
+
+func scanSignUps(rows *sql.Rows) (signUps []SignUp, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var s SignUp
+		err = rows.Scan(&s.PersonId, &s.Name, &s.Email, &s.Status, &s.Role,
+			&s.Registered)
+		if err != nil {
+			return signUps, err
+		}
+		signUps = append(signUps, s)
+	}
+	return signUps, rows.Err()
+}
+
+// Get the ID of the person with the address "email", or zero if
+// there is no one with it. Case is ignored, since most mail servers
+// ignore it.
+func personIdFromEmail(store *bagzullaDb.Store, email string) (personId int64, err error) {
+	err = store.Stmt(personEmailQuery).QueryRow(email).Scan(&personId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return personId, err
+}
+
+// Only these characters are allowed in names, so that they can go
+// into pages and URLs as they are.
+func validNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.ContainsRune("._-@", c)
+}
+
+// Check a name and address for a person. "personId" is the person
+// being edited, or zero for someone new. The return value is a list of
+// the problems.
+func checkPerson(store *bagzullaDb.Store, personId int64, name string, email string) (problems []string, err error) {
+	switch {
+	case name == "":
+		problems = append(problems, "The name is empty.")
+	case len(name) > maxNameLength:
+		problems = append(problems,
+			fmt.Sprintf("The name is longer than %d characters.", maxNameLength))
+	case strings.IndexFunc(name, func(c rune) bool { return !validNameChar(c) }) >= 0:
+		problems = append(problems,
+			"The name may only have letters, digits, and the characters . _ - @")
+	case strings.EqualFold(name, "None"):
+		problems = append(problems, "The name None is used for nobody.")
+	default:
+		person, err := store.PersonFromName(name)
+		if err != nil {
+			return problems, err
+		}
+		if person.PersonId != 0 && person.PersonId != personId {
+			problems = append(problems, "Someone else has that name.")
+		}
+	}
+	addr, perr := mail.ParseAddress(email)
+	switch {
+	case perr != nil || addr.Address != email || strings.ContainsAny(email, `<>"'&`):
+		problems = append(problems, "The email address is not valid.")
+	default:
+		other, err := personIdFromEmail(store, email)
+		if err != nil {
+			return problems, err
+		}
+		if other != 0 && other != personId {
+			problems = append(problems, "Someone else has that email address.")
+		}
+	}
+	return problems, nil
+}
+
+// Check a new password and its repetition.
+func checkNewPassword(password string, again string) (problems []string) {
+	if len(password) < minPasswordLength {
+		problems = append(problems, fmt.Sprintf("The password must have at least %d characters.", minPasswordLength))
+	}
+	if password != again {
+		problems = append(problems, "The two passwords are different.")
+	}
+	return problems
+}
+
+// Make a token for the link in the verification mail. Only its hash
+// is kept in the database.
+func newVerifyToken() (token string, hash string, err error) {
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(buf)
+	return token, verifyHash(token), nil
+}
+
+func verifyHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Is there a sign-up page? People cannot sign up when the passwords
+// are somewhere other than the person table.
+func (ba *Bagapp) SignUpOpen() bool {
+	if !ba.registration {
+		return false
+	}
+	bu, ok := ba.store.(*baguser)
+	return ok && bu.checker == nil
+}
+
+type registerPage struct {
+	Name     string
+	Email    string
+	Problems []string
+	// Does the address have to be checked?
+	Mail bool
+	// Set after signing up.
+	Done   bool
+	Status string
+}
+
+// Sign up at /register/.
+func registerHandler(b *Bagreply) {
+	if !b.App.SignUpOpen() {
+		b.w.WriteHeader(http.StatusNotFound)
+		b.errorPage("People cannot sign up on this server.")
+		return
+	}
+	b.Title = "Sign up"
+	var rp registerPage
+	rp.Mail = b.App.mailEnabled()
+	if b.r.Method != "POST" {
+		b.runTemplate("register.html", rp)
+		return
+	}
+	rp.Name = strings.TrimSpace(b.r.PostFormValue("name"))
+	rp.Email = strings.TrimSpace(b.r.PostFormValue("email"))
+	password := b.r.PostFormValue("password")
+	var err error
+	rp.Problems, err = checkPerson(b.data(), 0, rp.Name, rp.Email)
+	if err != nil {
+		b.errorPage("Error checking sign-up: %s", err)
+		return
+	}
+	rp.Problems = append(rp.Problems,
+		checkNewPassword(password, b.r.PostFormValue("password2"))...)
+	if len(rp.Problems) > 0 {
+		b.runTemplate("register.html", rp)
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		b.errorPage("Error hashing password: %s", err)
+		return
+	}
+	rp.Status = accountPending
+	var token string
+	var verify sql.NullString
+	if rp.Mail {
+		rp.Status = accountUnverified
+		token, verify.String, err = newVerifyToken()
+		if err != nil {
+			b.errorPage("Error making verification token: %s", err)
+			return
+		}
+		verify.Valid = true
+	}
+	result, err := b.data().Stmt(insertSignUpQuery).Exec(rp.Name, rp.Email, hash,
+		signUpRole.String(), rp.Status, verify, time.Now())
+	if err != nil {
+		b.errorPage("Error adding %s: %s", rp.Name, err)
+		return
+	}
+	personId, err := result.LastInsertId()
+	if err != nil {
+		b.errorPage("Error adding %s: %s", rp.Name, err)
+		return
+	}
+	if rp.Mail {
+		err = b.App.sendMail(rp.Email, "Please confirm your address",
+			fmt.Sprintf(verifyMail, rp.Name, b.App.TopURL, b.App.TopURL, token))
+		if err != nil {
+			log.Printf("Error mailing %s: %s", rp.Email, err)
+			// Let them try again.
+			b.data().Stmt(deleteSignUpQuery).Exec(personId)
+			b.errorPage("The mail to %s could not be sent. Please try again later.", rp.Email)
+			return
+		}
+	}
+	log.Printf("%s (%d) signed up", rp.Name, personId)
+	rp.Done = true
+	b.runTemplate("register.html", rp)
+}
+
+var verifyMail = `Hello %s,
+
+Someone, probably you, signed up at %s with this address. To confirm
+it, please open
+
+%s/verify/?token=%s
+
+If it was not you, please ignore this mail.
+`
+
+var approvedMail = `Hello %s,
+
+Your login at %s is ready.
+`
+
+type verifyPage struct {
+	Token string
+	Done  bool
+}
+
+// Confirm an address with the token from the mail at /verify/. The
+// link shows a button rather than confirming straight away, so that
+// programs which look at links in mail do not confirm it.
+func verifyHandler(b *Bagreply) {
+	b.Title = "Confirm address"
+	var vp verifyPage
+	vp.Token = b.r.FormValue("token")
+	if b.r.Method != "POST" {
+		b.runTemplate("verify.html", vp)
+		return
+	}
+	result, err := b.data().Stmt(verifyPersonQuery).Exec(verifyHash(vp.Token))
+	if err != nil {
+		b.errorPage("Error confirming address: %s", err)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		b.errorPage("Error confirming address: %s", err)
+		return
+	}
+	if n == 0 {
+		b.errorPage("This link has already been used or is not right.")
+		return
+	}
+	vp.Done = true
+	b.runTemplate("verify.html", vp)
+}
+
+type registrationsPage struct {
+	SignUps []SignUp
+	Roles   []string
+}
+
+// The sign-ups waiting for an admin, at /registrations/.
+func registrationsHandler(b *Bagreply) {
+	if b.r.Method == "POST" && !approveControls(b) {
+		return
+	}
+	rows, err := b.data().Stmt(signUpsQuery).Query()
+	if err != nil {
+		b.errorPage("Error getting sign-ups: %s", err)
+		return
+	}
+	var rp registrationsPage
+	rp.SignUps, err = scanSignUps(rows)
+	if err != nil {
+		b.errorPage("Error getting sign-ups: %s", err)
+		return
+	}
+	rp.Roles = grantableRoles
+	b.Title = "Sign-ups"
+	b.runTemplate("registrations.html", rp)
+}
+
+// Approve or reject a sign-up. The return value is false if there was
+// an error.
+func approveControls(b *Bagreply) (ok bool) {
+	personId, err := strconv.ParseInt(b.r.PostFormValue("person"), 10, 64)
+	if err != nil {
+		b.errorPage("Bad person %s", strconv.Quote(b.r.PostFormValue("person")))
+		return false
+	}
+	rows, err := b.data().Stmt(signUpQuery).Query(personId)
+	if err != nil {
+		b.errorPage("Error getting person %d: %s", personId, err)
+		return false
+	}
+	signUps, err := scanSignUps(rows)
+	if err != nil {
+		b.errorPage("Error getting person %d: %s", personId, err)
+		return false
+	}
+	if len(signUps) == 0 {
+		b.errorPage("Person %d is not waiting for approval", personId)
+		return false
+	}
+	s := signUps[0]
+	if b.r.PostFormValue("reject") != "" {
+		_, err = b.data().Stmt(deleteSignUpQuery).Exec(personId)
+		if err != nil {
+			b.errorPage("Error removing %s: %s", s.Name, err)
+			return false
+		}
+		b.App.personNames.forget(personId)
+		log.Printf("%s rejected the sign-up of %s", b.User.Name, s.Name)
+		return true
+	}
+	r, found := roleFromName(b.r.PostFormValue("role"))
+	if !found || r == roleNone {
+		b.errorPage("Unknown role %s", strconv.Quote(b.r.PostFormValue("role")))
+		return false
+	}
+	ok = b.inTx(func() bool {
+		store := b.data()
+		_, err = store.Stmt(setPersonRoleQuery).Exec(r.String(), personId)
+		if err == nil {
+			_, err = store.Stmt(setPersonStatusQuery).Exec(accountActive, personId)
+		}
+		if err != nil {
+			b.errorPage("Error approving %s: %s", s.Name, err)
+			return false
+		}
+		return true
+	})
+	if !ok {
+		return false
+	}
+	log.Printf("%s approved %s as %s", b.User.Name, s.Name, r)
+	if b.App.mailEnabled() {
+		err = b.App.sendMail(s.Email, "Your login is ready",
+			fmt.Sprintf(approvedMail, s.Name, b.App.TopURL))
+		if err != nil {
+			log.Printf("Error mailing %s: %s", s.Email, err)
+		}
+	}
+	return true
+}
+
+// Handle the forms on the person page with which an admin changes
+// the name, address or password of "person", or deactivates them. The
+// return value is false if there was an error.
+func personControls(b *Bagreply, person *bagzullaDb.Person) (ok bool) {
+	if b.r.Method != "POST" {
+		return true
+	}
+	edit := b.r.PostFormValue("edit-person") != ""
+	status := b.r.PostFormValue("set-status")
+	if !edit && status == "" {
+		return true
+	}
+	if b.NotAllowed(roleAdmin, 0) {
+		return false
+	}
+	if status != "" {
+		if status != accountActive && status != accountInactive {
+			b.errorPage("Unknown status %s", strconv.Quote(status))
+			return false
+		}
+		if person.PersonId == b.User.PersonId {
+			b.errorPage("You cannot change your own status.")
+			return false
+		}
+		old, err := personStatus(b.data(), person.PersonId)
+		if err != nil {
+			b.errorPage("Error getting status of %s: %s", person.Name, err)
+			return false
+		}
+		if old != accountActive && old != accountInactive {
+			b.errorPage("%s is waiting for approval.", person.Name)
+			return false
+		}
+		ok = b.inTx(func() bool {
+			store := b.data()
+			_, err = store.Stmt(setPersonStatusQuery).Exec(status, person.PersonId)
+			if err == nil && status == accountInactive {
+				_, err = store.Stmt(deletePersonSessionsQuery).Exec(person.PersonId)
+			}
+			if err != nil {
+				b.errorPage("Error changing the status of %s: %s", person.Name, err)
+				return false
+			}
+			return true
+		})
+		if !ok {
+			return false
+		}
+		log.Printf("%s made %s %s", b.User.Name, person.Name, status)
+		return true
+	}
+	name := strings.TrimSpace(b.r.PostFormValue("name"))
+	email := strings.TrimSpace(b.r.PostFormValue("email"))
+	password := b.r.PostFormValue("password")
+	problems, err := checkPerson(b.data(), person.PersonId, name, email)
+	if err != nil {
+		b.errorPage("Error checking %s: %s", person.Name, err)
+		return false
+	}
+	if password != "" {
+		problems = append(problems,
+			checkNewPassword(password, b.r.PostFormValue("password2"))...)
+	}
+	if len(problems) > 0 {
+		b.errorPage("%s", strings.Join(problems, " "))
+		return false
+	}
+	ok = b.inTx(func() bool {
+		store := b.data()
+		_, err = store.Stmt(editPersonQuery).Exec(name, email, person.PersonId)
+		if err == nil && password != "" {
+			var hash string
+			hash, err = hashPassword(password)
+			if err == nil {
+				_, err = store.Stmt(setPasswordQuery).Exec(hash, person.PersonId)
+			}
+		}
+		if err != nil {
+			b.errorPage("Error changing %s: %s", person.Name, err)
+			return false
+		}
+		return true
+	})
+	if !ok {
+		return false
+	}
+	b.App.personNames.forget(person.PersonId)
+	person.Name = name
+	person.Email = email
+	return true
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A stand-in SMTP server which keeps the mail it is sent.
+type fakeSMTP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	mail     []string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "220 localhost\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			fmt.Fprintf(conn, "250 localhost\r\n")
+		case command == "DATA":
+			fmt.Fprintf(conn, "354 go on\r\n")
+			var data strings.Builder
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			f.mu.Lock()
+			f.mail = append(f.mail, data.String())
+			f.mu.Unlock()
+			fmt.Fprintf(conn, "250 sent\r\n")
+		case command == "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "250 OK\r\n")
+		}
+	}
+}
+
+func (f *fakeSMTP) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.mail...)
+}
+
+func TestPasswordHash(t *testing.T) {
+	// From RFC 7914, section 11.
+	sum := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	expect := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if fmt.Sprintf("%x", sum) != expect {
+		t.Errorf("PBKDF2 gave %x", sum)
+	}
+	hash, err := hashPassword("sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, passwordHashPrefix) || strings.Contains(hash, "sesame") {
+		t.Errorf("Bad hash %s", hash)
+	}
+	again, err := hashPassword("sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == again {
+		t.Errorf("Two hashes of the same password are the same")
+	}
+	tests := []struct {
+		stored   string
+		password string
+		match    bool
+	}{
+		{hash, "sesame", true},
+		{hash, "Sesame", false},
+		{hash, "", false},
+		// People from before the hashes.
+		{"sesame", "sesame", true},
+		{"sesame", "other", false},
+		{"", "", false},
+		{passwordHashPrefix + "x$y", "sesame", false},
+	}
+	for _, test := range tests {
+		if passwordMatch(test.stored, test.password) != test.match {
+			t.Errorf("passwordMatch(%q, %q) is not %t", test.stored,
+				test.password, test.match)
+		}
+	}
+}
+
+func TestSignUp(t *testing.T) {
+	ba := getTestApp(t)
+	smtpServer := startFakeSMTP(t)
+	defer smtpServer.listener.Close()
+	defer func() {
+		ba.registration = false
+		ba.smtp = smtpConfig{}
+	}()
+	ba.registration = true
+	ba.smtp = smtpConfig{
+		addr: smtpServer.listener.Addr().String(),
+		from: "bagzulla@localhost",
+	}
+	_, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES('boss', 'boss@localhost', 'x', 'admin')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boss, err := insertToken(ba.data, Token{PersonId: personIdOf(t, ba, "boss"),
+		Name: "t", Scope: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(fn BagFunc, perm role, path string, form url.Values, token string) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, perm)(w, r)
+		return w
+	}
+	signUp := func(name string, email string, password string, again string) *httptest.ResponseRecorder {
+		return send(registerHandler, roleViewer, "/register/", url.Values{
+			"name": {name}, "email": {email},
+			"password": {password}, "password2": {again},
+		}, "")
+	}
+
+	bad := []struct {
+		name, email, password, again, problem string
+	}{
+		{"tony", "new@localhost", "long enough", "long enough", "Someone else has that name"},
+		{"erin", "TONY@localhost", "long enough", "long enough", "Someone else has that email"},
+		{"erin", "not an address", "long enough", "long enough", "not valid"},
+		{"<b>erin", "erin@localhost", "long enough", "long enough", "may only have"},
+		{"erin", "erin@localhost", "short", "short", "at least 8"},
+		{"erin", "erin@localhost", "long enough", "long enougH", "different"},
+	}
+	for _, test := range bad {
+		w := signUp(test.name, test.email, test.password, test.again)
+		if !strings.Contains(w.Body.String(), test.problem) {
+			t.Errorf("Sign-up %s %s: no %q", test.name, test.email, test.problem)
+		}
+	}
+	if len(smtpServer.sent()) != 0 {
+		t.Fatalf("Mail sent for a bad sign-up")
+	}
+
+	w := signUp("erin", "erin@localhost", "correct horse", "correct horse")
+	if !strings.Contains(w.Body.String(), "A mail has been sent") {
+		t.Fatalf("Sign-up failed: %s", w.Body.String())
+	}
+	erin := personIdOf(t, ba, "erin")
+	var stored string
+	err = ba.db.QueryRow(`SELECT password FROM person WHERE person_id = ?`, erin).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, passwordHashPrefix) {
+		t.Errorf("Password is not hashed: %s", stored)
+	}
+	expectStatus(t, ba, erin, accountUnverified)
+	mails := smtpServer.sent()
+	if len(mails) != 1 {
+		t.Fatalf("Expected one mail, got %d", len(mails))
+	}
+	if !strings.Contains(mails[0], "To: erin@localhost\r\n") {
+		t.Errorf("Mail is not to erin: %s", mails[0])
+	}
+	link := regexp.MustCompile(`http://localhost/verify/\?token=([0-9a-f]+)`).FindStringSubmatch(mails[0])
+	if link == nil {
+		t.Fatalf("No link in %s", mails[0])
+	}
+	w = tryLogin(ba, "erin", "correct horse", "192.0.2.36")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "confirm your address") ||
+		w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("erin logged in before confirming the address: %d %s", w.Code, w.Body.String())
+	}
+
+	// Following the link only shows the button.
+	w = send(verifyHandler, roleViewer, "/verify/?token="+link[1], nil, "")
+	if !strings.Contains(w.Body.String(), link[1]) {
+		t.Errorf("Verify page has no token")
+	}
+	expectStatus(t, ba, erin, accountUnverified)
+	w = send(verifyHandler, roleViewer, "/verify/", url.Values{"token": {"bad"}}, "")
+	if !strings.Contains(w.Body.String(), "not right") {
+		t.Errorf("Bad token accepted")
+	}
+	send(verifyHandler, roleViewer, "/verify/", url.Values{"token": {link[1]}}, "")
+	expectStatus(t, ba, erin, accountPending)
+	w = tryLogin(ba, "erin", "correct horse", "192.0.2.36")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "waiting for approval") ||
+		w.Header().Get("Set-Cookie") != "" {
+		t.Errorf("erin logged in before being approved: %d %s", w.Code, w.Body.String())
+	}
+	var events int
+	err = ba.db.QueryRow(`SELECT COUNT(*) FROM auth_event WHERE name = 'erin'`).Scan(&events)
+	if err != nil || events != 0 {
+		t.Errorf("Logins before approval made %d events: %v", events, err)
+	}
+
+	// The admin's queue.
+	w = send(registrationsHandler, roleAdmin, "/registrations/", nil, boss)
+	if !strings.Contains(w.Body.String(), "erin@localhost") {
+		t.Errorf("erin is not in the queue")
+	}
+	w = send(registrationsHandler, roleAdmin, "/registrations/", nil, "")
+	if strings.Contains(w.Body.String(), "erin@localhost") {
+		t.Errorf("Anonymous user saw the queue")
+	}
+	send(registrationsHandler, roleAdmin, "/registrations/", url.Values{
+		"person": {fmt.Sprint(erin)}, "role": {"developer"}, "approve": {"1"},
+	}, boss)
+	expectStatus(t, ba, erin, accountActive)
+	r, err := personRole(ba.data, erin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != roleDeveloper {
+		t.Errorf("erin approved as %s", r)
+	}
+	if len(smtpServer.sent()) != 2 {
+		t.Errorf("No mail about the approval")
+	}
+	w = tryLogin(ba, "erin", "correct horse", "192.0.2.36")
+	if w.Code != http.StatusFound {
+		t.Errorf("erin could not log in after approval: %d", w.Code)
+	}
+
+	// Without mail, sign-ups wait for the admin straight away.
+	ba.smtp = smtpConfig{}
+	signUp("frank", "frank@localhost", "correct horse", "correct horse")
+	frank := personIdOf(t, ba, "frank")
+	expectStatus(t, ba, frank, accountPending)
+	send(registrationsHandler, roleAdmin, "/registrations/", url.Values{
+		"person": {fmt.Sprint(frank)}, "reject": {"1"},
+	}, boss)
+	expectStatus(t, ba, frank, "")
+	// Active people cannot be rejected.
+	send(registrationsHandler, roleAdmin, "/registrations/", url.Values{
+		"person": {fmt.Sprint(erin)}, "reject": {"1"},
+	}, boss)
+	expectStatus(t, ba, erin, accountActive)
+
+	// The admin edits erin, then deactivates her.
+	personPath := fmt.Sprintf("/person/%d", erin)
+	send(showPerson, roleViewer, personPath, url.Values{
+		"edit-person": {"1"}, "name": {"erin2"}, "email": {"erin2@localhost"},
+		"password": {"battery staple"}, "password2": {"battery staple"},
+	}, boss)
+	name, _ := getPersonName(&Bagreply{App: ba}, erin)
+	if name != "erin2" {
+		t.Errorf("Name not changed: %s", name)
+	}
+	w = tryLogin(ba, "erin2", "battery staple", "192.0.2.37")
+	if w.Code != http.StatusFound {
+		t.Errorf("erin2 could not log in with the new password: %d", w.Code)
+	}
+	erinToken, err := insertToken(ba.data, Token{PersonId: erin, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = send(showPerson, roleViewer, personPath, url.Values{
+		"edit-person": {"1"}, "name": {"tony"}, "email": {"erin2@localhost"},
+	}, boss)
+	if !strings.Contains(w.Body.String(), "Someone else has that name") {
+		t.Errorf("Renamed to an existing name")
+	}
+	send(showPerson, roleViewer, personPath, url.Values{"set-status": {"inactive"}}, boss)
+	expectStatus(t, ba, erin, accountInactive)
+	var sessions int
+	err = ba.db.QueryRow(`SELECT COUNT(*) FROM session WHERE person_id = ?`, erin).Scan(&sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessions != 0 {
+		t.Errorf("Deactivated person still has %d sessions", sessions)
+	}
+	if tryLogin(ba, "erin2", "battery staple", "192.0.2.38").Code == http.StatusFound {
+		t.Errorf("Deactivated person logged in")
+	}
+	w = send(showPerson, roleViewer, personPath, nil, erinToken)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Deactivated person's token: expected %d, got %d",
+			http.StatusUnauthorized, w.Code)
+	}
+	send(showPerson, roleViewer, personPath, url.Values{"set-status": {"active"}}, boss)
+	expectStatus(t, ba, erin, accountActive)
+	w = send(showPerson, roleViewer, personPath, url.Values{"set-status": {"active"}}, erinToken)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Non-admin changed a status: %d", w.Code)
+	}
+}
+
+func personIdOf(t *testing.T, ba *Bagapp, name string) (personId int64) {
+	err := ba.db.QueryRow(`SELECT person_id FROM person WHERE name = ?`, name).Scan(&personId)
+	if err != nil {
+		t.Fatalf("No person %s: %s", name, err)
+	}
+	return personId
+}
+
+func expectStatus(t *testing.T, ba *Bagapp, personId int64, expect string) {
+	t.Helper()
+	status, err := personStatus(ba.data, personId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != expect {
+		t.Errorf("Person %d: expected status %q, got %q", personId, expect, status)
+	}
+}
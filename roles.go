@@ -0,0 +1,374 @@
+package main
+
+/* Roles of people and their permissions in projects. The rules are
+   in bagzullaDb/roles.go, which the command-line client uses too. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type role = bagzullaDb.Role
+
+const (
+	roleNone      = bagzullaDb.RoleNone
+	roleViewer    = bagzullaDb.RoleViewer
+	roleReporter  = bagzullaDb.RoleReporter
+	roleDeveloper = bagzullaDb.RoleDeveloper
+	roleAdmin     = bagzullaDb.RoleAdmin
+)
+
+// The roles which can be given to people, for the forms.
+var grantableRoles = bagzullaDb.Roles[roleViewer:]
+
+var roleFromName = bagzullaDb.RoleFromName
+var personRole = bagzullaDb.PersonRole
+var personGrants = bagzullaDb.PersonGrants
+
+// What is known about the permissions of the user of one request.
+// This is read from the database the first time it is needed.
+type permissions struct {
+	bagzullaDb.Permissions
+	// Reading the permissions failed, so the user has no role in
+	// any project.
+	failed bool
+}
+
+// Read the user's permissions from the database. If this fails, the
+// user has no role in any project, so nothing can be seen or
+// changed, and makeHandler sends an error page.
+func (b *Bagreply) getPermissions() *permissions {
+	if b.perms != nil {
+		return b.perms
+	}
+	var personId int64
+	if b.User != nil {
+		personId = b.User.PersonId
+	}
+	p, err := bagzullaDb.ReadPermissions(b.data(), personId)
+	if err != nil {
+		log.Printf("Error getting permissions: %s", err)
+		b.perms = &permissions{Permissions: bagzullaDb.Permissions{Role: roleNone}, failed: true}
+		return b.perms
+	}
+	b.perms = &permissions{Permissions: p}
+	return b.perms
+}
+
+// The role of the user in the project with ID "projectId". If
+// "projectId" is zero, this is the user's highest role in any
+// project.
+func (b *Bagreply) roleIn(projectId int64) role {
+	p := b.getPermissions()
+	if p.failed {
+		return roleNone
+	}
+	return p.RoleIn(projectId)
+}
+
+// Can the user see the project with ID "projectId"?
+func (b *Bagreply) canSee(projectId int64) bool {
+	return b.roleIn(projectId) >= roleViewer
+}
+
+// Is the user an admin? This is for the templates.
+func (b *Bagreply) Admin() bool {
+	return b.User != nil && b.roleIn(0) == roleAdmin
+}
+
+// Is the project with ID "projectId" private?
+func (b *Bagreply) isPrivate(projectId int64) bool {
+	return b.getPermissions().Private[projectId]
+}
+
+// Remove the bugs which the user cannot see, or which are in the
+// trash, from "bugs".
+func (b *Bagreply) visibleBugs(bugs []bagzullaDb.Bug) (visible []bagzullaDb.Bug) {
+	for _, bug := range bugs {
+		if bug.Deleted.IsZero() && b.canSee(bug.ProjectId) {
+			visible = append(visible, bug)
+		}
+	}
+	return visible
+}
+
+// Remove the projects which the user cannot see from "projects".
+func (b *Bagreply) visibleProjects(projects []bagzullaDb.Project) (visible []bagzullaDb.Project) {
+	for _, p := range projects {
+		if b.canSee(p.ProjectId) {
+			visible = append(visible, p)
+		}
+	}
+	return visible
+}
+
+// Indicate that the user does not have the role "need" in the project
+// with ID "projectId", or in any project if "projectId" is zero. The
+// return value is true if the user may not go on. A project which the
+// user cannot see is reported as not existing.
+func (b *Bagreply) NotAllowed(need role, projectId int64) bool {
+	if need >= roleReporter && b.NotLoggedIn() {
+		return true
+	}
+	if need == roleAdmin && !b.needScope("admin") {
+		return true
+	}
+	have := b.roleIn(projectId)
+	if have >= need {
+		return false
+	}
+	if projectId != 0 && have == roleNone {
+		b.w.WriteHeader(http.StatusNotFound)
+		b.errorPage("There is no project with ID %d", projectId)
+		return true
+	}
+	if b.User == nil {
+		b.ErrorLogin()
+		return true
+	}
+	b.w.WriteHeader(http.StatusForbidden)
+	if b.getPermissions().Archived[projectId] {
+		name, _ := getProjectName(b, projectId)
+		b.errorPage("%s is archived, so it cannot be changed", name)
+	} else if projectId != 0 {
+		name, _ := getProjectName(b, projectId)
+		b.errorPage("You need to be a %s in %s to do this", need, name)
+	} else {
+		b.errorPage("You need to be a %s to do this", need)
+	}
+	return true
+}
+
+// Check that the user has the role "need" in the project of the bug
+// with ID "bugId". The return value is true if the user may not go
+// on.
+func (b *Bagreply) NotAllowedBug(need role, bugId int64) bool {
+	bug, err := b.data().BugFromId(bugId)
+	if err != nil {
+		b.errorPage("Error retrieving bug with id %d from database: %s",
+			bugId, err)
+		return true
+	}
+	return b.NotAllowed(need, bug.ProjectId) || b.inTrash("bug", bugId, bug.Deleted)
+}
+
+// Find the bug or project which the text "t" belongs to. "found" is
+// false if it does not belong to anything, for example the old
+// version of an edited text. "deleted" is true if what it belongs to
+// is in the trash.
+func textOwner(store *bagzullaDb.Store, t text) (bugId int64, projectId int64, found bool, deleted bool, err error) {
+	bugId = t.BugId
+	if bugId == 0 {
+		var bugs []bagzullaDb.Bug
+		bugs, err = store.BugsFromTitle(t.TxtId)
+		if err == nil && len(bugs) == 0 {
+			bugs, err = store.BugsFromDescription(t.TxtId)
+		}
+		if err != nil {
+			return 0, 0, false, false, err
+		}
+		if len(bugs) > 0 {
+			bugId = bugs[0].BugId
+		}
+	}
+	// The search gives the bug of a comment, but not whether the
+	// comment is in the trash.
+	if bugId == 0 || t.Type.String == "comment" {
+		comments, err := store.CommentsFromTxtId(t.TxtId)
+		if err != nil {
+			return 0, 0, false, false, err
+		}
+		if len(comments) > 0 {
+			bugId = comments[0].BugId
+			deleted = !comments[0].Deleted.IsZero()
+		}
+	}
+	if bugId != 0 {
+		bug, err := store.BugFromId(bugId)
+		deleted = deleted || !bug.Deleted.IsZero()
+		return bugId, bug.ProjectId, err == nil, deleted, err
+	}
+	projects, err := store.ProjectsFromDescription(t.TxtId)
+	if err != nil {
+		return 0, 0, false, false, err
+	}
+	if len(projects) > 0 {
+		return 0, projects[0].ProjectId, true, false, nil
+	}
+	parts, err := store.PartsFromDescription(t.TxtId)
+	if err != nil {
+		return 0, 0, false, false, err
+	}
+	if len(parts) > 0 {
+		return 0, parts[0].ProjectId, true, !parts[0].Deleted.IsZero(), nil
+	}
+	return 0, 0, false, false, nil
+}
+
+// Remove the search results which the user cannot see, or which
+// belong to something in the trash. Texts which do not belong to
+// anything are only shown if the user can see every project.
+func (b *Bagreply) visibleTexts(texts []text) (visible []text) {
+	hidden := b.getPermissions().failed
+	for projectId := range b.getPermissions().Private {
+		if !b.canSee(projectId) {
+			hidden = true
+		}
+	}
+	for _, t := range texts {
+		bugId, projectId, found, deleted, err := textOwner(b.data(), t)
+		if err != nil {
+			log.Printf("Error finding owner of text %d: %s", t.TxtId, err)
+			continue
+		}
+		if deleted || found && !b.canSee(projectId) || !found && hidden {
+			continue
+		}
+		t.BugId = bugId
+		visible = append(visible, t)
+	}
+	return visible
+}
+
+var setPersonRoleSql = `UPDATE person SET role = ? WHERE person_id = ?`
+var setPersonRoleQuery = bagzullaDb.NewQuery(setPersonRoleSql)
+var deleteGrantSql = `DELETE FROM grant WHERE person_id = ? AND project_id = ?`
+var deleteGrantQuery = bagzullaDb.NewQuery(deleteGrantSql)
+var insertGrantSql = `INSERT INTO grant(person_id, project_id, role) VALUES (?, ?, ?)`
+var insertGrantQuery = bagzullaDb.NewQuery(insertGrantSql)
+var setProjectPrivateSql = `UPDATE project SET private = ? WHERE project_id = ?`
+var setProjectPrivateQuery = bagzullaDb.NewQuery(setProjectPrivateSql)
+
+var makeAdminSql = `UPDATE person SET role = '` + roleAdmin.String() + `' WHERE name = ?`
+var makeAdminQuery = bagzullaDb.NewQuery(makeAdminSql)
+
+// Give the person called "name" the admin role, for the first admin of
+// a database, who cannot be made on the web.
+func makeAdmin(store *bagzullaDb.Store, name string) error {
+	result, err := store.Stmt(makeAdminQuery).Exec(name)
+	if err != nil {
+		return err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return fmt.Errorf("No person called '%s'", name)
+	}
+	return nil
+}
+
+// A grant for display on the person page.
+type Grant struct {
+	ProjectId   int64
+	ProjectName string
+	Role        role
+}
+
+// Get the grants of "personId" with the project names.
+func grantList(b *Bagreply, personId int64) (grants []Grant, ok bool) {
+	gm, err := personGrants(b.data(), personId)
+	if err != nil {
+		b.errorPage("Error getting grants of person %d: %s", personId, err)
+		return grants, false
+	}
+	for projectId, r := range gm {
+		name, ok := getProjectName(b, projectId)
+		if !ok {
+			return grants, false
+		}
+		grants = append(grants, Grant{
+			ProjectId:   projectId,
+			ProjectName: name,
+			Role:        r,
+		})
+	}
+	return grants, true
+}
+
+// Handle the forms on the person page which change the role and
+// grants of "person". The return value is false if there was an
+// error.
+func roleControls(b *Bagreply, person bagzullaDb.Person) (ok bool) {
+	if b.r.Method != "POST" {
+		return true
+	}
+	roleName := b.r.PostFormValue("set-role")
+	grantProject := b.r.PostFormValue("grant-project")
+	revokeProject := b.r.PostFormValue("revoke-grant")
+	if roleName == "" && grantProject == "" && revokeProject == "" {
+		return true
+	}
+	if b.NotAllowed(roleAdmin, 0) {
+		return false
+	}
+	var err error
+	switch {
+	case roleName != "":
+		r, found := roleFromName(roleName)
+		if !found || r == roleNone {
+			b.errorPage("Unknown role %s", strconv.Quote(roleName))
+			return false
+		}
+		_, err = b.data().Stmt(setPersonRoleQuery).Exec(r.String(), person.PersonId)
+	case grantProject != "":
+		projectId, perr := strconv.ParseInt(grantProject, 10, 64)
+		r, found := roleFromName(b.r.PostFormValue("grant-role"))
+		if perr != nil || !found || r == roleNone {
+			b.errorPage("Bad project or role for grant")
+			return false
+		}
+		err = b.data().Transact(func(tx *bagzullaDb.Store) error {
+			_, err := tx.Stmt(deleteGrantQuery).Exec(person.PersonId, projectId)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Stmt(insertGrantQuery).Exec(person.PersonId,
+				projectId, r.String())
+			return err
+		})
+	case revokeProject != "":
+		projectId, perr := strconv.ParseInt(revokeProject, 10, 64)
+		if perr != nil {
+			b.errorPage("Bad project ID %s", strconv.Quote(revokeProject))
+			return false
+		}
+		_, err = b.data().Stmt(deleteGrantQuery).Exec(person.PersonId, projectId)
+	}
+	if err != nil {
+		b.errorPage("Error changing the role of %s: %s", person.Name, err)
+		return false
+	}
+	// The admin may have changed their own role.
+	b.perms = nil
+	return true
+}
+
+// Make a project private or public from the project page.
+func privateControls(b *Bagreply, projectId int64) (ok bool) {
+	if b.r.Method != "POST" {
+		return true
+	}
+	private := b.r.PostFormValue("set-private")
+	if private == "" {
+		return true
+	}
+	if b.NotAllowed(roleAdmin, 0) {
+		return false
+	}
+	value := 0
+	if private == "1" {
+		value = 1
+	}
+	_, err := b.data().Stmt(setProjectPrivateQuery).Exec(value, projectId)
+	if err != nil {
+		b.errorPage("Error changing project %d: %s", projectId, err)
+		return false
+	}
+	b.perms = nil
+	return true
+}
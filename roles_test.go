@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPrivateProject(t *testing.T) {
+	ba := getTestApp(t)
+	result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status, private)
+VALUES('Secret', '', 1, 1, 0, 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId, _ := result.LastInsertId()
+	bugId, err := addBug(ba.data, "Secret bug", "Hush", projectId, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// duncan may look at the project, tony may not.
+	_, err = ba.db.Exec(insertGrantSql, 1, projectId, "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	duncan, err := insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tony, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bugPath := fmt.Sprintf("/bug/%d", bugId)
+	comment := url.Values{"comment-text": {"Hello"}}.Encode()
+	tests := []struct {
+		name    string
+		token   string
+		fn      BagFunc
+		perm    role
+		path    string
+		post    string
+		status  int
+		contain bool
+	}{
+		{"anonymous bug", "", bugHandler, roleViewer, bugPath, "", http.StatusNotFound, false},
+		{"anonymous list", "", allBugsHandler, roleViewer, "/bugs/", "", http.StatusOK, false},
+		{"anonymous project", "", showProject, roleViewer,
+			fmt.Sprintf("/project/%d", projectId), "", http.StatusNotFound, false},
+		{"tony bug", tony, bugHandler, roleViewer, bugPath, "", http.StatusNotFound, false},
+		{"tony list", tony, allBugsHandler, roleViewer, "/bugs/", "", http.StatusOK, false},
+		{"duncan bug", duncan, bugHandler, roleViewer, bugPath, "", http.StatusOK, true},
+		{"duncan list", duncan, allBugsHandler, roleViewer, "/bugs/", "", http.StatusOK, true},
+		{"duncan comment", duncan, bugHandler, roleViewer, bugPath, comment,
+			http.StatusForbidden, false},
+		{"tony controls", tony, controls, roleAdmin, "/controls/", "", http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		var r *http.Request
+		if test.post != "" {
+			r = httptest.NewRequest("POST", test.path, strings.NewReader(test.post))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", test.path, nil)
+		}
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		makeHandler(ba, test.fn, test.perm)(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status,
+				w.Code)
+		}
+		if strings.Contains(w.Body.String(), "Secret bug") != test.contain {
+			t.Errorf("%s: expected secret bug shown to be %t", test.name,
+				test.contain)
+		}
+	}
+	// The open bugs of the private project are not counted on the
+	// list of projects of people who cannot see it.
+	w := httptest.NewRecorder()
+	makeHandler(ba, listProjects, roleViewer)(w, httptest.NewRequest("GET", "/projects/", nil))
+	if !strings.Contains(w.Body.String(), `class="open-bugs"`) || strings.Contains(w.Body.String(), "Secret") {
+		t.Errorf("Bad list of projects: %s", w.Body.String())
+	}
+}
+
+// Duplicates and dependencies can only be changed on bugs which the
+// user may change, whichever field of the form they are in.
+func TestLinkedBugPermissions(t *testing.T) {
+	ba := getTestApp(t)
+	result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status, private)
+VALUES('Linked secret', '', 1, 1, 0, 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId, _ := result.LastInsertId()
+	secret, err := addBug(ba.data, "Secret original", "Hush", projectId, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := addBug(ba.data, "Secret copy", "Hush", projectId, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := addBug(ba.data, "Public link", "Open", 2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ba.data.InsertDuplicate(bagzullaDb.Duplicate{Original: secret, Duplicate: copied})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ba.data.UpdateStatusForBug(3, copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ba.data.InsertDependency(bagzullaDb.Dependency{Cause: secret, Effect: public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tony, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(fn BagFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+tony)
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, roleDeveloper)(w, r)
+		return w
+	}
+	publicId := fmt.Sprint(public)
+	tests := []struct {
+		name string
+		fn   BagFunc
+		path string
+		form url.Values
+	}{
+		{"delete duplicate", deleteDuplicate, "/delete-duplicate/",
+			url.Values{"duplicate": {fmt.Sprint(copied)}}},
+		{"delete original", deleteDuplicate, "/delete-duplicate/",
+			url.Values{"original": {fmt.Sprint(secret)}, "bug": {publicId}}},
+		{"bad bug", deleteDuplicate, "/delete-duplicate/",
+			url.Values{"bug": {"x"}, "duplicate": {fmt.Sprint(copied)}}},
+		{"add duplicate", editDuplicates, "/edit-duplicates/" + publicId,
+			url.Values{"duplicates": {fmt.Sprint(secret)}}},
+		{"add original", editDuplicates, "/edit-duplicates/" + publicId,
+			url.Values{"originals": {fmt.Sprint(secret)}}},
+		{"add dependency", editDependencies, "/edit-dependencies/" + publicId,
+			url.Values{"blocks": {fmt.Sprint(copied)}}},
+		{"delete dependency", deleteDependency, "/delete-dependency/",
+			url.Values{"cause": {fmt.Sprint(secret)}, "effect": {publicId}, "bug": {publicId}}},
+	}
+	for _, test := range tests {
+		w := post(test.fn, test.path, test.form)
+		if w.Code == http.StatusFound {
+			t.Errorf("%s: changed a bug in a private project", test.name)
+		}
+	}
+	var count int
+	err = ba.db.QueryRow(`SELECT COUNT(*) FROM duplicate WHERE original = ? OR duplicate = ?`,
+		secret, secret).Scan(&count)
+	if err != nil || count != 1 {
+		t.Errorf("Duplicates of the secret bug changed: %d %v", count, err)
+	}
+	err = ba.db.QueryRow(`SELECT COUNT(*) FROM dependency WHERE cause = ? OR effect = ?`,
+		secret, copied).Scan(&count)
+	if err != nil || count != 1 {
+		t.Errorf("Dependencies of the secret bugs changed: %d %v", count, err)
+	}
+	for bugId, status := range map[int64]int64{secret: 0, copied: 3, public: 0} {
+		bug, err := ba.data.BugFromId(bugId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bug.Status != status {
+			t.Errorf("Bug %d has status %d, not %d", bugId, bug.Status, status)
+		}
+	}
+}
+
+// If the permissions cannot be read, the user has no role anywhere,
+// rather than the role of someone who is not logged in.
+func TestPermissionsFailClosed(t *testing.T) {
+	store := closedStore(t, "closed.db")
+	b := Bagreply{App: &Bagapp{db: store.DB, data: store}, User: &bagzullaDb.Person{PersonId: 1, Name: "duncan"}}
+	if !b.getPermissions().failed {
+		t.Fatal("Reading permissions from a closed database did not fail")
+	}
+	for _, projectId := range []int64{0, 1, 2} {
+		if r := b.roleIn(projectId); r != roleNone {
+			t.Errorf("Role in project %d is %s", projectId, r)
+		}
+	}
+	b.User = nil
+	b.perms = nil
+	if b.canSee(2) {
+		t.Errorf("Can see a project without permissions")
+	}
+}
+
+func TestMakeAdmin(t *testing.T) {
+	ba := getTestApp(t)
+	_, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES('adele', 'adele@localhost', 'x', 'reporter')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = makeAdmin(ba.data, "adele")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var role string
+	err = ba.db.QueryRow(`SELECT role FROM person WHERE name = 'adele'`).Scan(&role)
+	if err != nil || role != "admin" {
+		t.Errorf("adele has role %q: %v", role, err)
+	}
+	if makeAdmin(ba.data, "nobody") == nil {
+		t.Errorf("Made an admin of nobody")
+	}
+}
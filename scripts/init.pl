@@ -12,9 +12,10 @@ chdir "$Bin/.." or die $!;
 if (-f $file) {
     rename $file, "$file.backup" or die $!;
 }
-my $status = system ("sqlite3 -batch $file < schema.txt");
+# The server makes the tables.
+my $status = system ("./bagzulla", "--database", $file, "--migrate-only");
 if ($status != 0) {
-    die "Failed to create $file due to errors from sqlite3";
+    die "Failed to create $file due to errors from ./bagzulla";
 }
 my $db = DBI->connect("dbi:SQLite:dbname=$file",'','',
 		      {RaiseError => 1, AutoCommit => 1});
@@ -25,7 +26,7 @@ for my $user (@$users) {
     $db->do ("INSERT INTO person(name,email,password) VALUES('$n','$n\@localhost','$p')");
 }
 $db->do ("INSERT INTO txt(content,entered) VALUES('Project unspecified',CURRENT_TIMESTAMP)");
-$db->do ("INSERT INTO project(name,directory,description,owner,status) VALUES('None','',1,1,0)");
+$db->do ("INSERT INTO project(name,directory,description,owner,status,inbox) VALUES('None','',1,1,0,1)");
 $db->disconnect ();
 exit;
 
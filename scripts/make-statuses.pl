@@ -15,7 +15,10 @@ my $tt = Template->new (
     ENCODING => 'utf8',
 );
 my $file = 'bagzulla-status.go';
-my $outfile = "$Bin/../$file";
-$tt->process ("$Bin/$file.tmpl", \%vars, $outfile, encoding => 'utf8')
-    or die '' . $tt->error ();
+# The command-line client needs the statuses too.
+for my $dir ("$Bin/..", "$Bin/../cmd/bag") {
+    my $outfile = "$dir/$file";
+    $tt->process ("$Bin/$file.tmpl", \%vars, $outfile, encoding => 'utf8')
+	or die '' . $tt->error ();
+}
 exit;
@@ -0,0 +1,239 @@
+package main
+
+/* Expiry, listing and revocation of login sessions, and the flags of
+   the session cookie. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often dead sessions are removed from the database.
+var sessionSweep = time.Hour
+
+// The format of CURRENT_TIMESTAMP in SQLite, which is used for the
+// times of sessions.
+var sqliteTime = "2006-01-02 15:04:05"
+
+type Session struct {
+	SessionId int64
+	PersonId  int64
+	Cookie    string
+	Start     time.Time
+	LastSeen  time.Time
+	UserAgent string
+	IP        string
+	// Is this the session of the current request?
+	Current bool
+}
+
+// Has the session expired at time "now"?
+func (ba *Bagapp) sessionExpired(s Session, now time.Time) bool {
+	if ba.sessionLifetime > 0 && now.Sub(s.Start) > ba.sessionLifetime {
+		return true
+	}
+	if ba.sessionIdle > 0 && now.Sub(s.LastSeen) > ba.sessionIdle {
+		return true
+	}
+	return false
+}
+
+var sessionFields = `session_id, person_id, cookie, start, last_seen,
+IFNULL(user_agent, ''), IFNULL(ip, '')`
+
+// Sessions from before last_seen was added have only the start time.
+func scanSession(rows *sql.Rows) (s Session, err error) {
+	var lastSeen sql.NullTime
+	err = rows.Scan(&s.SessionId, &s.PersonId, &s.Cookie, &s.Start,
+		&lastSeen, &s.UserAgent, &s.IP)
+	s.LastSeen = s.Start
+	if lastSeen.Valid {
+		s.LastSeen = lastSeen.Time
+	}
+	return s, err
+}
+
+var personSessionsSQL = `SELECT ` + sessionFields + ` FROM session
+WHERE person_id = ? ORDER BY IFNULL(last_seen, start) DESC`
+var personSessionsQuery = bagzullaDb.NewQuery(personSessionsSQL)
+
+func personSessions(ba *Bagapp, personId int64) (sessions []Session, err error) {
+	rows, err := ba.data.Stmt(personSessionsQuery).Query(personId)
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return sessions, err
+		}
+		if ba.sessionExpired(s, now) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+var touchSessionSQL = `UPDATE session
+SET last_seen = CURRENT_TIMESTAMP, user_agent = ?, ip = ?
+WHERE cookie = ?`
+var touchSessionQuery = bagzullaDb.NewQuery(touchSessionSQL)
+
+// Record that the session of the current request was used.
+func (b *Bagreply) touchSession() {
+	cookie, err := b.r.Cookie(cookieName)
+	if err != nil {
+		return
+	}
+	_, err = b.data().Stmt(touchSessionQuery).Exec(b.r.UserAgent(), remoteIP(b.r),
+		cookie.Value)
+	if err != nil {
+		log.Printf("Error updating session: %s", err)
+	}
+}
+
+var deleteSessionSQL = `DELETE FROM session WHERE session_id = ? AND person_id = ?`
+var deleteSessionQuery = bagzullaDb.NewQuery(deleteSessionSQL)
+
+var sweepSessionsSQL = `DELETE FROM session
+WHERE start < ? OR IFNULL(last_seen, start) < ?`
+var sweepSessionsQuery = bagzullaDb.NewQuery(sweepSessionsSQL)
+
+// Remove the sessions which have expired from the database.
+func (ba *Bagapp) sweepSessions(now time.Time) (removed int64, err error) {
+	if ba.sessionLifetime <= 0 && ba.sessionIdle <= 0 {
+		return 0, nil
+	}
+	// The zero time formats as a time before every session.
+	var started, seen time.Time
+	if ba.sessionLifetime > 0 {
+		started = now.Add(-ba.sessionLifetime)
+	}
+	if ba.sessionIdle > 0 {
+		seen = now.Add(-ba.sessionIdle)
+	}
+	result, err := ba.data.Stmt(sweepSessionsQuery).Exec(
+		started.UTC().Format(sqliteTime), seen.UTC().Format(sqliteTime))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Remove expired sessions every "sessionSweep" until the server
+// stops.
+func (ba *Bagapp) sessionSweeper() {
+	ticker := time.NewTicker(sessionSweep)
+	defer ticker.Stop()
+	for {
+		removed, err := ba.sweepSessions(time.Now())
+		if err != nil {
+			log.Printf("Error removing expired sessions: %s", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d expired sessions", removed)
+		}
+		select {
+		case <-ba.Context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// The address of the client. If the request came through a proxy on
+// this machine, the address the proxy was sent from is used.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		forwarded := r.Header.Get("X-Forwarded-For")
+		if forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	return host
+}
+
+// Is the connection to the user over HTTPS?
+func (b *Bagreply) secure() bool {
+	return b.App.secureCookies || b.r.TLS != nil ||
+		strings.EqualFold(b.r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// Set the HttpOnly, SameSite and Secure flags to the session cookie
+// which the login package has set, and limit its lifetime to the
+// lifetime of the session.
+func (b *Bagreply) cookieFlags() {
+	h := b.w.Header()
+	cookies := (&http.Response{Header: h}).Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	h.Del("Set-Cookie")
+	for _, c := range cookies {
+		if c.Name == cookieName {
+			c.HttpOnly = true
+			c.SameSite = http.SameSiteLaxMode
+			c.Secure = b.secure()
+			if c.MaxAge >= 0 && b.App.sessionLifetime > 0 {
+				c.Expires = time.Now().Add(b.App.sessionLifetime)
+			}
+		}
+		http.SetCookie(b.w, c)
+	}
+}
+
+type sessionsPage struct {
+	Sessions []Session
+}
+
+// Show the user's sessions at /sessions/, and revoke them.
+func sessionsHandler(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	personId := b.User.PersonId
+	if b.r.Method == "POST" {
+		revoke := b.r.PostFormValue("revoke-session")
+		sessionId, err := strconv.ParseInt(revoke, 10, 64)
+		if err != nil {
+			b.errorPage("Bad session ID %s", strconv.Quote(revoke))
+			return
+		}
+		_, err = b.data().Stmt(deleteSessionQuery).Exec(sessionId, personId)
+		if err != nil {
+			b.errorPage("Error revoking session %d: %s", sessionId, err)
+			return
+		}
+		http.Redirect(b.w, b.r, b.r.URL.Path, http.StatusFound)
+		return
+	}
+	var sp sessionsPage
+	var err error
+	sp.Sessions, err = personSessions(b.App, personId)
+	if err != nil {
+		b.errorPage("Error getting sessions: %s", err)
+		return
+	}
+	cookie, err := b.r.Cookie(cookieName)
+	if err == nil {
+		for i := range sp.Sessions {
+			sp.Sessions[i].Current = sp.Sessions[i].Cookie == cookie.Value
+		}
+	}
+	b.Title = "Sessions"
+	b.runTemplate("sessions.html", sp)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	ba := getTestApp(t)
+	defer func() {
+		ba.sessionIdle = 0
+		ba.sessionLifetime = 0
+	}()
+	ba.sessionIdle = time.Hour
+	ba.sessionLifetime = 24 * time.Hour
+	bu := baguser{b: ba}
+	// These times are in the format of CURRENT_TIMESTAMP.
+	now := time.Now().UTC()
+	sessions := []struct {
+		cookie string
+		start  time.Time
+		seen   time.Time
+		alive  bool
+	}{
+		{"fresh", now.Add(-time.Minute), now, true},
+		{"idle", now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), false},
+		{"old", now.Add(-48 * time.Hour), now, false},
+	}
+	for _, s := range sessions {
+		_, err := ba.db.Exec(`INSERT INTO session(person_id, cookie, start, last_seen)
+VALUES(2, ?, ?, ?)`, s.cookie, s.start.Format(sqliteTime), s.seen.Format(sqliteTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range sessions {
+		user, found, err := bu.LookUpCookie(s.cookie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != s.alive {
+			t.Errorf("Session %s: expected found %t, got %t", s.cookie,
+				s.alive, found)
+		}
+		if found && user != "tony" {
+			t.Errorf("Session %s: expected tony, got %s", s.cookie, user)
+		}
+	}
+	// Put back the expired sessions for the sweeper.
+	for _, s := range sessions[1:] {
+		_, err := ba.db.Exec(`INSERT INTO session(person_id, cookie, start, last_seen)
+VALUES(2, ?, ?, ?)`, s.cookie, s.start.Format(sqliteTime), s.seen.Format(sqliteTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := ba.sweepSessions(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected to remove 2 sessions, removed %d", removed)
+	}
+	left, err := personSessions(ba, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Cookie != "fresh" {
+		t.Errorf("Unexpected sessions left %+v", left)
+	}
+	bu.DeleteCookie("fresh")
+}
+
+func TestCookieFlags(t *testing.T) {
+	ba := getTestApp(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/login/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	b := Bagreply{App: ba, w: w, r: r}
+	http.SetCookie(w, &http.Cookie{Name: cookieName, Value: "abcde", Path: "/"})
+	b.cookieFlags()
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one cookie, got %d", len(cookies))
+	}
+	c := cookies[0]
+	if c.Value != "abcde" || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("Unexpected cookie %s", c)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+/* Sending mail through an SMTP server, for checking the addresses of
+   people who sign up. */
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+var smtpTimeout = 30 * time.Second
+
+// The SMTP server and the sender of the mail.
+type smtpConfig struct {
+	// host:port of the server. If empty, no mail is sent.
+	addr string
+	// The login for the server, if it needs one.
+	user     string
+	password string
+	// The From address of the mail.
+	from string
+}
+
+// Can the server send mail?
+func (ba *Bagapp) mailEnabled() bool {
+	return ba.smtp.addr != ""
+}
+
+// Make the text of a mail.
+func mailMessage(from string, to string, subject string, body string, now time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return b.String()
+}
+
+// Send a mail to "to". The connection uses STARTTLS if the server
+// offers it, and it must if there is a login.
+func (ba *Bagapp) sendMail(to string, subject string, body string) error {
+	s := ba.smtp
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("Line break in mail header")
+	}
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if s.user != "" {
+		// PlainAuth refuses to send the password without TLS,
+		// except to localhost.
+		err = c.Auth(smtp.PlainAuth("", s.user, s.password, host))
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(s.from)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(mailMessage(s.from, to, subject, body, time.Now())))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -20,7 +20,11 @@ function setParts(partEl, text) {
 	partEl.add(none);
 	for (var i = 0; i < nParts; i++) {
 		var option = document.createElement("option");
-		option.text = parts[i].Name;
+		var indent = "";
+		for (var j = 0; j < parts[i].Depth; j++) {
+			indent += "\u00a0\u00a0\u00a0";
+		}
+		option.text = indent + parts[i].Name;
 		option.value = parts[i].PartId;
 		partEl.add(option);
 	}
@@ -62,7 +66,7 @@ function restoreParts() {
 
 function setProject() {
 	var project = document.getElementById("project").value;
-	if (project == "13") {
+	if (project == inboxProject) {
 		removeParts();
 		return;
 	}
@@ -70,6 +74,145 @@ function setProject() {
 	getParts(project);
 }
 
+// Files pasted or dropped onto the comment box of a bug are attached
+// to the bug. Each one has a progress bar under the box while it is
+// sent, and when it is attached, a reference to it like "attachment
+// 12" goes into the comment where the cursor is. The bug page shows
+// the reference as a link, or as a thumbnail for images.
+
+function csrfToken(box) {
+	var input = box.form.elements["csrf"];
+	if (input) {
+		return input.value;
+	}
+	return "";
+}
+
+function insertReference(box, text) {
+	var start = box.selectionStart;
+	var before = box.value.substring(0, start);
+	var after = box.value.substring(box.selectionEnd);
+	if (before.length > 0 && !/\s$/.test(before)) {
+		text = " " + text;
+	}
+	if (!/^\s/.test(after)) {
+		text = text + " ";
+	}
+	box.value = before + text + after;
+	var cursor = start + text.length;
+	box.setSelectionRange(cursor, cursor);
+	// Warn before leaving the page with the reference unsent.
+	box.dispatchEvent(new Event("input", {bubbles: true}));
+}
+
+function uploadName(file) {
+	if (file.name && file.name != "image.png") {
+		return file.name;
+	}
+	// Pasted screenshots are all called image.png, or have no name.
+	var name = "screenshot-" + Date.now();
+	var type = file.type.split("/");
+	if (type[0] == "image" && type.length == 2) {
+		name += "." + type[1];
+	}
+	return name;
+}
+
+function uploadFailed(row, name, message) {
+	row.className = "failed";
+	row.textContent = "Could not attach " + name + ": " + message;
+}
+
+function uploadFile(box, file) {
+	var name = uploadName(file);
+	var row = document.createElement("div");
+	var label = document.createElement("span");
+	label.textContent = name + " ";
+	var progress = document.createElement("progress");
+	progress.max = file.size;
+	progress.value = 0;
+	row.appendChild(label);
+	row.appendChild(progress);
+	document.getElementById("uploads").appendChild(row);
+
+	var data = new FormData();
+	data.append("bug-id", box.dataset.bugId);
+	data.append("attachment", file, name);
+	var xhttp = new XMLHttpRequest();
+	xhttp.upload.onprogress = function(e) {
+		if (e.lengthComputable) {
+			progress.max = e.total;
+			progress.value = e.loaded;
+		}
+	};
+	xhttp.onload = function() {
+		var reply;
+		try {
+			reply = JSON.parse(this.responseText);
+		} catch (e) {
+			reply = {Error: "the server replied with status " + this.status};
+		}
+		if (this.status != 200 || reply.Error) {
+			uploadFailed(row, name, reply.Error || "status " + this.status);
+			return;
+		}
+		insertReference(box, reply.Reference);
+		row.textContent = name + " is " + reply.Reference;
+	};
+	xhttp.onerror = function() {
+		uploadFailed(row, name, "the connection failed");
+	};
+	xhttp.open("POST", topURL + "/upload-json/", true);
+	xhttp.setRequestHeader("X-CSRF-Token", csrfToken(box));
+	xhttp.send(data);
+}
+
+function uploadFiles(box, files) {
+	for (var i = 0; i < files.length; i++) {
+		uploadFile(box, files[i]);
+	}
+}
+
+function hasFiles(transfer) {
+	return transfer && Array.prototype.indexOf.call(transfer.types, "Files") >= 0;
+}
+
+function setupUploads() {
+	var box = document.getElementById("comment-text");
+	if (!box || !box.dataset.bugId || !window.FormData) {
+		return;
+	}
+	box.addEventListener("paste", function(e) {
+		var clip = e.clipboardData;
+		// Copied text may come with a picture of itself, but then
+		// the text is what is wanted.
+		if (!clip || clip.files.length == 0 || clip.getData("text/plain") != "") {
+			return;
+		}
+		e.preventDefault();
+		uploadFiles(box, clip.files);
+	});
+	box.addEventListener("dragover", function(e) {
+		if (hasFiles(e.dataTransfer)) {
+			e.preventDefault();
+			box.classList.add("dropping");
+		}
+	});
+	box.addEventListener("dragleave", function() {
+		box.classList.remove("dropping");
+	});
+	box.addEventListener("drop", function(e) {
+		box.classList.remove("dropping");
+		if (!hasFiles(e.dataTransfer)) {
+			return;
+		}
+		e.preventDefault();
+		uploadFiles(box, e.dataTransfer.files);
+	});
+}
+
+addEventListener("DOMContentLoaded", setupUploads);
+
 "use strict";
 
 (() => {
@@ -2,6 +2,15 @@
 use warnings;
 use strict;
 use LWP::UserAgent;
+# The token needs the admin scope. Make one on your person page.
+my $token = $ENV{BAGZULLA_TOKEN};
+if (! $token) {
+    die "Set BAGZULLA_TOKEN to an API token with the admin scope";
+}
 my $ua = LWP::UserAgent->new ();
-$ua->get ("http://mikan/bagpub/controls/?stop=1");
+my $r = $ua->post ("http://mikan/bagpub/controls/", {stop => 1},
+		   Authorization => "Bearer $token");
+if (! $r->is_success ()) {
+    die "Could not stop server: " . $r->status_line ();
+}
 exit;
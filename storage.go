@@ -0,0 +1,149 @@
+package main
+
+/* The directory of uploaded files. Files are only ever found from a
+   row of the attachment or image table, never from a name in a URL,
+   and the names from the rows are checked before they are used, so a
+   request cannot reach a file outside the directory. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fileStore struct {
+	// The absolute path of the directory.
+	root string
+}
+
+// Make the directory "dir" into a store, making it if it does not
+// exist.
+func openFileStore(dir string) (fs fileStore, err error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return fs, err
+	}
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return fs, err
+	}
+	return fileStore{root: root}, nil
+}
+
+// Is "sum" a hex SHA-256?
+func validHash(sum string) bool {
+	if len(sum) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil && strings.ToLower(sum) == sum
+}
+
+// The file with the contents which have the hex SHA-256 "sum".
+func (fs fileStore) path(sum string) (string, error) {
+	if !validHash(sum) {
+		return "", fmt.Errorf("Bad file hash %q", sum)
+	}
+	return filepath.Join(fs.root, "sha256", sum[:2], sum), nil
+}
+
+func (fs fileStore) thumbPath(sum string) (string, error) {
+	if !validHash(sum) {
+		return "", fmt.Errorf("Bad file hash %q", sum)
+	}
+	return filepath.Join(fs.root, "thumbs", sum+".png"), nil
+}
+
+// The file of an image from the image table, which was uploaded
+// before there were attachments.
+func (fs fileStore) imagePath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("Bad image file name %q", name)
+	}
+	return filepath.Join(fs.root, name), nil
+}
+
+func (fs fileStore) open(sum string) (*os.File, error) {
+	path, err := fs.path(sum)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Store the contents of "r" under their SHA-256. "a" is filled in
+// with the size, hash and type.
+func (fs fileStore) store(r io.Reader, a *Attachment, maxSize int64) (err error) {
+	dir := filepath.Join(fs.root, "sha256")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(dir, "upload*")
+	if err != nil {
+		return fmt.Errorf("Error creating temp file: %s", err)
+	}
+	defer os.Remove(temp.Name())
+	hash := sha256.New()
+	var head headWriter
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	a.Size, err = io.Copy(io.MultiWriter(temp, hash, &head), r)
+	closeErr := temp.Close()
+	if err != nil {
+		return fmt.Errorf("Error writing file: %s", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("Error writing file: %s", closeErr)
+	}
+	if maxSize > 0 && a.Size > maxSize {
+		return fmt.Errorf("The file is larger than the limit of %s", formatSize(maxSize))
+	}
+	a.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	a.ContentType = attachmentType(a.Filename, a.ContentType, head.head)
+	path, err := fs.path(a.SHA256)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(path)
+	if err == nil {
+		// There is one already.
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// Remove the stored file with hash "sum" if no attachment uses it.
+func (fs fileStore) removeUnused(store *bagzullaDb.Store, sum string) error {
+	var uses int
+	err := store.Stmt(hashUsesQuery).QueryRow(sum).Scan(&uses)
+	if err != nil || uses > 0 {
+		return err
+	}
+	thumb, err := fs.thumbPath(sum)
+	if err != nil {
+		return err
+	}
+	os.Remove(thumb)
+	path, err := fs.path(sum)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
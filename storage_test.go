@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStorePaths(t *testing.T) {
+	fs := fileStore{root: "/files"}
+	sum := strings.Repeat("ab", 32)
+	path, err := fs.path(sum)
+	if err != nil || path != "/files/sha256/ab/"+sum {
+		t.Errorf("path(%s) is %s %v", sum, path, err)
+	}
+	for _, bad := range []string{"", "../../etc/passwd", strings.ToUpper(sum),
+		sum[:62] + "/x", sum + "0"} {
+		if _, err := fs.path(bad); err == nil {
+			t.Errorf("path(%q) accepted", bad)
+		}
+		if _, err := fs.thumbPath(bad); err == nil {
+			t.Errorf("thumbPath(%q) accepted", bad)
+		}
+	}
+	for _, bad := range []string{"", ".", "..", "../secret", "a/b", `a\b`, "a\x00b"} {
+		if _, err := fs.imagePath(bad); err == nil {
+			t.Errorf("imagePath(%q) accepted", bad)
+		}
+	}
+	path, err = fs.imagePath("upload123")
+	if err != nil || path != "/files/upload123" {
+		t.Errorf("imagePath(upload123) is %s %v", path, err)
+	}
+}
+
+// Send a request to "fn" with the API token "token".
+func request(ba *Bagapp, fn BagFunc, perm role, method string, path string, token string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	makeHandler(ba, fn, perm)(w, r)
+	return w
+}
+
+func TestServeFiles(t *testing.T) {
+	ba := getTestApp(t)
+	bugId, err := addBug(ba.data, "Served", "Files", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tony, err := insertToken(ba.data, Token{PersonId: 2, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("0123456789 serve me in pieces\n")
+	uploadFile(ba, tony, bugId, "pieces.txt", content)
+	attachments, err := bugAttachments(ba.data, bugId)
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("Upload failed: %v %v", attachments, err)
+	}
+	a := attachments[0]
+	path := fmt.Sprintf("/attachment/%d", a.AttachmentId)
+	gz := map[string]string{"Accept-Encoding": "gzip"}
+
+	// Ranges, which are not compressed.
+	w := request(ba, attachmentHandler, roleViewer, "GET", path, tony,
+		map[string]string{"Range": "bytes=2-5", "Accept-Encoding": "gzip"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Errorf("Range gave %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Range was compressed")
+	}
+	w = request(ba, attachmentHandler, roleViewer, "GET", path, tony, gz)
+	if w.Body.String() != string(content) || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Whole file gave %q, %q", w.Body.String(), w.Header().Get("Content-Encoding"))
+	}
+	etag := w.Header().Get("ETag")
+	if etag != `"`+a.SHA256+`"` {
+		t.Errorf("ETag is %s", etag)
+	}
+	w = request(ba, attachmentHandler, roleViewer, "GET", path, tony,
+		map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match gave %d", w.Code)
+	}
+
+	// Pages are still compressed.
+	w = request(ba, bugHandler, roleViewer, "GET", fmt.Sprintf("/bug/%d", bugId), tony, gz)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Bug page not compressed")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ioutil.ReadAll(zr)
+	if err != nil || !strings.Contains(string(page), "pieces.txt") {
+		t.Errorf("Bad compressed bug page: %v", err)
+	}
+
+	// A file outside the directory, and rows which point at it.
+	secret := filepath.Join(filepath.Dir(ba.files.root), "secret")
+	err = ioutil.WriteFile(secret, []byte("the secret"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ba.db.Exec(`INSERT INTO image(file, bug_id, person_id) VALUES('../secret', ?, 2)`, bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badImage, _ := result.LastInsertId()
+	result, err = ba.db.Exec(`INSERT INTO attachment(bug_id, person_id, filename, content_type,
+size, sha256, entered) VALUES(?, 2, 'x', 'text/plain', 10, '../../secret', CURRENT_TIMESTAMP)`, bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badAttachment, _ := result.LastInsertId()
+	traversals := []struct {
+		fn   BagFunc
+		path string
+	}{
+		{imageHandler, fmt.Sprintf("/image/%d", badImage)},
+		{imageHandler, "/image/..%2Fsecret"},
+		{imageHandler, "/image/../secret"},
+		{attachmentHandler, fmt.Sprintf("/attachment/%d", badAttachment)},
+		{attachmentHandler, "/attachment/..%2F..%2Fsecret"},
+		{attachmentThumbHandler, fmt.Sprintf("/attachment-thumb/%d", badAttachment)},
+	}
+	for _, test := range traversals {
+		w = request(ba, test.fn, roleViewer, "GET", test.path, tony, nil)
+		if strings.Contains(w.Body.String(), "the secret") {
+			t.Errorf("%s sent the file outside the directory", test.path)
+		}
+	}
+	w = request(ba, deleteImage, roleReporter, "POST", fmt.Sprintf("/delete-image/%d", badImage), tony, nil)
+	if _, err := os.Stat(secret); err != nil {
+		t.Errorf("Deleting image %d removed the file outside the directory", badImage)
+	}
+
+	// Images from before the attachments, by ID or by name.
+	pngData := []byte("\x89PNG\r\n\x1a\n")
+	err = ioutil.WriteFile(filepath.Join(ba.files.root, "upload1"), pngData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = ba.db.Exec(`INSERT INTO image(file, bug_id, person_id) VALUES('upload1', ?, 1)`, bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageId, _ := result.LastInsertId()
+	for _, p := range []string{fmt.Sprintf("/image/%d", imageId), "/image/upload1"} {
+		w = request(ba, imageHandler, roleViewer, "GET", p, tony, nil)
+		if !bytes.Equal(w.Body.Bytes(), pngData) || w.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("%s gave %d %q", p, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDeleteFiles(t *testing.T) {
+	ba := getTestApp(t)
+	bugId, err := addBug(ba.data, "Deleted", "Files", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := make(map[string]string)
+	for _, name := range []string{"rita", "rob"} {
+		result, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES(?, ?, 'x', 'reporter')`, name, name+"@localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		personId, _ := result.LastInsertId()
+		tokens[name], err = insertToken(ba.data, Token{PersonId: personId, Name: "t", Scope: "write"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	duncan, err := insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadFile(ba, tokens["rita"], bugId, "rita.txt", []byte("rita's file"))
+	uploadFile(ba, tokens["rob"], bugId, "rob.txt", []byte("rob's file"))
+	attachments, err := bugAttachments(ba.data, bugId)
+	if err != nil || len(attachments) != 2 {
+		t.Fatalf("Uploads failed: %v %v", attachments, err)
+	}
+	ritas := fmt.Sprintf("/delete-attachment/%d", attachments[0].AttachmentId)
+	robs := fmt.Sprintf("/delete-attachment/%d", attachments[1].AttachmentId)
+	tests := []struct {
+		who    string
+		token  string
+		path   string
+		status int
+	}{
+		{"rita deleting rob's", tokens["rita"], robs, http.StatusForbidden},
+		{"rita deleting her own", tokens["rita"], ritas, http.StatusFound},
+		{"developer deleting rob's", duncan, robs, http.StatusFound},
+	}
+	for _, test := range tests {
+		w := request(ba, deleteAttachment, roleReporter, "POST", test.path, test.token, nil)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.who, test.status, w.Code)
+		}
+	}
+	attachments, _ = bugAttachments(ba.data, bugId)
+	if len(attachments) != 0 {
+		t.Errorf("%d attachments left", len(attachments))
+	}
+
+	err = ioutil.WriteFile(filepath.Join(ba.files.root, "upload2"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ba.db.Exec(`INSERT INTO image(file, bug_id, person_id) VALUES('upload2', ?, 2)`, bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageId, _ := result.LastInsertId()
+	path := fmt.Sprintf("/delete-image/%d", imageId)
+	w := request(ba, deleteImage, roleReporter, "POST", path, tokens["rob"], nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("rob deleting tony's image: expected %d, got %d", http.StatusForbidden, w.Code)
+	}
+	w = request(ba, deleteImage, roleReporter, "POST", path, duncan, nil)
+	if w.Code != http.StatusFound {
+		t.Errorf("Developer deleting an image: expected %d, got %d", http.StatusFound, w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(ba.files.root, "upload2")); !os.IsNotExist(err) {
+		t.Errorf("Image file not removed")
+	}
+}
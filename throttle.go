@@ -0,0 +1,254 @@
+package main
+
+/* Limits on guessing passwords. Every login attempt is recorded in
+   the auth_event table. After a failed login, the next attempt for
+   the same name or from the same address has to wait, with the wait
+   doubling after each failure, and after "loginFailures" failures the
+   name is locked for "loginLockout". The names are tracked whether
+   or not anyone has them, and the messages are the same either way,
+   so the replies do not show which names exist. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long to wait after the first failed login. The wait doubles
+// with each further failure.
+var loginDelay = time.Second
+
+// Several people may share an address, so an address is allowed this
+// many times as many failures as a name.
+var ipFailureFactor = 4
+
+// Failures older than this are forgotten.
+var loginMemory = 24 * time.Hour
+
+// The message for every failed login.
+var loginFailedMessage = "Wrong name or password"
+
+// The kinds of auth_event.
+const (
+	authLogin   = "login"
+	authFailure = "failure"
+	authLocked  = "locked"
+)
+
+type AuthEvent struct {
+	AuthEventId int64
+	Entered     time.Time
+	Name        string
+	// Zero if there is no person called Name.
+	PersonId int64
+	IP       string
+	// One of authLogin, authFailure or authLocked.
+	Event string
+}
+
+// When a lock which started with "e" and lasts "lockout" ends.
+func (e AuthEvent) Until(lockout time.Duration) time.Time {
+	return e.Entered.Add(lockout)
+}
+
+var insertAuthEventSql = `
+INSERT INTO auth_event(entered, name, person_id, ip, event)
+VALUES (?, ?, ?, ?, ?)
+`
+var insertAuthEventQuery = bagzullaDb.NewQuery(insertAuthEventSql)
+
+var authEventFields = `auth_event_id, entered, name, person_id, ip, event`
+
+// Only the most recent events are looked at, which are more than
+// enough to reach the lockout.
+var nameAuthEventsSql = `SELECT ` + authEventFields + ` FROM auth_event
+WHERE name = ? ORDER BY auth_event_id DESC LIMIT 1000`
+var nameAuthEventsQuery = bagzullaDb.NewQuery(nameAuthEventsSql)
+
+var ipAuthEventsSql = `SELECT ` + authEventFields + ` FROM auth_event
+WHERE ip = ? ORDER BY auth_event_id DESC LIMIT 1000`
+var ipAuthEventsQuery = bagzullaDb.NewQuery(ipAuthEventsSql)
+
+var recentAuthEventsSql = `SELECT ` + authEventFields + ` FROM auth_event
+ORDER BY auth_event_id DESC LIMIT ?`
+var recentAuthEventsQuery = bagzullaDb.NewQuery(recentAuthEventsSql)
+
+func insertAuthEvent(store *bagzullaDb.Store, e AuthEvent) error {
+	_, err := store.Stmt(insertAuthEventQuery).Exec(e.Entered, e.Name, e.PersonId,
+		e.IP, e.Event)
+	return err
+}
+
+func scanAuthEvents(rows *sql.Rows) (events []AuthEvent, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		var e AuthEvent
+		err = rows.Scan(&e.AuthEventId, &e.Entered, &e.Name, &e.PersonId,
+			&e.IP, &e.Event)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func recentAuthEvents(store *bagzullaDb.Store, limit int) (events []AuthEvent, err error) {
+	rows, err := store.Stmt(recentAuthEventsQuery).Query(limit)
+	if err != nil {
+		return events, err
+	}
+	return scanAuthEvents(rows)
+}
+
+// Count the failed logins in "events", newest first, since the last
+// successful one. "last" is the time of the most recent failure.
+func countFailures(events []AuthEvent, now time.Time) (failures int, last time.Time) {
+	for _, e := range events {
+		if e.Event == authLogin || now.Sub(e.Entered) > loginMemory {
+			break
+		}
+		if e.Event != authFailure {
+			continue
+		}
+		if failures == 0 {
+			last = e.Entered
+		}
+		failures++
+	}
+	return failures, last
+}
+
+// How long after "last" someone with "failures" failed logins has to
+// wait.
+func (ba *Bagapp) failureDelay(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	if failures >= ba.loginFailures {
+		return ba.loginLockout
+	}
+	delay := loginDelay << uint(failures-1)
+	if delay > ba.loginLockout {
+		delay = ba.loginLockout
+	}
+	return delay
+}
+
+func queryAuthEvents(store *bagzullaDb.Store, query *bagzullaDb.Query, value string) (events []AuthEvent, err error) {
+	rows, err := store.Stmt(query).Query(value)
+	if err != nil {
+		return events, err
+	}
+	return scanAuthEvents(rows)
+}
+
+// How long the person trying to log in as "name" from "ip" has to
+// wait before trying again. "failures" is the number of failures for
+// "name".
+func (ba *Bagapp) loginWait(name string, ip string, now time.Time) (wait time.Duration, failures int, err error) {
+	if ba.loginFailures <= 0 {
+		return 0, 0, nil
+	}
+	events, err := queryAuthEvents(ba.data, nameAuthEventsQuery, name)
+	if err != nil {
+		return 0, 0, err
+	}
+	failures, last := countFailures(events, now)
+	wait = last.Add(ba.failureDelay(failures)).Sub(now)
+	events, err = queryAuthEvents(ba.data, ipAuthEventsQuery, ip)
+	if err != nil {
+		return 0, 0, err
+	}
+	ipFailures, ipLast := countFailures(events, now)
+	ipWait := ipLast.Add(ba.failureDelay(ipFailures / ipFailureFactor)).Sub(now)
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, failures, nil
+}
+
+// Record an attempt to log in as "name". The person ID is recorded to
+// make the admin page easier to read.
+func (b *Bagreply) authEvent(name string, event string) {
+	person, err := b.data().PersonFromName(name)
+	if err != nil {
+		log.Printf("Error looking up %s: %s", name, err)
+	}
+	e := AuthEvent{
+		Entered:  time.Now(),
+		Name:     name,
+		PersonId: person.PersonId,
+		IP:       remoteIP(b.r),
+		Event:    event,
+	}
+	err = insertAuthEvent(b.data(), e)
+	if err != nil {
+		log.Printf("Error recording %s of %s: %s", event, name, err)
+	}
+}
+
+// Check whether "name" may try to log in now. If not, an error page
+// is sent and the return value is false.
+func (b *Bagreply) loginAllowed(name string) bool {
+	wait, _, err := b.App.loginWait(name, remoteIP(b.r), time.Now())
+	if err != nil {
+		b.errorPage("Error checking logins: %s", err)
+		return false
+	}
+	if wait == 0 {
+		return true
+	}
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	b.w.Header().Set("Retry-After", fmt.Sprintf("%d", int64(wait/time.Second)))
+	b.w.WriteHeader(http.StatusTooManyRequests)
+	b.errorPage("Too many failed logins. Please try again in %s.", wait)
+	return false
+}
+
+// Record a failed login, and lock the name if it has failed too many
+// times.
+func (b *Bagreply) loginFailed(name string) {
+	b.authEvent(name, authFailure)
+	if b.App.loginFailures <= 0 {
+		return
+	}
+	_, failures, err := b.App.loginWait(name, remoteIP(b.r), time.Now())
+	if err != nil {
+		log.Printf("Error counting failed logins: %s", err)
+		return
+	}
+	if failures >= b.App.loginFailures {
+		log.Printf("Locking %s after %d failed logins", name, failures)
+		b.authEvent(name, authLocked)
+	}
+}
+
+type authEventsPage struct {
+	Events []AuthEvent
+	// How long a lock lasts.
+	Lockout time.Duration
+}
+
+// Show the recent logins at /auth-events/ for the admins.
+func authEventsHandler(b *Bagreply) {
+	var ap authEventsPage
+	var err error
+	ap.Events, err = recentAuthEvents(b.data(), 200)
+	if err != nil {
+		b.errorPage("Error getting logins: %s", err)
+		return
+	}
+	ap.Lockout = b.App.loginLockout
+	b.Title = "Logins"
+	b.runTemplate("auth-events.html", ap)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tryLogin(ba *Bagapp, name string, password string, ip string) *httptest.ResponseRecorder {
+	form := url.Values{"name": {name}, "password": {password}}
+	r := httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	makeHandler(ba, loginHandler, roleViewer)(w, r)
+	return w
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ba := getTestApp(t)
+	defer func(delay time.Duration) {
+		ba.loginFailures = 0
+		ba.loginLockout = 0
+		loginDelay = delay
+	}(loginDelay)
+	ba.loginFailures = 3
+	ba.loginLockout = time.Hour
+	// Forget the logins of the other tests.
+	_, err := ba.db.Exec(`DELETE FROM auth_event`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures look the same whether or not the name exists.
+	known := tryLogin(ba, "duncan", "wrong", "198.51.100.1")
+	unknown := tryLogin(ba, "nobody", "wrong", "198.51.100.2")
+	if !strings.Contains(known.Body.String(), loginFailedMessage) {
+		t.Errorf("Failed login does not say %q", loginFailedMessage)
+	}
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Errorf("Failed logins of known and unknown names differ")
+	}
+	// Trying again at once, even with the right password, must wait.
+	for _, name := range []string{"duncan", "nobody"} {
+		w := tryLogin(ba, name, "12345", "198.51.100.3")
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Retry of %s: expected status %d, got %d", name,
+				http.StatusTooManyRequests, w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("Retry of %s: no Retry-After", name)
+		}
+	}
+
+	// The wait doubles after each failure.
+	now := time.Now()
+	for i, expect := range []time.Duration{time.Second, 2 * time.Second, time.Hour} {
+		_, err := ba.db.Exec(`INSERT INTO auth_event(entered, name, ip, event)
+VALUES (?, 'backoff', '203.0.113.1', 'failure')`, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wait, failures, err := ba.loginWait("backoff", "203.0.113.2", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures != i+1 || wait != expect {
+			t.Errorf("After %d failures: expected wait %s, got %d failures and wait %s",
+				i+1, expect, failures, wait)
+		}
+	}
+	wait, _, err := ba.loginWait("backoff", "203.0.113.2", now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 {
+		t.Errorf("Lock did not end: wait %s", wait)
+	}
+	// An address is allowed more failures than a name.
+	wait, _, err = ba.loginWait("someone-else", "203.0.113.1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 {
+		t.Errorf("Address slowed down after too few failures: wait %s", wait)
+	}
+
+	// Enough failures lock the name, so the right password no longer
+	// works.
+	loginDelay = 0
+	for i := 0; i < ba.loginFailures; i++ {
+		tryLogin(ba, "tony", "wrong", "198.51.100.4")
+	}
+	w := tryLogin(ba, "tony", "abcde", "198.51.100.5")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Locked name: expected status %d, got %d",
+			http.StatusTooManyRequests, w.Code)
+	}
+	events, err := recentAuthEvents(ba.data, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[0].Event != authLocked || events[0].Name != "tony" || events[0].PersonId != 2 {
+		t.Errorf("Lock not recorded: %+v", events)
+	}
+
+	// The admins can see it.
+	r := httptest.NewRequest("GET", "/auth-events/", nil)
+	rec := httptest.NewRecorder()
+	b := Bagreply{App: ba, w: rec, r: r}
+	authEventsHandler(&b)
+	if !strings.Contains(rec.Body.String(), "locked until") {
+		t.Errorf("Lock not shown on the logins page")
+	}
+
+	// A successful login clears the failures.
+	ba.loginLockout = 0
+	w = tryLogin(ba, "tony", "abcde", "198.51.100.6")
+	if w.Code != http.StatusFound {
+		t.Errorf("Login after lock: expected status %d, got %d",
+			http.StatusFound, w.Code)
+	}
+	for _, c := range (&http.Response{Header: w.Header()}).Cookies() {
+		ba.store.DeleteCookie(c.Value)
+	}
+	_, failures, err := ba.loginWait("tony", "198.51.100.6", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 0 {
+		t.Errorf("Failures not cleared by login: %d", failures)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+/* Personal API tokens, so that scripts can use the server without
+   logging in with a cookie. A token is sent in the header
+
+       Authorization: Bearer <token>
+
+   Only the SHA-256 hash of the token is kept in the database. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scopes a token may have. Each scope allows everything the
+// scopes before it allow.
+var tokenScopes = []string{
+	"read",
+	"write",
+	"admin",
+}
+
+// The start of every token, to make them easy to recognise.
+var tokenPrefix = "bz_"
+
+type Token struct {
+	TokenId  int64
+	PersonId int64
+	Name     string
+	// One of tokenScopes
+	Scope   string
+	Created time.Time
+	// Zero if the token does not expire
+	Expires  time.Time
+	LastUsed time.Time
+}
+
+func scopeLevel(scope string) int {
+	for i, s := range tokenScopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// Does the token allow "scope"?
+func (t *Token) has(scope string) bool {
+	level := scopeLevel(scope)
+	return level >= 0 && scopeLevel(t.Scope) >= level
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// Make a new random token.
+func makeTokenString() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var insertTokenSql = `
+INSERT INTO token(person_id, name, hash, scope, created, expires)
+VALUES (?, ?, ?, ?, ?, ?)
+`
+var insertTokenQuery = bagzullaDb.NewQuery(insertTokenSql)
+
+var tokenFields = `token_id, person_id, name, scope, created, expires, last_used`
+
+var personTokensSql = `SELECT ` + tokenFields + ` FROM token
+WHERE person_id = ? ORDER BY token_id`
+var personTokensQuery = bagzullaDb.NewQuery(personTokensSql)
+
+var tokenFromHashSql = `SELECT ` + tokenFields + ` FROM token
+WHERE hash = ?`
+var tokenFromHashQuery = bagzullaDb.NewQuery(tokenFromHashSql)
+
+var deleteTokenSql = `DELETE FROM token WHERE token_id = ? AND person_id = ?`
+var deleteTokenQuery = bagzullaDb.NewQuery(deleteTokenSql)
+
+var touchTokenSql = `UPDATE token SET last_used = ? WHERE token_id = ?`
+var touchTokenQuery = bagzullaDb.NewQuery(touchTokenSql)
+
+func scanToken(rows interface{ Scan(...interface{}) error }) (t Token, err error) {
+	var expires, lastUsed sql.NullTime
+	err = rows.Scan(&t.TokenId, &t.PersonId, &t.Name, &t.Scope, &t.Created,
+		&expires, &lastUsed)
+	if expires.Valid {
+		t.Expires = expires.Time
+	}
+	if lastUsed.Valid {
+		t.LastUsed = lastUsed.Time
+	}
+	return t, err
+}
+
+// Store a new token for "t.PersonId" and return the token itself,
+// which is not kept anywhere.
+func insertToken(store *bagzullaDb.Store, t Token) (token string, err error) {
+	token, err = makeTokenString()
+	if err != nil {
+		return "", err
+	}
+	var expires interface{}
+	if !t.Expires.IsZero() {
+		expires = t.Expires
+	}
+	_, err = store.Stmt(insertTokenQuery).Exec(t.PersonId, t.Name, hashToken(token),
+		t.Scope, time.Now(), expires)
+	return token, err
+}
+
+func personTokens(store *bagzullaDb.Store, personId int64) (tokens []Token, err error) {
+	rows, err := store.Stmt(personTokensQuery).Query(personId)
+	if err != nil {
+		return tokens, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Find the token from what the client sent. "found" is false if there
+// is no such token.
+func tokenFromString(store *bagzullaDb.Store, token string) (t Token, found bool, err error) {
+	t, err = scanToken(store.Stmt(tokenFromHashQuery).QueryRow(hashToken(token)))
+	if err == sql.ErrNoRows {
+		return t, false, nil
+	}
+	return t, err == nil, err
+}
+
+func deleteToken(store *bagzullaDb.Store, tokenId int64, personId int64) error {
+	_, err := store.Stmt(deleteTokenQuery).Exec(tokenId, personId)
+	return err
+}
+
+// Get the token from the Authorization header, if there is one.
+func bearerToken(r *http.Request) (token string, found bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")), true
+}
+
+// Get the person who owns the token in the Authorization header. If
+// the token is not acceptable, an error is sent and "ok" is false.
+func (b *Bagreply) tokenUser(token string) (user bagzullaDb.Person, ok bool) {
+	t, found, err := tokenFromString(b.data(), token)
+	if err != nil {
+		log.Printf("Error looking up token: %s", err)
+		http.Error(b.w, "Error looking up token", http.StatusInternalServerError)
+		return user, false
+	}
+	now := time.Now()
+	if !found || t.expired(now) {
+		b.w.Header().Set("WWW-Authenticate", `Bearer realm="bagzulla"`)
+		http.Error(b.w, "Unknown or expired token", http.StatusUnauthorized)
+		return user, false
+	}
+	user, err = b.data().PersonFromId(t.PersonId)
+	if err != nil {
+		log.Printf("Error getting owner %d of token %d: %s", t.PersonId,
+			t.TokenId, err)
+		http.Error(b.w, "Error looking up token", http.StatusInternalServerError)
+		return user, false
+	}
+	_, err = b.data().Stmt(touchTokenQuery).Exec(now, t.TokenId)
+	if err != nil {
+		log.Printf("Error updating last use of token %d: %s", t.TokenId, err)
+	}
+	t.LastUsed = now
+	b.Token = &t
+	return user, true
+}
+
+// Check that the request is allowed "scope". Requests with a cookie
+// are allowed everything. If not allowed, an error page is sent and
+// the return value is false.
+func (b *Bagreply) needScope(scope string) bool {
+	if b.Token == nil || b.Token.has(scope) {
+		return true
+	}
+	b.w.WriteHeader(http.StatusForbidden)
+	b.errorPage("Token %s does not have %s scope", html.EscapeString(b.Token.Name), scope)
+	return false
+}
+
+// Handle the creation and revocation of tokens from the person page
+// of "person". The return value is the new token, if one was made,
+// and false if there was an error.
+func tokenControls(b *Bagreply, person bagzullaDb.Person) (token string, ok bool) {
+	if b.r.Method != "POST" {
+		return "", true
+	}
+	create := b.r.PostFormValue("new-token") != ""
+	revoke := b.r.PostFormValue("revoke-token")
+	if !create && revoke == "" {
+		return "", true
+	}
+	if b.NotLoggedIn() {
+		return "", false
+	}
+	// A token cannot be used to make more tokens.
+	if b.Token != nil || b.User.PersonId != person.PersonId {
+		b.errorPage("Only %s can change %s's tokens", person.Name, person.Name)
+		return "", false
+	}
+	if revoke != "" {
+		tokenId, err := strconv.ParseInt(revoke, 10, 64)
+		if err != nil {
+			b.errorPage("Bad token ID %s", html.EscapeString(revoke))
+			return "", false
+		}
+		err = deleteToken(b.data(), tokenId, person.PersonId)
+		if err != nil {
+			b.errorPage("Error deleting token %d: %s", tokenId, err)
+			return "", false
+		}
+		return "", true
+	}
+	t := Token{
+		PersonId: person.PersonId,
+		Name:     strings.TrimSpace(b.r.PostFormValue("name")),
+		Scope:    b.r.PostFormValue("scope"),
+	}
+	if t.Name == "" {
+		b.errorPage("The token needs a name")
+		return "", false
+	}
+	if scopeLevel(t.Scope) < 0 {
+		b.errorPage("Unknown scope %s", html.EscapeString(t.Scope))
+		return "", false
+	}
+	days := b.r.PostFormValue("days")
+	if days != "" && days != "0" {
+		n, err := strconv.ParseInt(days, 10, 64)
+		if err != nil || n < 0 {
+			b.errorPage("Bad number of days %s", html.EscapeString(days))
+			return "", false
+		}
+		t.Expires = time.Now().Add(time.Duration(n) * 24 * time.Hour)
+	}
+	token, err := insertToken(b.data(), t)
+	if err != nil {
+		b.errorPage("Error making token: %s", err)
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	ba := getTestApp(t)
+	read, err := insertToken(ba.data, Token{PersonId: 2, Name: "read", Scope: "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := insertToken(ba.data, Token{PersonId: 2, Name: "admin", Scope: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := insertToken(ba.data, Token{
+		PersonId: 2,
+		Name:     "old",
+		Scope:    "admin",
+		Expires:  time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusOK},
+		{read, http.StatusForbidden},
+		{admin, http.StatusOK},
+		{old, http.StatusUnauthorized},
+		{"bz_nonsense", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		var user string
+		handler := makeHandler(ba, func(b *Bagreply) {
+			if b.User != nil {
+				user = b.User.Name
+			}
+			b.needScope("admin")
+		}, roleViewer)
+		r := httptest.NewRequest("GET", "/controls/", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.status {
+			t.Errorf("Token %q: expected status %d, got %d", test.token,
+				test.status, w.Code)
+		}
+		if test.status == http.StatusOK && test.token != "" && user != "tony" {
+			t.Errorf("Token %q: expected user tony, got %q", test.token, user)
+		}
+	}
+	tokens, err := personTokens(ba.data, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other tests may also make tokens for tony.
+	names := make(map[string]bool)
+	for _, tok := range tokens {
+		names[tok.Name] = true
+		if tok.Name == "admin" && tok.LastUsed.IsZero() {
+			t.Errorf("Last use of token was not recorded")
+		}
+	}
+	for _, name := range []string{"read", "admin", "old"} {
+		if !names[name] {
+			t.Errorf("Token %s was not listed", name)
+		}
+	}
+}
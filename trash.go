@@ -0,0 +1,722 @@
+package main
+
+/* The trash. Deleting a bug, comment, part or project only marks it
+   with the time and the person, which hides it everywhere except on
+   the trash page of the admins. From there it can be restored or,
+   once it has been in the trash for longer than --trash-keep, purged,
+   which removes it and everything which belongs to it from the
+   database, along with its files. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The tables of the things which can be put in the trash.
+var trashTables = map[string]bool{
+	"bug":     true,
+	"comment": true,
+	"part":    true,
+	"project": true,
+}
+
+var trashSql = `UPDATE %[1]s SET deleted = ?, deleted_by = ?
+WHERE %[1]s_id = ? AND deleted IS NULL`
+var restoreSql = `UPDATE %[1]s SET deleted = NULL, deleted_by = NULL
+WHERE %[1]s_id = ? AND deleted IS NOT NULL`
+
+var trashBugsQuery = bagzullaDb.NewQuery("SELECT " + bagzullaDb.BugFields +
+	" FROM bug WHERE deleted IS NOT NULL")
+var trashCommentsQuery = bagzullaDb.NewQuery("SELECT " + bagzullaDb.CommentFields +
+	" FROM comment WHERE deleted IS NOT NULL")
+var trashPartsQuery = bagzullaDb.NewQuery("SELECT " + bagzullaDb.PartFields +
+	" FROM part WHERE deleted IS NOT NULL")
+var trashProjectsQuery = bagzullaDb.NewQuery("SELECT " + bagzullaDb.ProjectFields +
+	" FROM project WHERE deleted IS NOT NULL")
+
+var bugAttachmentSumsQuery = bagzullaDb.NewQuery(`SELECT sha256 FROM attachment WHERE bug_id = ?`)
+var deleteBugAttachmentsQuery = bagzullaDb.NewQuery(`DELETE FROM attachment WHERE bug_id = ?`)
+
+// What else goes with a project when it is purged.
+var deleteProjectQueries = []*bagzullaDb.Query{
+	bagzullaDb.NewQuery(`DELETE FROM grant WHERE project_id = ?`),
+	bagzullaDb.NewQuery(`DELETE FROM delivery WHERE webhook_id IN
+(SELECT webhook_id FROM webhook WHERE project_id = ?)`),
+	bagzullaDb.NewQuery(`DELETE FROM webhook WHERE project_id = ?`),
+	bagzullaDb.NewQuery(`DELETE FROM project_event WHERE project_id = ?`),
+}
+
+// Send a "not found" page if the "kind" with ID "id" was put in the
+// trash at "deleted". The return value is true if it is in the trash.
+func (b *Bagreply) inTrash(kind string, id int64, deleted time.Time) bool {
+	if deleted.IsZero() {
+		return false
+	}
+	b.w.WriteHeader(http.StatusNotFound)
+	b.errorPage("The %s with ID %d is in the trash", kind, id)
+	return true
+}
+
+// Put the "kind" with ID "id" in the trash, or take it out if
+// "restore" is true.
+func setTrash(store *bagzullaDb.Store, kind string, id int64, personId int64, restore bool) error {
+	if !trashTables[kind] {
+		return fmt.Errorf("Unknown kind %s", kind)
+	}
+	var result interface {
+		RowsAffected() (int64, error)
+	}
+	var err error
+	if restore {
+		stmt, perr := store.Prepared(fmt.Sprintf(restoreSql, kind))
+		if perr != nil {
+			return perr
+		}
+		result, err = stmt.Exec(id)
+	} else {
+		stmt, perr := store.Prepared(fmt.Sprintf(trashSql, kind))
+		if perr != nil {
+			return perr
+		}
+		result, err = stmt.Exec(time.Now(), personId, id)
+	}
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows != 1 {
+		if restore {
+			return fmt.Errorf("The %s with ID %d is not in the trash", kind, id)
+		}
+		return fmt.Errorf("The %s with ID %d is already in the trash", kind, id)
+	}
+	return nil
+}
+
+// Put the "kind" with ID "id" in the trash, with an error page if
+// that fails.
+func (b *Bagreply) moveToTrash(kind string, id int64) bool {
+	err := setTrash(b.data(), kind, id, b.User.PersonId, false)
+	if err != nil {
+		b.errorPage("Error deleting %s %d: %s", kind, id, err)
+		return false
+	}
+	return true
+}
+
+// The parts in "parts" which are not in the trash.
+func liveParts(parts []bagzullaDb.Part) (live []bagzullaDb.Part) {
+	for _, p := range parts {
+		if p.Deleted.IsZero() {
+			live = append(live, p)
+		}
+	}
+	return live
+}
+
+// The comments in "comments" which are not in the trash.
+func liveComments(comments []bagzullaDb.Comment) (live []bagzullaDb.Comment) {
+	for _, c := range comments {
+		if c.Deleted.IsZero() {
+			live = append(live, c)
+		}
+	}
+	return live
+}
+
+// Delete a bug with the form on the bug page.
+func deleteBug(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	bug, ok := getBug(b)
+	if !ok {
+		return
+	}
+	ok = b.inTx(func() bool {
+		if !b.moveToTrash("bug", bug.BugId) {
+			return false
+		}
+		b.bugEvent("deleted", bug.BugId, "", "", "")
+		return true
+	})
+	if !ok {
+		return
+	}
+	redirectToProject(b, bug.ProjectId)
+}
+
+// Delete a comment with the form on the bug page. As with editing,
+// people may delete their own comments, but only developers may
+// delete other people's.
+func deleteComment(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	comment, ok := findComment(b)
+	if !ok {
+		return
+	}
+	need := b.perm
+	if comment.PersonId != b.User.PersonId {
+		need = roleDeveloper
+	}
+	if b.NotAllowedBug(need, comment.BugId) {
+		return
+	}
+	ok = b.inTx(func() bool {
+		return b.moveToTrash("comment", comment.CommentId) &&
+			b.updateChanged(comment.BugId)
+	})
+	if !ok {
+		return
+	}
+	b.redirectToBug(comment.BugId)
+}
+
+// Delete a part of a project. Its bugs keep their part, so that they
+// are in it again if it is restored.
+func deletePart(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	part, ok := getPart(b)
+	if !ok {
+		return
+	}
+	children, err := b.data().PartsFromParentId(part.PartId)
+	if err != nil {
+		b.errorPage("Error getting the parts of %s: %s", part.Name, err)
+		return
+	}
+	if len(liveParts(children)) > 0 {
+		b.errorPage("Part %s has parts under it, so they need to be moved or deleted first", part.Name)
+		return
+	}
+	if !b.moveToTrash("part", part.PartId) {
+		return
+	}
+	redirectToProject(b, part.ProjectId)
+}
+
+// Delete a project with the form on the project page.
+func deleteProject(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	project, ok := getAdminProject(b)
+	if !ok {
+		return
+	}
+	if project.ProjectId == b.inbox() {
+		b.errorPage("Project %s is the inbox, so it cannot be deleted", project.Name)
+		return
+	}
+	if !b.moveToTrash("project", project.ProjectId) {
+		return
+	}
+	b.perms = nil
+	log.Printf("%s deleted project %s", b.User.Name, project.Name)
+	http.Redirect(b.w, b.r, b.App.TopURL+"/projects/", http.StatusFound)
+}
+
+// The files of the things being purged, which are removed once the
+// rows have gone.
+type purge struct {
+	// The paths of the files of images.
+	images []string
+	// The hashes of the files of attachments.
+	sums []string
+}
+
+// Remove the comment "c" and its text.
+func (p *purge) comment(store *bagzullaDb.Store, c bagzullaDb.Comment) error {
+	err := store.DeleteComment(c.CommentId)
+	if err != nil {
+		return err
+	}
+	return store.DeleteTxt(c.TxtId)
+}
+
+// Remove the bug "bug", with its comments, texts, files and links to
+// other bugs.
+func (p *purge) bug(fs fileStore, store *bagzullaDb.Store, bug bagzullaDb.Bug) error {
+	comments, err := store.CommentsFromBugId(bug.BugId)
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		err = p.comment(store, c)
+		if err != nil {
+			return err
+		}
+	}
+	causes, err := store.DependenciesFromCause(bug.BugId)
+	if err != nil {
+		return err
+	}
+	effects, err := store.DependenciesFromEffect(bug.BugId)
+	if err != nil {
+		return err
+	}
+	// A bug which depends on itself is in both lists.
+	done := make(map[int64]bool)
+	for _, d := range append(causes, effects...) {
+		if done[d.DependencyId] {
+			continue
+		}
+		done[d.DependencyId] = true
+		err = store.DeleteDependency(d.DependencyId)
+		if err != nil {
+			return err
+		}
+	}
+	err = removeDuplicate(store, bug.BugId)
+	if err != nil {
+		return err
+	}
+	err = removeDuplicateOrig(store, bug.BugId)
+	if err != nil {
+		return err
+	}
+	images, err := store.ImagesFromBugId(bug.BugId)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		path, err := fs.imagePath(image.File)
+		if err != nil {
+			return err
+		}
+		err = store.DeleteImage(image.ImageId)
+		if err != nil {
+			return err
+		}
+		p.images = append(p.images, path)
+	}
+	rows, err := store.Stmt(bugAttachmentSumsQuery).Query(bug.BugId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sum string
+		err = rows.Scan(&sum)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		p.sums = append(p.sums, sum)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	_, err = store.Stmt(deleteBugAttachmentsQuery).Exec(bug.BugId)
+	if err != nil {
+		return err
+	}
+	err = store.DeleteBug(bug.BugId)
+	if err != nil {
+		return err
+	}
+	err = store.DeleteTxt(bug.Title)
+	if err != nil {
+		return err
+	}
+	return store.DeleteTxt(bug.Description)
+}
+
+// Remove the part "part". Its bugs are left without a part, and the
+// parts under it go to the top.
+func (p *purge) part(store *bagzullaDb.Store, part bagzullaDb.Part) error {
+	_, err := store.Stmt(setNoPartQuery).Exec(part.PartId)
+	if err != nil {
+		return err
+	}
+	_, err = store.Stmt(noParentQuery).Exec(part.PartId)
+	if err != nil {
+		return err
+	}
+	err = store.DeletePart(part.PartId)
+	if err != nil {
+		return err
+	}
+	return store.DeleteTxt(part.Description)
+}
+
+// Remove the project "project" and everything in it.
+func (p *purge) project(fs fileStore, store *bagzullaDb.Store, project bagzullaDb.Project) error {
+	bugs, err := store.BugsFromProjectId(project.ProjectId)
+	if err != nil {
+		return err
+	}
+	for _, bug := range bugs {
+		err = p.bug(fs, store, bug)
+		if err != nil {
+			return err
+		}
+	}
+	parts, err := store.PartsFromProjectId(project.ProjectId)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		err = p.part(store, part)
+		if err != nil {
+			return err
+		}
+	}
+	commits, err := store.GitcommitsFromProjectId(project.ProjectId)
+	if err != nil {
+		return err
+	}
+	for _, c := range commits {
+		err = store.DeleteGitcommit(c.GitcommitId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, q := range deleteProjectQueries {
+		_, err = store.Stmt(q).Exec(project.ProjectId)
+		if err != nil {
+			return err
+		}
+	}
+	err = store.DeleteProject(project.ProjectId)
+	if err != nil {
+		return err
+	}
+	return store.DeleteTxt(project.Description)
+}
+
+// Remove the files of the purged things. This is done after the
+// transaction is committed, so that nothing is lost if it fails.
+func (p *purge) removeFiles(ba *Bagapp) {
+	for _, path := range p.images {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing image %s: %s", path, err)
+		}
+	}
+	for _, sum := range p.sums {
+		err := ba.files.removeUnused(ba.data, sum)
+		if err != nil {
+			log.Printf("Error removing attachment file %s: %s", sum, err)
+		}
+	}
+}
+
+// Something in the trash.
+type TrashItem struct {
+	Kind string
+	Id   int64
+	Name string
+	// The page of what it belongs to, and its name.
+	Where     string
+	WhereName string
+	Deleted   time.Time
+	DeletedBy int64
+	Person    string
+	// Has it been in the trash long enough to be purged?
+	Expired bool
+}
+
+type trashPage struct {
+	Items []TrashItem
+	// How long things stay in the trash.
+	Keep    string
+	Expired int
+}
+
+// Write "d" as a number of days if it is a whole number of them.
+func formatKeep(d time.Duration) string {
+	day := 24 * time.Hour
+	if d >= day && d%day == 0 {
+		days := int64(d / day)
+		if days == 1 {
+			return "a day"
+		}
+		return fmt.Sprintf("%d days", days)
+	}
+	return d.String()
+}
+
+// The start of "s", for the names of comments.
+func excerpt(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	r := []rune(s)
+	if len(r) > max {
+		return string(r[:max]) + "…"
+	}
+	return s
+}
+
+// Everything in the trash, with the longest there first.
+func (b *Bagreply) trashItems() (items []TrashItem, ok bool) {
+	store := b.data()
+	add := func(kind string, id int64, name string, deleted time.Time, by int64) {
+		items = append(items, TrashItem{
+			Kind:      kind,
+			Id:        id,
+			Name:      name,
+			Deleted:   deleted,
+			DeletedBy: by,
+			Expired:   time.Since(deleted) >= b.App.trashKeep,
+		})
+	}
+	rows, err := store.Stmt(trashProjectsQuery).Query()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	projects, err := bagzullaDb.ProjectsFromRows(rows)
+	rows.Close()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	for _, p := range projects {
+		add("project", p.ProjectId, p.Name, p.Deleted, p.DeletedBy)
+	}
+	rows, err = store.Stmt(trashPartsQuery).Query()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	parts, err := bagzullaDb.PartsFromRows(rows)
+	rows.Close()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	for _, p := range parts {
+		add("part", p.PartId, p.Name, p.Deleted, p.DeletedBy)
+		items[len(items)-1].Where = fmt.Sprintf("../project/%d", p.ProjectId)
+		items[len(items)-1].WhereName, ok = getProjectName(b, p.ProjectId)
+		if !ok {
+			return nil, false
+		}
+	}
+	rows, err = store.Stmt(trashBugsQuery).Query()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	bugs, err := bagzullaDb.BugsFromRows(rows)
+	rows.Close()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	for _, bug := range bugs {
+		title, ok := b.GetText(bug.Title)
+		if !ok {
+			return nil, false
+		}
+		add("bug", bug.BugId, title, bug.Deleted, bug.DeletedBy)
+		items[len(items)-1].Where = fmt.Sprintf("../project/%d", bug.ProjectId)
+		items[len(items)-1].WhereName, ok = getProjectName(b, bug.ProjectId)
+		if !ok {
+			return nil, false
+		}
+	}
+	rows, err = store.Stmt(trashCommentsQuery).Query()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	comments, err := bagzullaDb.CommentsFromRows(rows)
+	rows.Close()
+	if err != nil {
+		b.errorPage("Error reading the trash: %s", err)
+		return nil, false
+	}
+	for _, c := range comments {
+		text, ok := b.GetText(c.TxtId)
+		if !ok {
+			return nil, false
+		}
+		add("comment", c.CommentId, excerpt(text, 60), c.Deleted, c.DeletedBy)
+		items[len(items)-1].Where = fmt.Sprintf("../bug/%d", c.BugId)
+		items[len(items)-1].WhereName = fmt.Sprintf("Bug %d", c.BugId)
+	}
+	for i := range items {
+		items[i].Person, ok = getPersonName(b, items[i].DeletedBy)
+		if !ok {
+			return nil, false
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Deleted.Before(items[j].Deleted)
+	})
+	return items, true
+}
+
+// An error unless something which was put in the trash at "deleted"
+// may be purged.
+func (ba *Bagapp) mayPurge(kind string, id int64, deleted time.Time) error {
+	if deleted.IsZero() {
+		return fmt.Errorf("The %s with ID %d is not in the trash", kind, id)
+	}
+	if time.Since(deleted) < ba.trashKeep {
+		return fmt.Errorf("The %s with ID %d has not been in the trash for %s",
+			kind, id, formatKeep(ba.trashKeep))
+	}
+	return nil
+}
+
+// Remove the "kind" with ID "id", which must have been in the trash
+// for long enough, from the database, and add its files to "p".
+func (ba *Bagapp) purgeOne(store *bagzullaDb.Store, p *purge, kind string, id int64) error {
+	switch kind {
+	case "bug":
+		bug, err := store.BugFromId(id)
+		if err == nil {
+			err = ba.mayPurge(kind, id, bug.Deleted)
+		}
+		if err != nil {
+			return err
+		}
+		return p.bug(ba.files, store, bug)
+	case "comment":
+		c, err := store.CommentFromId(id)
+		if err == nil {
+			err = ba.mayPurge(kind, id, c.Deleted)
+		}
+		if err != nil {
+			return err
+		}
+		return p.comment(store, c)
+	case "part":
+		part, err := store.PartFromId(id)
+		if err == nil {
+			err = ba.mayPurge(kind, id, part.Deleted)
+		}
+		if err != nil {
+			return err
+		}
+		return p.part(store, part)
+	case "project":
+		project, err := store.ProjectFromId(id)
+		if err == nil {
+			err = ba.mayPurge(kind, id, project.Deleted)
+		}
+		if err != nil {
+			return err
+		}
+		return p.project(ba.files, store, project)
+	}
+	return fmt.Errorf("Unknown kind %s", kind)
+}
+
+// The order in which the expired things are purged, so that nothing
+// is purged with what it belongs to before its own turn.
+var purgeOrder = []string{"comment", "bug", "part", "project"}
+
+// Purge everything which has been in the trash for long enough.
+func (b *Bagreply) purgeExpired() (ok bool) {
+	items, ok := b.trashItems()
+	if !ok {
+		return false
+	}
+	var purged purge
+	count := 0
+	ok = b.inTx(func() bool {
+		for _, kind := range purgeOrder {
+			for _, item := range items {
+				if item.Kind != kind || !item.Expired {
+					continue
+				}
+				err := b.App.purgeOne(b.data(), &purged, item.Kind, item.Id)
+				if err != nil {
+					b.errorPage("Error purging %s %d: %s", item.Kind, item.Id, err)
+					return false
+				}
+				count++
+			}
+		}
+		return true
+	})
+	if !ok {
+		return false
+	}
+	purged.removeFiles(b.App)
+	log.Printf("%s purged %d expired items from the trash", b.User.Name, count)
+	return true
+}
+
+// Restore or purge things with the forms on the trash page. The return
+// value is false if there was an error.
+func trashControls(b *Bagreply) (ok bool) {
+	if b.r.PostFormValue("purge-expired") != "" {
+		return b.purgeExpired()
+	}
+	kind := b.r.PostFormValue("kind")
+	id, err := strconv.ParseInt(b.r.PostFormValue("id"), 10, 64)
+	if !trashTables[kind] || err != nil {
+		b.errorPage("Bad item %s %s", strconv.Quote(kind),
+			strconv.Quote(b.r.PostFormValue("id")))
+		return false
+	}
+	if b.r.PostFormValue("purge") != "" {
+		var purged purge
+		ok = b.inTx(func() bool {
+			err := b.App.purgeOne(b.data(), &purged, kind, id)
+			if err != nil {
+				b.errorPage("Error purging %s %d: %s", kind, id, err)
+				return false
+			}
+			return true
+		})
+		if !ok {
+			return false
+		}
+		purged.removeFiles(b.App)
+		log.Printf("%s purged %s %d", b.User.Name, kind, id)
+		return true
+	}
+	ok = b.inTx(func() bool {
+		err := setTrash(b.data(), kind, id, 0, true)
+		if err != nil {
+			b.errorPage("Error restoring %s %d: %s", kind, id, err)
+			return false
+		}
+		if kind == "bug" {
+			b.bugEvent("restored", id, "", "", "")
+		}
+		return true
+	})
+	b.perms = nil
+	return ok
+}
+
+// The admins' page of what is in the trash.
+func trashHandler(b *Bagreply) {
+	if b.r.Method == "POST" && !trashControls(b) {
+		return
+	}
+	var tp trashPage
+	var ok bool
+	tp.Items, ok = b.trashItems()
+	if !ok {
+		return
+	}
+	tp.Keep = formatKeep(b.App.trashKeep)
+	for _, item := range tp.Items {
+		if item.Expired {
+			tp.Expired++
+		}
+	}
+	b.Title = "Trash"
+	b.runTemplate("trash.html", tp)
+}
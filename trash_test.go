@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	ba := getTestApp(t)
+	defer func(keep time.Duration) {
+		ba.trashKeep = keep
+	}(ba.trashKeep)
+	ba.trashKeep = time.Hour
+	result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status)
+VALUES('Rubbish', '', 1, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId, _ := result.LastInsertId()
+	binned, err := addBug(ba.data, "Binned bug", "In the rubbish", projectId, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bugId, err := addBug(ba.data, "Thrown away", "Soon gone", 2, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentId, err := addComment(ba.data, bugId, 1, "Regrettable remark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := make(map[string]string)
+	for _, p := range [][2]string{{"rhoda", "reporter"}, {"sweeper", "admin"}} {
+		result, err := ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES(?, ?, 'x', ?)`, p[0], p[0]+"@localhost", p[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		personId, _ := result.LastInsertId()
+		tokens[p[0]], err = insertToken(ba.data, Token{PersonId: personId, Name: "t", Scope: "admin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens["duncan"], err = insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("Only attached to the rubbish")
+	w := uploadFile(ba, tokens["duncan"], binned, "rubbish.txt", content)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Upload failed: %d %s", w.Code, w.Body.String())
+	}
+	attachments, err := bugAttachments(ba.data, binned)
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("Expected one attachment, got %v %v", attachments, err)
+	}
+	file, err := ba.files.path(attachments[0].SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(fn BagFunc, perm role, path string, form url.Values, token string) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, perm)(w, r)
+		return w
+	}
+	bugPath := fmt.Sprintf("/bug/%d", bugId)
+	commentPath := fmt.Sprintf("/delete-comment/%d", commentId)
+	none := url.Values{}
+
+	// Reporters may only delete their own comments.
+	w = send(deleteComment, roleReporter, commentPath, none, tokens["rhoda"])
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Reporter deleted someone else's comment: %d", w.Code)
+	}
+	w = send(deleteComment, roleReporter, commentPath, none, tokens["duncan"])
+	if w.Code != http.StatusFound {
+		t.Errorf("Deleting a comment: %d %s", w.Code, w.Body.String())
+	}
+	w = send(bugHandler, roleViewer, bugPath, nil, tokens["duncan"])
+	if strings.Contains(w.Body.String(), "Regrettable remark") {
+		t.Errorf("Deleted comment is on the bug page")
+	}
+	w = send(search, roleViewer, "/search/?searchterm=Regrettable", nil, tokens["duncan"])
+	if strings.Contains(w.Body.String(), "Regrettable remark") {
+		t.Errorf("Deleted comment was found by the search")
+	}
+
+	w = send(deleteBug, roleDeveloper, fmt.Sprintf("/delete-bug/%d", bugId), none, tokens["duncan"])
+	if w.Code != http.StatusFound {
+		t.Errorf("Deleting a bug: %d %s", w.Code, w.Body.String())
+	}
+	w = send(bugHandler, roleViewer, bugPath, nil, tokens["duncan"])
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Deleted bug: expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+	for _, path := range []string{"/bugs/", "/feed/recent/", "/search/?searchterm=Soon"} {
+		fn := allBugsHandler
+		if strings.HasPrefix(path, "/feed") {
+			fn = feedHandler
+		} else if strings.HasPrefix(path, "/search") {
+			fn = search
+		}
+		w = send(fn, roleViewer, path, nil, tokens["duncan"])
+		if strings.Contains(w.Body.String(), "Thrown away") || strings.Contains(w.Body.String(), "Soon gone") {
+			t.Errorf("Deleted bug is in %s", path)
+		}
+	}
+
+	// Only admins see the trash.
+	w = send(trashHandler, roleAdmin, "/trash/", nil, tokens["duncan"])
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Developer saw the trash: %d", w.Code)
+	}
+	w = send(trashHandler, roleAdmin, "/trash/", nil, tokens["sweeper"])
+	if !strings.Contains(w.Body.String(), "Thrown away") ||
+		!strings.Contains(w.Body.String(), "Regrettable remark") {
+		t.Errorf("The trash does not show the deleted bug and comment")
+	}
+
+	restore := url.Values{"kind": {"bug"}, "id": {fmt.Sprint(bugId)}, "restore": {"1"}}
+	send(trashHandler, roleAdmin, "/trash/", restore, tokens["sweeper"])
+	w = send(bugHandler, roleViewer, bugPath, nil, tokens["duncan"])
+	if w.Code != http.StatusOK {
+		t.Errorf("Restored bug: expected %d, got %d", http.StatusOK, w.Code)
+	}
+	send(deleteBug, roleDeveloper, fmt.Sprintf("/delete-bug/%d", bugId), none, tokens["duncan"])
+
+	// Nothing can be purged until it has been in the trash for long
+	// enough.
+	purge := url.Values{"kind": {"bug"}, "id": {fmt.Sprint(bugId)}, "purge": {"1"}}
+	w = send(trashHandler, roleAdmin, "/trash/", purge, tokens["sweeper"])
+	if !strings.Contains(w.Body.String(), "has not been in the trash") {
+		t.Errorf("Purged too soon: %s", w.Body.String())
+	}
+	if _, err := ba.data.BugFromId(bugId); err != nil {
+		t.Errorf("Bug gone after refused purge: %s", err)
+	}
+	ba.trashKeep = 0
+	send(trashHandler, roleAdmin, "/trash/", purge, tokens["sweeper"])
+	if _, err := ba.data.BugFromId(bugId); err == nil {
+		t.Errorf("Bug not purged")
+	}
+	if _, err := ba.data.CommentFromId(commentId); err == nil {
+		t.Errorf("Comment not purged with its bug")
+	}
+
+	// No bugs can be added to a part in the trash, nor to a part
+	// through another project.
+	description, err := storeText(ba.data, "Scrap metal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partId, err := ba.data.InsertPart(bagzullaDb.Part{Name: "Scrap", ProjectId: projectId, Description: description})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(deletePart, roleDeveloper, fmt.Sprintf("/delete-part/%d", partId), none, tokens["duncan"])
+	newBug := url.Values{"title": {"Into the scrap"}}
+	w = send(addBugToPartHandler, roleReporter, fmt.Sprintf("/add-bug-to-part/%d", partId), newBug, tokens["duncan"])
+	if w.Code != http.StatusNotFound || w.Header().Get("Location") != "" {
+		t.Errorf("Added a bug to a part in the trash: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	newBug.Set("part", fmt.Sprint(partId))
+	w = send(addBugToProjectHandler, roleReporter, fmt.Sprintf("/add-bug-to-project/%d", projectId), newBug, tokens["duncan"])
+	if w.Code == http.StatusFound {
+		t.Errorf("Added a bug to a part in the trash through its project")
+	}
+	send(trashHandler, roleAdmin, "/trash/", url.Values{"kind": {"part"}, "id": {fmt.Sprint(partId)}, "restore": {"1"}}, tokens["sweeper"])
+	w = send(addBugToProjectHandler, roleReporter, "/add-bug-to-project/2", newBug, tokens["duncan"])
+	if w.Code == http.StatusFound {
+		t.Errorf("Added a bug to a part of another project")
+	}
+	var count int
+	err = ba.db.QueryRow(`SELECT COUNT(*) FROM bug WHERE part_id = ?`, partId).Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("Part has %d bugs: %v", count, err)
+	}
+
+	// A project takes its bugs and their files with it.
+	projectPath := fmt.Sprintf("/project/%d", projectId)
+	w = send(deleteProject, roleAdmin, "/delete-project/1", none, tokens["sweeper"])
+	if w.Code == http.StatusFound {
+		t.Errorf("Deleted the project None")
+	}
+	send(deleteProject, roleAdmin, "/delete-project/"+fmt.Sprint(projectId), none, tokens["sweeper"])
+	w = send(showProject, roleViewer, projectPath, nil, tokens["sweeper"])
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Deleted project: expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+	w = send(listProjects, roleViewer, "/projects/", nil, tokens["duncan"])
+	if strings.Contains(w.Body.String(), "Rubbish") {
+		t.Errorf("Deleted project is in the list of projects")
+	}
+	w = send(bugHandler, roleViewer, fmt.Sprintf("/bug/%d", binned), nil, tokens["sweeper"])
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Bug of deleted project: expected %d, got %d", http.StatusNotFound, w.Code)
+	}
+	send(trashHandler, roleAdmin, "/trash/", url.Values{"purge-expired": {"1"}}, tokens["sweeper"])
+	if _, err := ba.data.ProjectFromId(projectId); err == nil {
+		t.Errorf("Project not purged")
+	}
+	if _, err := ba.data.BugFromId(binned); err == nil {
+		t.Errorf("Bug not purged with its project")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Attachment file not removed: %v", err)
+	}
+	w = send(trashHandler, roleAdmin, "/trash/", nil, tokens["sweeper"])
+	if !strings.Contains(w.Body.String(), "The trash is empty") {
+		t.Errorf("Things left in the trash: %s", w.Body.String())
+	}
+}
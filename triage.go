@@ -0,0 +1,215 @@
+package main
+
+/* The inbox. Bugs can be entered without saying which project they
+   belong to, and then go into the inbox project, which is the one
+   with project.inbox set. Admins can make any active project the
+   inbox from its page. The triage page lists the open bugs of the
+   inbox, with a form for each one to give it a project, a part and a
+   priority. */
+
+import (
+	"bagzulla/bagzullaDb"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The ID of the inbox project, or zero if there is none.
+func (b *Bagreply) inbox() int64 {
+	return b.getPermissions().Inbox
+}
+
+// The inbox project, or an error if there is none.
+func inboxProject(store *bagzullaDb.Store) (project bagzullaDb.Project, err error) {
+	projects, err := store.ProjectsFromInbox(1)
+	if err != nil {
+		return project, err
+	}
+	for _, p := range projects {
+		if p.Deleted.IsZero() {
+			return p, nil
+		}
+	}
+	return project, fmt.Errorf("there is no inbox project")
+}
+
+var setInboxSql = `UPDATE project SET inbox = (project_id = ?)`
+var setInboxQuery = bagzullaDb.NewQuery(setInboxSql)
+
+// Make the project at the end of the URL the inbox, instead of the
+// one which was.
+func setInbox(b *Bagreply) {
+	if b.NotLoggedIn() {
+		return
+	}
+	project, ok := getProject(b)
+	if !ok || b.projectClosed(project) {
+		return
+	}
+	_, err := b.data().Stmt(setInboxQuery).Exec(project.ProjectId)
+	if err != nil {
+		b.errorPage("Error making %s the inbox: %s", project.Name, err)
+		return
+	}
+	b.perms = nil
+	log.Printf("%s made project %s the inbox", b.User.Name, project.Name)
+	redirectToProject(b, project.ProjectId)
+}
+
+// A project and one of its parts, or no part, which a bug in the
+// inbox can go to.
+type triagePlace struct {
+	Value string
+	Part  string
+}
+
+type triageProject struct {
+	Project bagzullaDb.Project
+	Inbox   bool
+	Places  []triagePlace
+}
+
+type triagePage struct {
+	Inbox      bagzullaDb.Project
+	Bugs       []ListBug
+	Paging     *bugPaging
+	Projects   []triageProject
+	Priorities []string
+}
+
+// The value of the place form field for part "partId" of project
+// "projectId".
+func placeValue(projectId int64, partId int64) string {
+	return fmt.Sprintf("%d:%d", projectId, partId)
+}
+
+func parsePlace(value string) (projectId int64, partId int64, err error) {
+	colon := strings.IndexByte(value, ':')
+	if colon < 0 {
+		return 0, 0, fmt.Errorf("no colon")
+	}
+	projectId, err = strconv.ParseInt(value[:colon], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	partId, err = strconv.ParseInt(value[colon+1:], 10, 64)
+	return projectId, partId, err
+}
+
+// The inbox, followed by the active projects which the user can
+// move bugs to with their parts.
+func (b *Bagreply) triageProjects(inbox bagzullaDb.Project) (projects []triageProject, ok bool) {
+	projects = append(projects, triageProject{
+		Project: inbox,
+		Inbox:   true,
+		Places:  []triagePlace{{Value: placeValue(inbox.ProjectId, 0)}},
+	})
+	open, ok := openProjects(b)
+	if !ok {
+		return nil, false
+	}
+	for _, p := range open {
+		if p.ProjectId == inbox.ProjectId || b.roleIn(p.ProjectId) < roleDeveloper {
+			continue
+		}
+		tp := triageProject{Project: p}
+		tp.Places = append(tp.Places, triagePlace{Value: placeValue(p.ProjectId, 0)})
+		parts, ok := b.projectPartTree(p.ProjectId)
+		if !ok {
+			return nil, false
+		}
+		for _, part := range parts {
+			tp.Places = append(tp.Places, triagePlace{
+				Value: placeValue(p.ProjectId, part.PartId),
+				Part:  part.Path,
+			})
+		}
+		projects = append(projects, tp)
+	}
+	return projects, true
+}
+
+// Give the bug of the form a project, part and priority.
+func (b *Bagreply) triageBug() (ok bool) {
+	bugId, err := strconv.ParseInt(b.r.PostFormValue("bug"), 10, 64)
+	if err != nil {
+		b.errorPage("Bad bug %s", strconv.Quote(b.r.PostFormValue("bug")))
+		return false
+	}
+	bug, err := b.data().BugFromId(bugId)
+	if err != nil {
+		b.errorPage("Error getting bug %d: %s", bugId, err)
+		return false
+	}
+	if b.NotAllowed(roleDeveloper, bug.ProjectId) || b.inTrash("bug", bugId, bug.Deleted) {
+		return false
+	}
+	if bug.ProjectId != b.inbox() {
+		b.errorPage("Bug %d is not in the inbox any more", bugId)
+		return false
+	}
+	projectId, partId, err := parsePlace(b.r.PostFormValue("place"))
+	if err != nil {
+		b.errorPage("Bad place %s: %s", strconv.Quote(b.r.PostFormValue("place")), err)
+		return false
+	}
+	if partId != 0 {
+		part, err := b.data().PartFromId(partId)
+		if err != nil || part.ProjectId != projectId || !part.Deleted.IsZero() {
+			b.errorPage("There is no part with ID %d in project %d", partId, projectId)
+			return false
+		}
+	}
+	priority, err := stringToPriority(b.r.PostFormValue("priority"))
+	if err != nil {
+		b.errorPage("Bad priority: %s", err)
+		return false
+	}
+	return b.inTx(func() bool {
+		if projectId != bug.ProjectId && !b.moveBug(bug, projectId, partId) {
+			return false
+		}
+		if priority != bug.Priority {
+			err = b.data().UpdatePriorityForBug(priority, bugId)
+			if err != nil {
+				b.errorPage("Error changing the priority of bug %d: %s", bugId, err)
+				return false
+			}
+			b.bugEvent("priority", bugId, priorities[bug.Priority], priorities[priority], "")
+		}
+		return b.updateChanged(bugId)
+	})
+}
+
+// The list of the open bugs in the inbox.
+func triageHandler(b *Bagreply) {
+	if b.inbox() == 0 {
+		b.errorPage("No project is the inbox. An admin can make one the inbox from its page.")
+		return
+	}
+	if b.r.Method == "POST" {
+		if b.triageBug() {
+			http.Redirect(b.w, b.r, b.r.URL.RequestURI(), http.StatusFound)
+		}
+		return
+	}
+	var tp triagePage
+	var ok bool
+	tp.Inbox, ok = projectFromId(b, b.inbox())
+	if !ok || b.NotAllowed(roleViewer, tp.Inbox.ProjectId) {
+		return
+	}
+	tp.Bugs, tp.Paging, ok = b.bugListPage(openProjectBugList, defaultPageSize, tp.Inbox.ProjectId)
+	if !ok {
+		return
+	}
+	tp.Projects, ok = b.triageProjects(tp.Inbox)
+	if !ok {
+		return
+	}
+	tp.Priorities = priorities
+	b.Title = "Triage"
+	b.runTemplate("triage.html", tp)
+}
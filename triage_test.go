@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTriage(t *testing.T) {
+	ba := getTestApp(t)
+	// The seed makes project 1 the inbox.
+	defer func() {
+		_, err := ba.db.Exec(setInboxSql, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	result, err := ba.db.Exec(`INSERT INTO project(name, directory, description, owner, status)
+VALUES('Sorted', '', 1, 1, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectId, _ := result.LastInsertId()
+	result, err = ba.db.Exec(`INSERT INTO part(name, project_id, description) VALUES('Sorting', ?, 1)`,
+		projectId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partId, _ := result.LastInsertId()
+	bugId, err := addBug(ba.data, "Wherever it goes", "Unsorted", 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = ba.db.Exec(`INSERT INTO person(name, email, password, role)
+VALUES('sorter', 'sorter@localhost', 'x', 'admin')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorterId, _ := result.LastInsertId()
+	admin, err := insertToken(ba.data, Token{PersonId: sorterId, Name: "t", Scope: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	developer, err := insertToken(ba.data, Token{PersonId: 1, Name: "t", Scope: "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(fn BagFunc, perm role, path string, form url.Values, token string) *httptest.ResponseRecorder {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest("GET", path, nil)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		makeHandler(ba, fn, perm)(w, r)
+		return w
+	}
+
+	w := send(triageHandler, roleDeveloper, "/triage/", nil, developer)
+	body := w.Body.String()
+	if !strings.Contains(body, "Wherever it goes") || !strings.Contains(body, "Sorted / Sorting") {
+		t.Errorf("Triage page does not show the bug and places: %s", body)
+	}
+	place := fmt.Sprintf("%d:%d", projectId, partId)
+	form := url.Values{"bug": {fmt.Sprint(bugId)}, "place": {place}, "priority": {"high"}}
+	w = send(triageHandler, roleDeveloper, "/triage/", form, developer)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Triage: %d %s", w.Code, w.Body.String())
+	}
+	bug, err := ba.data.BugFromId(bugId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bug.ProjectId != projectId || bug.PartId != partId || priorities[bug.Priority] != "high" {
+		t.Errorf("Bug not sorted out: project %d part %d priority %d",
+			bug.ProjectId, bug.PartId, bug.Priority)
+	}
+	w = send(triageHandler, roleDeveloper, "/triage/", nil, developer)
+	if strings.Contains(w.Body.String(), "Wherever it goes") {
+		t.Errorf("Sorted bug is still on the triage page")
+	}
+	w = send(triageHandler, roleDeveloper, "/triage/", form, developer)
+	if !strings.Contains(w.Body.String(), "not in the inbox") {
+		t.Errorf("Triaged a bug which is not in the inbox: %s", w.Body.String())
+	}
+
+	// A part of one project cannot go with another.
+	other, err := addBug(ba.data, "Mismatched", "Unsorted", 1, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = send(triageHandler, roleDeveloper, "/triage/", url.Values{"bug": {fmt.Sprint(other)},
+		"place": {fmt.Sprintf("2:%d", partId)}, "priority": {"unknown"}}, developer)
+	if bug, _ := ba.data.BugFromId(other); bug.ProjectId != 1 {
+		t.Errorf("Bug moved with a part of another project")
+	}
+
+	w = send(setInbox, roleAdmin, fmt.Sprintf("/set-inbox/%d", projectId), url.Values{}, developer)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Developer changed the inbox: %d", w.Code)
+	}
+	w = send(setInbox, roleAdmin, fmt.Sprintf("/set-inbox/%d", 2), url.Values{}, admin)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Changing the inbox: %d %s", w.Code, w.Body.String())
+	}
+	project, err := inboxProject(ba.data)
+	if err != nil || project.ProjectId != 2 {
+		t.Errorf("The inbox is %d, not 2: %v", project.ProjectId, err)
+	}
+	w = send(deleteProject, roleAdmin, "/delete-project/2", url.Values{}, admin)
+	if !strings.Contains(w.Body.String(), "is the inbox") {
+		t.Errorf("Deleted the inbox: %d", w.Code)
+	}
+	w = send(triageHandler, roleDeveloper, "/triage/", nil, developer)
+	if !strings.Contains(w.Body.String(), "Bagzulla") {
+		t.Errorf("Triage page is not of the new inbox")
+	}
+}
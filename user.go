@@ -4,48 +4,169 @@ package main
 
 import (
 	"bagzulla/bagzullaDb"
-	"database/sql"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // This implements the interface of login.LoginStore.
 type baguser struct {
 	b *Bagapp
+	// What checks the passwords, if not the person table.
+	checker passwordChecker
 }
 
 func (bu *baguser) CheckPassword(user string, password string) (found bool) {
-	person, err := bagzullaDb.PersonFromName(bu.b.db, user)
-	if person.PersonId == 0 {
+	if bu.checker != nil {
+		return bu.checkExternal(user, password)
+	}
+	person, err := bu.b.data.PersonFromName(user)
+	found = err == nil && person.PersonId != 0
+	// The password is checked against a hash whether or not there
+	// is a person called "user", so that the time taken does not
+	// tell.
+	stored := noPasswordHash
+	if found && strings.HasPrefix(person.Password, passwordHashPrefix) {
+		stored = person.Password
+	}
+	matched := passwordMatch(stored, password)
+	if found && stored == noPasswordHash {
+		matched = passwordMatch(person.Password, password)
+	}
+	if !found || !matched {
 		return false
 	}
+	active, err := personActive(bu.b.data, person.PersonId)
 	if err != nil {
+		log.Printf("Error getting status of %s: %s", user, err)
 		return false
 	}
-	if person.Password == password {
-		return true
+	return active
+}
+
+// The hashes of passwords in the person table are PBKDF2 with SHA-256,
+// written as pbkdf2-sha256$iterations$salt$hash.
+var passwordHashPrefix = "pbkdf2-sha256$"
+var passwordIterations = 100000
+
+// A hash to check passwords against for names which nobody has, so
+// that it takes as long as checking the password of a real person.
+var noPasswordHash = makePasswordHash("", make([]byte, 16), passwordIterations)
+
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], block)
+		prf.Write(n[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// Hash "password" with a new salt, for the person table.
+func hashPassword(password string) (hash string, err error) {
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	return makePasswordHash(password, salt, passwordIterations), nil
+}
+
+func makePasswordHash(password string, salt []byte, iterations int) string {
+	sum := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("%s%d$%s$%s", passwordHashPrefix, iterations,
+		enc.EncodeToString(salt), enc.EncodeToString(sum))
+}
+
+// Does "password" match "stored" from the person table? The people
+// added before passwords were hashed have the password itself.
+func passwordMatch(stored string, password string) bool {
+	if !strings.HasPrefix(stored, passwordHashPrefix) {
+		return stored != "" &&
+			subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, passwordHashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < 1 {
+		return false
 	}
-	return false
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	computed := makePasswordHash(password, salt, iterations)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(stored)) == 1
 }
 
 var deleteCookieSQL = `DELETE FROM session WHERE cookie=?`
-var deleteCookieStmt *sql.Stmt
+var deleteCookieQuery = bagzullaDb.NewQuery(deleteCookieSQL)
 
 func (bu *baguser) DeleteCookie(cookie string) (err error) {
 	if len(cookie) == 0 {
 		return fmt.Errorf("Empty cookie")
 	}
-	if deleteCookieStmt == nil {
-		deleteCookieStmt, err = bu.b.db.Prepare(deleteCookieSQL)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = deleteCookieStmt.Exec(cookie)
+	_, err = bu.b.data.Stmt(deleteCookieQuery).Exec(cookie)
 	return err
 }
 
+// Check the password with "bu.checker", and make a person for the
+// user if they do not have one yet.
+func (bu *baguser) checkExternal(user string, password string) (found bool) {
+	ok, err := bu.checker.checkPassword(user, password)
+	if err != nil {
+		log.Printf("Error checking password of %s: %s", user, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	person, err := ensurePerson(bu.b.data, user)
+	if err != nil {
+		log.Printf("Error adding person %s: %s", user, err)
+		return false
+	}
+	active, err := personActive(bu.b.data, person.PersonId)
+	if err != nil {
+		log.Printf("Error getting status of %s: %s", user, err)
+		return false
+	}
+	return active
+}
+
 func (bu *baguser) FindUser(user string) (found bool) {
-	person, err := bagzullaDb.PersonFromName(bu.b.db, user)
+	// People may not have a person yet if their passwords are
+	// somewhere else.
+	if bu.checker != nil {
+		return true
+	}
+	person, err := bu.b.data.PersonFromName(user)
 	if person.PersonId == 0 {
 		return false
 	}
@@ -56,30 +177,26 @@ func (bu *baguser) FindUser(user string) (found bool) {
 }
 
 func (bu *baguser) LookUpCookie(cookie string) (user string, found bool, err error) {
-	var userID int64
-	userID, found, err = SearchCookie(bu.b, cookie)
+	session, found, err := SearchCookie(bu.b, cookie)
 	if err != nil || !found {
 		return "", found, err
 	}
-	person, err := bagzullaDb.PersonFromId(bu.b.db, userID)
+	if bu.b.sessionExpired(session, time.Now()) {
+		return "", false, bu.DeleteCookie(cookie)
+	}
+	person, err := bu.b.data.PersonFromId(session.PersonId)
 	if err != nil {
 		return "", false, err
 	}
 	return person.Name, true, nil
 }
 
-var storeLogin = `INSERT INTO session(person_id,cookie,start) VALUES(?,?,CURRENT_TIMESTAMP)`
-var storeLoginStmt *sql.Stmt
+var storeLogin = `INSERT INTO session(person_id,cookie,start,last_seen) VALUES(?,?,CURRENT_TIMESTAMP,CURRENT_TIMESTAMP)`
+var storeLoginQuery = bagzullaDb.NewQuery(storeLogin)
 
 func (bu *baguser) StoreLogin(user string, cookie string) (err error) {
-	person, err := bagzullaDb.PersonFromName(bu.b.db, user)
+	person, err := bu.b.data.PersonFromName(user)
 	pid := person.PersonId
-	if storeLoginStmt == nil {
-		storeLoginStmt, err = bu.b.db.Prepare(storeLogin)
-		if err != nil {
-			return err
-		}
-	}
-	_, err = storeLoginStmt.Exec(pid, cookie)
+	_, err = bu.b.data.Stmt(storeLoginQuery).Exec(pid, cookie)
 	return err
 }
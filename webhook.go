@@ -0,0 +1,445 @@
+// Send notifications of changes to bugs to other programs, such as
+// chat bots or continuous integration, by posting JSON to URLs
+// ("webhooks").
+
+// Each webhook has a secret, and each post carries a header
+//
+//     X-Bagzulla-Signature: sha256=<hex HMAC-SHA256 of the body>
+//
+// so that the receiver can check that the post came from us.
+
+package main
+
+import (
+	"bagzulla/bagzullaDb"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of event which are sent to webhooks.
+var webhookEvents = []string{
+	"created",
+	"commented",
+	"status",
+	"priority",
+	"reassigned",
+	"deleted",
+	"restored",
+}
+
+// The number of times to try to deliver a payload.
+var webhookAttempts = 5
+
+// The time to wait after the first failed attempt. This doubles after
+// each failure.
+var webhookBackoff = 2 * time.Second
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// A URL which is sent notifications.
+type Webhook struct {
+	WebhookId int64
+	// The project the webhook is notified about, or zero for all
+	// projects.
+	ProjectId int64
+	// The name of the project, for display.
+	ProjectName string
+	URL         string
+	Secret      string
+	// Space-separated list of events to send, or empty for all
+	// events.
+	Events string
+}
+
+// Does the webhook want to know about "event"?
+func (w Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range strings.Fields(w.Events) {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// A record of an attempt to send a payload to a webhook.
+type Delivery struct {
+	DeliveryId int64
+	WebhookId  int64
+	URL        string
+	Event      string
+	Payload    string
+	Attempts   int64
+	// The HTTP status of the latest attempt, or zero if there was no
+	// response.
+	Status  int64
+	Error   string
+	Created time.Time
+	// The time the payload was accepted, or zero if it has not been.
+	Delivered time.Time
+}
+
+// The bug in a webhook payload.
+type webhookBug struct {
+	Id        int64  `json:"id"`
+	URL       string `json:"url"`
+	Title     string `json:"title"`
+	ProjectId int64  `json:"project_id"`
+	Project   string `json:"project"`
+	PartId    int64  `json:"part_id"`
+	Status    string `json:"status"`
+	Priority  string `json:"priority"`
+	OwnerId   int64  `json:"owner_id"`
+}
+
+// The JSON sent to the webhook.
+type webhookPayload struct {
+	Event  string     `json:"event"`
+	Time   time.Time  `json:"time"`
+	Bug    webhookBug `json:"bug"`
+	Person string     `json:"person,omitempty"`
+	// The previous and current values for status, priority and
+	// reassigned events.
+	Old     string `json:"old,omitempty"`
+	New     string `json:"new,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Sign "body" with "secret".
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Make a random secret for a new webhook.
+func newSecret() (string, error) {
+	buf := make([]byte, 20)
+	_, err := io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+var webhooksSql = `
+SELECT webhook.webhook_id, webhook.project_id, IFNULL(project.name, ''),
+webhook.url, webhook.secret, IFNULL(webhook.events, '')
+FROM webhook
+LEFT JOIN project ON project.project_id = webhook.project_id
+ORDER BY webhook.webhook_id
+`
+var webhooksQuery = bagzullaDb.NewQuery(webhooksSql)
+
+// Get all the webhooks.
+func allWebhooks(store *bagzullaDb.Store) (hooks []Webhook, err error) {
+	rows, err := store.Stmt(webhooksQuery).Query()
+	if err != nil {
+		return hooks, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var w Webhook
+		err = rows.Scan(&w.WebhookId, &w.ProjectId, &w.ProjectName,
+			&w.URL, &w.Secret, &w.Events)
+		if err != nil {
+			return hooks, err
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+var insertWebhookSql = `
+INSERT INTO webhook(project_id, url, secret, events) VALUES (?, ?, ?, ?)
+`
+var insertWebhookQuery = bagzullaDb.NewQuery(insertWebhookSql)
+
+func insertWebhook(store *bagzullaDb.Store, w Webhook) (int64, error) {
+	result, err := store.Stmt(insertWebhookQuery).Exec(w.ProjectId, w.URL, w.Secret, w.Events)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+var deleteWebhookSql = `DELETE FROM webhook WHERE webhook_id = ?`
+var deleteWebhookQuery = bagzullaDb.NewQuery(deleteWebhookSql)
+
+func deleteWebhook(store *bagzullaDb.Store, webhookId int64) error {
+	_, err := store.Stmt(deleteWebhookQuery).Exec(webhookId)
+	return err
+}
+
+var insertDeliverySql = `
+INSERT INTO delivery(webhook_id, url, event, payload, attempts, status, created)
+VALUES (?, ?, ?, ?, 0, 0, ?)
+`
+var insertDeliveryQuery = bagzullaDb.NewQuery(insertDeliverySql)
+
+var updateDeliverySql = `
+UPDATE delivery SET attempts = ?, status = ?, error = ?, delivered = ?
+WHERE delivery_id = ?
+`
+var updateDeliveryQuery = bagzullaDb.NewQuery(updateDeliverySql)
+
+var recentDeliveriesSql = `
+SELECT delivery_id, webhook_id, url, event, payload, attempts, status,
+IFNULL(error, ''), created, delivered
+FROM delivery
+ORDER BY delivery_id DESC
+LIMIT ?
+`
+var recentDeliveriesQuery = bagzullaDb.NewQuery(recentDeliveriesSql)
+
+// Get the most recent "max" deliveries.
+func recentDeliveries(store *bagzullaDb.Store, max int64) (deliveries []Delivery, err error) {
+	rows, err := store.Stmt(recentDeliveriesQuery).Query(max)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d Delivery
+		var delivered sql.NullTime
+		err = rows.Scan(&d.DeliveryId, &d.WebhookId, &d.URL, &d.Event,
+			&d.Payload, &d.Attempts, &d.Status, &d.Error, &d.Created,
+			&delivered)
+		if err != nil {
+			return deliveries, err
+		}
+		if delivered.Valid {
+			d.Delivered = delivered.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Make the bug part of a payload.
+func (ba *Bagapp) payloadBug(bugId int64) (wb webhookBug, err error) {
+	bug, err := ba.data.BugFromId(bugId)
+	if err != nil {
+		return wb, err
+	}
+	title, err := ba.data.TxtFromId(bug.Title)
+	if err != nil {
+		return wb, err
+	}
+	wb = webhookBug{
+		Id:        bug.BugId,
+		URL:       fmt.Sprintf("%s/bug/%d", ba.TopURL, bug.BugId),
+		Title:     title.Content,
+		ProjectId: bug.ProjectId,
+		PartId:    bug.PartId,
+		Status:    statuses[bug.Status],
+		Priority:  priorities[bug.Priority],
+		OwnerId:   bug.Owner,
+	}
+	project, err := ba.data.ProjectFromId(bug.ProjectId)
+	if err == nil {
+		wb.Project = project.Name
+	}
+	return wb, nil
+}
+
+// Send "event" about bug "bugId" to all the webhooks which want to
+// know about it. The sending happens in the background, and failures
+// are only recorded in the delivery log.
+func (ba *Bagapp) bugEvent(event string, bugId int64, person string, old string, new string, comment string) {
+	hooks, err := allWebhooks(ba.data)
+	if err != nil {
+		log.Printf("Error getting webhooks: %s", err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	p := webhookPayload{
+		Event:   event,
+		Time:    time.Now(),
+		Person:  person,
+		Old:     old,
+		New:     new,
+		Comment: comment,
+	}
+	p.Bug, err = ba.payloadBug(bugId)
+	if err != nil {
+		log.Printf("Error making webhook payload for bug %d: %s", bugId, err)
+		return
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("Error making webhook payload for bug %d: %s", bugId, err)
+		return
+	}
+	for _, w := range hooks {
+		if w.ProjectId != 0 && w.ProjectId != p.Bug.ProjectId {
+			continue
+		}
+		if !w.wants(event) {
+			continue
+		}
+		result, err := ba.data.Stmt(insertDeliveryQuery).Exec(w.WebhookId, w.URL,
+			event, string(body), time.Now())
+		if err != nil {
+			log.Printf("Error recording delivery to %s: %s", w.URL, err)
+			continue
+		}
+		deliveryId, err := result.LastInsertId()
+		if err != nil {
+			log.Printf("Error recording delivery to %s: %s", w.URL, err)
+			continue
+		}
+		ba.hooks.Add(1)
+		go func(w Webhook) {
+			defer ba.hooks.Done()
+			ba.deliver(w, deliveryId, event, body)
+		}(w)
+	}
+}
+
+// Post "body" to the webhook, retrying with increasing waits until it
+// is accepted or we run out of attempts.
+func (ba *Bagapp) deliver(w Webhook, deliveryId int64, event string, body []byte) {
+	wait := webhookBackoff
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		status, err := postWebhook(w, deliveryId, event, body)
+		var errText string
+		var delivered interface{}
+		if err != nil {
+			errText = err.Error()
+		} else {
+			delivered = time.Now()
+		}
+		_, dberr := ba.data.Stmt(updateDeliveryQuery).Exec(attempt, status, errText,
+			delivered, deliveryId)
+		if dberr != nil {
+			log.Printf("Error updating delivery %d: %s", deliveryId, dberr)
+		}
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Giving up delivery %d to %s: %s", deliveryId, w.URL, err)
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-ba.Context.Done():
+			return
+		}
+		wait *= 2
+	}
+}
+
+// Make one attempt to post "body" to the webhook.
+func postWebhook(w Webhook, deliveryId int64, event string, body []byte) (status int, err error) {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bagzulla-Webhook")
+	req.Header.Set("X-Bagzulla-Event", event)
+	req.Header.Set("X-Bagzulla-Delivery", strconv.FormatInt(deliveryId, 10))
+	req.Header.Set("X-Bagzulla-Signature", webhookSignature(w.Secret, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Send an event about the bug, with the current user as the person
+// who caused it.
+func (b *Bagreply) bugEvent(event string, bugId int64, old string, new string, comment string) {
+	person := ""
+	if b.User != nil {
+		person = b.User.Name
+	}
+	b.onCommit(func() {
+		b.App.bugEvent(event, bugId, person, old, new, comment)
+	})
+}
+
+// Handle the webhook forms of the controls page. The return value is
+// false if an error page was printed.
+func webhookControls(b *Bagreply) bool {
+	if b.r.Method != "POST" {
+		return true
+	}
+	add := b.r.PostFormValue("add-webhook")
+	if len(add) > 0 {
+		var w Webhook
+		w.URL = strings.TrimSpace(b.r.PostFormValue("url"))
+		if !strings.HasPrefix(w.URL, "http://") && !strings.HasPrefix(w.URL, "https://") {
+			b.errorPage("Webhook URL '%s' should start with http:// or https://", w.URL)
+			return false
+		}
+		var err error
+		w.ProjectId, err = strconv.ParseInt(b.r.PostFormValue("project"), 10, 64)
+		if err != nil {
+			b.errorPage("Error parsing project ID: %s", err)
+			return false
+		}
+		w.Secret = strings.TrimSpace(b.r.PostFormValue("secret"))
+		if len(w.Secret) == 0 {
+			w.Secret, err = newSecret()
+			if err != nil {
+				b.errorPage("Error making secret: %s", err)
+				return false
+			}
+		}
+		var events []string
+		for _, e := range b.r.PostForm["event"] {
+			for _, known := range webhookEvents {
+				if e == known {
+					events = append(events, e)
+				}
+			}
+		}
+		w.Events = strings.Join(events, " ")
+		_, err = insertWebhook(b.data(), w)
+		if err != nil {
+			b.errorPage("Error adding webhook: %s", err)
+			return false
+		}
+	}
+	del := b.r.PostFormValue("delete-webhook")
+	if len(del) > 0 {
+		webhookId, err := strconv.ParseInt(del, 10, 64)
+		if err != nil {
+			b.errorPage("Error parsing webhook ID %s: %s", del, err)
+			return false
+		}
+		err = deleteWebhook(b.data(), webhookId)
+		if err != nil {
+			b.errorPage("Error deleting webhook %d: %s", webhookId, err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Something which receives webhook posts.
+type hookReceiver struct {
+	sync.Mutex
+	// Fail this many posts before accepting.
+	fail      int
+	bodies    [][]byte
+	headers   []http.Header
+	responses []int
+}
+
+func (hr *hookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hr.Lock()
+	defer hr.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	hr.bodies = append(hr.bodies, body)
+	hr.headers = append(hr.headers, r.Header)
+	status := http.StatusOK
+	if hr.fail > 0 {
+		hr.fail--
+		status = http.StatusInternalServerError
+	}
+	hr.responses = append(hr.responses, status)
+	w.WriteHeader(status)
+}
+
+func TestWebhook(t *testing.T) {
+	ba := getTestApp(t)
+	webhookBackoff = time.Millisecond
+	hr := &hookReceiver{fail: 2}
+	server := httptest.NewServer(hr)
+	defer server.Close()
+	bugId, err := addBug(ba.data, "Webhook bug", "Description", 2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Webhook{
+		ProjectId: 2,
+		URL:       server.URL,
+		Secret:    "sekrit",
+		Events:    "status",
+	}
+	w.WebhookId, err = insertWebhook(ba.data, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteWebhook(ba.data, w.WebhookId)
+	// This hook is for another project, so it should not be sent
+	// anything.
+	other := Webhook{ProjectId: 1, URL: server.URL, Secret: "x"}
+	other.WebhookId, err = insertWebhook(ba.data, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteWebhook(ba.data, other.WebhookId)
+
+	// The hook is not interested in this event.
+	ba.bugEvent("priority", bugId, "tony", "unknown", "high", "")
+	ba.bugEvent("status", bugId, "tony", "open", "fixed", "")
+	ba.hooks.Wait()
+
+	hr.Lock()
+	defer hr.Unlock()
+	if len(hr.bodies) != 3 {
+		t.Fatalf("Expected three posts, got %d", len(hr.bodies))
+	}
+	if hr.responses[2] != http.StatusOK {
+		t.Errorf("Final response was %d", hr.responses[2])
+	}
+	for i, body := range hr.bodies {
+		sig := hr.headers[i].Get("X-Bagzulla-Signature")
+		if sig != webhookSignature("sekrit", body) {
+			t.Errorf("Bad signature %s", sig)
+		}
+		if hr.headers[i].Get("X-Bagzulla-Event") != "status" {
+			t.Errorf("Bad event header %s", hr.headers[i].Get("X-Bagzulla-Event"))
+		}
+	}
+	var p webhookPayload
+	err = json.Unmarshal(hr.bodies[2], &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Event != "status" || p.Old != "open" || p.New != "fixed" || p.Person != "tony" {
+		t.Errorf("Unexpected payload %+v", p)
+	}
+	if p.Bug.Id != bugId || p.Bug.Title != "Webhook bug" || p.Bug.Project != "Bagzulla" {
+		t.Errorf("Unexpected bug in payload %+v", p.Bug)
+	}
+
+	deliveries, err := recentDeliveries(ba.data, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, d := range deliveries {
+		if d.WebhookId == other.WebhookId {
+			t.Errorf("Delivery to the other project's webhook")
+		}
+		if d.WebhookId != w.WebhookId {
+			continue
+		}
+		if found {
+			t.Errorf("More than one delivery")
+		}
+		found = true
+		if d.Attempts != 3 || d.Status != http.StatusOK || d.Delivered.IsZero() || d.Error != "" {
+			t.Errorf("Unexpected delivery log %+v", d)
+		}
+	}
+	if !found {
+		t.Errorf("Delivery was not logged")
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	ba := getTestApp(t)
+	webhookBackoff = time.Millisecond
+	hr := &hookReceiver{fail: 100}
+	server := httptest.NewServer(hr)
+	defer server.Close()
+	bugId, err := addBug(ba.data, "Failing webhook bug", "", 2, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := Webhook{URL: server.URL, Secret: "x"}
+	w.WebhookId, err = insertWebhook(ba.data, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteWebhook(ba.data, w.WebhookId)
+	ba.bugEvent("commented", bugId, "duncan", "", "", "Hello")
+	ba.hooks.Wait()
+	hr.Lock()
+	posts := len(hr.bodies)
+	hr.Unlock()
+	if posts != webhookAttempts {
+		t.Errorf("Expected %d attempts, got %d", webhookAttempts, posts)
+	}
+	deliveries, err := recentDeliveries(ba.data, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deliveries {
+		// Webhook IDs may be reused after deletion, so match the
+		// URL of this test's server.
+		if d.URL != server.URL {
+			continue
+		}
+		if !d.Delivered.IsZero() || d.Status != http.StatusInternalServerError || d.Error == "" {
+			t.Errorf("Unexpected delivery log %+v", d)
+		}
+	}
+}
+
+func TestWebhookControlsNeedLogin(t *testing.T) {
+	ba := getTestApp(t)
+	webhookId, err := insertWebhook(ba.data, Webhook{ProjectId: 2, URL: "http://localhost/", Secret: "hushhush"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deleteWebhook(ba.data, webhookId)
+	w := httptest.NewRecorder()
+	makeHandler(ba, controls, roleAdmin)(w, httptest.NewRequest("GET", "/controls/", nil))
+	body := w.Body.String()
+	if strings.Contains(body, "hushhush") || !strings.Contains(body, "not logged in") {
+		t.Errorf("Webhook controls shown without logging in: %s", body)
+	}
+}